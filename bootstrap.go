@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/Muchogoc/go-oauth2-server/config"
+	"github.com/Muchogoc/go-oauth2-server/internal"
+	"github.com/Muchogoc/go-oauth2-server/internal/bootstrap"
+	"github.com/Muchogoc/go-oauth2-server/internal/store"
+	"github.com/Muchogoc/go-oauth2-server/log"
+)
+
+var bootstrapCommands = []command{
+	{"apply", "[file]", "apply a bootstrap file, by default the bootstrap_file setting", runBootstrapApply},
+	{"validate", "[file]", "check a bootstrap file without applying it", runBootstrapValidate},
+	{"export", "", "write the scopes, roles, clients and users of the database as a bootstrap file", runBootstrapExport},
+}
+
+// applyBootstrapFile loads a bootstrap file and applies it to a store.
+func applyBootstrapFile(ctx context.Context, cfg config.Provider, storage store.Storage, path string) error {
+	file, err := bootstrap.Load(path, internal.NewPasswordPolicy(cfg))
+	if err != nil {
+		return err
+	}
+
+	result, err := bootstrap.Apply(ctx, storage, file)
+	if err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"file":    path,
+		"scopes":  result.Scopes,
+		"roles":   result.Roles,
+		"clients": result.Clients,
+		"users":   result.Users,
+	}).Info("applied bootstrap file")
+
+	return nil
+}
+
+// bootstrapPath returns the file given on the command line, or the configured one.
+func bootstrapPath(cfg config.Provider, args []string) (string, error) {
+	if len(args) > 0 {
+		return args[0], nil
+	}
+
+	if path := cfg.GetString("bootstrap_file"); path != "" {
+		return path, nil
+	}
+
+	return "", fmt.Errorf("no file given and bootstrap_file is not set")
+}
+
+// runBootstrapApply implements `bootstrap apply`.
+func runBootstrapApply(cfg config.Provider, args []string) error {
+	flags := newFlagSet("bootstrap apply", "[file]")
+
+	if err := parseArgsBetween(flags, args, 0, 1); err != nil {
+		return err
+	}
+
+	path, err := bootstrapPath(cfg, flags.Args())
+	if err != nil {
+		return err
+	}
+
+	storage, err := openStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+
+	return applyBootstrapFile(context.Background(), cfg, storage, path)
+}
+
+// runBootstrapValidate implements `bootstrap validate`.
+func runBootstrapValidate(cfg config.Provider, args []string) error {
+	flags := newFlagSet("bootstrap validate", "[file]")
+
+	if err := parseArgsBetween(flags, args, 0, 1); err != nil {
+		return err
+	}
+
+	path, err := bootstrapPath(cfg, flags.Args())
+	if err != nil {
+		return err
+	}
+
+	file, err := bootstrap.Load(path, internal.NewPasswordPolicy(cfg))
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s declares %d scopes, %d roles, %d clients and %d users\n",
+		path, len(file.Scopes), len(file.Roles), len(file.Clients), len(file.Users))
+
+	return nil
+}
+
+// runBootstrapExport implements `bootstrap export`. The format follows the
+// extension of the output file, YAML unless it is .json.
+func runBootstrapExport(cfg config.Provider, args []string) error {
+	flags := newFlagSet("bootstrap export", "")
+	output := flags.String("o", "", "file to write, the standard output when left out")
+	format := flags.String("format", "", "yaml or json, by default from the extension of the output file")
+	withSecrets := flags.Bool("with-secrets", false, "include the hashes of client secrets and passwords")
+
+	if err := parseArgs(flags, args, 0); err != nil {
+		return err
+	}
+
+	if *format == "" {
+		*format = "yaml"
+		if filepath.Ext(*output) == ".json" {
+			*format = "json"
+		}
+	}
+
+	storage, err := openStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+
+	file, err := bootstrap.Export(context.Background(), storage, *withSecrets)
+	if err != nil {
+		return err
+	}
+
+	if *output == "" {
+		return file.Write(os.Stdout, *format)
+	}
+
+	// the export may hold secret hashes
+	out, err := os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+
+	if err := file.Write(out, *format); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
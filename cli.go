@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	osuser "os/user"
+	"strings"
+
+	"github.com/Muchogoc/go-oauth2-server/config"
+	"github.com/Muchogoc/go-oauth2-server/internal/store"
+	"github.com/Muchogoc/go-oauth2-server/log"
+)
+
+// errUsage is returned by commands given arguments that do not make sense, once
+// the usage of the command has been printed.
+var errUsage = errors.New("invalid usage")
+
+// newFlagSet returns the flags of a command. args describes its positional
+// arguments in the usage message.
+func newFlagSet(name string, args string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), strings.TrimSpace("usage: go-oauth2-server "+name+" [flags] "+args))
+		flags.PrintDefaults()
+	}
+
+	return flags
+}
+
+// parseArgs parses the flags of a command and checks that it was given exactly
+// as many positional arguments as it takes.
+func parseArgs(flags *flag.FlagSet, args []string, positional int) error {
+	return parseArgsBetween(flags, args, positional, positional)
+}
+
+// parseArgsBetween parses the flags of a command and checks that it was given
+// between min and max positional arguments.
+func parseArgsBetween(flags *flag.FlagSet, args []string, min int, max int) error {
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+
+		return errUsage
+	}
+
+	if flags.NArg() < min || flags.NArg() > max {
+		flags.Usage()
+		return errUsage
+	}
+
+	return nil
+}
+
+// listFlag collects a flag that can be repeated or given a comma separated list.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+
+	return nil
+}
+
+// openStore connects to the database for a management command. The memory
+// driver is refused as its data only lives in the server process.
+func openStore(cfg config.Provider) (*store.Store, error) {
+	if cfg.GetString("database_driver") == "memory" {
+		return nil, errors.New("the memory driver keeps its data in the server process, use the admin API instead")
+	}
+
+	return store.NewStore(cfg)
+}
+
+// readPassword reads a password from the first line of the standard input, so
+// that it does not show up in the process list or the shell history.
+func readPassword() (string, error) {
+	if info, err := os.Stdin.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		fmt.Fprint(os.Stderr, "Password: ")
+	}
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("failed to read the password from the standard input: %w", err)
+	}
+
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// printJSON writes a value to the standard output as indented JSON.
+func printJSON(value interface{}) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+
+	return encoder.Encode(value)
+}
+
+// problemsError joins the problems found validating the input of a command.
+func problemsError(problems []string) error {
+	return fmt.Errorf("invalid input:\n  %s", strings.Join(problems, "\n  "))
+}
+
+// auditCLI logs a change made from the command line, like auditAdmin does for
+// the admin API.
+func auditCLI(action string, fields log.Fields) {
+	actor := "cli"
+	if current, err := osuser.Current(); err == nil {
+		actor = "cli:" + current.Username
+	}
+
+	entry := log.Fields{
+		"event":  "admin",
+		"action": action,
+		"actor":  actor,
+	}
+
+	for key, value := range fields {
+		entry[key] = value
+	}
+
+	log.WithFields(entry).Info("admin action")
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/Muchogoc/go-oauth2-server/config"
+	"github.com/Muchogoc/go-oauth2-server/internal"
+	"github.com/Muchogoc/go-oauth2-server/internal/store"
+	"github.com/Muchogoc/go-oauth2-server/log"
+	"github.com/google/uuid"
+	"github.com/ory/fosite"
+)
+
+var clientCommands = []command{
+	{"create", "", "register a client and print its secret", runClientCreate},
+	{"list", "", "list clients", runClientList},
+	{"rotate-secret", "<client id>", "generate a new secret for a confidential client", runClientRotateSecret},
+	{"delete", "<client id>", "revoke the tokens of a client and remove it", runClientDelete},
+}
+
+// runClientCreate implements `client create`. The client is validated like the
+// admin API does, and the generated secret is printed once with the client.
+func runClientCreate(cfg config.Provider, args []string) error {
+	var params internal.ClientRequest
+
+	var redirectURIs, scopes, audience, grantTypes, responseTypes listFlag
+
+	flags := newFlagSet("client create", "")
+	flags.StringVar(&params.ID, "id", "", "client ID, generated when left out")
+	flags.BoolVar(&params.Public, "public", false, "register a public client, which has no secret")
+	flags.Var(&redirectURIs, "redirect-uri", "allowed redirect URI, repeatable")
+	flags.Var(&scopes, "scope", "scope the client may request, repeatable")
+	flags.Var(&audience, "audience", "audience the client may request, repeatable")
+	flags.Var(&grantTypes, "grant-type", "grant the client may use, repeatable (default authorization_code)")
+	flags.Var(&responseTypes, "response-type", "response type the client may use, repeatable")
+	flags.StringVar(&params.TokenEndpointAuthMethod, "auth-method", "", "token endpoint authentication method")
+	flags.Float64Var(&params.RateLimit, "rate-limit", 0, "requests per second allowed to the token endpoint, 0 for the default")
+	flags.IntVar(&params.RateLimitBurst, "rate-limit-burst", 0, "burst allowed above the rate limit, 0 for the default")
+	flags.TextVar(&params.AccessTokenLifespan, "access-token-lifespan", internal.Duration(0), "lifespan of access tokens, 0 for the default")
+	flags.TextVar(&params.RefreshTokenLifespan, "refresh-token-lifespan", internal.Duration(0), "lifespan of refresh tokens, 0 for the default")
+	flags.TextVar(&params.AuthorizeCodeLifespan, "authorize-code-lifespan", internal.Duration(0), "lifespan of authorization codes, 0 for the default")
+	flags.TextVar(&params.IDTokenLifespan, "id-token-lifespan", internal.Duration(0), "lifespan of ID tokens, 0 for the default")
+	flags.BoolVar(&params.DisableRefreshTokenRotation, "no-refresh-token-rotation", false, "keep refresh tokens working when they are used instead of replacing them")
+	flags.TextVar(&params.RefreshTokenMaxAge, "refresh-token-max-age", internal.Duration(0), "how long after signing in a grant can be refreshed, 0 for no limit")
+
+	if err := parseArgs(flags, args, 0); err != nil {
+		return err
+	}
+
+	params.RedirectURIs, params.Scopes, params.Audience = redirectURIs, scopes, audience
+	params.GrantTypes, params.ResponseTypes = grantTypes, responseTypes
+
+	if params.ID == "" {
+		params.ID = uuid.NewString()
+	}
+
+	params.Normalise()
+
+	if problems := params.Validate(); len(problems) > 0 {
+		return problemsError(problems)
+	}
+
+	storage, err := openStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+
+	client := &store.Client{ID: params.ID, Active: true}
+	params.Apply(client)
+
+	var secret string
+
+	if !client.Public {
+		plaintext, hash, err := internal.NewClientSecret()
+		if err != nil {
+			return err
+		}
+
+		secret, client.Secret = plaintext, hash
+	}
+
+	err = storage.CreateClient(context.Background(), client)
+	switch {
+	case errors.Is(err, store.ErrClientExists):
+		return fmt.Errorf("client %s already exists", client.ID)
+	case err != nil:
+		return err
+	}
+
+	auditCLI("client.create", log.Fields{"client_id": client.ID})
+
+	response := internal.NewClientResponse(*client)
+	response.Secret = secret
+
+	return printJSON(response)
+}
+
+// runClientList implements `client list`.
+func runClientList(cfg config.Provider, args []string) error {
+	var filter store.ClientFilter
+
+	flags := newFlagSet("client list", "")
+	flags.StringVar(&filter.Search, "q", "", "only list clients whose ID contains this")
+	flags.StringVar(&filter.GrantType, "grant-type", "", "only list clients that may use this grant")
+	asJSON := flags.Bool("json", false, "print the clients as JSON")
+
+	if err := parseArgs(flags, args, 0); err != nil {
+		return err
+	}
+
+	storage, err := openStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+
+	clients, _, err := storage.ListClients(context.Background(), filter)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		result := []internal.ClientResponse{}
+		for _, client := range clients {
+			result = append(result, internal.NewClientResponse(client))
+		}
+
+		return printJSON(result)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "CLIENT ID\tACTIVE\tPUBLIC\tGRANTS\tSCOPES")
+
+	for _, client := range clients {
+		fmt.Fprintf(w, "%s\t%t\t%t\t%s\t%s\n",
+			client.ID, client.Active, client.Public,
+			strings.Join(client.Grants, ","), strings.Join(client.Scopes, ","))
+	}
+
+	return w.Flush()
+}
+
+// runClientRotateSecret implements `client rotate-secret`. The previous secret
+// keeps working until the next rotation unless -revoke-previous is set.
+func runClientRotateSecret(cfg config.Provider, args []string) error {
+	flags := newFlagSet("client rotate-secret", "<client id>")
+	revokePrevious := flags.Bool("revoke-previous", false, "stop the current secret from working straight away")
+
+	if err := parseArgs(flags, args, 1); err != nil {
+		return err
+	}
+
+	storage, err := openStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+
+	ctx := context.Background()
+
+	client, err := storage.GetClientByID(ctx, flags.Arg(0))
+	if errors.Is(err, fosite.ErrNotFound) {
+		return fmt.Errorf("client %s does not exist", flags.Arg(0))
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if client.Public {
+		return fmt.Errorf("client %s is public and has no secret", client.ID)
+	}
+
+	plaintext, hash, err := internal.NewClientSecret()
+	if err != nil {
+		return err
+	}
+
+	client.RotatedSecrets = nil
+	if !*revokePrevious && client.Secret != "" {
+		client.RotatedSecrets = []string{client.Secret}
+	}
+
+	client.Secret = hash
+
+	if err := storage.UpdateClient(ctx, client); err != nil {
+		return err
+	}
+
+	auditCLI("client.rotate_secret", log.Fields{"client_id": client.ID, "revoke_previous": *revokePrevious})
+
+	response := internal.NewClientResponse(*client)
+	response.Secret = plaintext
+
+	return printJSON(response)
+}
+
+// runClientDelete implements `client delete`.
+func runClientDelete(cfg config.Provider, args []string) error {
+	flags := newFlagSet("client delete", "<client id>")
+
+	if err := parseArgs(flags, args, 1); err != nil {
+		return err
+	}
+
+	storage, err := openStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+
+	id := flags.Arg(0)
+
+	err = storage.DeleteClient(context.Background(), id)
+	switch {
+	case errors.Is(err, fosite.ErrNotFound):
+		return fmt.Errorf("client %s does not exist", id)
+	case err != nil:
+		return err
+	}
+
+	auditCLI("client.delete", log.Fields{"client_id": id})
+
+	fmt.Printf("deleted client %s\n", id)
+
+	return nil
+}
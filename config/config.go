@@ -1,14 +1,20 @@
 package config
 
 import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/spf13/viper"
 )
 
 // Provider defines a set of read-only methods for accessing the application
 // configuration params as defined in one of the config files.
 type Provider interface {
+	AllKeys() []string
 	ConfigFileUsed() string
 	Get(key string) interface{}
 	GetBool(key string) bool
@@ -27,6 +33,10 @@ type Provider interface {
 	IsSet(key string) bool
 }
 
+// DefaultGlobalSecret is the oauth2_global_secret used unless configured, which
+// the server only accepts in dev_mode.
+const DefaultGlobalSecret = "some-cool-secret-that-is-32bytes"
+
 var defaultConfig *viper.Viper
 
 // Config returns a default config providers
@@ -39,8 +49,82 @@ func LoadConfigProvider(appName string) Provider {
 	return readViperConfig(appName)
 }
 
+// appName prefixes the environment variables of settings.
+const appName = "GO-OAUTH2-SERVER"
+
 func init() {
-	defaultConfig = readViperConfig("GO-OAUTH2-SERVER")
+	defaultConfig = readViperConfig(appName)
+}
+
+// ReadConfigFile reads a YAML, TOML or JSON file, by its extension, into the
+// default config provider. Environment variables take precedence over the file.
+func ReadConfigFile(path string) error {
+	defaultConfig.SetConfigFile(path)
+
+	if err := defaultConfig.ReadInConfig(); err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	return nil
+}
+
+// watchDelay lets writes to a config file settle before it is read again, since
+// editors and deployment tools often write files in several steps.
+const watchDelay = 200 * time.Millisecond
+
+// Watch reads a config file again whenever it changes and passes the result to
+// onChange, along with the error when the file cannot be read. Every change is
+// read into a new provider, so that the providers in use are never modified.
+func Watch(path string, onChange func(cfg Provider, err error)) {
+	var (
+		mu    sync.Mutex
+		timer *time.Timer
+	)
+
+	read := func() {
+		v := readViperConfig(appName)
+		v.SetConfigFile(path)
+
+		if err := v.ReadInConfig(); err != nil {
+			onChange(nil, fmt.Errorf("failed to read config file: %w", err))
+			return
+		}
+
+		onChange(v, nil)
+	}
+
+	watcher := viper.New()
+	watcher.SetConfigFile(path)
+
+	watcher.OnConfigChange(func(fsnotify.Event) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if timer != nil {
+			timer.Stop()
+		}
+
+		timer = time.AfterFunc(watchDelay, read)
+	})
+
+	watcher.WatchConfig()
+}
+
+// Secret returns a secret setting, read from the file named by the same key with
+// a _file suffix when that is set, so that secrets can be mounted rather than
+// passed in the environment. Surrounding whitespace of the file is ignored.
+func Secret(cfg Provider, key string) (string, error) {
+	path := cfg.GetString(key + "_file")
+	if path == "" {
+		return cfg.GetString(key), nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s_file: %w", key, err)
+	}
+
+	return strings.TrimSpace(string(data)), nil
 }
 
 func readViperConfig(appName string) *viper.Viper {
@@ -53,6 +137,137 @@ func readViperConfig(appName string) *viper.Viper {
 	v.SetDefault("json_logs", false)
 	v.SetDefault("loglevel", "debug")
 	v.SetDefault("listen_address", ":8000")
+	// how long in-flight requests are given to complete on SIGINT or SIGTERM
+	v.SetDefault("shutdown_timeout", 30*time.Second)
+	v.SetDefault("public_url", "http://localhost:8000")
+	// addresses or CIDR ranges of the proxies trusted to give the client IP in the
+	// X-Forwarded-For header, which is ignored when empty
+	v.SetDefault("trusted_proxies", []string{})
+	// HTTPS is served once a PEM certificate and key are set, and they are reloaded
+	// when their files change
+	v.SetDefault("tls_cert_file", "")
+	v.SetDefault("tls_key_file", "")
+	// "1.2" or "1.3"
+	v.SetDefault("tls_min_version", "1.2")
+	// names of the TLS 1.2 cipher suites allowed, Go's secure defaults when empty
+	v.SetDefault("tls_cipher_suites", []string{})
+	// plain HTTP listener redirecting to HTTPS, such as ":80", disabled when empty
+	v.SetDefault("tls_redirect_address", "")
+	// Strict-Transport-Security header of HTTPS responses, disabled at 0
+	v.SetDefault("hsts_max_age", 365*24*time.Hour)
+	v.SetDefault("hsts_include_subdomains", false)
+	// relaxes the checks made on startup, such as the refusal of the default
+	// oauth2_global_secret
+	v.SetDefault("dev_mode", false)
+
+	// oauth2, the global secret signs the HMAC tokens and must be at least 32
+	// bytes. It can also be read from the file named by oauth2_global_secret_file
+	v.SetDefault("oauth2_global_secret", DefaultGlobalSecret)
+	// previous global secrets, which keep validating tokens issued with them
+	v.SetDefault("oauth2_rotated_global_secrets", []string{})
+	v.SetDefault("oauth2_access_token_lifespan", time.Hour)
+	v.SetDefault("oauth2_refresh_token_lifespan", 24*time.Hour)
+	v.SetDefault("oauth2_authorize_code_lifespan", 5*time.Minute)
+	v.SetDefault("oauth2_id_token_lifespan", time.Hour)
+	// minimum length of the state and nonce parameters
+	v.SetDefault("oauth2_min_parameter_entropy", 8)
+	// includes the cause of errors in the responses to clients
+	v.SetDefault("oauth2_send_debug_messages", false)
+
+	// database, the driver is one of "sqlite", "postgres", "mysql" or "memory"
+	v.SetDefault("database_driver", "sqlite")
+	v.SetDefault("database_dsn", "auth.db")
+	v.SetDefault("database_max_open_conns", 0)
+	v.SetDefault("database_max_idle_conns", 2)
+	v.SetDefault("database_conn_max_lifetime", 30*time.Minute)
+	v.SetDefault("database_conn_max_idle_time", 5*time.Minute)
+	// secret key for the hashes of stored token signatures, required outside
+	// dev_mode. It can also be read from the file named by token_hash_pepper_file
+	v.SetDefault("token_hash_pepper", "")
+	// retired peppers, which tokens issued before a rotation are still found with,
+	// or read one per line from the file named by token_hash_previous_peppers_file
+	v.SetDefault("token_hash_previous_peppers", []string{})
+	// encryption at rest of request forms and session claims, disabled without a key file
+	v.SetDefault("encryption_key_provider", "local")
+	v.SetDefault("encryption_keyfile", "")
+	// refuses to start, or to run migrations, without an encryption key
+	v.SetDefault("encryption_required", false)
+	// replicas that do not migrate on start refuse to run against an outdated schema
+	v.SetDefault("database_migrate_on_start", true)
+
+	// read-through cache of active clients. Invalidation only reaches the local
+	// process, other replicas see changes once their entries expire
+	v.SetDefault("cache_enabled", false)
+	v.SetDefault("cache_client_ttl", time.Minute)
+	v.SetDefault("cache_max_entries", 10000)
+
+	// webauthn relying party
+	v.SetDefault("webauthn_rp_id", "localhost")
+	v.SetDefault("webauthn_rp_display_name", "The Savant")
+	v.SetDefault("webauthn_rp_origins", []string{"http://localhost:8000"})
+
+	// brute-force protection on the login form
+	v.SetDefault("lockout_username_threshold", 5)
+	v.SetDefault("lockout_ip_threshold", 20)
+	v.SetDefault("lockout_duration", 15*time.Minute)
+	v.SetDefault("lockout_backoff_base", time.Second)
+	v.SetDefault("lockout_backoff_max", 30*time.Second)
+	v.SetDefault("lockout_window", 15*time.Minute)
+
+	// self-service registration
+	v.SetDefault("require_email_verification", false)
+	v.SetDefault("email_verification_lifespan", 24*time.Hour)
+	v.SetDefault("password_min_length", 8)
+	v.SetDefault("password_require_mixed_case", false)
+	v.SetDefault("password_require_digit", false)
+	v.SetDefault("password_require_symbol", false)
+	v.SetDefault("password_history_size", 5)
+	v.SetDefault("password_reset_lifespan", time.Hour)
+
+	// outgoing email, "log" or "file"
+	v.SetDefault("mailer", "log")
+	v.SetDefault("mailer_file_dir", "mail")
+
+	// token and introspection endpoint rate limits, in requests per second
+	v.SetDefault("ratelimit_ip_rate", 20)
+	v.SetDefault("ratelimit_ip_burst", 40)
+	v.SetDefault("ratelimit_client_rate", 10)
+	v.SetDefault("ratelimit_client_burst", 20)
+	// buckets each rate limit keeps in memory, the least recently used is dropped
+	// when a new IP or client needs one
+	v.SetDefault("ratelimit_max_buckets", 100000)
+	// registrations per second allowed from a client IP, one every 20 seconds
+	v.SetDefault("ratelimit_register_rate", 0.05)
+	v.SetDefault("ratelimit_register_burst", 5)
+	// forgot password requests per second allowed from a client IP, and reset
+	// emails per second sent to one account, one every 5 minutes
+	v.SetDefault("ratelimit_forgot_password_rate", 0.05)
+	v.SetDefault("ratelimit_forgot_password_burst", 5)
+	v.SetDefault("ratelimit_password_reset_email_rate", 1.0/300)
+	v.SetDefault("ratelimit_password_reset_email_burst", 3)
+
+	// garbage collection of expired codes, tokens and sessions
+	v.SetDefault("gc_enabled", true)
+	v.SetDefault("gc_interval", time.Hour)
+	v.SetDefault("gc_batch_size", 500)
+	v.SetDefault("gc_retention", 24*time.Hour)
+	v.SetDefault("gc_refresh_token_grace_period", 24*time.Hour)
+
+	// exposes expvar metrics on /debug/vars
+	v.SetDefault("metrics_enabled", false)
+
+	// scope an access token needs to use the /admin API
+	v.SetDefault("admin_scope", "admin")
+	// role a user needs to be granted the admin scope when signing in
+	v.SetDefault("admin_role", "admin")
+
+	// directory of HTML templates used in place of the built-in ones of the same
+	// name, see internal/html
+	v.SetDefault("templates_dir", "")
+
+	// YAML or JSON file of scopes, roles, clients and users applied on startup,
+	// see bootstrap.example.yaml
+	v.SetDefault("bootstrap_file", "")
 
 	return v
 }
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/Muchogoc/go-oauth2-server/config"
+	"github.com/Muchogoc/go-oauth2-server/internal/janitor"
+)
+
+// runGC implements the `gc` subcommand, a single garbage collection pass.
+func runGC(cfg config.Provider, args []string) error {
+	if err := parseArgs(newFlagSet("gc", ""), args, 0); err != nil {
+		return err
+	}
+
+	storage, err := openStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+
+	purged, err := janitor.NewJanitor(cfg, storage).Run(context.Background())
+	if err != nil {
+		return err
+	}
+
+	var tables []string
+	for table := range purged {
+		tables = append(tables, table)
+	}
+
+	sort.Strings(tables)
+
+	for _, table := range tables {
+		fmt.Printf("%-20s %d\n", table, purged[table])
+	}
+
+	return nil
+}
@@ -0,0 +1,602 @@
+package internal
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/Muchogoc/go-oauth2-server/internal/store"
+	"github.com/Muchogoc/go-oauth2-server/log"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/ory/fosite"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var clientIDPattern = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,64}$`)
+
+// supportedGrantTypes are the grants this server has handlers for.
+var supportedGrantTypes = []string{"authorization_code", "implicit", "refresh_token", "client_credentials"}
+
+// responseTypeGrants maps each response type to the grant it needs.
+var responseTypeGrants = map[string]string{
+	"code":  "authorization_code",
+	"token": "implicit",
+}
+
+var supportedAuthMethods = []string{"client_secret_basic", "client_secret_post", "none"}
+
+// ClientRequest is the body of the create and update client endpoints. Field
+// names follow the dynamic client registration metadata of RFC 7591.
+type ClientRequest struct {
+	ID                      string   `json:"client_id"`
+	Public                  bool     `json:"public"`
+	RedirectURIs            []string `json:"redirect_uris"`
+	Scopes                  []string `json:"scopes"`
+	Audience                []string `json:"audience"`
+	GrantTypes              []string `json:"grant_types"`
+	ResponseTypes           []string `json:"response_types"`
+	TokenEndpointAuthMethod string   `json:"token_endpoint_auth_method"`
+	RateLimit               float64  `json:"rate_limit"`
+	RateLimitBurst          int      `json:"rate_limit_burst"`
+
+	// token lifespans and refresh policy, zero uses the server settings
+	AccessTokenLifespan         Duration `json:"access_token_lifespan"`
+	RefreshTokenLifespan        Duration `json:"refresh_token_lifespan"`
+	AuthorizeCodeLifespan       Duration `json:"authorize_code_lifespan"`
+	IDTokenLifespan             Duration `json:"id_token_lifespan"`
+	DisableRefreshTokenRotation bool     `json:"disable_refresh_token_rotation"`
+	RefreshTokenMaxAge          Duration `json:"refresh_token_max_age"`
+}
+
+// ClientResponse describes a client. The secret is only ever included in the
+// response that generated it.
+type ClientResponse struct {
+	ID                      string   `json:"client_id"`
+	Secret                  string   `json:"client_secret,omitempty"`
+	Active                  bool     `json:"active"`
+	Public                  bool     `json:"public"`
+	RedirectURIs            []string `json:"redirect_uris"`
+	Scopes                  []string `json:"scopes"`
+	Audience                []string `json:"audience"`
+	GrantTypes              []string `json:"grant_types"`
+	ResponseTypes           []string `json:"response_types"`
+	TokenEndpointAuthMethod string   `json:"token_endpoint_auth_method"`
+	RateLimit               float64  `json:"rate_limit"`
+	RateLimitBurst          int      `json:"rate_limit_burst"`
+
+	// the overrides are left out when the server settings apply
+	AccessTokenLifespan         Duration  `json:"access_token_lifespan,omitempty"`
+	RefreshTokenLifespan        Duration  `json:"refresh_token_lifespan,omitempty"`
+	AuthorizeCodeLifespan       Duration  `json:"authorize_code_lifespan,omitempty"`
+	IDTokenLifespan             Duration  `json:"id_token_lifespan,omitempty"`
+	DisableRefreshTokenRotation bool      `json:"disable_refresh_token_rotation"`
+	RefreshTokenMaxAge          Duration  `json:"refresh_token_max_age,omitempty"`
+	RotatedSecrets              int       `json:"rotated_secrets"`
+	CreatedAt                   time.Time `json:"created_at"`
+	UpdatedAt                   time.Time `json:"updated_at"`
+}
+
+type ClientList struct {
+	Clients []ClientResponse `json:"clients"`
+	Total   int64            `json:"total"`
+	Limit   int              `json:"limit"`
+	Offset  int              `json:"offset"`
+}
+
+type RotateSecretRequest struct {
+	// RevokePrevious stops the current secret from working straight away instead
+	// of accepting it alongside the new one until the next rotation
+	RevokePrevious bool `json:"revoke_previous"`
+}
+
+// NewClientResponse describes a client, leaving out its secret.
+func NewClientResponse(client store.Client) ClientResponse {
+	return ClientResponse{
+		ID:                      client.ID,
+		Active:                  client.Active,
+		Public:                  client.Public,
+		RedirectURIs:            nonNil(client.RedirectURIs),
+		Scopes:                  nonNil(client.Scopes),
+		Audience:                nonNil(client.Audience),
+		GrantTypes:              nonNil(client.Grants),
+		ResponseTypes:           nonNil(client.ResponseTypes),
+		TokenEndpointAuthMethod: client.TokenEndpointAuthMethod,
+		RateLimit:               client.RateLimit,
+		RateLimitBurst:          client.RateLimitBurst,
+
+		AccessTokenLifespan:         Duration(client.AccessTokenLifespan),
+		RefreshTokenLifespan:        Duration(client.RefreshTokenLifespan),
+		AuthorizeCodeLifespan:       Duration(client.AuthorizeCodeLifespan),
+		IDTokenLifespan:             Duration(client.IDTokenLifespan),
+		DisableRefreshTokenRotation: client.DisableRefreshTokenRotation,
+		RefreshTokenMaxAge:          Duration(client.RefreshTokenMaxAge),
+
+		RotatedSecrets: len(client.RotatedSecrets),
+		CreatedAt:      client.CreatedAt,
+		UpdatedAt:      client.UpdatedAt,
+	}
+}
+
+// nonNil makes empty lists encode as [] rather than null.
+func nonNil(values []string) []string {
+	if values == nil {
+		return []string{}
+	}
+
+	return values
+}
+
+// Normalise fills in the defaults of RFC 7591 for the fields left out.
+func (r *ClientRequest) Normalise() {
+	r.ID = strings.TrimSpace(r.ID)
+
+	if len(r.GrantTypes) == 0 {
+		r.GrantTypes = []string{"authorization_code"}
+	}
+
+	if len(r.ResponseTypes) == 0 && fosite.Arguments(r.GrantTypes).Has("authorization_code") {
+		r.ResponseTypes = []string{"code"}
+	}
+
+	if r.TokenEndpointAuthMethod == "" {
+		r.TokenEndpointAuthMethod = "client_secret_basic"
+		if r.Public {
+			r.TokenEndpointAuthMethod = "none"
+		}
+	}
+}
+
+// Validate returns a message for every field that is not acceptable.
+func (r ClientRequest) Validate() []string {
+	var problems []string
+
+	if !clientIDPattern.MatchString(r.ID) {
+		problems = append(problems, "client_id must be 1 to 64 letters, digits, dots, dashes or underscores.")
+	}
+
+	grants := fosite.Arguments(r.GrantTypes)
+
+	for _, grant := range r.GrantTypes {
+		if !fosite.Arguments(supportedGrantTypes).Has(grant) {
+			problems = append(problems, fmt.Sprintf("grant_types: %q is not supported.", grant))
+		}
+	}
+
+	if r.Public && grants.Has("client_credentials") {
+		problems = append(problems, "grant_types: public clients cannot use client_credentials.")
+	}
+
+	for _, combination := range r.ResponseTypes {
+		types := strings.Fields(combination)
+		if len(types) == 0 {
+			problems = append(problems, "response_types: empty response type.")
+			continue
+		}
+
+		seen := make(map[string]bool)
+
+		for _, responseType := range types {
+			grant, ok := responseTypeGrants[responseType]
+
+			switch {
+			case !ok:
+				problems = append(problems, fmt.Sprintf("response_types: %q is not supported.", responseType))
+			case seen[responseType]:
+				problems = append(problems, fmt.Sprintf("response_types: %q repeats %q.", combination, responseType))
+			case !grants.Has(grant):
+				problems = append(problems, fmt.Sprintf("response_types: %q requires the %s grant.", responseType, grant))
+			}
+
+			seen[responseType] = true
+		}
+	}
+
+	if (grants.Has("authorization_code") || grants.Has("implicit")) && len(r.RedirectURIs) == 0 {
+		problems = append(problems, "redirect_uris: at least one is required for the authorization_code and implicit grants.")
+	}
+
+	for _, uri := range r.RedirectURIs {
+		if problem := validateRedirectURI(uri); problem != "" {
+			problems = append(problems, fmt.Sprintf("redirect_uris: %q %s.", uri, problem))
+		}
+	}
+
+	for _, scope := range r.Scopes {
+		if scope == "" || strings.ContainsAny(scope, " \t\n\"\\") {
+			problems = append(problems, fmt.Sprintf("scopes: %q is not a valid scope.", scope))
+		}
+	}
+
+	for _, audience := range r.Audience {
+		if strings.TrimSpace(audience) == "" {
+			problems = append(problems, "audience: empty audience.")
+		}
+	}
+
+	switch {
+	case !fosite.Arguments(supportedAuthMethods).Has(r.TokenEndpointAuthMethod):
+		problems = append(problems, fmt.Sprintf("token_endpoint_auth_method: %q is not supported.", r.TokenEndpointAuthMethod))
+	case r.Public && r.TokenEndpointAuthMethod != "none":
+		problems = append(problems, "token_endpoint_auth_method: public clients must use none.")
+	case !r.Public && r.TokenEndpointAuthMethod == "none":
+		problems = append(problems, "token_endpoint_auth_method: confidential clients must authenticate.")
+	}
+
+	if r.RateLimit < 0 || r.RateLimitBurst < 0 {
+		problems = append(problems, "rate_limit and rate_limit_burst must not be negative.")
+	}
+
+	if r.AccessTokenLifespan < 0 || r.RefreshTokenLifespan < 0 || r.AuthorizeCodeLifespan < 0 || r.IDTokenLifespan < 0 {
+		problems = append(problems, "access_token_lifespan, refresh_token_lifespan, authorize_code_lifespan and id_token_lifespan must not be negative.")
+	}
+
+	if r.RefreshTokenMaxAge < 0 {
+		problems = append(problems, "refresh_token_max_age must not be negative.")
+	}
+
+	return problems
+}
+
+// validateRedirectURI describes what is wrong with a redirect URI, if anything.
+// Plain HTTP is only accepted for loopback addresses, see RFC 8252 section 7.3.
+func validateRedirectURI(uri string) string {
+	parsed, err := url.Parse(uri)
+	if err != nil || !parsed.IsAbs() {
+		return "must be an absolute URI"
+	}
+
+	if parsed.Fragment != "" || strings.Contains(uri, "#") {
+		return "must not contain a fragment"
+	}
+
+	switch parsed.Scheme {
+	case "https":
+		if parsed.Host == "" {
+			return "must have a host"
+		}
+	case "http":
+		host := parsed.Hostname()
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			return "must use https unless it points at a loopback address"
+		}
+	default:
+		// private-use schemes of native apps are reverse domain names, RFC 8252 section 7.1
+		if !strings.Contains(parsed.Scheme, ".") {
+			return "must use https or a reverse domain name scheme"
+		}
+	}
+
+	return ""
+}
+
+// NewClientSecret generates a client secret and returns it with its bcrypt hash.
+func NewClientSecret() (string, string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", fmt.Errorf("failed to generate client secret: %w", err)
+	}
+
+	plaintext := base64.RawURLEncoding.EncodeToString(secret)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(plaintext), bcrypt.DefaultCost)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to hash client secret: %w", err)
+	}
+
+	return plaintext, string(hash), nil
+}
+
+// Apply copies the editable fields of a request onto a client.
+func (r ClientRequest) Apply(client *store.Client) {
+	client.Public = r.Public
+	client.RedirectURIs = r.RedirectURIs
+	client.Scopes = r.Scopes
+	client.Audience = r.Audience
+	client.Grants = r.GrantTypes
+	client.ResponseTypes = r.ResponseTypes
+	client.TokenEndpointAuthMethod = r.TokenEndpointAuthMethod
+	client.RateLimit = r.RateLimit
+	client.RateLimitBurst = r.RateLimitBurst
+	client.AccessTokenLifespan = time.Duration(r.AccessTokenLifespan)
+	client.RefreshTokenLifespan = time.Duration(r.RefreshTokenLifespan)
+	client.AuthorizeCodeLifespan = time.Duration(r.AuthorizeCodeLifespan)
+	client.IDTokenLifespan = time.Duration(r.IDTokenLifespan)
+	client.DisableRefreshTokenRotation = r.DisableRefreshTokenRotation
+	client.RefreshTokenMaxAge = time.Duration(r.RefreshTokenMaxAge)
+}
+
+// ListClientsHandler lists clients a page at a time. The q, active, public and
+// grant_type query parameters filter the list.
+func (a Auth) ListClientsHandler(c *gin.Context) {
+	limit, offset, err := pagination(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_request", "error_description": err.Error()})
+		return
+	}
+
+	filter := store.ClientFilter{
+		Search:    c.Query("q"),
+		GrantType: c.Query("grant_type"),
+		Limit:     limit,
+		Offset:    offset,
+	}
+
+	if filter.Active, err = optionalBool(c, "active"); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_request", "error_description": err.Error()})
+		return
+	}
+
+	if filter.Public, err = optionalBool(c, "public"); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_request", "error_description": err.Error()})
+		return
+	}
+
+	clients, total, err := a.store.ListClients(c.Request.Context(), filter)
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+
+	result := ClientList{
+		Clients: []ClientResponse{},
+		Total:   total,
+		Limit:   limit,
+		Offset:  offset,
+	}
+
+	for _, client := range clients {
+		result.Clients = append(result.Clients, NewClientResponse(client))
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// GetClientHandler describes a single client.
+func (a Auth) GetClientHandler(c *gin.Context) {
+	client, err := a.store.GetClientByID(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, NewClientResponse(*client))
+}
+
+// CreateClientHandler registers a client. Confidential clients get a generated
+// secret, which is returned in this response only.
+func (a Auth) CreateClientHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	var params ClientRequest
+	if err := c.ShouldBindJSON(&params); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_request", "error_description": err.Error()})
+		return
+	}
+
+	if params.ID == "" {
+		params.ID = uuid.NewString()
+	}
+
+	params.Normalise()
+
+	if problems := params.Validate(); len(problems) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_client_metadata", "problems": problems})
+		return
+	}
+
+	client := &store.Client{ID: params.ID, Active: true}
+	params.Apply(client)
+
+	var secret string
+
+	if !client.Public {
+		plaintext, hash, err := NewClientSecret()
+		if err != nil {
+			adminError(c, err)
+			return
+		}
+
+		secret, client.Secret = plaintext, hash
+	}
+
+	err := a.store.CreateClient(ctx, client)
+	switch {
+	case errors.Is(err, store.ErrClientExists):
+		c.JSON(http.StatusConflict, gin.H{"error": "client_exists"})
+		return
+	case err != nil:
+		adminError(c, err)
+		return
+	}
+
+	auditAdmin(c, "client.create", log.Fields{"client_id": client.ID})
+
+	response := NewClientResponse(*client)
+	response.Secret = secret
+
+	c.JSON(http.StatusCreated, response)
+}
+
+// UpdateClientHandler replaces the metadata of a client. A client made
+// confidential gets a new secret, returned in this response only.
+func (a Auth) UpdateClientHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	client, err := a.store.GetClientByID(ctx, c.Param("id"))
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+
+	var params ClientRequest
+	if err := c.ShouldBindJSON(&params); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_request", "error_description": err.Error()})
+		return
+	}
+
+	if params.ID != "" && params.ID != client.ID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_request", "error_description": "client_id cannot be changed"})
+		return
+	}
+
+	params.ID = client.ID
+	params.Normalise()
+
+	if problems := params.Validate(); len(problems) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_client_metadata", "problems": problems})
+		return
+	}
+
+	params.Apply(client)
+
+	var secret string
+
+	switch {
+	case client.Public:
+		client.Secret, client.RotatedSecrets = "", nil
+	case client.Secret == "":
+		plaintext, hash, err := NewClientSecret()
+		if err != nil {
+			adminError(c, err)
+			return
+		}
+
+		secret, client.Secret = plaintext, hash
+	}
+
+	if err := a.store.UpdateClient(ctx, client); err != nil {
+		adminError(c, err)
+		return
+	}
+
+	auditAdmin(c, "client.update", log.Fields{"client_id": client.ID})
+
+	response := NewClientResponse(*client)
+	response.Secret = secret
+
+	c.JSON(http.StatusOK, response)
+}
+
+// ActivateClientHandler lets a deactivated client request tokens again.
+func (a Auth) ActivateClientHandler(c *gin.Context) {
+	a.setClientActive(c, true)
+}
+
+// DeactivateClientHandler stops a client from requesting tokens and revokes the
+// tokens it holds, keeping its registration so that it can be reactivated.
+func (a Auth) DeactivateClientHandler(c *gin.Context) {
+	a.setClientActive(c, false)
+}
+
+func (a Auth) setClientActive(c *gin.Context, active bool) {
+	ctx := c.Request.Context()
+
+	client, err := a.store.GetClientByID(ctx, c.Param("id"))
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+
+	client.Active = active
+
+	// the tokens of a deactivated client are revoked in the same transaction, so
+	// that the client is never left inactive with tokens still valid
+	err = a.transaction(ctx, func(ctx context.Context) error {
+		if err := a.store.UpdateClient(ctx, client); err != nil {
+			return err
+		}
+
+		if active {
+			return nil
+		}
+
+		return a.store.RevokeClientTokens(ctx, client.ID)
+	})
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+
+	action := "client.activate"
+	if !active {
+		action = "client.deactivate"
+	}
+
+	auditAdmin(c, action, log.Fields{"client_id": client.ID})
+
+	c.JSON(http.StatusOK, NewClientResponse(*client))
+}
+
+// DeleteClientHandler revokes the tokens of a client and removes it for good.
+func (a Auth) DeleteClientHandler(c *gin.Context) {
+	id := c.Param("id")
+
+	if err := a.store.DeleteClient(c.Request.Context(), id); err != nil {
+		adminError(c, err)
+		return
+	}
+
+	auditAdmin(c, "client.delete", log.Fields{"client_id": id})
+
+	c.Status(http.StatusNoContent)
+}
+
+// RotateClientSecretHandler generates a new secret for a confidential client and
+// returns it in this response only. The previous secret keeps working until the
+// next rotation, unless revoke_previous is set.
+func (a Auth) RotateClientSecretHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	var params RotateSecretRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&params); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_request", "error_description": err.Error()})
+			return
+		}
+	}
+
+	client, err := a.store.GetClientByID(ctx, c.Param("id"))
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+
+	if client.Public {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_request", "error_description": "public clients have no secret"})
+		return
+	}
+
+	plaintext, hash, err := NewClientSecret()
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+
+	client.RotatedSecrets = nil
+	if !params.RevokePrevious && client.Secret != "" {
+		client.RotatedSecrets = []string{client.Secret}
+	}
+
+	client.Secret = hash
+
+	if err := a.store.UpdateClient(ctx, client); err != nil {
+		adminError(c, err)
+		return
+	}
+
+	auditAdmin(c, "client.rotate_secret", log.Fields{"client_id": client.ID, "revoke_previous": params.RevokePrevious})
+
+	response := NewClientResponse(*client)
+	response.Secret = plaintext
+
+	c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,203 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Muchogoc/go-oauth2-server/internal/store"
+	"github.com/gin-gonic/gin"
+)
+
+func TestValidateRedirectURI(t *testing.T) {
+	tests := []struct {
+		uri     string
+		problem string
+	}{
+		{"https://example.com/callback", ""},
+		{"https://example.com/callback?tenant=1", ""},
+		{"http://localhost:3000/callback", ""},
+		{"http://127.0.0.1/callback", ""},
+		{"http://[::1]:8080/callback", ""},
+		{"com.example.app:/callback", ""},
+		{"/callback", "must be an absolute URI"},
+		{"https://example.com/callback#token", "must not contain a fragment"},
+		{"https://example.com/callback#", "must not contain a fragment"},
+		{"https:///callback", "must have a host"},
+		{"http://example.com/callback", "must use https unless it points at a loopback address"},
+		{"http://localhost.example.com/callback", "must use https unless it points at a loopback address"},
+		{"myapp:/callback", "must use https or a reverse domain name scheme"},
+		{"javascript:alert(1)", "must use https or a reverse domain name scheme"},
+	}
+
+	for _, tt := range tests {
+		if problem := validateRedirectURI(tt.uri); problem != tt.problem {
+			t.Errorf("validateRedirectURI(%q) = %q, want %q", tt.uri, problem, tt.problem)
+		}
+	}
+}
+
+func TestClientRequestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(r *ClientRequest)
+		problem string
+	}{
+		{"valid", func(r *ClientRequest) {}, ""},
+		{"public", func(r *ClientRequest) { r.Public, r.TokenEndpointAuthMethod = true, "" }, ""},
+		{"invalid ID", func(r *ClientRequest) { r.ID = "my client" }, "client_id must be"},
+		{"unsupported grant", func(r *ClientRequest) { r.GrantTypes = append(r.GrantTypes, "password") }, `grant_types: "password" is not supported.`},
+		{"public client credentials", func(r *ClientRequest) {
+			r.Public, r.TokenEndpointAuthMethod = true, ""
+			r.GrantTypes = append(r.GrantTypes, "client_credentials")
+		}, "public clients cannot use client_credentials"},
+		{"empty response type", func(r *ClientRequest) { r.ResponseTypes = []string{" "} }, "empty response type"},
+		{"unsupported response type", func(r *ClientRequest) { r.ResponseTypes = []string{"code id_token"} }, `"id_token" is not supported`},
+		{"repeated response type", func(r *ClientRequest) { r.ResponseTypes = []string{"code code"} }, `"code code" repeats "code"`},
+		{"response type without grant", func(r *ClientRequest) { r.ResponseTypes = []string{"token"} }, `"token" requires the implicit grant`},
+		{"no redirect URI", func(r *ClientRequest) { r.RedirectURIs = nil }, "at least one is required"},
+		{"invalid redirect URI", func(r *ClientRequest) { r.RedirectURIs = []string{"http://example.com"} }, "must use https"},
+		{"invalid scope", func(r *ClientRequest) { r.Scopes = []string{"read write"} }, `scopes: "read write" is not a valid scope.`},
+		{"empty audience", func(r *ClientRequest) { r.Audience = []string{" "} }, "empty audience"},
+		{"unsupported auth method", func(r *ClientRequest) { r.TokenEndpointAuthMethod = "private_key_jwt" }, `"private_key_jwt" is not supported`},
+		{"public client with a secret", func(r *ClientRequest) { r.Public, r.TokenEndpointAuthMethod = true, "client_secret_basic" }, "public clients must use none"},
+		{"confidential client without a secret", func(r *ClientRequest) { r.TokenEndpointAuthMethod = "none" }, "confidential clients must authenticate"},
+		{"negative rate limit", func(r *ClientRequest) { r.RateLimitBurst = -1 }, "must not be negative"},
+		{"negative lifespan", func(r *ClientRequest) { r.AccessTokenLifespan = Duration(-time.Minute) }, "must not be negative"},
+		{"negative max age", func(r *ClientRequest) { r.RefreshTokenMaxAge = Duration(-time.Minute) }, "refresh_token_max_age must not be negative"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := ClientRequest{
+				ID:           "my-client",
+				RedirectURIs: []string{"https://example.com/callback"},
+				Scopes:       []string{"openid", "offline"},
+				GrantTypes:   []string{"authorization_code", "refresh_token"},
+			}
+
+			tt.change(&request)
+			request.Normalise()
+
+			problems := request.Validate()
+
+			switch {
+			case tt.problem == "" && len(problems) > 0:
+				t.Errorf("got problems %q, want none", problems)
+			case tt.problem != "" && !strings.Contains(strings.Join(problems, "\n"), tt.problem):
+				t.Errorf("got problems %q, want one containing %q", problems, tt.problem)
+			}
+		})
+	}
+}
+
+// scopedToken returns an access token of the test client with a scope.
+func (s *testServer) scopedToken(t *testing.T, scope string) string {
+	t.Helper()
+
+	response := s.token(t, url.Values{"grant_type": {"client_credentials"}, "scope": {scope}})
+	if response.Code != http.StatusOK {
+		t.Fatalf("token returned %d: %s", response.Code, response.Body.String())
+	}
+
+	var body struct {
+		AccessToken string `json:"access_token"`
+	}
+
+	if err := json.Unmarshal(response.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+
+	return body.AccessToken
+}
+
+func TestAdminRequiresAdminToken(t *testing.T) {
+	server := newTestServer(t, newTestConfig(t, nil))
+
+	router := gin.New()
+	router.GET("/admin/clients", server.auth.RequireAdmin(), server.auth.ListClientsHandler)
+
+	admin := server.scopedToken(t, "admin")
+	profile := server.scopedToken(t, "profile")
+
+	tests := []struct {
+		name          string
+		authorization string
+		status        int
+		challenge     string
+	}{
+		{"no token", "", http.StatusUnauthorized, `Bearer realm="admin"`},
+		{"unknown token", "Bearer not-a-token", http.StatusUnauthorized, `error="invalid_token"`},
+		{"without the admin scope", "Bearer " + profile, http.StatusForbidden, `error="insufficient_scope", scope="admin"`},
+		{"admin", "Bearer " + admin, http.StatusOK, ""},
+	}
+
+	for _, tt := range tests {
+		request := httptest.NewRequest(http.MethodGet, "/admin/clients", nil)
+		if tt.authorization != "" {
+			request.Header.Set("Authorization", tt.authorization)
+		}
+
+		response := serve(router, request)
+		if response.Code != tt.status {
+			t.Errorf("%s: got %d, want %d", tt.name, response.Code, tt.status)
+		}
+
+		if challenge := response.Header().Get("WWW-Authenticate"); !strings.Contains(challenge, tt.challenge) {
+			t.Errorf("%s: got challenge %q, want %q", tt.name, challenge, tt.challenge)
+		}
+	}
+
+	// a revoked token is refused straight away
+	if err := server.store.RevokeClientTokens(context.Background(), testClientID); err != nil {
+		t.Fatal(err)
+	}
+
+	request := httptest.NewRequest(http.MethodGet, "/admin/clients", nil)
+	request.Header.Set("Authorization", "Bearer "+admin)
+
+	if response := serve(router, request); response.Code != http.StatusUnauthorized {
+		t.Errorf("a revoked admin token got %d, want 401", response.Code)
+	}
+}
+
+// failingRevocationStorage fails to revoke tokens.
+type failingRevocationStorage struct {
+	store.Storage
+}
+
+func (s failingRevocationStorage) RevokeClientTokens(ctx context.Context, clientID string) error {
+	return errors.New("revocation failed")
+}
+
+func (s failingRevocationStorage) RevokeUserTokens(ctx context.Context, userID string) error {
+	return errors.New("revocation failed")
+}
+
+func TestDeactivateClientRollsBackWhenRevocationFails(t *testing.T) {
+	server := newTestServer(t, newTestConfig(t, nil))
+	server.auth.store = failingRevocationStorage{Storage: server.store}
+
+	router := gin.New()
+	router.POST("/admin/clients/:id/deactivate", server.auth.DeactivateClientHandler)
+
+	response := serve(router, httptest.NewRequest(http.MethodPost, "/admin/clients/"+testClientID+"/deactivate", nil))
+	if response.Code != http.StatusInternalServerError {
+		t.Fatalf("deactivating returned %d, want 500", response.Code)
+	}
+
+	client, err := server.store.GetClientByID(context.Background(), testClientID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !client.Active {
+		t.Error("the client was deactivated although its tokens were not revoked")
+	}
+}
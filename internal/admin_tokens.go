@@ -0,0 +1,314 @@
+package internal
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Muchogoc/go-oauth2-server/internal/store"
+	"github.com/Muchogoc/go-oauth2-server/log"
+	"github.com/gin-gonic/gin"
+	"github.com/ory/fosite"
+)
+
+// RevokeTokensRequest selects the tokens to revoke in bulk. At least one field
+// must be set, so that a mistaken request cannot sign out everyone.
+type RevokeTokensRequest struct {
+	GrantID      string     `json:"grant_id"`
+	UserID       string     `json:"user_id"`
+	ClientID     string     `json:"client_id"`
+	Scope        string     `json:"scope"`
+	IssuedAfter  *time.Time `json:"issued_after"`
+	IssuedBefore *time.Time `json:"issued_before"`
+}
+
+// RevocationResponse reports how many codes and tokens were revoked by table.
+type RevocationResponse struct {
+	Revoked map[string]int64 `json:"revoked"`
+	Total   int64            `json:"total"`
+}
+
+type SessionList struct {
+	Sessions []SessionResponse `json:"sessions"`
+	Total    int64             `json:"total"`
+	Limit    int               `json:"limit"`
+	Offset   int               `json:"offset"`
+}
+
+func (r RevokeTokensRequest) filter() store.TokenFilter {
+	filter := store.TokenFilter{
+		RequestID: r.GrantID,
+		UserID:    r.UserID,
+		ClientID:  r.ClientID,
+		Scope:     r.Scope,
+	}
+
+	if r.IssuedAfter != nil {
+		filter.IssuedAfter = *r.IssuedAfter
+	}
+
+	if r.IssuedBefore != nil {
+		filter.IssuedBefore = *r.IssuedBefore
+	}
+
+	return filter
+}
+
+// tokenFilterParams reads the grant_id, user_id, client_id, scope, issued_after
+// and issued_before query parameters. Times are in RFC 3339 format.
+func tokenFilterParams(c *gin.Context) (store.TokenFilter, error) {
+	filter := store.TokenFilter{
+		RequestID: c.Query("grant_id"),
+		UserID:    c.Query("user_id"),
+		ClientID:  c.Query("client_id"),
+		Scope:     c.Query("scope"),
+	}
+
+	var err error
+
+	if filter.IssuedAfter, err = optionalTime(c, "issued_after"); err != nil {
+		return filter, err
+	}
+
+	if filter.IssuedBefore, err = optionalTime(c, "issued_before"); err != nil {
+		return filter, err
+	}
+
+	return filter, nil
+}
+
+// tokenTypeParam reads the type query parameter, returning an empty type when it
+// is absent.
+func tokenTypeParam(c *gin.Context) (fosite.TokenType, error) {
+	switch value := fosite.TokenType(c.Query("type")); value {
+	case "", fosite.AccessToken, fosite.RefreshToken:
+		return value, nil
+	default:
+		return "", fmt.Errorf("type must be %s or %s", fosite.AccessToken, fosite.RefreshToken)
+	}
+}
+
+// groupSessions collects tokens, listed newest first, into the sessions they
+// belong to, most recently used first.
+func groupSessions(tokens []store.TokenInfo) []SessionResponse {
+	sessions := make(map[string]*SessionResponse)
+	neverExpires := make(map[string]bool)
+
+	var order []string
+
+	for _, token := range tokens {
+		session, ok := sessions[token.SessionID]
+		if !ok {
+			session = &SessionResponse{
+				ID:           token.SessionID,
+				ClientID:     token.ClientID,
+				UserID:       token.UserID,
+				Username:     token.Username,
+				LastIssuedAt: token.RequestedAt,
+			}
+			sessions[token.SessionID] = session
+			order = append(order, token.SessionID)
+		}
+
+		if token.Type == fosite.RefreshToken {
+			session.RefreshTokens++
+		} else {
+			session.AccessTokens++
+		}
+
+		switch {
+		case token.ExpiresAt == nil:
+			neverExpires[token.SessionID] = true
+		case session.ExpiresAt == nil || token.ExpiresAt.After(*session.ExpiresAt):
+			session.ExpiresAt = token.ExpiresAt
+		}
+	}
+
+	result := []SessionResponse{}
+
+	for _, id := range order {
+		session := *sessions[id]
+		if neverExpires[id] {
+			session.ExpiresAt = nil
+		}
+
+		result = append(result, session)
+	}
+
+	return result
+}
+
+// ListTokensHandler lists access and refresh tokens a page at a time, newest
+// first. Only active tokens are listed unless active_only is false.
+func (a Auth) ListTokensHandler(c *gin.Context) {
+	limit, offset, err := pagination(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_request", "error_description": err.Error()})
+		return
+	}
+
+	filter, err := tokenFilterParams(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_request", "error_description": err.Error()})
+		return
+	}
+
+	if filter.Type, err = tokenTypeParam(c); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_request", "error_description": err.Error()})
+		return
+	}
+
+	activeOnly, err := optionalBool(c, "active_only")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_request", "error_description": err.Error()})
+		return
+	}
+
+	filter.ActiveOnly = activeOnly == nil || *activeOnly
+	filter.Limit, filter.Offset = limit, offset
+
+	tokens, total, err := a.store.ListTokens(c.Request.Context(), filter)
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+
+	result := TokenList{
+		Tokens: []TokenResponse{},
+		Total:  total,
+		Limit:  limit,
+		Offset: offset,
+	}
+
+	for _, token := range tokens {
+		result.Tokens = append(result.Tokens, newTokenResponse(token))
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// ListSessionsHandler lists the sessions that still have active tokens matching
+// the query parameters a page at a time, most recently used first.
+func (a Auth) ListSessionsHandler(c *gin.Context) {
+	limit, offset, err := pagination(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_request", "error_description": err.Error()})
+		return
+	}
+
+	filter, err := tokenFilterParams(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_request", "error_description": err.Error()})
+		return
+	}
+
+	filter.ActiveOnly = true
+
+	tokens, _, err := a.store.ListTokens(c.Request.Context(), filter)
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+
+	sessions := groupSessions(tokens)
+
+	result := SessionList{
+		Sessions: []SessionResponse{},
+		Total:    int64(len(sessions)),
+		Limit:    limit,
+		Offset:   offset,
+	}
+
+	if offset < len(sessions) {
+		sessions = sessions[offset:]
+		if len(sessions) > limit {
+			sessions = sessions[:limit]
+		}
+
+		result.Sessions = sessions
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// RevokeTokensHandler revokes every code and token matching the request body.
+func (a Auth) RevokeTokensHandler(c *gin.Context) {
+	var params RevokeTokensRequest
+	if err := c.ShouldBindJSON(&params); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_request", "error_description": err.Error()})
+		return
+	}
+
+	filter := params.filter()
+	if filter.IsEmpty() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_request", "error_description": "at least one of grant_id, user_id, client_id, scope, issued_after or issued_before is required"})
+		return
+	}
+
+	a.revokeTokens(c, "tokens.revoke", filter)
+}
+
+// RevokeGrantHandler revokes the code and every token issued for a grant.
+func (a Auth) RevokeGrantHandler(c *gin.Context) {
+	a.revokeTokens(c, "grant.revoke", store.TokenFilter{RequestID: c.Param("id")})
+}
+
+// RevokeUserTokensHandler revokes every code and token issued to a user.
+func (a Auth) RevokeUserTokensHandler(c *gin.Context) {
+	user, err := a.store.GetUserByID(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+
+	a.revokeTokens(c, "user.revoke_tokens", store.TokenFilter{UserID: user.ID})
+}
+
+// RevokeClientTokensHandler revokes every code and token issued to a client.
+func (a Auth) RevokeClientTokensHandler(c *gin.Context) {
+	client, err := a.store.GetClientByID(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+
+	a.revokeTokens(c, "client.revoke_tokens", store.TokenFilter{ClientID: client.ID})
+}
+
+func (a Auth) revokeTokens(c *gin.Context, action string, filter store.TokenFilter) {
+	counts, err := a.store.RevokeTokens(c.Request.Context(), filter)
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+
+	result := RevocationResponse{Revoked: counts}
+	for _, count := range counts {
+		result.Total += count
+	}
+
+	fields := log.Fields{"revoked": result.Total}
+
+	for key, value := range map[string]string{
+		"grant_id":  filter.RequestID,
+		"user_id":   filter.UserID,
+		"client_id": filter.ClientID,
+		"scope":     filter.Scope,
+	} {
+		if value != "" {
+			fields[key] = value
+		}
+	}
+
+	if !filter.IssuedAfter.IsZero() {
+		fields["issued_after"] = filter.IssuedAfter.Format(time.RFC3339)
+	}
+
+	if !filter.IssuedBefore.IsZero() {
+		fields["issued_before"] = filter.IssuedBefore.Format(time.RFC3339)
+	}
+
+	auditAdmin(c, action, fields)
+
+	c.JSON(http.StatusOK, result)
+}
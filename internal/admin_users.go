@@ -0,0 +1,634 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	netmail "net/mail"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Muchogoc/go-oauth2-server/internal/mail"
+	"github.com/Muchogoc/go-oauth2-server/internal/store"
+	"github.com/Muchogoc/go-oauth2-server/log"
+	"github.com/gin-gonic/gin"
+	"github.com/ory/fosite"
+)
+
+var rolePattern = regexp.MustCompile(`^[a-zA-Z0-9_.:-]{1,64}$`)
+
+// UserRequest is the body of the create and update user endpoints. The password
+// and roles are only read when creating a user.
+type UserRequest struct {
+	Username      string   `json:"username"`
+	Name          string   `json:"name"`
+	Email         string   `json:"email"`
+	EmailVerified bool     `json:"email_verified"`
+	Password      string   `json:"password"`
+	Roles         []string `json:"roles"`
+}
+
+// UserResponse describes a user. Password hashes are never included.
+type UserResponse struct {
+	ID                    string    `json:"id"`
+	Username              string    `json:"username"`
+	Name                  string    `json:"name"`
+	Email                 string    `json:"email"`
+	EmailVerified         bool      `json:"email_verified"`
+	Active                bool      `json:"active"`
+	PasswordResetRequired bool      `json:"password_reset_required"`
+	Passkeys              int       `json:"passkeys"`
+	Roles                 []string  `json:"roles"`
+	CreatedAt             time.Time `json:"created_at"`
+	UpdatedAt             time.Time `json:"updated_at"`
+}
+
+type UserList struct {
+	Users  []UserResponse `json:"users"`
+	Total  int64          `json:"total"`
+	Limit  int            `json:"limit"`
+	Offset int            `json:"offset"`
+}
+
+type RolesRequest struct {
+	Roles []string `json:"roles"`
+}
+
+// TokenResponse describes an access or refresh token without revealing it.
+type TokenResponse struct {
+	ID        string     `json:"id"`
+	Type      string     `json:"type"`
+	GrantID   string     `json:"grant_id"`
+	ClientID  string     `json:"client_id"`
+	SessionID string     `json:"session_id"`
+	UserID    string     `json:"user_id,omitempty"`
+	Username  string     `json:"username,omitempty"`
+	Scopes    []string   `json:"scopes"`
+	Active    bool       `json:"active"`
+	IssuedAt  time.Time  `json:"issued_at"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+type TokenList struct {
+	Tokens []TokenResponse `json:"tokens"`
+	Total  int64           `json:"total"`
+	Limit  int             `json:"limit"`
+	Offset int             `json:"offset"`
+}
+
+// SessionResponse describes a login of a user to a client that still has active
+// tokens.
+type SessionResponse struct {
+	ID            string    `json:"session_id"`
+	ClientID      string    `json:"client_id"`
+	UserID        string    `json:"user_id,omitempty"`
+	Username      string    `json:"username,omitempty"`
+	LastIssuedAt  time.Time `json:"last_issued_at"`
+	AccessTokens  int       `json:"access_tokens"`
+	RefreshTokens int       `json:"refresh_tokens"`
+	// ExpiresAt is when the last of its tokens expires, nil if one never does
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+type ResetPasswordResponse struct {
+	EmailSent bool `json:"email_sent"`
+}
+
+// NewUserResponse describes a user together with their roles.
+func NewUserResponse(user store.User, roles []string) UserResponse {
+	return UserResponse{
+		ID:                    user.ID,
+		Username:              user.Username,
+		Name:                  user.Name,
+		Email:                 user.Email,
+		EmailVerified:         user.EmailVerified,
+		Active:                user.Active,
+		PasswordResetRequired: user.PasswordResetRequired,
+		Passkeys:              len(user.Credentials),
+		Roles:                 nonNil(roles),
+		CreatedAt:             user.CreatedAt,
+		UpdatedAt:             user.UpdatedAt,
+	}
+}
+
+func newTokenResponse(token store.TokenInfo) TokenResponse {
+	return TokenResponse{
+		ID:        token.ID,
+		Type:      string(token.Type),
+		GrantID:   token.RequestID,
+		ClientID:  token.ClientID,
+		SessionID: token.SessionID,
+		UserID:    token.UserID,
+		Username:  token.Username,
+		Scopes:    nonNil(token.Scopes),
+		Active:    token.Active,
+		IssuedAt:  token.RequestedAt,
+		ExpiresAt: token.ExpiresAt,
+	}
+}
+
+// Normalise trims the whitespace around the username, name and email address.
+func (r *UserRequest) Normalise() {
+	r.Username = strings.TrimSpace(r.Username)
+	r.Name = strings.TrimSpace(r.Name)
+	r.Email = strings.TrimSpace(r.Email)
+}
+
+// Validate returns a message for every field that is not acceptable. The email
+// address is optional as operators may create accounts for people without one.
+func (r UserRequest) Validate() []string {
+	var problems []string
+
+	if !usernamePattern.MatchString(r.Username) {
+		problems = append(problems, "username must be 3 to 32 letters, digits, dots, dashes or underscores.")
+	}
+
+	if r.Name == "" {
+		problems = append(problems, "name is required.")
+	}
+
+	if r.Email != "" {
+		if address, err := netmail.ParseAddress(r.Email); err != nil || address.Address != r.Email {
+			problems = append(problems, "email must be a valid email address.")
+		}
+	}
+
+	return problems
+}
+
+// NormaliseRoles sorts roles and drops duplicates, returning a message for every
+// role that is not acceptable.
+func NormaliseRoles(roles []string) ([]string, []string) {
+	var problems []string
+
+	seen := make(map[string]bool)
+	result := []string{}
+
+	for _, role := range roles {
+		role = strings.TrimSpace(role)
+
+		if !rolePattern.MatchString(role) {
+			problems = append(problems, fmt.Sprintf("roles: %q must be 1 to 64 letters, digits, dots, colons, dashes or underscores.", role))
+			continue
+		}
+
+		if !seen[role] {
+			seen[role] = true
+			result = append(result, role)
+		}
+	}
+
+	sort.Strings(result)
+
+	return result, problems
+}
+
+// userError responds to the errors of creating or updating a user.
+func userError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, store.ErrUsernameTaken):
+		c.JSON(http.StatusConflict, gin.H{"error": "username_taken"})
+	case errors.Is(err, store.ErrEmailTaken):
+		c.JSON(http.StatusConflict, gin.H{"error": "email_taken"})
+	default:
+		adminError(c, err)
+	}
+}
+
+// respondUser writes a user together with their roles.
+func (a Auth) respondUser(c *gin.Context, status int, user *store.User) {
+	roles, err := a.store.GetUserRoles(c.Request.Context(), user.ID)
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+
+	c.JSON(status, NewUserResponse(*user, roles))
+}
+
+// ListUsersHandler lists users a page at a time. The q, active and role query
+// parameters filter the list.
+func (a Auth) ListUsersHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	limit, offset, err := pagination(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_request", "error_description": err.Error()})
+		return
+	}
+
+	filter := store.UserFilter{
+		Search: c.Query("q"),
+		Role:   c.Query("role"),
+		Limit:  limit,
+		Offset: offset,
+	}
+
+	if filter.Active, err = optionalBool(c, "active"); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_request", "error_description": err.Error()})
+		return
+	}
+
+	users, total, err := a.store.ListUsers(ctx, filter)
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+
+	result := UserList{
+		Users:  []UserResponse{},
+		Total:  total,
+		Limit:  limit,
+		Offset: offset,
+	}
+
+	for _, user := range users {
+		roles, err := a.store.GetUserRoles(ctx, user.ID)
+		if err != nil {
+			adminError(c, err)
+			return
+		}
+
+		result.Users = append(result.Users, NewUserResponse(user, roles))
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// GetUserHandler describes a single user.
+func (a Auth) GetUserHandler(c *gin.Context) {
+	user, err := a.store.GetUserByID(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+
+	a.respondUser(c, http.StatusOK, user)
+}
+
+// CreateUserHandler creates an active user with the given password and roles.
+func (a Auth) CreateUserHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	var params UserRequest
+	if err := c.ShouldBindJSON(&params); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_request", "error_description": err.Error()})
+		return
+	}
+
+	params.Normalise()
+
+	problems := params.Validate()
+	problems = append(problems, a.passwords.Validate(params.Password, params.Username)...)
+
+	roles, roleProblems := NormaliseRoles(params.Roles)
+	problems = append(problems, roleProblems...)
+
+	if len(problems) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_user", "problems": problems})
+		return
+	}
+
+	password, err := store.HashPassword(params.Password)
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+
+	user := &store.User{
+		Active:        true,
+		Name:          params.Name,
+		Username:      params.Username,
+		Password:      password,
+		Email:         params.Email,
+		EmailVerified: params.EmailVerified && params.Email != "",
+	}
+
+	if user.EmailVerified {
+		now := time.Now()
+		user.EmailVerifiedAt = &now
+	}
+
+	if err := a.store.CreateUser(ctx, user); err != nil {
+		userError(c, err)
+		return
+	}
+
+	if err := a.store.SetUserRoles(ctx, user.ID, roles); err != nil {
+		adminError(c, err)
+		return
+	}
+
+	auditAdmin(c, "user.create", log.Fields{"user_id": user.ID, "username": user.Username, "roles": roles})
+
+	a.respondUser(c, http.StatusCreated, user)
+}
+
+// UpdateUserHandler replaces the profile of a user. Changing the email address
+// marks it unverified unless email_verified is set.
+func (a Auth) UpdateUserHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	user, err := a.store.GetUserByID(ctx, c.Param("id"))
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+
+	var params UserRequest
+	if err := c.ShouldBindJSON(&params); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_request", "error_description": err.Error()})
+		return
+	}
+
+	params.Normalise()
+
+	if problems := params.Validate(); len(problems) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_user", "problems": problems})
+		return
+	}
+
+	verified := params.EmailVerified && params.Email != ""
+
+	switch {
+	case !verified:
+		user.EmailVerifiedAt = nil
+	case !user.EmailVerified || user.Email != params.Email:
+		now := time.Now()
+		user.EmailVerifiedAt = &now
+	}
+
+	user.Username = params.Username
+	user.Name = params.Name
+	user.Email = params.Email
+	user.EmailVerified = verified
+
+	if err := a.store.UpdateUser(ctx, user); err != nil {
+		userError(c, err)
+		return
+	}
+
+	auditAdmin(c, "user.update", log.Fields{"user_id": user.ID, "username": user.Username})
+
+	a.respondUser(c, http.StatusOK, user)
+}
+
+// ActivateUserHandler lets a deactivated user sign in again.
+func (a Auth) ActivateUserHandler(c *gin.Context) {
+	a.setUserActive(c, true)
+}
+
+// DeactivateUserHandler stops a user from signing in and revokes their tokens,
+// keeping the account so that it can be reactivated.
+func (a Auth) DeactivateUserHandler(c *gin.Context) {
+	a.setUserActive(c, false)
+}
+
+func (a Auth) setUserActive(c *gin.Context, active bool) {
+	ctx := c.Request.Context()
+
+	user, err := a.store.GetUserByID(ctx, c.Param("id"))
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+
+	user.Active = active
+
+	// the tokens of a deactivated user are revoked in the same transaction, so that
+	// the user is never left inactive with tokens still valid
+	err = a.transaction(ctx, func(ctx context.Context) error {
+		if err := a.store.UpdateUser(ctx, user); err != nil {
+			return err
+		}
+
+		if active {
+			return nil
+		}
+
+		return a.store.RevokeUserTokens(ctx, user.ID)
+	})
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+
+	action := "user.activate"
+	if !active {
+		action = "user.deactivate"
+	}
+
+	auditAdmin(c, action, log.Fields{"user_id": user.ID, "username": user.Username})
+
+	a.respondUser(c, http.StatusOK, user)
+}
+
+// DeleteUserHandler revokes the tokens of a user and removes the account for good.
+func (a Auth) DeleteUserHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	user, err := a.store.GetUserByID(ctx, c.Param("id"))
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+
+	if err := a.store.DeleteUser(ctx, user.ID); err != nil {
+		adminError(c, err)
+		return
+	}
+
+	// a new account with the same username should not inherit a lockout
+	if err := a.store.ClearLoginAttempt(ctx, usernameKey(user.Username)); err != nil {
+		log.Errorf("failed to clear login attempts of deleted user: %v", err)
+	}
+
+	auditAdmin(c, "user.delete", log.Fields{"user_id": user.ID, "username": user.Username})
+
+	c.Status(http.StatusNoContent)
+}
+
+// ResetUserPasswordHandler stops a user from signing in with their password until
+// they choose a new one, revokes their tokens and emails them a reset link when
+// they have an email address.
+func (a Auth) ResetUserPasswordHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	user, err := a.store.GetUserByID(ctx, c.Param("id"))
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+
+	user.PasswordResetRequired = true
+
+	if err := a.store.UpdateUser(ctx, user); err != nil {
+		adminError(c, err)
+		return
+	}
+
+	if err := a.store.RevokeUserTokens(ctx, user.ID); err != nil {
+		adminError(c, err)
+		return
+	}
+
+	var response ResetPasswordResponse
+
+	if user.Email != "" {
+		if err := a.sendRequiredPasswordResetEmail(c, user); err != nil {
+			log.Errorf("failed to send password reset email: %v", err)
+		} else {
+			response.EmailSent = true
+		}
+	}
+
+	auditAdmin(c, "user.reset_password", log.Fields{"user_id": user.ID, "username": user.Username, "email_sent": response.EmailSent})
+
+	c.JSON(http.StatusAccepted, response)
+}
+
+func (a Auth) sendRequiredPasswordResetEmail(c *gin.Context, user *store.User) error {
+	link, err := a.passwordResetLink(c, user)
+	if err != nil {
+		return err
+	}
+
+	return a.mailer.Send(c.Request.Context(), mail.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf(
+			"Hi %s,\n\nAn administrator has asked you to choose a new password and signed you out everywhere. Open the link below to choose a new password:\n\n%s\n\nThe link expires in %s. Once it has, use the forgot password page to get a new one.\n",
+			user.Name, link, a.resetLifespan,
+		),
+	})
+}
+
+// SetUserRolesHandler replaces the roles of a user. Removing a role revokes the
+// tokens of the user, since they may carry scopes granted by that role, such as
+// the admin scope.
+func (a Auth) SetUserRolesHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	var params RolesRequest
+	if err := c.ShouldBindJSON(&params); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_request", "error_description": err.Error()})
+		return
+	}
+
+	roles, problems := NormaliseRoles(params.Roles)
+	if len(problems) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_user", "problems": problems})
+		return
+	}
+
+	user, err := a.store.GetUserByID(ctx, c.Param("id"))
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+
+	var removed []string
+
+	err = a.transaction(ctx, func(ctx context.Context) error {
+		current, err := a.store.GetUserRoles(ctx, user.ID)
+		if err != nil {
+			return err
+		}
+
+		for _, role := range current {
+			if !fosite.Arguments(roles).Has(role) {
+				removed = append(removed, role)
+			}
+		}
+
+		if err := a.store.SetUserRoles(ctx, user.ID, roles); err != nil {
+			return err
+		}
+
+		if len(removed) == 0 {
+			return nil
+		}
+
+		return a.store.RevokeUserTokens(ctx, user.ID)
+	})
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+
+	auditAdmin(c, "user.set_roles", log.Fields{"user_id": user.ID, "username": user.Username, "roles": roles, "removed_roles": removed})
+
+	a.respondUser(c, http.StatusOK, user)
+}
+
+// UserTokensHandler lists the active access and refresh tokens of a user a page
+// at a time. The type query parameter narrows it down to one kind of token.
+func (a Auth) UserTokensHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	limit, offset, err := pagination(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_request", "error_description": err.Error()})
+		return
+	}
+
+	tokenType, err := tokenTypeParam(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_request", "error_description": err.Error()})
+		return
+	}
+
+	user, err := a.store.GetUserByID(ctx, c.Param("id"))
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+
+	tokens, total, err := a.store.ListTokens(ctx, store.TokenFilter{
+		Type:       tokenType,
+		UserID:     user.ID,
+		ActiveOnly: true,
+		Limit:      limit,
+		Offset:     offset,
+	})
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+
+	result := TokenList{
+		Tokens: []TokenResponse{},
+		Total:  total,
+		Limit:  limit,
+		Offset: offset,
+	}
+
+	for _, token := range tokens {
+		result.Tokens = append(result.Tokens, newTokenResponse(token))
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// UserSessionsHandler lists the sessions of a user that still have active tokens,
+// most recently used first.
+func (a Auth) UserSessionsHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	user, err := a.store.GetUserByID(ctx, c.Param("id"))
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+
+	tokens, _, err := a.store.ListTokens(ctx, store.TokenFilter{UserID: user.ID, ActiveOnly: true})
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"sessions": groupSessions(tokens)})
+}
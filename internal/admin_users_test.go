@@ -0,0 +1,86 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRemovingRolesRevokesTokens(t *testing.T) {
+	tests := []struct {
+		name    string
+		roles   string
+		revoked bool
+	}{
+		{"admin role removed", `{"roles": ["auditor"]}`, true},
+		{"role added", `{"roles": ["admin", "auditor"]}`, false},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			server := newTestServer(t, newTestConfig(t, nil))
+			user := server.createUser(t, "alice", "correct horse")
+
+			if err := server.store.SetUserRoles(context.Background(), user.ID, []string{"admin"}); err != nil {
+				t.Fatal(err)
+			}
+
+			form := passwordLogin("alice", "correct horse")
+			form["scopes"] = []string{"openid", "admin"}
+
+			_, token := server.exchangeCode(t, authorizationCode(t, server.authorize(t, "openid admin", form)))
+
+			router := gin.New()
+			router.GET("/admin/clients", server.auth.RequireAdmin(), func(c *gin.Context) { c.Status(http.StatusOK) })
+			router.PUT("/admin/users/:id/roles", server.auth.SetUserRolesHandler)
+
+			request := httptest.NewRequest(http.MethodPut, "/admin/users/"+user.ID+"/roles", strings.NewReader(tt.roles))
+			request.Header.Set("Content-Type", "application/json")
+
+			if response := serve(router, request); response.Code != http.StatusOK {
+				t.Fatalf("setting the roles returned %d: %s", response.Code, response.Body.String())
+			}
+
+			request = httptest.NewRequest(http.MethodGet, "/admin/clients", nil)
+			request.Header.Set("Authorization", "Bearer "+token)
+
+			want := http.StatusOK
+			if tt.revoked {
+				want = http.StatusUnauthorized
+			}
+
+			if response := serve(router, request); response.Code != want {
+				t.Errorf("the admin API returned %d to the user's token, want %d", response.Code, want)
+			}
+		})
+	}
+}
+
+func TestDeactivateUserRollsBackWhenRevocationFails(t *testing.T) {
+	server := newTestServer(t, newTestConfig(t, nil))
+	user := server.createUser(t, "alice", "correct horse")
+	server.auth.store = failingRevocationStorage{Storage: server.store}
+
+	router := gin.New()
+	router.POST("/admin/users/:id/deactivate", server.auth.DeactivateUserHandler)
+
+	response := serve(router, httptest.NewRequest(http.MethodPost, "/admin/users/"+user.ID+"/deactivate", nil))
+	if response.Code != http.StatusInternalServerError {
+		t.Fatalf("deactivating returned %d, want 500", response.Code)
+	}
+
+	user, err := server.store.GetUserByID(context.Background(), user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !user.Active {
+		t.Error("the user was deactivated although their tokens were not revoked")
+	}
+}
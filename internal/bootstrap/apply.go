@@ -0,0 +1,363 @@
+package bootstrap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Muchogoc/go-oauth2-server/internal"
+	"github.com/Muchogoc/go-oauth2-server/internal/store"
+	"github.com/ory/fosite"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Counts records what applying a file did to one kind of declaration.
+type Counts struct {
+	Created   int `json:"created"`
+	Updated   int `json:"updated"`
+	Unchanged int `json:"unchanged"`
+}
+
+func (c Counts) String() string {
+	return fmt.Sprintf("%d created, %d updated, %d unchanged", c.Created, c.Updated, c.Unchanged)
+}
+
+// Result records what applying a file did.
+type Result struct {
+	Scopes  Counts `json:"scopes"`
+	Roles   Counts `json:"roles"`
+	Clients Counts `json:"clients"`
+	Users   Counts `json:"users"`
+}
+
+// Apply creates the declarations of a validated file that are missing from the
+// store and updates those that differ, in one transaction. Clients and users that
+// are not declared are left alone. Deactivating a client or a user revokes its
+// tokens, like the admin API does.
+func Apply(ctx context.Context, storage store.Storage, file *File) (Result, error) {
+	var result Result
+
+	// every new confidential client needs a secret, which is checked before
+	// anything is written
+	for _, client := range file.Clients {
+		if client.Public || client.Secret != "" || client.SecretHash != "" {
+			continue
+		}
+
+		_, err := storage.GetClientByID(ctx, client.ID)
+		switch {
+		case errors.Is(err, fosite.ErrNotFound):
+			return result, fmt.Errorf("client %s does not exist yet and declares no client_secret or client_secret_hash", client.ID)
+		case err != nil:
+			return result, err
+		}
+	}
+
+	ctx, err := storage.BeginTX(ctx)
+	if err != nil {
+		return result, err
+	}
+
+	if err := apply(ctx, storage, file, &result); err != nil {
+		if rollbackErr := storage.Rollback(ctx); rollbackErr != nil {
+			return result, fmt.Errorf("%w, and failed to roll back: %v", err, rollbackErr)
+		}
+
+		return result, err
+	}
+
+	if err := storage.Commit(ctx); err != nil {
+		return result, err
+	}
+
+	return result, nil
+}
+
+func apply(ctx context.Context, storage store.Storage, file *File, result *Result) error {
+	if err := applyScopes(ctx, storage, file.Scopes, &result.Scopes); err != nil {
+		return err
+	}
+
+	if err := applyRoles(ctx, storage, file.Roles, &result.Roles); err != nil {
+		return err
+	}
+
+	for _, client := range file.Clients {
+		if err := applyClient(ctx, storage, client, &result.Clients); err != nil {
+			return fmt.Errorf("client %s: %w", client.ID, err)
+		}
+	}
+
+	for _, user := range file.Users {
+		if err := applyUser(ctx, storage, user, &result.Users); err != nil {
+			return fmt.Errorf("user %s: %w", user.Username, err)
+		}
+	}
+
+	return nil
+}
+
+func applyScopes(ctx context.Context, storage store.Storage, scopes []Scope, counts *Counts) error {
+	existing, err := storage.ListScopes(ctx)
+	if err != nil {
+		return err
+	}
+
+	descriptions := make(map[string]string)
+	for _, scope := range existing {
+		descriptions[scope.Name] = scope.Description
+	}
+
+	for _, scope := range scopes {
+		description, ok := descriptions[scope.Name]
+
+		switch {
+		case !ok:
+			counts.Created++
+		case description != scope.Description:
+			counts.Updated++
+		default:
+			counts.Unchanged++
+			continue
+		}
+
+		if err := storage.SaveScope(ctx, &store.Scope{Name: scope.Name, Description: scope.Description}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func applyRoles(ctx context.Context, storage store.Storage, roles []Role, counts *Counts) error {
+	existing, err := storage.ListRoles(ctx)
+	if err != nil {
+		return err
+	}
+
+	descriptions := make(map[string]string)
+	for _, role := range existing {
+		descriptions[role.Name] = role.Description
+	}
+
+	for _, role := range roles {
+		description, ok := descriptions[role.Name]
+
+		switch {
+		case !ok:
+			counts.Created++
+		case description != role.Description:
+			counts.Updated++
+		default:
+			counts.Unchanged++
+			continue
+		}
+
+		if err := storage.SaveRole(ctx, &store.Role{Name: role.Name, Description: role.Description}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// secretHash returns the declared hash of a secret, or else the current hash when
+// it matches the declared plain text secret, or else a new hash of it.
+func secretHash(plaintext string, hash string, current string) (string, error) {
+	if hash != "" {
+		return hash, nil
+	}
+
+	if plaintext == "" || (current != "" && bcrypt.CompareHashAndPassword([]byte(current), []byte(plaintext)) == nil) {
+		return current, nil
+	}
+
+	return store.HashPassword(plaintext)
+}
+
+func applyClient(ctx context.Context, storage store.Storage, declared Client, counts *Counts) error {
+	request := declared.request()
+
+	existing, err := storage.GetClientByID(ctx, declared.ID)
+	if errors.Is(err, fosite.ErrNotFound) {
+		client := &store.Client{ID: declared.ID, Active: isActive(declared.Active)}
+		request.Apply(client)
+
+		if !client.Public {
+			if client.Secret, err = secretHash(declared.Secret, declared.SecretHash, ""); err != nil {
+				return err
+			}
+		}
+
+		counts.Created++
+
+		return storage.CreateClient(ctx, client)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	client := *existing
+	request.Apply(&client)
+	client.Active = isActive(declared.Active)
+
+	if client.Public {
+		client.Secret, client.RotatedSecrets = "", nil
+	} else {
+		if client.Secret, err = secretHash(declared.Secret, declared.SecretHash, existing.Secret); err != nil {
+			return err
+		}
+
+		if client.Secret != existing.Secret && existing.Secret != "" {
+			client.RotatedSecrets = []string{existing.Secret}
+		}
+	}
+
+	if !clientChanged(*existing, client) {
+		counts.Unchanged++
+		return nil
+	}
+
+	if err := storage.UpdateClient(ctx, &client); err != nil {
+		return err
+	}
+
+	if existing.Active && !client.Active {
+		if err := storage.RevokeClientTokens(ctx, client.ID); err != nil {
+			return err
+		}
+	}
+
+	counts.Updated++
+
+	return nil
+}
+
+// clientChanged reports whether applying a declaration changed a client.
+func clientChanged(before store.Client, after store.Client) bool {
+	return before.Active != after.Active ||
+		before.Public != after.Public ||
+		before.Secret != after.Secret ||
+		!sameStrings(before.RotatedSecrets, after.RotatedSecrets) ||
+		!sameStrings(before.RedirectURIs, after.RedirectURIs) ||
+		!sameStrings(before.Scopes, after.Scopes) ||
+		!sameStrings(before.Audience, after.Audience) ||
+		!sameStrings(before.Grants, after.Grants) ||
+		!sameStrings(before.ResponseTypes, after.ResponseTypes) ||
+		before.TokenEndpointAuthMethod != after.TokenEndpointAuthMethod ||
+		before.RateLimit != after.RateLimit ||
+		before.RateLimitBurst != after.RateLimitBurst ||
+		before.AccessTokenLifespan != after.AccessTokenLifespan ||
+		before.RefreshTokenLifespan != after.RefreshTokenLifespan ||
+		before.AuthorizeCodeLifespan != after.AuthorizeCodeLifespan ||
+		before.IDTokenLifespan != after.IDTokenLifespan ||
+		before.DisableRefreshTokenRotation != after.DisableRefreshTokenRotation ||
+		before.RefreshTokenMaxAge != after.RefreshTokenMaxAge
+}
+
+func applyUser(ctx context.Context, storage store.Storage, declared User, counts *Counts) error {
+	request := declared.request()
+
+	roles, _ := internal.NormaliseRoles(request.Roles)
+
+	existing, err := storage.GetUser(ctx, request.Username)
+	if errors.Is(err, fosite.ErrNotFound) {
+		user := &store.User{
+			Active:        isActive(declared.Active),
+			Name:          request.Name,
+			Username:      request.Username,
+			Email:         request.Email,
+			EmailVerified: request.EmailVerified && request.Email != "",
+		}
+
+		if user.EmailVerified {
+			now := time.Now()
+			user.EmailVerifiedAt = &now
+		}
+
+		if user.Password, err = secretHash(declared.Password, declared.PasswordHash, ""); err != nil {
+			return err
+		}
+
+		if err := storage.CreateUser(ctx, user); err != nil {
+			return err
+		}
+
+		counts.Created++
+
+		return storage.SetUserRoles(ctx, user.ID, roles)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	user := *existing
+	user.Name = request.Name
+	user.Email = request.Email
+	user.EmailVerified = request.EmailVerified && request.Email != ""
+	user.Active = isActive(declared.Active)
+
+	switch {
+	case !user.EmailVerified:
+		user.EmailVerifiedAt = nil
+	case !existing.EmailVerified:
+		now := time.Now()
+		user.EmailVerifiedAt = &now
+	}
+
+	current, err := storage.GetUserRoles(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+
+	changed := user.Name != existing.Name ||
+		user.Email != existing.Email ||
+		user.EmailVerified != existing.EmailVerified ||
+		user.Active != existing.Active
+
+	if changed {
+		if err := storage.UpdateUser(ctx, &user); err != nil {
+			return err
+		}
+	}
+
+	if !sameStrings(current, roles) {
+		changed = true
+
+		if err := storage.SetUserRoles(ctx, user.ID, roles); err != nil {
+			return err
+		}
+	}
+
+	if existing.Active && !user.Active {
+		if err := storage.RevokeUserTokens(ctx, user.ID); err != nil {
+			return err
+		}
+	}
+
+	if changed {
+		counts.Updated++
+	} else {
+		counts.Unchanged++
+	}
+
+	return nil
+}
+
+// sameStrings compares two lists, treating nil and empty lists alike.
+func sameStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,304 @@
+// Package bootstrap declares the scopes, roles, clients and users a deployment
+// starts with in a YAML or JSON file. Applying a file creates what is missing and
+// updates what differs, so that it can run on every startup, and the current
+// state of a store can be exported back into a file to promote it to another
+// environment.
+package bootstrap
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/Muchogoc/go-oauth2-server/internal"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+)
+
+// File is the content of a bootstrap file.
+type File struct {
+	Scopes  []Scope  `json:"scopes,omitempty" yaml:"scopes,omitempty"`
+	Roles   []Role   `json:"roles,omitempty" yaml:"roles,omitempty"`
+	Clients []Client `json:"clients,omitempty" yaml:"clients,omitempty"`
+	Users   []User   `json:"users,omitempty" yaml:"users,omitempty"`
+}
+
+// Scope declares a scope. Once any scope is declared, clients may only be
+// allowed the declared ones.
+type Scope struct {
+	Name        string `json:"name" yaml:"name"`
+	Description string `json:"description,omitempty" yaml:"description,omitempty"`
+}
+
+// Role declares a role. Once any role is declared, users may only be given the
+// declared ones.
+type Role struct {
+	Name        string `json:"name" yaml:"name"`
+	Description string `json:"description,omitempty" yaml:"description,omitempty"`
+}
+
+// Client declares a client with the metadata of the admin API. A confidential
+// client needs its secret, in plain text or as a bcrypt hash, when it is created;
+// when the secret changes the previous one keeps working until the next change.
+type Client struct {
+	ID string `json:"client_id" yaml:"client_id"`
+	// Active defaults to true
+	Active                  *bool    `json:"active,omitempty" yaml:"active,omitempty"`
+	Secret                  string   `json:"client_secret,omitempty" yaml:"client_secret,omitempty"`
+	SecretHash              string   `json:"client_secret_hash,omitempty" yaml:"client_secret_hash,omitempty"`
+	Public                  bool     `json:"public,omitempty" yaml:"public,omitempty"`
+	RedirectURIs            []string `json:"redirect_uris,omitempty" yaml:"redirect_uris,omitempty"`
+	Scopes                  []string `json:"scopes,omitempty" yaml:"scopes,omitempty"`
+	Audience                []string `json:"audience,omitempty" yaml:"audience,omitempty"`
+	GrantTypes              []string `json:"grant_types,omitempty" yaml:"grant_types,omitempty"`
+	ResponseTypes           []string `json:"response_types,omitempty" yaml:"response_types,omitempty"`
+	TokenEndpointAuthMethod string   `json:"token_endpoint_auth_method,omitempty" yaml:"token_endpoint_auth_method,omitempty"`
+	RateLimit               float64  `json:"rate_limit,omitempty" yaml:"rate_limit,omitempty"`
+	RateLimitBurst          int      `json:"rate_limit_burst,omitempty" yaml:"rate_limit_burst,omitempty"`
+
+	AccessTokenLifespan         internal.Duration `json:"access_token_lifespan,omitempty" yaml:"access_token_lifespan,omitempty"`
+	RefreshTokenLifespan        internal.Duration `json:"refresh_token_lifespan,omitempty" yaml:"refresh_token_lifespan,omitempty"`
+	AuthorizeCodeLifespan       internal.Duration `json:"authorize_code_lifespan,omitempty" yaml:"authorize_code_lifespan,omitempty"`
+	IDTokenLifespan             internal.Duration `json:"id_token_lifespan,omitempty" yaml:"id_token_lifespan,omitempty"`
+	DisableRefreshTokenRotation bool              `json:"disable_refresh_token_rotation,omitempty" yaml:"disable_refresh_token_rotation,omitempty"`
+	RefreshTokenMaxAge          internal.Duration `json:"refresh_token_max_age,omitempty" yaml:"refresh_token_max_age,omitempty"`
+}
+
+// User declares a user. The password, in plain text or as a bcrypt hash, is only
+// set when the user is created, so that users can change it afterwards.
+type User struct {
+	Username      string `json:"username" yaml:"username"`
+	Name          string `json:"name" yaml:"name"`
+	Email         string `json:"email,omitempty" yaml:"email,omitempty"`
+	EmailVerified bool   `json:"email_verified,omitempty" yaml:"email_verified,omitempty"`
+	// Active defaults to true
+	Active       *bool    `json:"active,omitempty" yaml:"active,omitempty"`
+	Password     string   `json:"password,omitempty" yaml:"password,omitempty"`
+	PasswordHash string   `json:"password_hash,omitempty" yaml:"password_hash,omitempty"`
+	Roles        []string `json:"roles,omitempty" yaml:"roles,omitempty"`
+}
+
+// ValidationError lists everything wrong with a bootstrap file.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid bootstrap file:\n  " + strings.Join(e.Problems, "\n  ")
+}
+
+// Load reads and validates a bootstrap file. JSON files are read as YAML, of
+// which JSON is a subset. Unknown fields are rejected so that typos do not go
+// unnoticed.
+func Load(path string, passwords internal.PasswordPolicy) (*File, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bootstrap file: %w", err)
+	}
+
+	return Parse(data, passwords)
+}
+
+// Parse decodes and validates the content of a bootstrap file.
+func Parse(data []byte, passwords internal.PasswordPolicy) (*File, error) {
+	var file File
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+
+	if err := decoder.Decode(&file); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to parse bootstrap file: %w", err)
+	}
+
+	if problems := file.Validate(passwords); len(problems) > 0 {
+		return nil, &ValidationError{Problems: problems}
+	}
+
+	return &file, nil
+}
+
+// Write encodes a file as "yaml" or "json".
+func (f *File) Write(w io.Writer, format string) error {
+	switch format {
+	case "yaml":
+		encoder := yaml.NewEncoder(w)
+		encoder.SetIndent(2)
+
+		if err := encoder.Encode(f); err != nil {
+			return err
+		}
+
+		return encoder.Close()
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+
+		return encoder.Encode(f)
+	default:
+		return fmt.Errorf("unsupported format: %s, expected yaml or json", format)
+	}
+}
+
+// request returns the admin API request matching a client, with its defaults
+// filled in.
+func (c Client) request() internal.ClientRequest {
+	request := internal.ClientRequest{
+		ID:                      c.ID,
+		Public:                  c.Public,
+		RedirectURIs:            c.RedirectURIs,
+		Scopes:                  c.Scopes,
+		Audience:                c.Audience,
+		GrantTypes:              c.GrantTypes,
+		ResponseTypes:           c.ResponseTypes,
+		TokenEndpointAuthMethod: c.TokenEndpointAuthMethod,
+		RateLimit:               c.RateLimit,
+		RateLimitBurst:          c.RateLimitBurst,
+
+		AccessTokenLifespan:         c.AccessTokenLifespan,
+		RefreshTokenLifespan:        c.RefreshTokenLifespan,
+		AuthorizeCodeLifespan:       c.AuthorizeCodeLifespan,
+		IDTokenLifespan:             c.IDTokenLifespan,
+		DisableRefreshTokenRotation: c.DisableRefreshTokenRotation,
+		RefreshTokenMaxAge:          c.RefreshTokenMaxAge,
+	}
+
+	request.Normalise()
+
+	return request
+}
+
+// request returns the admin API request matching a user.
+func (u User) request() internal.UserRequest {
+	request := internal.UserRequest{
+		Username:      u.Username,
+		Name:          u.Name,
+		Email:         u.Email,
+		EmailVerified: u.EmailVerified,
+		Roles:         u.Roles,
+	}
+
+	request.Normalise()
+
+	return request
+}
+
+// isActive reads an optional active flag, which defaults to true.
+func isActive(active *bool) bool {
+	return active == nil || *active
+}
+
+// Validate returns a message for every declaration that is not acceptable.
+// Clients and users are held to the same rules as in the admin API.
+func (f *File) Validate(passwords internal.PasswordPolicy) []string {
+	var problems []string
+
+	scopes := make(map[string]bool)
+
+	for i, scope := range f.Scopes {
+		switch {
+		case scope.Name == "" || strings.ContainsAny(scope.Name, " \t\n\"\\"):
+			problems = append(problems, fmt.Sprintf("scopes[%d]: %q is not a valid scope.", i, scope.Name))
+		case scopes[scope.Name]:
+			problems = append(problems, fmt.Sprintf("scopes[%d]: %q is declared twice.", i, scope.Name))
+		}
+
+		scopes[scope.Name] = true
+	}
+
+	roles := make(map[string]bool)
+
+	for i, role := range f.Roles {
+		if _, invalid := internal.NormaliseRoles([]string{role.Name}); len(invalid) > 0 || role.Name != strings.TrimSpace(role.Name) {
+			problems = append(problems, fmt.Sprintf("roles[%d]: %q is not a valid role.", i, role.Name))
+		} else if roles[role.Name] {
+			problems = append(problems, fmt.Sprintf("roles[%d]: %q is declared twice.", i, role.Name))
+		}
+
+		roles[role.Name] = true
+	}
+
+	clients := make(map[string]bool)
+
+	for i, client := range f.Clients {
+		prefix := fmt.Sprintf("clients[%d] %s: ", i, client.ID)
+
+		if clients[client.ID] {
+			problems = append(problems, prefix+"declared twice.")
+		}
+
+		clients[client.ID] = true
+
+		for _, problem := range client.request().Validate() {
+			problems = append(problems, prefix+problem)
+		}
+
+		switch {
+		case client.Secret != "" && client.SecretHash != "":
+			problems = append(problems, prefix+"client_secret and client_secret_hash cannot both be set.")
+		case client.Public && (client.Secret != "" || client.SecretHash != ""):
+			problems = append(problems, prefix+"public clients have no secret.")
+		case client.SecretHash != "" && !isBcryptHash(client.SecretHash):
+			problems = append(problems, prefix+"client_secret_hash must be a bcrypt hash.")
+		}
+
+		if len(f.Scopes) > 0 {
+			for _, scope := range client.Scopes {
+				if !scopes[scope] {
+					problems = append(problems, prefix+fmt.Sprintf("scopes: %q is not declared.", scope))
+				}
+			}
+		}
+	}
+
+	users := make(map[string]bool)
+
+	for i, user := range f.Users {
+		request := user.request()
+		prefix := fmt.Sprintf("users[%d] %s: ", i, request.Username)
+
+		if users[request.Username] {
+			problems = append(problems, prefix+"declared twice.")
+		}
+
+		users[request.Username] = true
+
+		for _, problem := range request.Validate() {
+			problems = append(problems, prefix+problem)
+		}
+
+		switch {
+		case user.Password != "" && user.PasswordHash != "":
+			problems = append(problems, prefix+"password and password_hash cannot both be set.")
+		case user.PasswordHash != "" && !isBcryptHash(user.PasswordHash):
+			problems = append(problems, prefix+"password_hash must be a bcrypt hash.")
+		case user.Password != "":
+			for _, problem := range passwords.Validate(user.Password, request.Username) {
+				problems = append(problems, prefix+problem)
+			}
+		}
+
+		normalised, invalid := internal.NormaliseRoles(user.Roles)
+		for _, problem := range invalid {
+			problems = append(problems, prefix+problem)
+		}
+
+		if len(f.Roles) > 0 {
+			for _, role := range normalised {
+				if !roles[role] {
+					problems = append(problems, prefix+fmt.Sprintf("roles: %q is not declared.", role))
+				}
+			}
+		}
+	}
+
+	return problems
+}
+
+func isBcryptHash(hash string) bool {
+	_, err := bcrypt.Cost([]byte(hash))
+	return err == nil
+}
@@ -0,0 +1,346 @@
+package bootstrap
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/Muchogoc/go-oauth2-server/internal"
+	"github.com/Muchogoc/go-oauth2-server/internal/store"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var testPasswords = internal.PasswordPolicy{MinLength: 8}
+
+const testFile = `
+scopes:
+  - name: openid
+  - name: profile
+    description: Your name
+roles:
+  - name: admin
+    description: Manages the server
+clients:
+  - client_id: web
+    client_secret: first secret
+    redirect_uris: [https://app.example.com/callback]
+    scopes: [openid, profile]
+    grant_types: [authorization_code, refresh_token]
+    response_types: [code]
+  - client_id: cli
+    public: true
+    redirect_uris: [http://127.0.0.1/callback]
+    scopes: [openid]
+    grant_types: [authorization_code]
+    response_types: [code]
+users:
+  - username: alice
+    name: Alice
+    email: alice@example.com
+    email_verified: true
+    password: correct horse
+    roles: [admin]
+  - username: bob
+    name: Bob
+    active: false
+    password: battery staple
+`
+
+func mustParse(t *testing.T, data string) *File {
+	t.Helper()
+
+	file, err := Parse([]byte(data), testPasswords)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return file
+}
+
+func mustApply(t *testing.T, storage store.Storage, file *File) Result {
+	t.Helper()
+
+	result, err := Apply(context.Background(), storage, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return result
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		problem string
+	}{
+		{
+			"invalid scope",
+			"scopes: [{name: 'open id'}]",
+			`scopes[0]: "open id" is not a valid scope.`,
+		},
+		{
+			"scope declared twice",
+			"scopes: [{name: openid}, {name: openid}]",
+			`scopes[1]: "openid" is declared twice.`,
+		},
+		{
+			"role declared twice",
+			"roles: [{name: admin}, {name: admin}]",
+			`roles[1]: "admin" is declared twice.`,
+		},
+		{
+			"client declared twice",
+			"clients: [{client_id: web, client_secret: s}, {client_id: web, client_secret: s}]",
+			"clients[1] web: declared twice.",
+		},
+		{
+			"invalid client",
+			"clients: [{client_id: web, client_secret: s, grant_types: [authorization_code]}]",
+			"clients[0] web: redirect_uris: at least one is required",
+		},
+		{
+			"secret and hash",
+			"clients: [{client_id: web, client_secret: s, client_secret_hash: h}]",
+			"clients[0] web: client_secret and client_secret_hash cannot both be set.",
+		},
+		{
+			"public client with a secret",
+			"clients: [{client_id: web, public: true, client_secret: s}]",
+			"clients[0] web: public clients have no secret.",
+		},
+		{
+			"secret hash that is not bcrypt",
+			"clients: [{client_id: web, client_secret_hash: plain}]",
+			"clients[0] web: client_secret_hash must be a bcrypt hash.",
+		},
+		{
+			"undeclared scope",
+			"scopes: [{name: openid}]\nclients: [{client_id: web, client_secret: s, scopes: [email]}]",
+			`clients[0] web: scopes: "email" is not declared.`,
+		},
+		{
+			"user declared twice",
+			"users: [{username: alice, name: Alice}, {username: alice, name: Alice}]",
+			"users[1] alice: declared twice.",
+		},
+		{
+			"invalid user",
+			"users: [{username: alice}]",
+			"users[0] alice: name is required.",
+		},
+		{
+			"password and hash",
+			"users: [{username: alice, name: Alice, password: correct horse, password_hash: h}]",
+			"users[0] alice: password and password_hash cannot both be set.",
+		},
+		{
+			"password hash that is not bcrypt",
+			"users: [{username: alice, name: Alice, password_hash: plain}]",
+			"users[0] alice: password_hash must be a bcrypt hash.",
+		},
+		{
+			"weak password",
+			"users: [{username: alice, name: Alice, password: short}]",
+			"users[0] alice: ",
+		},
+		{
+			"undeclared role",
+			"roles: [{name: admin}]\nusers: [{username: alice, name: Alice, roles: [auditor]}]",
+			`users[0] alice: roles: "auditor" is not declared.`,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse([]byte(tt.file), testPasswords)
+
+			var invalid *ValidationError
+			if !errors.As(err, &invalid) {
+				t.Fatalf("got %v, want a ValidationError", err)
+			}
+
+			for _, problem := range invalid.Problems {
+				if strings.HasPrefix(problem, tt.problem) {
+					return
+				}
+			}
+
+			t.Errorf("got %q, want a problem starting with %q", invalid.Problems, tt.problem)
+		})
+	}
+
+	if _, err := Parse([]byte("clients: [{client_id: web, secret: s}]"), testPasswords); err == nil {
+		t.Error("an unknown field was accepted")
+	}
+
+	mustParse(t, testFile)
+}
+
+func TestApplyTwiceChangesNothing(t *testing.T) {
+	storage := store.NewMemoryStore()
+	file := mustParse(t, testFile)
+
+	first := mustApply(t, storage, file)
+
+	if first.Scopes.Created != 2 || first.Roles.Created != 1 || first.Clients.Created != 2 || first.Users.Created != 2 {
+		t.Errorf("the first run did %+v, want everything created", first)
+	}
+
+	before, err := storage.GetClientByID(context.Background(), "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second := mustApply(t, storage, file)
+
+	want := Result{
+		Scopes:  Counts{Unchanged: 2},
+		Roles:   Counts{Unchanged: 1},
+		Clients: Counts{Unchanged: 2},
+		Users:   Counts{Unchanged: 2},
+	}
+
+	if second != want {
+		t.Errorf("the second run did %+v, want %+v", second, want)
+	}
+
+	after, err := storage.GetClientByID(context.Background(), "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if after.Secret != before.Secret || len(after.RotatedSecrets) != 0 {
+		t.Error("the second run hashed the client secret again")
+	}
+
+	bob, err := storage.GetUser(context.Background(), "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bob.Active {
+		t.Error("a user declared inactive is active")
+	}
+
+	alice, err := storage.GetUser(context.Background(), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roles, err := storage.GetUserRoles(context.Background(), alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(roles) != 1 || roles[0] != "admin" {
+		t.Errorf("alice has roles %v, want [admin]", roles)
+	}
+}
+
+func TestApplyRotatesClientSecrets(t *testing.T) {
+	storage := store.NewMemoryStore()
+	mustApply(t, storage, mustParse(t, testFile))
+
+	rotated := mustParse(t, strings.Replace(testFile, "first secret", "second secret", 1))
+
+	if result := mustApply(t, storage, rotated); result.Clients != (Counts{Updated: 1, Unchanged: 1}) {
+		t.Errorf("rotating the secret did %+v to the clients", result.Clients)
+	}
+
+	client, err := storage.GetClientByID(context.Background(), "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(client.Secret), []byte("second secret")) != nil {
+		t.Error("the new secret was not stored")
+	}
+
+	if len(client.RotatedSecrets) != 1 || bcrypt.CompareHashAndPassword([]byte(client.RotatedSecrets[0]), []byte("first secret")) != nil {
+		t.Errorf("got %d rotated secrets, want the first secret", len(client.RotatedSecrets))
+	}
+
+	// declaring the same secret again keeps the previous one working
+	if result := mustApply(t, storage, rotated); result.Clients != (Counts{Unchanged: 2}) {
+		t.Errorf("applying the same secret again did %+v to the clients", result.Clients)
+	}
+
+	if result := mustApply(t, storage, mustParse(t, testFile)); result.Clients != (Counts{Updated: 1, Unchanged: 1}) {
+		t.Errorf("rotating back did %+v to the clients", result.Clients)
+	}
+
+	client, err = storage.GetClientByID(context.Background(), "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(client.RotatedSecrets) != 1 || bcrypt.CompareHashAndPassword([]byte(client.RotatedSecrets[0]), []byte("second secret")) != nil {
+		t.Error("only the secret replaced last should keep working")
+	}
+}
+
+func TestExportRoundTrips(t *testing.T) {
+	source := store.NewMemoryStore()
+	mustApply(t, source, mustParse(t, testFile))
+
+	exported, err := Export(context.Background(), source, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, format := range []string{"yaml", "json"} {
+		format := format
+
+		t.Run(format, func(t *testing.T) {
+			var written bytes.Buffer
+			if err := exported.Write(&written, format); err != nil {
+				t.Fatal(err)
+			}
+
+			// applying the export to the store it came from changes nothing
+			if result := mustApply(t, source, mustParse(t, written.String())); result.Clients.Updated+result.Users.Updated != 0 {
+				t.Errorf("applying the export to its own store did %+v", result)
+			}
+
+			target := store.NewMemoryStore()
+			mustApply(t, target, mustParse(t, written.String()))
+
+			imported, err := Export(context.Background(), target, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var rewritten bytes.Buffer
+			if err := imported.Write(&rewritten, format); err != nil {
+				t.Fatal(err)
+			}
+
+			if rewritten.String() != written.String() {
+				t.Errorf("the export changed on the way through:\n%s\nwant:\n%s", rewritten.String(), written.String())
+			}
+
+			alice, err := target.GetUser(context.Background(), "alice")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if bcrypt.CompareHashAndPassword([]byte(alice.Password), []byte("correct horse")) != nil {
+				t.Error("the password did not survive the export")
+			}
+		})
+	}
+
+	withoutSecrets, err := Export(context.Background(), source, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Apply(context.Background(), store.NewMemoryStore(), withoutSecrets); err == nil {
+		t.Error("a confidential client was created without a secret")
+	}
+}
@@ -0,0 +1,107 @@
+package bootstrap
+
+import (
+	"context"
+
+	"github.com/Muchogoc/go-oauth2-server/internal"
+	"github.com/Muchogoc/go-oauth2-server/internal/store"
+)
+
+// Export describes the scopes, roles, clients and users of a store as a
+// bootstrap file. Client secret and password hashes are only included when
+// withSecrets is set; without them, confidential clients that do not exist yet
+// cannot be created from the file.
+func Export(ctx context.Context, storage store.Storage, withSecrets bool) (*File, error) {
+	file := &File{}
+
+	scopes, err := storage.ListScopes(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, scope := range scopes {
+		file.Scopes = append(file.Scopes, Scope{Name: scope.Name, Description: scope.Description})
+	}
+
+	roles, err := storage.ListRoles(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, role := range roles {
+		file.Roles = append(file.Roles, Role{Name: role.Name, Description: role.Description})
+	}
+
+	clients, _, err := storage.ListClients(ctx, store.ClientFilter{})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, client := range clients {
+		declared := Client{
+			ID:                      client.ID,
+			Active:                  inactive(client.Active),
+			Public:                  client.Public,
+			RedirectURIs:            client.RedirectURIs,
+			Scopes:                  client.Scopes,
+			Audience:                client.Audience,
+			GrantTypes:              client.Grants,
+			ResponseTypes:           client.ResponseTypes,
+			TokenEndpointAuthMethod: client.TokenEndpointAuthMethod,
+			RateLimit:               client.RateLimit,
+			RateLimitBurst:          client.RateLimitBurst,
+
+			AccessTokenLifespan:         internal.Duration(client.AccessTokenLifespan),
+			RefreshTokenLifespan:        internal.Duration(client.RefreshTokenLifespan),
+			AuthorizeCodeLifespan:       internal.Duration(client.AuthorizeCodeLifespan),
+			IDTokenLifespan:             internal.Duration(client.IDTokenLifespan),
+			DisableRefreshTokenRotation: client.DisableRefreshTokenRotation,
+			RefreshTokenMaxAge:          internal.Duration(client.RefreshTokenMaxAge),
+		}
+
+		if withSecrets && !client.Public {
+			declared.SecretHash = client.Secret
+		}
+
+		file.Clients = append(file.Clients, declared)
+	}
+
+	users, _, err := storage.ListUsers(ctx, store.UserFilter{})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, user := range users {
+		roles, err := storage.GetUserRoles(ctx, user.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		declared := User{
+			Username:      user.Username,
+			Name:          user.Name,
+			Email:         user.Email,
+			EmailVerified: user.EmailVerified,
+			Active:        inactive(user.Active),
+			Roles:         roles,
+		}
+
+		if withSecrets {
+			declared.PasswordHash = user.Password
+		}
+
+		file.Users = append(file.Users, declared)
+	}
+
+	return file, nil
+}
+
+// inactive returns the optional active flag of an export, which is left out for
+// active clients and users.
+func inactive(active bool) *bool {
+	if active {
+		return nil
+	}
+
+	return &active
+}
@@ -0,0 +1,239 @@
+// Package envelope implements envelope encryption: data is encrypted with an
+// AES-GCM data key, and the data key is itself encrypted ("wrapped") with a
+// key-encryption key held by a KeyProvider. Only wrapped data keys are stored
+// next to the data, so rotating the key-encryption key only means rewrapping them.
+package envelope
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Algorithm identifies the encryption scheme of an Envelope.
+const Algorithm = "A256GCM"
+
+// prefix tags a stored envelope and its format version. Envelopes are stored as a
+// JSON string holding the prefix and the base64 encoded envelope, so that they
+// stay valid JSON and cannot be mistaken for the JSON objects they encrypt.
+const prefix = "envelope:v1:"
+
+// maxDataKeyUses bounds how many values are encrypted with one data key, keeping
+// the chance of a random nonce repeating negligible.
+const maxDataKeyUses = 1 << 20
+
+// maxCachedDataKeys bounds the cache of unwrapped data keys.
+const maxCachedDataKeys = 1024
+
+var ErrUnknownKey = errors.New("unknown key encryption key")
+
+// KeyProvider wraps and unwraps data keys with key-encryption keys.
+type KeyProvider interface {
+	// CurrentKeyID returns the ID of the key new data keys are wrapped with
+	CurrentKeyID() string
+	Wrap(ctx context.Context, keyID string, dataKey []byte) ([]byte, error)
+	Unwrap(ctx context.Context, keyID string, wrapped []byte) ([]byte, error)
+}
+
+// Envelope is the stored form of an encrypted value.
+type Envelope struct {
+	Algorithm string `json:"alg"`
+	// KeyID identifies the key-encryption key that wrapped the data key
+	KeyID      string `json:"kid"`
+	DataKey    []byte `json:"dek"`
+	Nonce      []byte `json:"iv"`
+	Ciphertext []byte `json:"ct"`
+}
+
+// Parse decodes an envelope, reporting false for data that is not one, such as
+// values written before encryption was enabled.
+func Parse(data []byte) (*Envelope, bool) {
+	var tagged string
+
+	if len(data) == 0 || data[0] != '"' || json.Unmarshal(data, &tagged) != nil {
+		return nil, false
+	}
+
+	encoded, ok := strings.CutPrefix(tagged, prefix)
+	if !ok {
+		return nil, false
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, false
+	}
+
+	var envelope Envelope
+
+	if err := json.Unmarshal(raw, &envelope); err != nil {
+		return nil, false
+	}
+
+	if envelope.Algorithm != Algorithm || envelope.KeyID == "" {
+		return nil, false
+	}
+
+	return &envelope, true
+}
+
+// encode returns the stored form of an envelope.
+func (e Envelope) encode() ([]byte, error) {
+	raw, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(prefix + base64.RawURLEncoding.EncodeToString(raw))
+}
+
+type dataKey struct {
+	keyID     string
+	plaintext []byte
+	wrapped   []byte
+	uses      int
+}
+
+// Cipher encrypts values into envelopes. Data keys are reused for a while and
+// unwrapped data keys are cached, so that the key provider is not called for
+// every value.
+type Cipher struct {
+	keys KeyProvider
+
+	mu        sync.Mutex
+	current   *dataKey
+	unwrapped map[string][]byte
+}
+
+func NewCipher(keys KeyProvider) *Cipher {
+	return &Cipher{
+		keys:      keys,
+		unwrapped: make(map[string][]byte),
+	}
+}
+
+// CurrentKeyID returns the ID of the key-encryption key used for new values.
+func (c *Cipher) CurrentKeyID() string {
+	return c.keys.CurrentKeyID()
+}
+
+// dataKey returns the data key for the next encryption, generating a new one when
+// the key-encryption key changed or the current one was used too often.
+func (c *Cipher) dataKey(ctx context.Context) (*dataKey, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	keyID := c.keys.CurrentKeyID()
+
+	if c.current == nil || c.current.keyID != keyID || c.current.uses >= maxDataKeyUses {
+		plaintext := make([]byte, 32)
+		if _, err := rand.Read(plaintext); err != nil {
+			return nil, fmt.Errorf("failed to generate data key: %w", err)
+		}
+
+		wrapped, err := c.keys.Wrap(ctx, keyID, plaintext)
+		if err != nil {
+			return nil, fmt.Errorf("failed to wrap data key: %w", err)
+		}
+
+		c.current = &dataKey{keyID: keyID, plaintext: plaintext, wrapped: wrapped}
+	}
+
+	c.current.uses++
+
+	return c.current, nil
+}
+
+// Encrypt returns the stored form of the envelope of a value.
+func (c *Cipher) Encrypt(ctx context.Context, plaintext []byte) ([]byte, error) {
+	key, err := c.dataKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(key.plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	return Envelope{
+		Algorithm:  Algorithm,
+		KeyID:      key.keyID,
+		DataKey:    key.wrapped,
+		Nonce:      nonce,
+		Ciphertext: aead.Seal(nil, nonce, plaintext, nil),
+	}.encode()
+}
+
+// Decrypt opens an envelope. Data that is not an envelope is returned as is, so
+// that values stored before encryption was enabled remain readable.
+func (c *Cipher) Decrypt(ctx context.Context, data []byte) ([]byte, error) {
+	envelope, ok := Parse(data)
+	if !ok {
+		return data, nil
+	}
+
+	key, err := c.unwrap(ctx, envelope.KeyID, envelope.DataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := aead.Open(nil, envelope.Nonce, envelope.Ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt value: %w", err)
+	}
+
+	return plaintext, nil
+}
+
+func (c *Cipher) unwrap(ctx context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	cacheKey := keyID + ":" + string(wrapped)
+
+	c.mu.Lock()
+	key, ok := c.unwrapped[cacheKey]
+	c.mu.Unlock()
+
+	if ok {
+		return key, nil
+	}
+
+	key, err := c.keys.Unwrap(ctx, keyID, wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key: %w", err)
+	}
+
+	c.mu.Lock()
+	if len(c.unwrapped) >= maxCachedDataKeys {
+		c.unwrapped = make(map[string][]byte)
+	}
+	c.unwrapped[cacheKey] = key
+	c.mu.Unlock()
+
+	return key, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key: %w", err)
+	}
+
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,97 @@
+package envelope
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestCipher returns a cipher with a random key-encryption key.
+func newTestCipher(t *testing.T) *Cipher {
+	t.Helper()
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := json.Marshal(keyFile{Current: "k1", Keys: map[string]string{"k1": base64.StdEncoding.EncodeToString(key)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "keys.json")
+	if err := os.WriteFile(path, file, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := NewLocalKeyProvider(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return NewCipher(keys)
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	cipher := newTestCipher(t)
+	plaintext := []byte(`{"scope":["openid"]}`)
+
+	sealed, err := cipher.Encrypt(context.Background(), plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// envelopes are stored in JSON columns
+	if !json.Valid(sealed) {
+		t.Errorf("the envelope is not valid JSON: %s", sealed)
+	}
+
+	envelope, ok := Parse(sealed)
+	if !ok || envelope.KeyID != "k1" {
+		t.Fatalf("the envelope was not recognised: %s", sealed)
+	}
+
+	opened, err := cipher.Decrypt(context.Background(), sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(opened, plaintext) {
+		t.Errorf("got %s, want %s", opened, plaintext)
+	}
+}
+
+func TestPlaintextLookingLikeAnEnvelope(t *testing.T) {
+	cipher := newTestCipher(t)
+
+	// session claims are free-form JSON and may carry these keys
+	values := []string{
+		`{"alg":"A256GCM","kid":"k1","dek":"","iv":"","ct":""}`,
+		`"envelope:v1:not base64"`,
+		`"envelope:v2:e30"`,
+		`null`,
+		`[]`,
+	}
+
+	for _, value := range values {
+		if _, ok := Parse([]byte(value)); ok {
+			t.Errorf("%s was parsed as an envelope", value)
+		}
+
+		opened, err := cipher.Decrypt(context.Background(), []byte(value))
+		if err != nil {
+			t.Errorf("decrypting %s failed: %v", value, err)
+			continue
+		}
+
+		if string(opened) != value {
+			t.Errorf("%s was read back as %s", value, opened)
+		}
+	}
+}
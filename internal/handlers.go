@@ -1,23 +1,71 @@
 package internal
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Muchogoc/go-oauth2-server/config"
 	"github.com/Muchogoc/go-oauth2-server/internal/html"
+	"github.com/Muchogoc/go-oauth2-server/internal/mail"
+	"github.com/Muchogoc/go-oauth2-server/internal/ratelimit"
 	"github.com/Muchogoc/go-oauth2-server/internal/store"
 	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/google/uuid"
 	"github.com/ory/fosite"
 )
 
 type Auth struct {
 	provider fosite.OAuth2Provider
-	store    *store.Store
+	store    store.Storage
+	webAuthn *webauthn.WebAuthn
+	mailer   mail.Mailer
+
+	lockout   LockoutPolicy
+	passwords PasswordPolicy
+
+	publicURL            string
+	verificationLifespan time.Duration
+	requireVerifiedEmail bool
+	resetLifespan        time.Duration
+	passwordHistory      int
+
+	// resetEmails throttles the password reset emails sent to each account
+	resetEmails     ratelimit.Backend
+	resetEmailLimit ratelimit.Limit
+
+	adminScope string
+	adminRole  string
 }
 
-func NewAuth(provider fosite.OAuth2Provider, store *store.Store) *Auth {
+func NewAuth(cfg config.Provider, provider fosite.OAuth2Provider, store store.Storage, webAuthn *webauthn.WebAuthn, mailer mail.Mailer) *Auth {
 
 	return &Auth{
 		provider: provider,
 		store:    store,
+		webAuthn: webAuthn,
+		mailer:   mailer,
+
+		lockout:   NewLockoutPolicy(cfg),
+		passwords: NewPasswordPolicy(cfg),
+
+		publicURL:            strings.TrimSuffix(cfg.GetString("public_url"), "/"),
+		verificationLifespan: cfg.GetDuration("email_verification_lifespan"),
+		requireVerifiedEmail: cfg.GetBool("require_email_verification"),
+		resetLifespan:        cfg.GetDuration("password_reset_lifespan"),
+		passwordHistory:      cfg.GetInt("password_history_size"),
+
+		resetEmails: ratelimit.NewMemoryBackend(cfg.GetInt("ratelimit_max_buckets")),
+		resetEmailLimit: ratelimit.Limit{
+			Rate:  cfg.GetFloat64("ratelimit_password_reset_email_rate"),
+			Burst: cfg.GetInt("ratelimit_password_reset_email_burst"),
+		},
+
+		adminScope: cfg.GetString("admin_scope"),
+		adminRole:  cfg.GetString("admin_role"),
 	}
 }
 
@@ -25,6 +73,10 @@ type Authorize struct {
 	Username string   `form:"username"`
 	Password string   `form:"password"`
 	Scopes   []string `form:"scopes"`
+
+	// A passkey assertion can be submitted in place of the username and password
+	WebAuthnSession   string `form:"webauthn_session"`
+	WebAuthnAssertion string `form:"webauthn_assertion"`
 }
 
 func (a Auth) AuthorizeHandler(c *gin.Context) {
@@ -46,35 +98,62 @@ func (a Auth) AuthorizeHandler(c *gin.Context) {
 	}
 
 	// Check if username exists
-	if params.Password == "" || params.Username == "" {
-		c.Writer.Header().Set("Content-Type", "text/html; charset=utf-8")
-		params := html.LoginParams{
-			Title:           "Login",
-			RequestedScopes: ar.GetRequestedScopes(),
-		}
+	if (params.Password == "" || params.Username == "") && params.WebAuthnAssertion == "" {
+		a.renderLogin(c, ar, "")
+		return
+	}
 
-		_ = html.Login(c.Writer, params)
+	allowed, err := a.beginLogin(ctx, params.Username, c.ClientIP())
+	if err != nil {
+		a.provider.WriteAuthorizeError(ctx, c.Writer, ar, err)
+		return
+	}
 
+	if !allowed {
+		a.renderLogin(c, ar, loginFailedMessage)
+		return
+	}
+
+	var user *store.User
+
+	if params.WebAuthnAssertion != "" {
+		user, err = a.authenticatePasskey(ctx, params.WebAuthnSession, params.WebAuthnAssertion)
+	} else {
+		user, err = a.authenticatePassword(ctx, params.Username, params.Password)
+	}
+
+	if errors.Is(err, store.ErrPasswordResetRequired) {
+		a.loginSucceeded(ctx, params.Username, c.ClientIP())
+		a.renderLogin(c, ar, "Your password must be reset before you can sign in. Use the forgot password link to choose a new one.")
 		return
 	}
 
-	err = a.store.Authenticate(ctx, params.Username, params.Password)
 	if err != nil {
-		a.provider.WriteAuthorizeError(ctx, c.Writer, ar, err)
+		a.loginFailed(ctx, params.Username, c.ClientIP())
+		a.renderLogin(c, ar, loginFailedMessage)
 		return
 	}
 
-	// let's see what scopes the user gave consent to
-	for _, scope := range params.Scopes {
-		ar.GrantScope(scope)
+	if a.requireVerifiedEmail && !user.EmailVerified {
+		// the failed logins are only reset by signing in
+		a.loginReleased(ctx, params.Username, c.ClientIP())
+		a.renderLogin(c, ar, "Please verify your email address before signing in.")
+		return
 	}
 
-	user, err := a.store.GetUser(ctx, params.Username)
+	a.loginSucceeded(ctx, user.Username, c.ClientIP())
+
+	// let's see what scopes the user gave consent to
+	scopes, err := a.consentedScopes(ctx, ar, user, params.Scopes)
 	if err != nil {
-		a.provider.WriteAuthorizeError(ctx, c.Writer, ar, err)
+		a.provider.WriteAuthorizeError(ctx, c.Writer, ar, fosite.ErrServerError.WithWrap(err).WithDebug(err.Error()))
 		return
 	}
 
+	for _, scope := range scopes {
+		ar.GrantScope(scope)
+	}
+
 	session, _ := store.NewSession(
 		ctx,
 		ar.GetClient().GetID(),
@@ -96,10 +175,86 @@ func (a Auth) AuthorizeHandler(c *gin.Context) {
 
 }
 
+// consentedScopes returns the scopes of the login form that can be granted: those
+// the client requested, leaving out the admin scope unless the user has the
+// admin role.
+func (a Auth) consentedScopes(ctx context.Context, ar fosite.AuthorizeRequester, user *store.User, consented []string) ([]string, error) {
+	var scopes []string
+
+	for _, scope := range consented {
+		if !ar.GetRequestedScopes().Has(scope) {
+			continue
+		}
+
+		if scope == a.adminScope {
+			roles, err := a.store.GetUserRoles(ctx, user.ID)
+			if err != nil {
+				return nil, err
+			}
+
+			if !fosite.Arguments(roles).Has(a.adminRole) {
+				continue
+			}
+		}
+
+		scopes = append(scopes, scope)
+	}
+
+	return scopes, nil
+}
+
+// loginFailedMessage is shown for every failed login so that the page does not
+// reveal whether the username exists or has been locked out.
+const loginFailedMessage = "Invalid username or password. Please try again later."
+
+func (a Auth) renderLogin(c *gin.Context, ar fosite.AuthorizeRequester, message string) {
+	c.Writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	params := html.LoginParams{
+		Title:           "Login",
+		Error:           message,
+		RequestedScopes: ar.GetRequestedScopes(),
+	}
+
+	_ = html.Login(c.Writer, params)
+}
+
+// transaction runs fn in a store transaction, so that the changes it makes with
+// the context it is given are either all kept or all rolled back.
+func (a Auth) transaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	ctx, err := a.store.BeginTX(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := fn(ctx); err != nil {
+		if rollbackErr := a.store.Rollback(ctx); rollbackErr != nil {
+			return fmt.Errorf("%w, and failed to roll back: %v", err, rollbackErr)
+		}
+
+		return err
+	}
+
+	return a.store.Commit(ctx)
+}
+
+func (a Auth) authenticatePassword(ctx context.Context, username string, password string) (*store.User, error) {
+	if err := a.store.Authenticate(ctx, username, password); err != nil {
+		return nil, err
+	}
+
+	return a.store.GetUser(ctx, username)
+}
+
 func (a Auth) TokenHandler(c *gin.Context) {
 	ctx := c.Request.Context()
 
 	ar, err := a.provider.NewAccessRequest(ctx, c.Request, new(store.Session))
+
+	// fosite only sets the client once it has been authenticated
+	if ar != nil && ar.GetClient() != nil {
+		c.Set(ratelimit.ClientKey, ar.GetClient())
+	}
+
 	if err != nil {
 		a.provider.WriteAccessError(ctx, c.Writer, ar, err)
 		return
@@ -140,9 +295,16 @@ func (a Auth) RevokeHandler(c *gin.Context) {
 }
 
 func (a Auth) IntrospectionHandler(c *gin.Context) {
-	ctx := c.Request.Context()
+	var caller fosite.Client
+	ctx := context.WithValue(c.Request.Context(), clientRecorderKey{}, &caller)
 
 	ir, err := a.provider.NewIntrospectionRequest(ctx, c.Request, new(store.Session))
+
+	// an inactive token is only reported after the caller has been authenticated
+	if caller != nil && (err == nil || errors.Is(err, fosite.ErrInactiveToken)) {
+		c.Set(ratelimit.ClientKey, caller)
+	}
+
 	if err != nil {
 		a.provider.WriteIntrospectionError(ctx, c.Writer, err)
 		return
@@ -0,0 +1,174 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/Muchogoc/go-oauth2-server/internal/ratelimit"
+	"github.com/Muchogoc/go-oauth2-server/internal/store"
+	"github.com/gin-gonic/gin"
+	"github.com/ory/fosite"
+)
+
+// lookupCountingStorage counts the clients loaded through the store.
+type lookupCountingStorage struct {
+	store.Storage
+	lookups atomic.Int32
+}
+
+func (s *lookupCountingStorage) GetClient(ctx context.Context, id string) (fosite.Client, error) {
+	s.lookups.Add(1)
+	return s.Storage.GetClient(ctx, id)
+}
+
+// clientCredentialsToken returns an access token of the test client.
+func (s *testServer) clientCredentialsToken(t *testing.T) string {
+	t.Helper()
+
+	response := s.token(t, url.Values{"grant_type": {"client_credentials"}, "scope": {"profile"}})
+	if response.Code != http.StatusOK {
+		t.Fatalf("token returned %d: %s", response.Code, response.Body.String())
+	}
+
+	var body struct {
+		AccessToken string `json:"access_token"`
+	}
+
+	if err := json.Unmarshal(response.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+
+	return body.AccessToken
+}
+
+// introspect posts a token to the introspection endpoint and returns the client
+// the handler published for the rate limiter.
+func (s *testServer) introspect(t *testing.T, token string, secret string) (int, fosite.Client) {
+	t.Helper()
+
+	var published fosite.Client
+
+	router := gin.New()
+	router.POST("/oauth2/introspect", func(c *gin.Context) {
+		c.Next()
+
+		if value, ok := c.Get(ratelimit.ClientKey); ok {
+			published = value.(fosite.Client)
+		}
+	}, s.auth.IntrospectionHandler)
+
+	request := httptest.NewRequest(http.MethodPost, "/oauth2/introspect", strings.NewReader(url.Values{"token": {token}}.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.SetBasicAuth(testClientID, secret)
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	return recorder.Code, published
+}
+
+func TestIntrospectionReusesAuthenticatedClient(t *testing.T) {
+	server := newTestServer(t, newTestConfig(t, nil))
+	token := server.clientCredentialsToken(t)
+
+	storage := &lookupCountingStorage{Storage: server.store}
+	server.auth.store = storage
+
+	for _, introspected := range []string{token, "not-a-token"} {
+		code, client := server.introspect(t, introspected, "client-secret")
+		if code != http.StatusOK {
+			t.Fatalf("introspection returned %d", code)
+		}
+
+		if client == nil || client.GetID() != testClientID {
+			t.Errorf("introspecting %q published client %v, want %s", introspected, client, testClientID)
+		}
+	}
+
+	if lookups := storage.lookups.Load(); lookups != 0 {
+		t.Errorf("the handler loaded the client %d more times", lookups)
+	}
+
+	if _, client := server.introspect(t, token, "wrong-secret"); client != nil {
+		t.Errorf("a caller with the wrong secret was charged as %s", client.GetID())
+	}
+}
+
+// exchangeCode swaps an authorization code for tokens and returns the granted
+// scopes and the access token.
+func (s *testServer) exchangeCode(t *testing.T, code string) (string, string) {
+	t.Helper()
+
+	response := s.token(t, url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {testRedirectURI},
+	})
+	if response.Code != http.StatusOK {
+		t.Fatalf("token returned %d: %s", response.Code, response.Body.String())
+	}
+
+	var body struct {
+		AccessToken string `json:"access_token"`
+		Scope       string `json:"scope"`
+	}
+
+	if err := json.Unmarshal(response.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+
+	return body.Scope, body.AccessToken
+}
+
+func TestAuthorizeGrantsConsentedScopes(t *testing.T) {
+	tests := []struct {
+		name      string
+		roles     []string
+		requested string
+		consented []string
+		granted   string
+		admin     int
+	}{
+		{"admin", []string{"admin"}, "openid admin", []string{"openid", "admin"}, "openid admin", http.StatusOK},
+		{"not an admin", []string{"auditor"}, "openid admin", []string{"openid", "admin"}, "openid", http.StatusForbidden},
+		{"not requested", []string{"admin"}, "openid", []string{"openid", "profile", "admin"}, "openid", http.StatusForbidden},
+		{"not consented", nil, "openid profile", []string{"profile"}, "profile", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			server := newTestServer(t, newTestConfig(t, nil))
+			user := server.createUser(t, "alice", "correct horse")
+
+			if err := server.store.SetUserRoles(context.Background(), user.ID, tt.roles); err != nil {
+				t.Fatal(err)
+			}
+
+			form := passwordLogin("alice", "correct horse")
+			form["scopes"] = tt.consented
+
+			granted, token := server.exchangeCode(t, authorizationCode(t, server.authorize(t, tt.requested, form)))
+			if granted != tt.granted {
+				t.Errorf("granted %q, want %q", granted, tt.granted)
+			}
+
+			router := gin.New()
+			router.GET("/admin/clients", server.auth.RequireAdmin(), func(c *gin.Context) { c.Status(http.StatusOK) })
+
+			request := httptest.NewRequest(http.MethodGet, "/admin/clients", nil)
+			request.Header.Set("Authorization", "Bearer "+token)
+
+			if response := serve(router, request); response.Code != tt.admin {
+				t.Errorf("the admin API returned %d, want %d", response.Code, tt.admin)
+			}
+		})
+	}
+}
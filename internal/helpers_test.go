@@ -0,0 +1,227 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Muchogoc/go-oauth2-server/config"
+	"github.com/Muchogoc/go-oauth2-server/internal/mail"
+	"github.com/Muchogoc/go-oauth2-server/internal/store"
+	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/ory/fosite/compose"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+const (
+	testOrigin      = "http://localhost:8000"
+	testClientID    = "test-client"
+	testRedirectURI = "http://localhost:3000/callback"
+)
+
+// newTestConfig returns the default configuration in dev_mode with settings
+// overridden.
+func newTestConfig(t *testing.T, settings map[string]interface{}) config.Provider {
+	t.Helper()
+
+	v := config.LoadConfigProvider("GO-OAUTH2-SERVER-TEST").(*viper.Viper)
+	v.Set("dev_mode", true)
+	v.Set("loglevel", "error")
+
+	for key, value := range settings {
+		v.Set(key, value)
+	}
+
+	return v
+}
+
+// recordingMailer keeps the messages it is asked to send.
+type recordingMailer struct {
+	mu       sync.Mutex
+	messages []mail.Message
+}
+
+func (m *recordingMailer) Send(ctx context.Context, message mail.Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.messages = append(m.messages, message)
+
+	return nil
+}
+
+func (m *recordingMailer) sent() []mail.Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]mail.Message(nil), m.messages...)
+}
+
+// testServer is an Auth backed by a memory store, with a confidential client
+// allowed the authorization code grant.
+type testServer struct {
+	auth     *Auth
+	store    *store.MemoryStore
+	mailer   *recordingMailer
+	oauth2   *OAuth2Config
+	webAuthn *webauthn.WebAuthn
+}
+
+func newTestServer(t *testing.T, cfg config.Provider) *testServer {
+	t.Helper()
+
+	storage := store.NewMemoryStore()
+
+	conf, err := NewOAuth2Config(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	provider := NewOAuth2Provider(
+		conf,
+		storage,
+		compose.NewOAuth2HMACStrategy(conf),
+		AuthorizeExplicitFactory,
+		compose.OAuth2AuthorizeImplicitFactory,
+		compose.OAuth2ClientCredentialsGrantFactory,
+		RefreshTokenGrantFactory,
+		compose.OAuth2TokenIntrospectionFactory,
+		compose.OAuth2TokenRevocationFactory,
+	)
+
+	webAuthn, err := webauthn.New(&webauthn.Config{
+		RPID:          cfg.GetString("webauthn_rp_id"),
+		RPDisplayName: cfg.GetString("webauthn_rp_display_name"),
+		RPOrigins:     cfg.GetStringSlice("webauthn_rp_origins"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secret, err := store.HashPassword("client-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = storage.CreateClient(context.Background(), &store.Client{
+		ID:            testClientID,
+		Active:        true,
+		Secret:        secret,
+		RedirectURIs:  store.StringArray{testRedirectURI},
+		Scopes:        store.StringArray{"openid", "offline", "profile", cfg.GetString("admin_scope")},
+		Grants:        store.StringArray{"authorization_code", "refresh_token", "client_credentials"},
+		ResponseTypes: store.StringArray{"code"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mailer := &recordingMailer{}
+
+	return &testServer{
+		auth:     NewAuth(cfg, provider, storage, webAuthn, mailer),
+		store:    storage,
+		mailer:   mailer,
+		oauth2:   conf,
+		webAuthn: webAuthn,
+	}
+}
+
+// createUser stores an active user with a password.
+func (s *testServer) createUser(t *testing.T, username string, password string) *store.User {
+	t.Helper()
+
+	hash, err := store.HashPassword(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := &store.User{
+		Active:        true,
+		Name:          username,
+		Username:      username,
+		Password:      hash,
+		Email:         username + "@example.com",
+		EmailVerified: true,
+	}
+
+	if err := s.store.CreateUser(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+
+	return user
+}
+
+// authorize posts the login form of the authorization endpoint and returns the
+// response.
+func (s *testServer) authorize(t *testing.T, scope string, form url.Values) *httptest.ResponseRecorder {
+	t.Helper()
+
+	query := url.Values{
+		"response_type": {"code"},
+		"client_id":     {testClientID},
+		"redirect_uri":  {testRedirectURI},
+		"scope":         {scope},
+		"state":         {"some-random-state"},
+	}
+
+	request := httptest.NewRequest(http.MethodPost, "/oauth2/auth?"+query.Encode(), strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.RemoteAddr = "192.0.2.1:1234"
+
+	recorder := httptest.NewRecorder()
+
+	router := gin.New()
+	router.POST("/oauth2/auth", s.auth.AuthorizeHandler)
+	router.ServeHTTP(recorder, request)
+
+	return recorder
+}
+
+// authorizationCode returns the code an authorize response redirected with, or
+// fails the test.
+func authorizationCode(t *testing.T, response *httptest.ResponseRecorder) string {
+	t.Helper()
+
+	if response.Code != http.StatusSeeOther && response.Code != http.StatusFound {
+		t.Fatalf("authorize returned %d, want a redirect: %s", response.Code, response.Body.String())
+	}
+
+	location, err := url.Parse(response.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code := location.Query().Get("code")
+	if code == "" {
+		t.Fatalf("authorize redirected to %s without a code", location)
+	}
+
+	return code
+}
+
+// token posts a form to the token endpoint with the test client's credentials.
+func (s *testServer) token(t *testing.T, form url.Values) *httptest.ResponseRecorder {
+	t.Helper()
+
+	request := httptest.NewRequest(http.MethodPost, "/oauth2/token", strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.SetBasicAuth(testClientID, "client-secret")
+
+	recorder := httptest.NewRecorder()
+
+	router := gin.New()
+	router.POST("/oauth2/token", s.auth.TokenHandler)
+	router.ServeHTTP(recorder, request)
+
+	return recorder
+}
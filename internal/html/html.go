@@ -2,20 +2,98 @@ package html
 
 import (
 	"embed"
+	"errors"
+	"fmt"
+	"html/template"
 	"io"
-	"text/template"
+	"io/fs"
+	"os"
+	"sync/atomic"
 )
 
-//go:embed *
+//go:embed *.html
 var files embed.FS
 
+// Templates are the parsed pages.
+type Templates struct {
+	pages map[string]*template.Template
+}
+
+var current atomic.Pointer[Templates]
+
+func init() {
+	templates, err := Load("")
+	if err != nil {
+		panic(err)
+	}
+
+	Use(templates)
+}
+
+// Load parses every page. The files of dir, when it is set, are used in place of
+// the built-in files of the same name, so that pages can be customised.
+func Load(dir string) (*Templates, error) {
+	fsys := fs.FS(files)
+	if dir != "" {
+		if _, err := os.Stat(dir); err != nil {
+			return nil, fmt.Errorf("failed to read templates: %w", err)
+		}
+
+		fsys = overlay{custom: os.DirFS(dir), builtin: files}
+	}
+
+	names, err := fs.Glob(files, "*.html")
+	if err != nil {
+		return nil, err
+	}
+
+	templates := &Templates{pages: make(map[string]*template.Template)}
+
+	for _, name := range names {
+		// included in every page
+		if name == "layout.html" || name == "webauthn.html" {
+			continue
+		}
+
+		page, err := template.New("layout.html").ParseFS(fsys, "layout.html", "webauthn.html", name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", name, err)
+		}
+
+		templates.pages[name] = page
+	}
+
+	return templates, nil
+}
+
+// Use makes the pages render with templates, also while others are rendering.
+func Use(templates *Templates) {
+	current.Store(templates)
+}
+
 func parse(file string) *template.Template {
-	return template.Must(
-		template.New("layout.html").ParseFS(files, "layout.html", file))
+	return current.Load().pages[file]
+}
+
+// overlay reads files from custom when they exist there, and from builtin
+// otherwise.
+type overlay struct {
+	custom  fs.FS
+	builtin fs.FS
+}
+
+func (o overlay) Open(name string) (fs.File, error) {
+	file, err := o.custom.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return o.builtin.Open(name)
+	}
+
+	return file, err
 }
 
 type LoginParams struct {
 	Title           string
+	Error           string
 	RequestedScopes []string
 }
 
@@ -23,3 +101,67 @@ func Login(w io.Writer, p LoginParams) error {
 	template := parse("login.html")
 	return template.Execute(w, p)
 }
+
+type RegisterPasskeyParams struct {
+	Title string
+}
+
+func RegisterPasskey(w io.Writer, p RegisterPasskeyParams) error {
+	template := parse("register_passkey.html")
+	return template.Execute(w, p)
+}
+
+type RegisterParams struct {
+	Title    string
+	Errors   []string
+	Username string
+	Name     string
+	Email    string
+}
+
+func Register(w io.Writer, p RegisterParams) error {
+	template := parse("register.html")
+	return template.Execute(w, p)
+}
+
+type MessageParams struct {
+	Title   string
+	Message string
+}
+
+func Message(w io.Writer, p MessageParams) error {
+	template := parse("message.html")
+	return template.Execute(w, p)
+}
+
+type ForgotPasswordParams struct {
+	Title  string
+	Errors []string
+}
+
+func ForgotPassword(w io.Writer, p ForgotPasswordParams) error {
+	template := parse("forgot_password.html")
+	return template.Execute(w, p)
+}
+
+type ResetPasswordParams struct {
+	Title  string
+	Errors []string
+	Token  string
+}
+
+func ResetPassword(w io.Writer, p ResetPasswordParams) error {
+	template := parse("reset_password.html")
+	return template.Execute(w, p)
+}
+
+type ChangePasswordParams struct {
+	Title    string
+	Errors   []string
+	Username string
+}
+
+func ChangePassword(w io.Writer, p ChangePasswordParams) error {
+	template := parse("change_password.html")
+	return template.Execute(w, p)
+}
@@ -0,0 +1,62 @@
+package html
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPagesEscapeParameters(t *testing.T) {
+	var page strings.Builder
+
+	err := Register(&page, RegisterParams{
+		Title:    "Register",
+		Errors:   []string{`<img src=x onerror="alert(1)">`},
+		Username: `"><script>alert(1)</script>`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(page.String(), "<script>alert") || strings.Contains(page.String(), "<img src=x") {
+		t.Errorf("the page rendered markup from its parameters:\n%s", page.String())
+	}
+
+	if !strings.Contains(page.String(), "&lt;img src=x") {
+		t.Errorf("the error was not rendered escaped:\n%s", page.String())
+	}
+}
+
+func TestCustomPagesEscapeParameters(t *testing.T) {
+	dir := t.TempDir()
+
+	custom := `{{define "content"}}<p>{{.Message}}</p>{{end}}`
+	if err := os.WriteFile(filepath.Join(dir, "message.html"), []byte(custom), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	templates, err := Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Use(templates)
+	t.Cleanup(func() {
+		builtin, err := Load("")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		Use(builtin)
+	})
+
+	var page strings.Builder
+	if err := Message(&page, MessageParams{Title: "Hello", Message: "<b>bold</b>"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(page.String(), "<p>&lt;b&gt;bold&lt;/b&gt;</p>") {
+		t.Errorf("the custom page did not escape its parameters:\n%s", page.String())
+	}
+}
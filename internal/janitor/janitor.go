@@ -0,0 +1,116 @@
+package janitor
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Muchogoc/go-oauth2-server/config"
+	"github.com/Muchogoc/go-oauth2-server/internal/store"
+	"github.com/Muchogoc/go-oauth2-server/log"
+)
+
+var (
+	// rowsPurged counts the rows deleted per table since the process started
+	rowsPurged = expvar.NewMap("gc_rows_purged")
+	runs       = expvar.NewInt("gc_runs")
+	failures   = expvar.NewInt("gc_failures")
+)
+
+// Janitor periodically deletes expired and invalidated codes, tokens and sessions.
+type Janitor struct {
+	store    store.Storage
+	policy   store.PurgePolicy
+	interval time.Duration
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewJanitor reads the garbage collection settings from the configuration.
+func NewJanitor(cfg config.Provider, storage store.Storage) *Janitor {
+	return &Janitor{
+		store: storage,
+		policy: store.PurgePolicy{
+			BatchSize:               cfg.GetInt("gc_batch_size"),
+			Retention:               cfg.GetDuration("gc_retention"),
+			RefreshTokenGracePeriod: cfg.GetDuration("gc_refresh_token_grace_period"),
+		},
+		interval: cfg.GetDuration("gc_interval"),
+	}
+}
+
+// Run performs a single garbage collection pass and returns the number of rows
+// deleted per table.
+func (j *Janitor) Run(ctx context.Context) (map[string]int64, error) {
+	start := time.Now()
+
+	purged, err := j.store.PurgeExpired(ctx, j.policy)
+
+	runs.Add(1)
+
+	var total int64
+	for table, count := range purged {
+		rowsPurged.Add(table, count)
+		total += count
+	}
+
+	if err != nil {
+		failures.Add(1)
+		return purged, err
+	}
+
+	log.WithFields(log.Fields{
+		"event":    "gc",
+		"purged":   purged,
+		"total":    total,
+		"duration": time.Since(start),
+	}).Info("purged expired tokens")
+
+	return purged, nil
+}
+
+// Start runs the janitor in the background every interval until Stop is called.
+// It fails when the interval is not positive.
+func (j *Janitor) Start() error {
+	if j.interval <= 0 {
+		return fmt.Errorf("gc_interval must be positive, got %s", j.interval)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	j.cancel = cancel
+
+	j.wg.Add(1)
+
+	go func() {
+		defer j.wg.Done()
+
+		ticker := time.NewTicker(j.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if _, err := j.Run(ctx); err != nil && ctx.Err() == nil {
+					log.Errorf("failed to purge expired tokens: %v", err)
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Stop interrupts a pass in progress and waits for the janitor to exit.
+func (j *Janitor) Stop() {
+	if j.cancel == nil {
+		return
+	}
+
+	j.cancel()
+	j.wg.Wait()
+}
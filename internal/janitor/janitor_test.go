@@ -0,0 +1,51 @@
+package janitor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Muchogoc/go-oauth2-server/config"
+	"github.com/Muchogoc/go-oauth2-server/internal/store"
+	"github.com/spf13/viper"
+)
+
+func newTestJanitor(t *testing.T, interval time.Duration) *Janitor {
+	t.Helper()
+
+	v := config.LoadConfigProvider("GO-OAUTH2-SERVER-TEST").(*viper.Viper)
+	v.Set("loglevel", "error")
+	v.Set("gc_interval", interval)
+
+	return NewJanitor(v, store.NewMemoryStore())
+}
+
+func TestStartRejectsNonPositiveInterval(t *testing.T) {
+	for _, interval := range []time.Duration{0, -time.Minute} {
+		janitor := newTestJanitor(t, interval)
+
+		if err := janitor.Start(); err == nil {
+			janitor.Stop()
+			t.Errorf("an interval of %s was accepted", interval)
+		}
+
+		// stopping a janitor that never started is harmless
+		janitor.Stop()
+	}
+}
+
+func TestStartRunsEveryInterval(t *testing.T) {
+	janitor := newTestJanitor(t, 10*time.Millisecond)
+
+	before := runs.Value()
+
+	if err := janitor.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	janitor.Stop()
+
+	if passes := runs.Value() - before; passes < 2 {
+		t.Errorf("ran %d passes in 100ms, want several", passes)
+	}
+}
@@ -0,0 +1,212 @@
+package internal
+
+import (
+	"context"
+	"time"
+
+	"github.com/Muchogoc/go-oauth2-server/config"
+	"github.com/Muchogoc/go-oauth2-server/internal/store"
+	"github.com/Muchogoc/go-oauth2-server/log"
+)
+
+// LockoutPolicy controls how failed logins are throttled. Every failure delays
+// the next attempt on the username exponentially, and reaching a threshold locks
+// the username or client IP out for a fixed duration. The client IP is not
+// delayed, since it may be shared by many users behind a NAT.
+type LockoutPolicy struct {
+	UsernameThreshold int
+	IPThreshold       int
+	Duration          time.Duration
+	BackoffBase       time.Duration
+	BackoffMax        time.Duration
+	// Window is how long failures are remembered after the last one
+	Window time.Duration
+}
+
+// NewLockoutPolicy reads the lockout thresholds from the configuration.
+func NewLockoutPolicy(cfg config.Provider) LockoutPolicy {
+	return LockoutPolicy{
+		UsernameThreshold: cfg.GetInt("lockout_username_threshold"),
+		IPThreshold:       cfg.GetInt("lockout_ip_threshold"),
+		Duration:          cfg.GetDuration("lockout_duration"),
+		BackoffBase:       cfg.GetDuration("lockout_backoff_base"),
+		BackoffMax:        cfg.GetDuration("lockout_backoff_max"),
+		Window:            cfg.GetDuration("lockout_window"),
+	}
+}
+
+func usernameKey(username string) string {
+	return "username:" + username
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+// retryAt returns the earliest time another login may be attempted for a record,
+// which is only delayed by the backoff if backoff is set.
+func (p LockoutPolicy) retryAt(attempt *store.LoginAttempt, backoff bool) time.Time {
+	if attempt.Failures == 0 {
+		return time.Time{}
+	}
+
+	if attempt.LockedUntil.After(attempt.LastFailureAt) {
+		return attempt.LockedUntil
+	}
+
+	if !backoff {
+		return time.Time{}
+	}
+
+	delay := p.BackoffBase
+	for i := 1; i < attempt.Failures && delay < p.BackoffMax; i++ {
+		delay *= 2
+	}
+
+	if delay > p.BackoffMax {
+		delay = p.BackoffMax
+	}
+
+	return attempt.LastFailureAt.Add(delay)
+}
+
+// loginKeys returns the keys a login is throttled by with their thresholds, the
+// client IP first. Only the username is subject to the backoff.
+func (a Auth) loginKeys(username string, ip string) []lockoutKey {
+	keys := []lockoutKey{{key: ipKey(ip), threshold: a.lockout.IPThreshold}}
+	if username != "" {
+		keys = append(keys, lockoutKey{key: usernameKey(username), threshold: a.lockout.UsernameThreshold, backoff: true})
+	}
+
+	return keys
+}
+
+type lockoutKey struct {
+	key       string
+	threshold int
+	backoff   bool
+}
+
+// beginLogin reserves a login attempt against the client IP and then the
+// username, and reports false as soon as one of them is throttled. The attempt
+// counts as a failure until loginSucceeded takes it back, and each key is checked
+// and updated atomically in the store, so concurrent attempts cannot all pass the
+// same check: the lockout thresholds hold however many requests are sent at once,
+// and once the username has failures its backoff applies to attempts still in
+// flight.
+func (a Auth) beginLogin(ctx context.Context, username string, ip string) (bool, error) {
+	for _, key := range a.loginKeys(username, ip) {
+		var reserved, locked bool
+
+		attempt, err := a.store.UpdateLoginAttempt(ctx, key.key, func(attempt *store.LoginAttempt) bool {
+			now := time.Now()
+
+			if a.lockout.retryAt(attempt, key.backoff).After(now) {
+				return false
+			}
+
+			// failures outside the window no longer count towards a lockout
+			if !attempt.LastFailureAt.IsZero() && now.Sub(attempt.LastFailureAt) > a.lockout.Window {
+				attempt.Failures = 0
+			}
+
+			// the first attempt on a key is not delayed by the ones in flight, the
+			// attempts after it wait for the backoff
+			if attempt.Failures > 0 {
+				attempt.LastFailureAt = now
+			}
+
+			attempt.Failures++
+			reserved = true
+
+			if key.threshold > 0 && attempt.Failures >= key.threshold {
+				attempt.LockedUntil = now.Add(a.lockout.Duration)
+				locked = true
+			}
+
+			return true
+		})
+		if err != nil {
+			return false, err
+		}
+
+		if locked {
+			log.WithFields(log.Fields{
+				"event":        "login_lockout",
+				"key":          key.key,
+				"failures":     attempt.Failures,
+				"locked_until": attempt.LockedUntil,
+			}).Warn("too many failed logins, locking out")
+		}
+
+		if !reserved {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// loginFailed starts the backoff of the attempt reserved by beginLogin, which
+// already counted as a failure.
+func (a Auth) loginFailed(ctx context.Context, username string, ip string) {
+	for _, key := range a.loginKeys(username, ip) {
+		_, err := a.store.UpdateLoginAttempt(ctx, key.key, func(attempt *store.LoginAttempt) bool {
+			attempt.LastFailureAt = time.Now()
+			return true
+		})
+		if err != nil {
+			log.Errorf("failed to record login attempt: %v", err)
+		}
+	}
+}
+
+// loginSucceeded takes back the attempt reserved against the client IP together
+// with one earlier failure, and resets the failed logins of the username. The
+// failures of a client IP shared by many users wear off as they sign in, while
+// one valid account does not wipe out guesses at the others, which stay limited
+// by their username.
+func (a Auth) loginSucceeded(ctx context.Context, username string, ip string) {
+	a.releaseAttempts(ctx, lockoutKey{key: ipKey(ip), threshold: a.lockout.IPThreshold}, 2)
+	a.clearLoginFailures(ctx, username)
+}
+
+// loginReleased takes back the attempt reserved by beginLogin when the
+// credentials were right but the user cannot sign in yet, leaving the earlier
+// failures in place.
+func (a Auth) loginReleased(ctx context.Context, username string, ip string) {
+	for _, key := range a.loginKeys(username, ip) {
+		a.releaseAttempts(ctx, key, 1)
+	}
+}
+
+// releaseAttempts takes back up to n failures of a key.
+func (a Auth) releaseAttempts(ctx context.Context, key lockoutKey, n int) {
+	_, err := a.store.UpdateLoginAttempt(ctx, key.key, func(attempt *store.LoginAttempt) bool {
+		if attempt.Failures == 0 {
+			return false
+		}
+
+		attempt.Failures -= n
+		if attempt.Failures < 0 {
+			attempt.Failures = 0
+		}
+
+		// unlock a key locked by the attempts taken back
+		if attempt.Failures < key.threshold {
+			attempt.LockedUntil = time.Time{}
+		}
+
+		return true
+	})
+	if err != nil {
+		log.Errorf("failed to record login attempt: %v", err)
+	}
+}
+
+// clearLoginFailures resets the failed logins of a username.
+func (a Auth) clearLoginFailures(ctx context.Context, username string) {
+	if err := a.store.ClearLoginAttempt(ctx, usernameKey(username)); err != nil {
+		log.Errorf("failed to clear login attempts: %v", err)
+	}
+}
@@ -0,0 +1,218 @@
+package internal
+
+import (
+	"context"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Muchogoc/go-oauth2-server/internal/store"
+)
+
+// countingStorage counts the passwords checked against the store.
+type countingStorage struct {
+	store.Storage
+	authentications atomic.Int32
+}
+
+func (s *countingStorage) Authenticate(ctx context.Context, name string, secret string) error {
+	s.authentications.Add(1)
+	return s.Storage.Authenticate(ctx, name, secret)
+}
+
+func passwordLogin(username string, password string) url.Values {
+	return url.Values{"username": {username}, "password": {password}}
+}
+
+// loginsInParallel posts n logins at once and waits for them.
+func (s *testServer) loginsInParallel(t *testing.T, n int, form url.Values) {
+	t.Helper()
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			s.authorize(t, "openid", form)
+		}()
+	}
+
+	wg.Wait()
+}
+
+func TestParallelLoginsCannotBypassLockout(t *testing.T) {
+	server := newTestServer(t, newTestConfig(t, map[string]interface{}{
+		"lockout_username_threshold": 5,
+		"lockout_ip_threshold":       0,
+		"lockout_backoff_base":       0,
+		"lockout_backoff_max":        0,
+	}))
+	server.createUser(t, "alice", "correct horse")
+
+	storage := &countingStorage{Storage: server.store}
+	server.auth.store = storage
+
+	server.loginsInParallel(t, 50, passwordLogin("alice", "wrong"))
+
+	if checked := storage.authentications.Load(); checked != 5 {
+		t.Errorf("%d passwords were checked, want the threshold of 5", checked)
+	}
+
+	attempt, err := server.store.GetLoginAttempt(context.Background(), usernameKey("alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if attempt.Failures != 5 || !attempt.LockedUntil.After(time.Now()) {
+		t.Errorf("got %d failures locked until %s, want 5 and locked", attempt.Failures, attempt.LockedUntil)
+	}
+
+	if response := server.authorize(t, "openid", passwordLogin("alice", "correct horse")); response.Header().Get("Location") != "" {
+		t.Errorf("a locked out user signed in")
+	}
+}
+
+func TestParallelFailuresAreAllCounted(t *testing.T) {
+	server := newTestServer(t, newTestConfig(t, map[string]interface{}{
+		"lockout_username_threshold": 0,
+		"lockout_ip_threshold":       0,
+		"lockout_backoff_base":       0,
+		"lockout_backoff_max":        0,
+	}))
+	server.createUser(t, "alice", "correct horse")
+
+	server.loginsInParallel(t, 20, passwordLogin("alice", "wrong"))
+
+	for _, key := range []string{usernameKey("alice"), ipKey("192.0.2.1")} {
+		attempt, err := server.store.GetLoginAttempt(context.Background(), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if attempt.Failures != 20 {
+			t.Errorf("%s has %d failures, want 20", key, attempt.Failures)
+		}
+	}
+}
+
+func TestParallelLoginsWaitForBackoff(t *testing.T) {
+	server := newTestServer(t, newTestConfig(t, map[string]interface{}{
+		"lockout_ip_threshold": 0,
+		"lockout_backoff_base": time.Minute,
+		"lockout_backoff_max":  time.Hour,
+	}))
+	server.createUser(t, "alice", "correct horse")
+
+	server.authorize(t, "openid", passwordLogin("alice", "wrong"))
+
+	storage := &countingStorage{Storage: server.store}
+	server.auth.store = storage
+
+	server.loginsInParallel(t, 20, passwordLogin("alice", "wrong"))
+
+	if checked := storage.authentications.Load(); checked != 0 {
+		t.Errorf("%d passwords were checked during the backoff, want none", checked)
+	}
+}
+
+func TestSuccessfulLoginsLeaveNoFailures(t *testing.T) {
+	server := newTestServer(t, newTestConfig(t, nil))
+	server.createUser(t, "alice", "correct horse")
+
+	for i := 0; i < 3; i++ {
+		authorizationCode(t, server.authorize(t, "openid", passwordLogin("alice", "correct horse")))
+	}
+
+	for _, key := range []string{usernameKey("alice"), ipKey("192.0.2.1")} {
+		attempt, err := server.store.GetLoginAttempt(context.Background(), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if attempt.Failures != 0 {
+			t.Errorf("%s has %d failures after successful logins", key, attempt.Failures)
+		}
+	}
+}
+
+func TestUnverifiedLoginsKeepFailures(t *testing.T) {
+	server := newTestServer(t, newTestConfig(t, map[string]interface{}{
+		"require_email_verification": true,
+		"lockout_backoff_base":       0,
+		"lockout_backoff_max":        0,
+	}))
+
+	user := server.createUser(t, "alice", "correct horse")
+	user.EmailVerified = false
+
+	if err := server.store.UpdateUser(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		server.authorize(t, "openid", passwordLogin("alice", "wrong"))
+	}
+
+	if response := server.authorize(t, "openid", passwordLogin("alice", "correct horse")); response.Header().Get("Location") != "" {
+		t.Fatalf("an unverified user signed in")
+	}
+
+	for _, key := range []string{usernameKey("alice"), ipKey("192.0.2.1")} {
+		attempt, err := server.store.GetLoginAttempt(context.Background(), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if attempt.Failures != 2 {
+			t.Errorf("%s has %d failures, want the 2 failed logins", key, attempt.Failures)
+		}
+	}
+}
+
+func TestBackoffOnlyDelaysTheUsername(t *testing.T) {
+	server := newTestServer(t, newTestConfig(t, map[string]interface{}{
+		"lockout_backoff_base": time.Minute,
+		"lockout_backoff_max":  time.Hour,
+	}))
+	server.createUser(t, "alice", "correct horse")
+	server.createUser(t, "bob", "battery staple")
+
+	server.authorize(t, "openid", passwordLogin("alice", "wrong"))
+
+	// another user behind the same IP is not delayed
+	authorizationCode(t, server.authorize(t, "openid", passwordLogin("bob", "battery staple")))
+
+	if response := server.authorize(t, "openid", passwordLogin("alice", "correct horse")); response.Header().Get("Location") != "" {
+		t.Error("a user signed in during the backoff")
+	}
+}
+
+func TestIPFailuresWearOffOnSuccess(t *testing.T) {
+	server := newTestServer(t, newTestConfig(t, map[string]interface{}{
+		"lockout_ip_threshold": 3,
+		"lockout_backoff_base": 0,
+		"lockout_backoff_max":  0,
+	}))
+	server.createUser(t, "alice", "correct horse")
+	server.createUser(t, "bob", "battery staple")
+
+	for i := 0; i < 2; i++ {
+		server.authorize(t, "openid", passwordLogin("alice", "wrong"))
+	}
+
+	// the attempt reaching the threshold succeeds and takes back an earlier failure
+	authorizationCode(t, server.authorize(t, "openid", passwordLogin("bob", "battery staple")))
+
+	attempt, err := server.store.GetLoginAttempt(context.Background(), ipKey("192.0.2.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if attempt.Failures != 1 || attempt.LockedUntil.After(time.Now()) {
+		t.Errorf("got %d failures locked until %s, want 1 and unlocked", attempt.Failures, attempt.LockedUntil)
+	}
+}
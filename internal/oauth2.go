@@ -0,0 +1,355 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Muchogoc/go-oauth2-server/config"
+	"github.com/Muchogoc/go-oauth2-server/internal/store"
+	"github.com/Muchogoc/go-oauth2-server/log"
+	"github.com/ory/fosite"
+	"github.com/ory/fosite/compose"
+	"github.com/ory/fosite/handler/oauth2"
+	fositestorage "github.com/ory/fosite/storage"
+)
+
+// minSecretLength is the shortest global secret the HMAC strategy accepts.
+const minSecretLength = 32
+
+// OAuth2Config is the fosite configuration of the server. Its lifespans and
+// whether debug messages are sent to clients can be replaced while requests are
+// being served; the rest is fixed once the provider is composed.
+type OAuth2Config struct {
+	*fosite.Config
+
+	settings atomic.Pointer[fosite.Config]
+}
+
+func NewOAuth2Config(cfg config.Provider) (*OAuth2Config, error) {
+	settings, err := LoadOAuth2Settings(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if string(settings.GlobalSecret) == config.DefaultGlobalSecret {
+		log.Warn("oauth2_global_secret is the default, tokens can be forged by anyone")
+	}
+
+	if settings.SendDebugMessagesToClients && !cfg.GetBool("dev_mode") {
+		log.Warn("oauth2_send_debug_messages is set, error details are sent to clients")
+	}
+
+	c := &OAuth2Config{Config: settings}
+	c.settings.Store(settings)
+
+	return c, nil
+}
+
+// SetSettings replaces the reloadable settings with those of a configuration
+// returned by LoadOAuth2Settings.
+func (c *OAuth2Config) SetSettings(settings *fosite.Config) {
+	c.settings.Store(settings)
+}
+
+func (c *OAuth2Config) GetAccessTokenLifespan(ctx context.Context) time.Duration {
+	return c.settings.Load().GetAccessTokenLifespan(ctx)
+}
+
+func (c *OAuth2Config) GetRefreshTokenLifespan(ctx context.Context) time.Duration {
+	return c.settings.Load().GetRefreshTokenLifespan(ctx)
+}
+
+func (c *OAuth2Config) GetAuthorizeCodeLifespan(ctx context.Context) time.Duration {
+	return c.settings.Load().GetAuthorizeCodeLifespan(ctx)
+}
+
+func (c *OAuth2Config) GetIDTokenLifespan(ctx context.Context) time.Duration {
+	return c.settings.Load().GetIDTokenLifespan(ctx)
+}
+
+func (c *OAuth2Config) GetSendDebugMessagesToClients(ctx context.Context) bool {
+	return c.settings.Load().GetSendDebugMessagesToClients(ctx)
+}
+
+// NewOAuth2Provider is compose.Compose for an OAuth2Config, whose handlers see
+// the settings it is updated with.
+func NewOAuth2Provider(config *OAuth2Config, storage interface{}, strategy interface{}, factories ...compose.Factory) fosite.OAuth2Provider {
+	for _, factory := range factories {
+		handler := factory(config, storage, strategy)
+
+		if h, ok := handler.(fosite.AuthorizeEndpointHandler); ok {
+			config.AuthorizeEndpointHandlers.Append(h)
+		}
+
+		if h, ok := handler.(fosite.TokenEndpointHandler); ok {
+			config.TokenEndpointHandlers.Append(h)
+		}
+
+		if h, ok := handler.(fosite.TokenIntrospector); ok {
+			config.TokenIntrospectionHandlers.Append(h)
+		}
+
+		if h, ok := handler.(fosite.RevocationHandler); ok {
+			config.RevocationHandlers.Append(h)
+		}
+
+		if h, ok := handler.(fosite.PushedAuthorizeEndpointHandler); ok {
+			config.PushedAuthorizeEndpointHandlers.Append(h)
+		}
+	}
+
+	return fosite.NewOAuth2Provider(recordingStorage{storage.(fosite.Storage)}, config)
+}
+
+// clientRecorderKey holds a *fosite.Client in a context, which the provider fills
+// with the first client it loads, so that a handler can reuse the client fosite
+// authenticated a request with instead of loading it again.
+type clientRecorderKey struct{}
+
+// recordingStorage is the storage of the provider, recording the clients it loads
+// for clientRecorderKey.
+type recordingStorage struct {
+	fosite.Storage
+}
+
+func (s recordingStorage) GetClient(ctx context.Context, id string) (fosite.Client, error) {
+	client, err := s.Storage.GetClient(ctx, id)
+
+	if recorded, ok := ctx.Value(clientRecorderKey{}).(*fosite.Client); ok && err == nil && *recorded == nil {
+		*recorded = client
+	}
+
+	return client, err
+}
+
+// LoadOAuth2Settings returns the fosite configuration of the oauth2 settings, or
+// every problem with them. Outside dev_mode the default global secret is
+// refused, since anyone could forge tokens with it.
+func LoadOAuth2Settings(cfg config.Provider) (*fosite.Config, error) {
+	var problems []string
+
+	secret, err := config.Secret(cfg, "oauth2_global_secret")
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case len(secret) < minSecretLength:
+		problems = append(problems, fmt.Sprintf("oauth2_global_secret must be at least %d bytes", minSecretLength))
+	case secret == config.DefaultGlobalSecret && !cfg.GetBool("dev_mode"):
+		problems = append(problems, "oauth2_global_secret must be changed from its default outside dev_mode")
+	}
+
+	var rotated [][]byte
+	for i, previous := range cfg.GetStringSlice("oauth2_rotated_global_secrets") {
+		if len(previous) < minSecretLength {
+			problems = append(problems, fmt.Sprintf("oauth2_rotated_global_secrets[%d] must be at least %d bytes", i, minSecretLength))
+		}
+
+		rotated = append(rotated, []byte(previous))
+	}
+
+	conf := &fosite.Config{
+		GlobalSecret:         []byte(secret),
+		RotatedGlobalSecrets: rotated,
+
+		AccessTokenLifespan:   cfg.GetDuration("oauth2_access_token_lifespan"),
+		RefreshTokenLifespan:  cfg.GetDuration("oauth2_refresh_token_lifespan"),
+		AuthorizeCodeLifespan: cfg.GetDuration("oauth2_authorize_code_lifespan"),
+		IDTokenLifespan:       cfg.GetDuration("oauth2_id_token_lifespan"),
+
+		MinParameterEntropy: cfg.GetInt("oauth2_min_parameter_entropy"),
+
+		SendDebugMessagesToClients: cfg.GetBool("oauth2_send_debug_messages"),
+	}
+
+	for _, key := range []string{
+		"oauth2_access_token_lifespan",
+		"oauth2_refresh_token_lifespan",
+		"oauth2_authorize_code_lifespan",
+		"oauth2_id_token_lifespan",
+	} {
+		if cfg.GetDuration(key) <= 0 {
+			problems = append(problems, key+" must be positive")
+		}
+	}
+
+	if conf.MinParameterEntropy < 1 {
+		problems = append(problems, "oauth2_min_parameter_entropy must be positive")
+	}
+
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("invalid configuration: %s", strings.Join(problems, ", "))
+	}
+
+	return conf, nil
+}
+
+type clientContextKey struct{}
+
+// clientLifespanConfig takes the lifespan of authorization codes from the client
+// of the request, which fosite only does for tokens.
+type clientLifespanConfig struct {
+	fosite.Configurator
+}
+
+func (c clientLifespanConfig) GetAuthorizeCodeLifespan(ctx context.Context) time.Duration {
+	fallback := c.Configurator.GetAuthorizeCodeLifespan(ctx)
+
+	client, ok := ctx.Value(clientContextKey{}).(fosite.Client)
+	if !ok {
+		return fallback
+	}
+
+	return fosite.GetEffectiveLifespan(client, fosite.GrantTypeAuthorizationCode, fosite.AuthorizeCode, fallback)
+}
+
+// AuthorizeExplicitFactory is compose.OAuth2AuthorizeExplicitFactory, with the
+// authorization code lifespan of clients applied.
+func AuthorizeExplicitFactory(config fosite.Configurator, storage interface{}, strategy interface{}) interface{} {
+	handler := compose.OAuth2AuthorizeExplicitFactory(clientLifespanConfig{config}, storage, strategy)
+
+	return &authorizeExplicitGrantHandler{handler.(*oauth2.AuthorizeExplicitGrantHandler)}
+}
+
+type authorizeExplicitGrantHandler struct {
+	*oauth2.AuthorizeExplicitGrantHandler
+}
+
+func (h *authorizeExplicitGrantHandler) HandleAuthorizeEndpointRequest(ctx context.Context, ar fosite.AuthorizeRequester, resp fosite.AuthorizeResponder) error {
+	ctx = context.WithValue(ctx, clientContextKey{}, ar.GetClient())
+
+	return h.AuthorizeExplicitGrantHandler.HandleAuthorizeEndpointRequest(ctx, ar, resp)
+}
+
+// refreshPolicy is implemented by clients that override how their grants are
+// refreshed, see store.Client.
+type refreshPolicy interface {
+	RotatesRefreshTokens() bool
+	GetRefreshTokenMaxAge() time.Duration
+}
+
+// RefreshTokenGrantFactory is compose.OAuth2RefreshTokenGrantFactory, with the
+// refresh policy of clients applied: grants stop being refreshable once they are
+// older than the client allows, and clients that do not rotate refresh tokens
+// keep using the same one.
+func RefreshTokenGrantFactory(config fosite.Configurator, storage interface{}, strategy interface{}) interface{} {
+	handler := compose.OAuth2RefreshTokenGrantFactory(config, storage, strategy)
+
+	return &refreshTokenGrantHandler{handler.(*oauth2.RefreshTokenGrantHandler)}
+}
+
+type refreshTokenGrantHandler struct {
+	*oauth2.RefreshTokenGrantHandler
+}
+
+func (h *refreshTokenGrantHandler) HandleTokenEndpointRequest(ctx context.Context, request fosite.AccessRequester) error {
+	if err := h.RefreshTokenGrantHandler.HandleTokenEndpointRequest(ctx, request); err != nil {
+		return err
+	}
+
+	policy, ok := request.GetClient().(refreshPolicy)
+	if !ok {
+		return nil
+	}
+
+	session, ok := request.GetSession().(*store.Session)
+	if !ok {
+		return nil
+	}
+
+	if !policy.RotatesRefreshTokens() {
+		// the refresh token is kept, and so is its expiry
+		signature := h.RefreshTokenStrategy.RefreshTokenSignature(ctx, request.GetRequestForm().Get("refresh_token"))
+
+		original, err := h.TokenRevocationStorage.GetRefreshTokenSession(ctx, signature, nil)
+		if err != nil {
+			return fosite.ErrServerError.WithWrap(err).WithDebug(err.Error())
+		}
+
+		session.SetExpiresAt(fosite.RefreshToken, original.GetSession().GetExpiresAt(fosite.RefreshToken))
+	}
+
+	// sessions record when the user signed in
+	if maxAge := policy.GetRefreshTokenMaxAge(); maxAge > 0 && !session.CreatedAt.IsZero() {
+		deadline := session.CreatedAt.Add(maxAge).UTC()
+
+		if time.Now().After(deadline) {
+			return fosite.ErrInvalidGrant.WithHint("The grant is older than the OAuth 2.0 Client allows refresh tokens to be used for.")
+		}
+
+		if expiry := session.GetExpiresAt(fosite.RefreshToken); expiry.IsZero() || expiry.After(deadline) {
+			session.SetExpiresAt(fosite.RefreshToken, deadline)
+		}
+	}
+
+	return nil
+}
+
+func (h *refreshTokenGrantHandler) PopulateTokenEndpointResponse(ctx context.Context, requester fosite.AccessRequester, responder fosite.AccessResponder) error {
+	policy, ok := requester.GetClient().(refreshPolicy)
+	if !ok || policy.RotatesRefreshTokens() || !h.CanHandleTokenEndpointRequest(ctx, requester) {
+		return h.RefreshTokenGrantHandler.PopulateTokenEndpointResponse(ctx, requester, responder)
+	}
+
+	accessToken, accessSignature, err := h.AccessTokenStrategy.GenerateAccessToken(ctx, requester)
+	if err != nil {
+		return fosite.ErrServerError.WithWrap(err).WithDebug(err.Error())
+	}
+
+	refreshToken := requester.GetRequestForm().Get("refresh_token")
+	signature := h.RefreshTokenStrategy.RefreshTokenSignature(ctx, refreshToken)
+
+	// the previous access tokens of the grant stay valid until they expire, since
+	// revoking them would revoke the whole grant
+	if err := h.createAccessTokenSession(ctx, signature, accessSignature, requester); err != nil {
+		return fosite.ErrServerError.WithWrap(err).WithDebug(err.Error())
+	}
+
+	lifespan := fosite.GetEffectiveLifespan(requester.GetClient(), fosite.GrantTypeRefreshToken, fosite.AccessToken, h.Config.GetAccessTokenLifespan(ctx))
+	if expiry := requester.GetSession().GetExpiresAt(fosite.AccessToken); !expiry.IsZero() {
+		lifespan = time.Until(expiry)
+	}
+
+	responder.SetAccessToken(accessToken)
+	responder.SetTokenType("bearer")
+	responder.SetExpiresIn(lifespan)
+	responder.SetScopes(requester.GetGrantedScopes())
+	responder.SetExtra("refresh_token", refreshToken)
+
+	return nil
+}
+
+// createAccessTokenSession stores a new access token for the grant of a refresh
+// token.
+func (h *refreshTokenGrantHandler) createAccessTokenSession(ctx context.Context, refreshSignature string, accessSignature string, requester fosite.AccessRequester) (err error) {
+	ctx, err = fositestorage.MaybeBeginTx(ctx, h.TokenRevocationStorage)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			if rollbackErr := fositestorage.MaybeRollbackTx(ctx, h.TokenRevocationStorage); rollbackErr != nil {
+				err = fmt.Errorf("%w, and failed to roll back: %v", err, rollbackErr)
+			}
+		}
+	}()
+
+	original, err := h.TokenRevocationStorage.GetRefreshTokenSession(ctx, refreshSignature, nil)
+	if err != nil {
+		return err
+	}
+
+	request := requester.Sanitize([]string{})
+	request.SetID(original.GetID())
+
+	if err := h.TokenRevocationStorage.CreateAccessTokenSession(ctx, accessSignature, request); err != nil {
+		return err
+	}
+
+	return fositestorage.MaybeCommitTx(ctx, h.TokenRevocationStorage)
+}
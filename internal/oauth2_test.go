@@ -0,0 +1,237 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/Muchogoc/go-oauth2-server/internal/store"
+	"github.com/ory/fosite"
+	"github.com/ory/fosite/compose"
+)
+
+// tokenResponse is the body of a successful token response.
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+// grant posts a form to the token endpoint and fails the test unless tokens are
+// issued.
+func (s *testServer) grant(t *testing.T, form url.Values) tokenResponse {
+	t.Helper()
+
+	response := s.token(t, form)
+	if response.Code != http.StatusOK {
+		t.Fatalf("token returned %d: %s", response.Code, response.Body.String())
+	}
+
+	var body tokenResponse
+	if err := json.Unmarshal(response.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+
+	return body
+}
+
+// updateClient changes the test client.
+func (s *testServer) updateClient(t *testing.T, change func(client *store.Client)) {
+	t.Helper()
+
+	client, err := s.store.GetClientByID(context.Background(), testClientID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	change(client)
+
+	if err := s.store.UpdateClient(context.Background(), client); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// signIn signs alice in with the offline scope and returns the authorization code.
+func (s *testServer) signIn(t *testing.T) string {
+	t.Helper()
+
+	form := passwordLogin("alice", "correct horse")
+	form["scopes"] = []string{"openid", "offline"}
+
+	return authorizationCode(t, s.authorize(t, "openid offline", form))
+}
+
+// refreshForm uses a refresh token.
+func refreshForm(token string) url.Values {
+	return url.Values{"grant_type": {"refresh_token"}, "refresh_token": {token}}
+}
+
+// codeForm exchanges an authorization code for tokens.
+func codeForm(code string) url.Values {
+	return url.Values{"grant_type": {"authorization_code"}, "code": {code}, "redirect_uri": {testRedirectURI}}
+}
+
+// checkExpiry fails the test unless an expiry is about lifespan from now, stored
+// expiries being rounded to the second.
+func checkExpiry(t *testing.T, name string, expiry time.Time, lifespan time.Duration) {
+	t.Helper()
+
+	if remaining := time.Until(expiry); remaining > lifespan+time.Second || remaining < lifespan-time.Minute {
+		t.Errorf("the %s expires in %s, want %s", name, remaining.Round(time.Second), lifespan)
+	}
+}
+
+func TestClientLifespansOverrideSettings(t *testing.T) {
+	server := newTestServer(t, newTestConfig(t, nil))
+	server.createUser(t, "alice", "correct horse")
+
+	server.updateClient(t, func(client *store.Client) {
+		client.AccessTokenLifespan = 5 * time.Minute
+		client.RefreshTokenLifespan = 2 * time.Hour
+		client.AuthorizeCodeLifespan = 90 * time.Second
+	})
+
+	ctx := context.Background()
+	strategy := compose.NewOAuth2HMACStrategy(server.oauth2)
+
+	code := server.signIn(t)
+
+	request, err := server.store.GetAuthorizeCodeSession(ctx, strategy.AuthorizeCodeSignature(ctx, code), &store.Session{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkExpiry(t, "authorization code", request.GetSession().GetExpiresAt(fosite.AuthorizeCode), 90*time.Second)
+
+	tokens := server.grant(t, codeForm(code))
+	if tokens.ExpiresIn > 300 || tokens.ExpiresIn < 240 {
+		t.Errorf("expires_in is %d, want 300", tokens.ExpiresIn)
+	}
+
+	request, err = server.store.GetRefreshTokenSession(ctx, strategy.RefreshTokenSignature(ctx, tokens.RefreshToken), &store.Session{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkExpiry(t, "access token", request.GetSession().GetExpiresAt(fosite.AccessToken), 5*time.Minute)
+	checkExpiry(t, "refresh token", request.GetSession().GetExpiresAt(fosite.RefreshToken), 2*time.Hour)
+
+	refreshed := server.grant(t, refreshForm(tokens.RefreshToken))
+	if refreshed.ExpiresIn > 300 || refreshed.ExpiresIn < 240 {
+		t.Errorf("a refreshed expires_in is %d, want 300", refreshed.ExpiresIn)
+	}
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	server := newTestServer(t, newTestConfig(t, nil))
+	server.createUser(t, "alice", "correct horse")
+
+	tokens := server.grant(t, codeForm(server.signIn(t)))
+	refreshed := server.grant(t, refreshForm(tokens.RefreshToken))
+
+	if refreshed.RefreshToken == tokens.RefreshToken {
+		t.Fatal("the refresh token was not rotated")
+	}
+
+	// using a rotated refresh token again revokes the grant
+	if response := server.token(t, refreshForm(tokens.RefreshToken)); response.Code == http.StatusOK {
+		t.Fatal("a used refresh token was accepted")
+	}
+
+	if response := server.token(t, refreshForm(refreshed.RefreshToken)); response.Code == http.StatusOK {
+		t.Error("the grant of a reused refresh token can still be refreshed")
+	}
+}
+
+func TestRefreshTokensWithoutRotation(t *testing.T) {
+	server := newTestServer(t, newTestConfig(t, nil))
+	server.createUser(t, "alice", "correct horse")
+
+	server.updateClient(t, func(client *store.Client) {
+		client.DisableRefreshTokenRotation = true
+	})
+
+	ctx := context.Background()
+	strategy := compose.NewOAuth2HMACStrategy(server.oauth2)
+
+	tokens := server.grant(t, codeForm(server.signIn(t)))
+
+	original, err := server.store.GetRefreshTokenSession(ctx, strategy.RefreshTokenSignature(ctx, tokens.RefreshToken), &store.Session{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		refreshed := server.grant(t, refreshForm(tokens.RefreshToken))
+
+		if refreshed.RefreshToken != tokens.RefreshToken {
+			t.Fatalf("refresh %d returned another refresh token", i)
+		}
+
+		if refreshed.AccessToken == tokens.AccessToken {
+			t.Fatalf("refresh %d returned the same access token", i)
+		}
+	}
+
+	// the refresh token keeps its expiry and the earlier access tokens stay valid
+	request, err := server.store.GetRefreshTokenSession(ctx, strategy.RefreshTokenSignature(ctx, tokens.RefreshToken), &store.Session{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := request.GetSession().GetExpiresAt(fosite.RefreshToken), original.GetSession().GetExpiresAt(fosite.RefreshToken); !got.Equal(want) {
+		t.Errorf("the refresh token expires at %s, want %s", got, want)
+	}
+
+	if _, err := server.store.GetAccessTokenSession(ctx, strategy.AccessTokenSignature(ctx, tokens.AccessToken), &store.Session{}); err != nil {
+		t.Errorf("the first access token is no longer valid: %v", err)
+	}
+}
+
+func TestRefreshTokenMaxAge(t *testing.T) {
+	server := newTestServer(t, newTestConfig(t, nil))
+	server.createUser(t, "alice", "correct horse")
+
+	server.updateClient(t, func(client *store.Client) {
+		client.RefreshTokenMaxAge = time.Hour
+	})
+
+	ctx := context.Background()
+	strategy := compose.NewOAuth2HMACStrategy(server.oauth2)
+
+	tokens := server.grant(t, codeForm(server.signIn(t)))
+	refreshed := server.grant(t, refreshForm(tokens.RefreshToken))
+
+	// a refreshed token does not outlive the maximum age of the grant
+	request, err := server.store.GetRefreshTokenSession(ctx, strategy.RefreshTokenSignature(ctx, refreshed.RefreshToken), &store.Session{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkExpiry(t, "refresh token", request.GetSession().GetExpiresAt(fosite.RefreshToken), time.Hour)
+
+	server.updateClient(t, func(client *store.Client) {
+		client.RefreshTokenMaxAge = time.Nanosecond
+	})
+
+	response := server.token(t, refreshForm(refreshed.RefreshToken))
+	if response.Code != http.StatusBadRequest {
+		t.Fatalf("refreshing a grant older than the maximum age returned %d: %s", response.Code, response.Body.String())
+	}
+
+	var body struct {
+		Error string `json:"error"`
+	}
+
+	if err := json.Unmarshal(response.Body.Bytes(), &body); err != nil || body.Error != fosite.ErrInvalidGrant.ErrorField {
+		t.Errorf("got error %q, want %s", body.Error, fosite.ErrInvalidGrant.ErrorField)
+	}
+
+	if _, err := server.store.GetRefreshTokenSession(ctx, strategy.RefreshTokenSignature(ctx, refreshed.RefreshToken), &store.Session{}); errors.Is(err, fosite.ErrInactiveToken) {
+		t.Error("refusing an old grant revoked its refresh token")
+	}
+}
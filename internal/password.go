@@ -0,0 +1,68 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/Muchogoc/go-oauth2-server/config"
+)
+
+// PasswordPolicy lists the requirements new passwords have to meet.
+type PasswordPolicy struct {
+	MinLength        int
+	RequireMixedCase bool
+	RequireDigit     bool
+	RequireSymbol    bool
+}
+
+// NewPasswordPolicy reads the password requirements from the configuration.
+func NewPasswordPolicy(cfg config.Provider) PasswordPolicy {
+	return PasswordPolicy{
+		MinLength:        cfg.GetInt("password_min_length"),
+		RequireMixedCase: cfg.GetBool("password_require_mixed_case"),
+		RequireDigit:     cfg.GetBool("password_require_digit"),
+		RequireSymbol:    cfg.GetBool("password_require_symbol"),
+	}
+}
+
+// Validate returns a message for every requirement the password fails to meet.
+func (p PasswordPolicy) Validate(password string, username string) []string {
+	var problems []string
+
+	if len([]rune(password)) < p.MinLength {
+		problems = append(problems, fmt.Sprintf("Password must be at least %d characters long.", p.MinLength))
+	}
+
+	var upper, lower, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r) || unicode.IsSpace(r):
+			symbol = true
+		}
+	}
+
+	if p.RequireMixedCase && !(upper && lower) {
+		problems = append(problems, "Password must contain both upper and lower case letters.")
+	}
+
+	if p.RequireDigit && !digit {
+		problems = append(problems, "Password must contain a digit.")
+	}
+
+	if p.RequireSymbol && !symbol {
+		problems = append(problems, "Password must contain a symbol.")
+	}
+
+	if username != "" && strings.Contains(strings.ToLower(password), strings.ToLower(username)) {
+		problems = append(problems, "Password must not contain the username.")
+	}
+
+	return problems
+}
@@ -0,0 +1,286 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/Muchogoc/go-oauth2-server/internal/html"
+	"github.com/Muchogoc/go-oauth2-server/internal/mail"
+	"github.com/Muchogoc/go-oauth2-server/internal/store"
+	"github.com/Muchogoc/go-oauth2-server/log"
+	"github.com/gin-gonic/gin"
+	"github.com/ory/fosite"
+)
+
+type ForgotPassword struct {
+	Email string `form:"email"`
+}
+
+type ResetPassword struct {
+	Token                string `form:"token"`
+	Password             string `form:"password"`
+	PasswordConfirmation string `form:"password_confirmation"`
+}
+
+type ChangePassword struct {
+	Username             string `form:"username"`
+	CurrentPassword      string `form:"current_password"`
+	Password             string `form:"password"`
+	PasswordConfirmation string `form:"password_confirmation"`
+}
+
+// ForgotPasswordPageHandler renders the form used to request a password reset link.
+func (a Auth) ForgotPasswordPageHandler(c *gin.Context) {
+	a.renderForgotPassword(c, nil)
+}
+
+// ForgotPasswordHandler emails a password reset link to the account with the given
+// email address. The response is the same whether or not the account exists.
+func (a Auth) ForgotPasswordHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	params := ForgotPassword{}
+	if err := c.ShouldBind(&params); err != nil || strings.TrimSpace(params.Email) == "" {
+		a.renderForgotPassword(c, []string{"Email is required."})
+		return
+	}
+
+	user, err := a.store.GetUserByEmail(ctx, strings.TrimSpace(params.Email))
+	if err == nil && user.Active {
+		// the response does not change, so that it cannot reveal the account either
+		if wait, err := a.resetEmails.Take(ctx, user.ID, a.resetEmailLimit); err != nil {
+			log.Errorf("failed to check the password reset email limit: %v", err)
+		} else if wait > 0 {
+			log.Warn("password reset emails to an account are being throttled")
+		} else if err := a.sendPasswordResetEmail(c, user); err != nil {
+			log.Errorf("failed to send password reset email: %v", err)
+		}
+	}
+
+	a.renderMessage(c, "Check your email", "If an account uses that email address, we have sent it a link to reset the password.")
+}
+
+// ResetPasswordPageHandler renders the form used to choose a new password.
+func (a Auth) ResetPasswordPageHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	token := c.Query("token")
+	if _, err := a.store.GetUserToken(ctx, store.UserTokenPasswordReset, token); err != nil {
+		a.renderMessage(c, "Reset failed", "The password reset link is invalid or has expired.")
+		return
+	}
+
+	a.renderResetPassword(c, token, nil)
+}
+
+// ResetPasswordHandler sets a new password using a reset token and revokes every
+// token and session of the user in the same transaction, since the old password
+// may have been compromised.
+func (a Auth) ResetPasswordHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	params := ResetPassword{}
+	if err := c.ShouldBind(&params); err != nil {
+		a.renderMessage(c, "Reset failed", "The password reset link is invalid or has expired.")
+		return
+	}
+
+	token, err := a.store.GetUserToken(ctx, store.UserTokenPasswordReset, params.Token)
+	if err != nil {
+		a.renderMessage(c, "Reset failed", "The password reset link is invalid or has expired.")
+		return
+	}
+
+	if problems := a.validateNewPassword(c, &token.User, params.Password, params.PasswordConfirmation); len(problems) > 0 {
+		a.renderResetPassword(c, params.Token, problems)
+		return
+	}
+
+	hash, err := store.HashPassword(params.Password)
+	if err != nil {
+		log.Errorf("failed to reset password: %v", err)
+		a.renderMessage(c, "Reset failed", "Something went wrong, please try again.")
+		return
+	}
+
+	// the token is only used up together with setting the accepted password and
+	// signing the user out everywhere
+	err = a.transaction(ctx, func(ctx context.Context) error {
+		if _, err := a.store.ResetUserPassword(ctx, params.Token, hash); err != nil {
+			return err
+		}
+
+		return a.store.RevokeUserTokens(ctx, token.UserID)
+	})
+	if errors.Is(err, fosite.ErrNotFound) {
+		a.renderMessage(c, "Reset failed", "The password reset link is invalid or has expired.")
+		return
+	}
+
+	if err != nil {
+		log.Errorf("failed to reset password: %v", err)
+		a.renderMessage(c, "Reset failed", "Something went wrong, please try again.")
+		return
+	}
+
+	a.clearLoginFailures(ctx, token.User.Username)
+
+	a.renderMessage(c, "Password reset", "Your password has been reset. You can now sign in with your new password.")
+}
+
+// ChangePasswordPageHandler renders the form used to change a known password.
+func (a Auth) ChangePasswordPageHandler(c *gin.Context) {
+	a.renderChangePassword(c, "", nil)
+}
+
+// ChangePasswordHandler replaces the password of a user that authenticates with
+// their current password and revokes their tokens and sessions in the same
+// transaction. The form is not signed in itself, so every session is revoked.
+func (a Auth) ChangePasswordHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	params := ChangePassword{}
+	if err := c.ShouldBind(&params); err != nil {
+		a.renderChangePassword(c, params.Username, []string{"The form is invalid."})
+		return
+	}
+
+	allowed, err := a.beginLogin(ctx, params.Username, c.ClientIP())
+	if err != nil || !allowed {
+		a.renderChangePassword(c, params.Username, []string{loginFailedMessage})
+		return
+	}
+
+	user, err := a.authenticatePassword(ctx, params.Username, params.CurrentPassword)
+	if errors.Is(err, store.ErrPasswordResetRequired) {
+		// the current password may be compromised, so only a reset link can replace it
+		a.loginSucceeded(ctx, params.Username, c.ClientIP())
+		a.renderChangePassword(c, params.Username, []string{"Your password must be reset. Use the forgot password link to choose a new one."})
+		return
+	}
+
+	if err != nil {
+		a.loginFailed(ctx, params.Username, c.ClientIP())
+		a.renderChangePassword(c, params.Username, []string{loginFailedMessage})
+		return
+	}
+
+	a.loginSucceeded(ctx, user.Username, c.ClientIP())
+
+	if problems := a.validateNewPassword(c, user, params.Password, params.PasswordConfirmation); len(problems) > 0 {
+		a.renderChangePassword(c, params.Username, problems)
+		return
+	}
+
+	hash, err := store.HashPassword(params.Password)
+	if err != nil {
+		log.Errorf("failed to change password: %v", err)
+		a.renderChangePassword(c, params.Username, []string{"Something went wrong, please try again."})
+		return
+	}
+
+	err = a.transaction(ctx, func(ctx context.Context) error {
+		if err := a.store.SetUserPassword(ctx, user.ID, hash); err != nil {
+			return err
+		}
+
+		return a.store.RevokeUserTokens(ctx, user.ID)
+	})
+	if err != nil {
+		log.Errorf("failed to change password: %v", err)
+		a.renderChangePassword(c, params.Username, []string{"Something went wrong, please try again."})
+		return
+	}
+
+	a.renderMessage(c, "Password changed", "Your password has been changed and you have been signed out everywhere.")
+}
+
+// validateNewPassword checks a new password against the password policy and the
+// user's password history.
+func (a Auth) validateNewPassword(c *gin.Context, user *store.User, password string, confirmation string) []string {
+	var problems []string
+
+	if password != confirmation {
+		problems = append(problems, "Passwords do not match.")
+	}
+
+	problems = append(problems, a.passwords.Validate(password, user.Username)...)
+	if len(problems) > 0 {
+		return problems
+	}
+
+	reused, err := a.store.PasswordReused(c.Request.Context(), user.ID, password, a.passwordHistory)
+	if err != nil {
+		log.Errorf("failed to check password history: %v", err)
+		return []string{"Something went wrong, please try again."}
+	}
+
+	if reused {
+		return []string{"Password must be different from your recent passwords."}
+	}
+
+	return nil
+}
+
+// passwordResetLink issues a password reset token and returns the link to use it.
+func (a Auth) passwordResetLink(c *gin.Context, user *store.User) (string, error) {
+	token, err := a.store.CreateUserToken(c.Request.Context(), user.ID, store.UserTokenPasswordReset, a.resetLifespan)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s/password/reset?token=%s", a.publicURL, url.QueryEscape(token)), nil
+}
+
+func (a Auth) sendPasswordResetEmail(c *gin.Context, user *store.User) error {
+	ctx := c.Request.Context()
+
+	link, err := a.passwordResetLink(c, user)
+	if err != nil {
+		return err
+	}
+
+	return a.mailer.Send(ctx, mail.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf(
+			"Hi %s,\n\nSomeone asked to reset the password of your account. If it was you, open the link below to choose a new password:\n\n%s\n\nThe link expires in %s. If you did not ask for a reset you can ignore this email.\n",
+			user.Name, link, a.resetLifespan,
+		),
+	})
+}
+
+func (a Auth) renderForgotPassword(c *gin.Context, problems []string) {
+	c.Writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	page := html.ForgotPasswordParams{
+		Title:  "Forgot password",
+		Errors: problems,
+	}
+
+	_ = html.ForgotPassword(c.Writer, page)
+}
+
+func (a Auth) renderResetPassword(c *gin.Context, token string, problems []string) {
+	c.Writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	page := html.ResetPasswordParams{
+		Title:  "Reset password",
+		Errors: problems,
+		Token:  token,
+	}
+
+	_ = html.ResetPassword(c.Writer, page)
+}
+
+func (a Auth) renderChangePassword(c *gin.Context, username string, problems []string) {
+	c.Writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	page := html.ChangePasswordParams{
+		Title:    "Change password",
+		Errors:   problems,
+		Username: username,
+	}
+
+	_ = html.ChangePassword(c.Writer, page)
+}
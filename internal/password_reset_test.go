@@ -0,0 +1,194 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Muchogoc/go-oauth2-server/internal/store"
+	"github.com/gin-gonic/gin"
+)
+
+// postForm posts a form to a handler and returns the response.
+func postForm(handler gin.HandlerFunc, form url.Values) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.RemoteAddr = "192.0.2.1:1234"
+
+	recorder := httptest.NewRecorder()
+
+	router := gin.New()
+	router.POST("/", handler)
+	router.ServeHTTP(recorder, request)
+
+	return recorder
+}
+
+func TestPasswordResetTokenSetsOnePassword(t *testing.T) {
+	server := newTestServer(t, newTestConfig(t, nil))
+	user := server.createUser(t, "alice", "correct horse")
+
+	token, err := server.store.CreateUserToken(context.Background(), user.ID, store.UserTokenPasswordReset, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		wg    sync.WaitGroup
+		reset atomic.Int32
+	)
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			password := "new password " + strings.Repeat("x", i)
+			response := postForm(server.auth.ResetPasswordHandler, url.Values{
+				"token":                 {token},
+				"password":              {password},
+				"password_confirmation": {password},
+			})
+
+			if strings.Contains(response.Body.String(), "Your password has been reset") {
+				reset.Add(1)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	if reset.Load() != 1 {
+		t.Fatalf("%d resets succeeded with one token, want 1", reset.Load())
+	}
+
+	// only the winning reset replaced the password
+	reused, err := server.store.PasswordReused(context.Background(), user.ID, "correct horse", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reused {
+		t.Error("the old password is not the only one in the history")
+	}
+
+	reused, err = server.store.PasswordReused(context.Background(), user.ID, "correct horse", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reused {
+		t.Error("the password was not replaced")
+	}
+}
+
+func TestRejectedPasswordKeepsResetToken(t *testing.T) {
+	server := newTestServer(t, newTestConfig(t, nil))
+	user := server.createUser(t, "alice", "correct horse")
+
+	token, err := server.store.CreateUserToken(context.Background(), user.ID, store.UserTokenPasswordReset, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	postForm(server.auth.ResetPasswordHandler, url.Values{
+		"token":                 {token},
+		"password":              {"new password"},
+		"password_confirmation": {"another password"},
+	})
+
+	if _, err := server.store.GetUserToken(context.Background(), store.UserTokenPasswordReset, token); err != nil {
+		t.Errorf("a rejected password used up the token: %v", err)
+	}
+}
+
+func TestPasswordResetEmailsAreThrottledPerAccount(t *testing.T) {
+	server := newTestServer(t, newTestConfig(t, map[string]interface{}{
+		"ratelimit_password_reset_email_rate":  0.001,
+		"ratelimit_password_reset_email_burst": 3,
+	}))
+	server.createUser(t, "alice", "correct horse")
+	server.createUser(t, "bob", "battery staple")
+
+	for i := 0; i < 10; i++ {
+		response := postForm(server.auth.ForgotPasswordHandler, url.Values{"email": {"alice@example.com"}})
+		if !strings.Contains(response.Body.String(), "Check your email") {
+			t.Fatalf("request %d got a different response: %s", i, response.Body.String())
+		}
+	}
+
+	postForm(server.auth.ForgotPasswordHandler, url.Values{"email": {"bob@example.com"}})
+
+	recipients := map[string]int{}
+	for _, message := range server.mailer.sent() {
+		recipients[message.To]++
+	}
+
+	if recipients["alice@example.com"] != 3 || recipients["bob@example.com"] != 1 {
+		t.Errorf("sent %v, want 3 emails to alice and 1 to bob", recipients)
+	}
+}
+
+func TestPasswordResetFailsWhenTokensAreNotRevoked(t *testing.T) {
+	server := newTestServer(t, newTestConfig(t, nil))
+	user := server.createUser(t, "alice", "correct horse")
+
+	token, err := server.store.CreateUserToken(context.Background(), user.ID, store.UserTokenPasswordReset, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.auth.store = failingRevocationStorage{Storage: server.store}
+
+	response := postForm(server.auth.ResetPasswordHandler, url.Values{
+		"token":                 {token},
+		"password":              {"new password"},
+		"password_confirmation": {"new password"},
+	})
+
+	if strings.Contains(response.Body.String(), "Your password has been reset") {
+		t.Fatal("the password was reset although the tokens were not revoked")
+	}
+
+	reused, err := server.store.PasswordReused(context.Background(), user.ID, "correct horse", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reused {
+		t.Error("the password was changed")
+	}
+
+	if _, err := server.store.GetUserToken(context.Background(), store.UserTokenPasswordReset, token); err != nil {
+		t.Errorf("the failed reset used up the token: %v", err)
+	}
+}
+
+func TestChangePasswordRevokesTokens(t *testing.T) {
+	server := newTestServer(t, newTestConfig(t, nil))
+	server.createUser(t, "alice", "correct horse")
+
+	tokens := server.grant(t, codeForm(server.signIn(t)))
+
+	response := postForm(server.auth.ChangePasswordHandler, url.Values{
+		"username":              {"alice"},
+		"current_password":      {"correct horse"},
+		"password":              {"battery staple"},
+		"password_confirmation": {"battery staple"},
+	})
+
+	if !strings.Contains(response.Body.String(), "Your password has been changed") {
+		t.Fatalf("the password was not changed: %s", response.Body.String())
+	}
+
+	if response := server.token(t, refreshForm(tokens.RefreshToken)); response.Code == http.StatusOK {
+		t.Error("a refresh token issued before the change was accepted")
+	}
+}
@@ -0,0 +1,143 @@
+package ratelimit
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often idle buckets are dropped from memory.
+const sweepInterval = time.Minute
+
+type bucket struct {
+	key     string
+	tokens  float64
+	updated time.Time
+	limit   Limit
+}
+
+// refill adds the tokens accrued since the bucket was last updated.
+func (b *bucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.updated).Seconds() * b.limit.Rate
+	if b.tokens > float64(b.limit.Burst) {
+		b.tokens = float64(b.limit.Burst)
+	}
+
+	b.updated = now
+}
+
+// wait returns how long until the bucket holds a whole token.
+func (b *bucket) wait() time.Duration {
+	if b.tokens >= 1 {
+		return 0
+	}
+
+	return time.Duration((1 - b.tokens) / b.limit.Rate * float64(time.Second))
+}
+
+// MemoryBackend is a Backend that keeps the buckets in the memory of the process.
+// It holds at most maxBuckets buckets: once full, the least recently used one is
+// dropped to make room, so that requests from ever new IPs or client IDs cannot
+// grow its memory without bound. Zero or less means no limit.
+type MemoryBackend struct {
+	mu         sync.Mutex
+	buckets    map[string]*list.Element
+	maxBuckets int
+	// recent orders the buckets from the most to the least recently used
+	recent    *list.List
+	lastSweep time.Time
+}
+
+func NewMemoryBackend(maxBuckets int) *MemoryBackend {
+	return &MemoryBackend{
+		buckets:    make(map[string]*list.Element),
+		maxBuckets: maxBuckets,
+		recent:     list.New(),
+		lastSweep:  time.Now(),
+	}
+}
+
+func (m *MemoryBackend) Take(ctx context.Context, key string, limit Limit) (time.Duration, error) {
+	if limit.Unlimited() {
+		return 0, nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	m.sweep(now)
+
+	var b *bucket
+
+	if element, ok := m.buckets[key]; ok {
+		m.recent.MoveToFront(element)
+		b = element.Value.(*bucket)
+	} else {
+		if m.maxBuckets > 0 && len(m.buckets) >= m.maxBuckets {
+			m.remove(m.recent.Back())
+		}
+
+		b = &bucket{key: key, tokens: float64(limit.Burst), updated: now}
+		m.buckets[key] = m.recent.PushFront(b)
+	}
+
+	b.limit = limit
+	b.refill(now)
+
+	if wait := b.wait(); wait > 0 {
+		return wait, nil
+	}
+
+	b.tokens--
+
+	return 0, nil
+}
+
+func (m *MemoryBackend) Return(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	element, ok := m.buckets[key]
+	if !ok {
+		return nil
+	}
+
+	b := element.Value.(*bucket)
+	b.refill(time.Now())
+
+	b.tokens++
+	if b.tokens > float64(b.limit.Burst) {
+		b.tokens = float64(b.limit.Burst)
+	}
+
+	return nil
+}
+
+// sweep drops buckets that have refilled completely, since they behave the
+// same as buckets that do not exist.
+func (m *MemoryBackend) sweep(now time.Time) {
+	if now.Sub(m.lastSweep) < sweepInterval {
+		return
+	}
+
+	for element := m.recent.Front(); element != nil; {
+		next := element.Next()
+
+		b := element.Value.(*bucket)
+		b.refill(now)
+
+		if b.tokens >= float64(b.limit.Burst) {
+			m.remove(element)
+		}
+
+		element = next
+	}
+
+	m.lastSweep = now
+}
+
+func (m *MemoryBackend) remove(element *list.Element) {
+	delete(m.buckets, m.recent.Remove(element).(*bucket).key)
+}
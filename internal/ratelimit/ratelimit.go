@@ -0,0 +1,196 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Muchogoc/go-oauth2-server/log"
+	"github.com/gin-gonic/gin"
+	"github.com/ory/fosite"
+)
+
+// ClientKey is the gin context key under which handlers publish the client that
+// authenticated the request, so that its requests count against its own bucket.
+const ClientKey = "ratelimit_client"
+
+// Limit describes a token bucket that refills at Rate tokens per second and
+// holds at most Burst tokens.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// Unlimited reports whether the limit is disabled.
+func (l Limit) Unlimited() bool {
+	return l.Rate <= 0 || l.Burst <= 0
+}
+
+// Backend keeps the state of the token buckets. The in-memory backend is local to
+// a single instance; a shared backend lets replicas enforce a common limit.
+type Backend interface {
+	// Take removes a token from the bucket identified by key. It returns zero when
+	// the request is allowed, or how long to wait until a token is available.
+	Take(ctx context.Context, key string, limit Limit) (time.Duration, error)
+
+	// Return puts back a token taken from the bucket identified by key, up to its
+	// burst. Unknown buckets are left alone.
+	Return(ctx context.Context, key string) error
+}
+
+// ClientWithRateLimit is implemented by clients that override the default client limit.
+type ClientWithRateLimit interface {
+	// GetRateLimit returns the requests per second and the burst allowed to the
+	// client, or a zero rate when it uses the default.
+	GetRateLimit() (float64, int)
+}
+
+// Limiter throttles requests by client IP and by authenticated client ID.
+type Limiter struct {
+	backend Backend
+
+	mu     sync.RWMutex
+	ip     Limit
+	client Limit
+	// overrides are the limits of the clients that override the default, learned
+	// when they authenticate
+	overrides map[string]Limit
+}
+
+func NewLimiter(backend Backend, ip Limit, client Limit) *Limiter {
+	return &Limiter{
+		backend: backend,
+		ip:      ip,
+		client:  client,
+
+		overrides: make(map[string]Limit),
+	}
+}
+
+// SetLimits replaces the IP limit and the default client limit while requests
+// are being served. Existing buckets keep their tokens.
+func (l *Limiter) SetLimits(ip Limit, client Limit) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.ip, l.client = ip, client
+}
+
+func (l *Limiter) limits() (Limit, Limit) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.ip, l.client
+}
+
+// clientLimit returns the limit of a client, its own when it overrides the default.
+func (l *Limiter) clientLimit(id string) Limit {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if limit, ok := l.overrides[id]; ok {
+		return limit
+	}
+
+	return l.client
+}
+
+// learn remembers the limit of an authenticated client for its next requests.
+func (l *Limiter) learn(client fosite.Client) {
+	override, ok := client.(ClientWithRateLimit)
+	if !ok {
+		return
+	}
+
+	rate, burst := override.GetRateLimit()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if rate > 0 {
+		l.overrides[client.GetID()] = Limit{Rate: rate, Burst: burst}
+	} else {
+		delete(l.overrides, client.GetID())
+	}
+}
+
+// Middleware rejects requests with 429 Too Many Requests once the bucket of
+// their IP or client is empty.
+//
+// The client a request claims is charged before the handler runs, so that no
+// request is served once its client's bucket is empty, however many are sent at
+// once. The token is given back when the handler does not authenticate that
+// client, so that an attacker sending someone else's client ID cannot drain that
+// client's bucket for longer than its requests take. A client's own limit
+// applies once it has authenticated, until then the default does.
+func (l *Limiter) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		ipLimit, _ := l.limits()
+
+		wait, err := l.backend.Take(ctx, "ip:"+c.ClientIP(), ipLimit)
+		if err != nil {
+			// never fail closed on an unavailable backend
+			log.Errorf("failed to apply ip rate limit: %v", err)
+		}
+
+		if wait > 0 {
+			tooManyRequests(c, wait)
+			return
+		}
+
+		id := claimedClientID(c.Request)
+		if id == "" {
+			c.Next()
+			return
+		}
+
+		wait, err = l.backend.Take(ctx, "client:"+id, l.clientLimit(id))
+		if err != nil {
+			log.Errorf("failed to apply client rate limit: %v", err)
+		}
+
+		if wait > 0 {
+			tooManyRequests(c, wait)
+			return
+		}
+
+		c.Next()
+
+		value, _ := c.Get(ClientKey)
+		if client, ok := value.(fosite.Client); ok && client.GetID() == id {
+			l.learn(client)
+			return
+		}
+
+		if err := l.backend.Return(ctx, "client:"+id); err != nil {
+			log.Errorf("failed to apply client rate limit: %v", err)
+		}
+	}
+}
+
+// claimedClientID returns the client ID a request presents, before it has been
+// authenticated.
+func claimedClientID(r *http.Request) string {
+	if id, _, ok := r.BasicAuth(); ok {
+		return id
+	}
+
+	// the handlers parse the form again; ParseForm keeps the already read body
+	if err := r.ParseForm(); err != nil {
+		return ""
+	}
+
+	return r.PostForm.Get("client_id")
+}
+
+func tooManyRequests(c *gin.Context, wait time.Duration) {
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+		"error":             "rate_limit_exceeded",
+		"error_description": "Too many requests, please retry later.",
+	})
+}
@@ -0,0 +1,207 @@
+package ratelimit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ory/fosite"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// limitedClient is a client overriding the default limit.
+type limitedClient struct {
+	fosite.DefaultClient
+	rate  float64
+	burst int
+}
+
+func (c *limitedClient) GetRateLimit() (float64, int) {
+	return c.rate, c.burst
+}
+
+// newRouter serves /token behind the limiter, with a handler that authenticates
+// the client with the password "secret", counting the requests it serves.
+func newRouter(limiter *Limiter, clients map[string]fosite.Client, served *atomic.Int32) *gin.Engine {
+	router := gin.New()
+	router.POST("/token", limiter.Middleware(), func(c *gin.Context) {
+		served.Add(1)
+
+		if id, secret, ok := c.Request.BasicAuth(); ok && secret == "secret" {
+			if client, ok := clients[id]; ok {
+				c.Set(ClientKey, client)
+			}
+		}
+
+		c.Status(http.StatusOK)
+	})
+
+	return router
+}
+
+func post(router http.Handler, id string, secret string, ip string) int {
+	request := httptest.NewRequest(http.MethodPost, "/token", nil)
+	request.SetBasicAuth(id, secret)
+	request.RemoteAddr = ip + ":1234"
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	return recorder.Code
+}
+
+func TestParallelRequestsCannotOverdrawClient(t *testing.T) {
+	limiter := NewLimiter(NewMemoryBackend(0), Limit{}, Limit{Rate: 0.001, Burst: 5})
+	clients := map[string]fosite.Client{"app": &fosite.DefaultClient{ID: "app"}}
+
+	var served atomic.Int32
+	router := newRouter(limiter, clients, &served)
+
+	var (
+		wg      sync.WaitGroup
+		limited atomic.Int32
+	)
+
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			if post(router, "app", "secret", "192.0.2.1") == http.StatusTooManyRequests {
+				limited.Add(1)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if served.Load() != 5 || limited.Load() != 45 {
+		t.Errorf("served %d and limited %d requests, want 5 and 45", served.Load(), limited.Load())
+	}
+}
+
+func TestUnauthenticatedRequestsDoNotDrainClient(t *testing.T) {
+	limiter := NewLimiter(NewMemoryBackend(0), Limit{}, Limit{Rate: 0.001, Burst: 2})
+	clients := map[string]fosite.Client{"app": &fosite.DefaultClient{ID: "app"}}
+
+	var served atomic.Int32
+	router := newRouter(limiter, clients, &served)
+
+	for i := 0; i < 10; i++ {
+		if code := post(router, "app", "wrong", "198.51.100.1"); code != http.StatusOK {
+			t.Fatalf("forged request %d returned %d, want it to reach the handler", i, code)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		if code := post(router, "app", "secret", "192.0.2.1"); code != http.StatusOK {
+			t.Fatalf("request %d of the client returned %d", i, code)
+		}
+	}
+
+	if code := post(router, "app", "secret", "192.0.2.1"); code != http.StatusTooManyRequests {
+		t.Errorf("a request past the burst returned %d", code)
+	}
+}
+
+func TestClientOverrideAppliesOnceAuthenticated(t *testing.T) {
+	limiter := NewLimiter(NewMemoryBackend(0), Limit{}, Limit{Rate: 0.001, Burst: 1})
+	clients := map[string]fosite.Client{
+		"batch": &limitedClient{DefaultClient: fosite.DefaultClient{ID: "batch"}, rate: 1000, burst: 1000},
+	}
+
+	var served atomic.Int32
+	router := newRouter(limiter, clients, &served)
+
+	if code := post(router, "batch", "secret", "192.0.2.1"); code != http.StatusOK {
+		t.Fatalf("the first request returned %d", code)
+	}
+
+	// the bucket refills at the client's own rate from now on
+	time.Sleep(50 * time.Millisecond)
+
+	for i := 0; i < 10; i++ {
+		if code := post(router, "batch", "secret", "192.0.2.1"); code != http.StatusOK {
+			t.Fatalf("request %d returned %d under the client's own limit", i, code)
+		}
+	}
+}
+
+func TestIPLimit(t *testing.T) {
+	limiter := NewLimiter(NewMemoryBackend(0), Limit{Rate: 0.001, Burst: 1}, Limit{})
+
+	var served atomic.Int32
+	router := newRouter(limiter, nil, &served)
+
+	post(router, "", "", "192.0.2.1")
+
+	request := httptest.NewRequest(http.MethodPost, "/token", nil)
+	request.RemoteAddr = "192.0.2.1:1234"
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusTooManyRequests {
+		t.Fatalf("got %d, want 429", recorder.Code)
+	}
+
+	if wait := recorder.Header().Get("Retry-After"); wait == "" || wait == "0" {
+		t.Errorf("Retry-After is %q", wait)
+	}
+
+	if code := post(router, "", "", "192.0.2.2"); code != http.StatusOK {
+		t.Errorf("another IP got %d", code)
+	}
+}
+
+func TestMemoryBackendRefills(t *testing.T) {
+	backend := NewMemoryBackend(0)
+	limit := Limit{Rate: 100, Burst: 1}
+
+	if wait, _ := backend.Take(context.Background(), "key", limit); wait != 0 {
+		t.Fatalf("a full bucket asked to wait %s", wait)
+	}
+
+	wait, _ := backend.Take(context.Background(), "key", limit)
+	if wait <= 0 || wait > 10*time.Millisecond {
+		t.Fatalf("an empty bucket asked to wait %s, want up to 10ms", wait)
+	}
+
+	time.Sleep(wait)
+
+	if wait, _ := backend.Take(context.Background(), "key", limit); wait != 0 {
+		t.Errorf("the bucket did not refill, wait %s", wait)
+	}
+}
+
+func TestMemoryBackendDropsLeastRecentlyUsedBuckets(t *testing.T) {
+	backend := NewMemoryBackend(2)
+	limit := Limit{Rate: 0.001, Burst: 1}
+	ctx := context.Background()
+
+	for _, key := range []string{"a", "b", "a", "c"} {
+		backend.Take(ctx, key, limit)
+	}
+
+	if len(backend.buckets) != 2 {
+		t.Fatalf("%d buckets are kept, want at most 2", len(backend.buckets))
+	}
+
+	// b was dropped to make room for c, a was used since and kept its state
+	if wait, _ := backend.Take(ctx, "a", limit); wait == 0 {
+		t.Error("the recently used bucket was dropped")
+	}
+
+	if wait, _ := backend.Take(ctx, "b", limit); wait != 0 {
+		t.Error("the least recently used bucket was kept")
+	}
+}
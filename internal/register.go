@@ -0,0 +1,210 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	netmail "net/mail"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/Muchogoc/go-oauth2-server/internal/html"
+	"github.com/Muchogoc/go-oauth2-server/internal/mail"
+	"github.com/Muchogoc/go-oauth2-server/internal/store"
+	"github.com/Muchogoc/go-oauth2-server/log"
+	"github.com/gin-gonic/gin"
+)
+
+var usernamePattern = regexp.MustCompile(`^[a-zA-Z0-9_.-]{3,32}$`)
+
+type Registration struct {
+	Username             string `form:"username"`
+	Name                 string `form:"name"`
+	Email                string `form:"email"`
+	Password             string `form:"password"`
+	PasswordConfirmation string `form:"password_confirmation"`
+}
+
+// validate returns a message for every field that is not acceptable.
+func (r Registration) validate(policy PasswordPolicy) []string {
+	var problems []string
+
+	if !usernamePattern.MatchString(r.Username) {
+		problems = append(problems, "Username must be 3 to 32 letters, digits, dots, dashes or underscores.")
+	}
+
+	if strings.TrimSpace(r.Name) == "" {
+		problems = append(problems, "Name is required.")
+	}
+
+	if address, err := netmail.ParseAddress(r.Email); err != nil || address.Address != r.Email {
+		problems = append(problems, "Email must be a valid email address.")
+	}
+
+	if r.Password != r.PasswordConfirmation {
+		problems = append(problems, "Passwords do not match.")
+	}
+
+	return append(problems, policy.Validate(r.Password, r.Username)...)
+}
+
+// RegisterPageHandler renders the self-service registration form.
+func (a Auth) RegisterPageHandler(c *gin.Context) {
+	a.renderRegister(c, Registration{}, nil)
+}
+
+// RegisterHandler creates an account and emails the user a link to verify
+// their email address. An email address that already has an account gets the
+// same reply, so that it cannot reveal which addresses are registered, and its
+// owner is emailed instead.
+func (a Auth) RegisterHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	params := Registration{}
+	if err := c.ShouldBind(&params); err != nil {
+		a.renderRegister(c, params, []string{"The registration form is invalid."})
+		return
+	}
+
+	params.Username = strings.TrimSpace(params.Username)
+	params.Email = strings.TrimSpace(params.Email)
+
+	if problems := params.validate(a.passwords); len(problems) > 0 {
+		a.renderRegister(c, params, problems)
+		return
+	}
+
+	password, err := store.HashPassword(params.Password)
+	if err != nil {
+		a.renderRegister(c, params, []string{"Something went wrong, please try again."})
+		return
+	}
+
+	user := &store.User{
+		Active:   true,
+		Name:     strings.TrimSpace(params.Name),
+		Username: params.Username,
+		Password: password,
+		Email:    params.Email,
+	}
+
+	err = a.store.CreateUser(ctx, user)
+	switch {
+	case errors.Is(err, store.ErrUsernameTaken):
+		a.renderRegister(c, params, []string{"That username is already taken."})
+		return
+	case errors.Is(err, store.ErrEmailTaken):
+		a.notifyEmailTaken(c, params.Email)
+	case err != nil:
+		log.Errorf("failed to register user: %v", err)
+		a.renderRegister(c, params, []string{"Something went wrong, please try again."})
+		return
+	default:
+		if err := a.sendVerificationEmail(c, user); err != nil {
+			log.Errorf("failed to send verification email: %v", err)
+		}
+	}
+
+	a.renderMessage(c, "Check your email", fmt.Sprintf("We have sent an email to %s, open the link in it to continue.", params.Email))
+}
+
+// notifyEmailTaken tells the owner of an email address that someone tried to
+// register with it. The emails count against the same per-account limit as
+// password reset emails.
+func (a Auth) notifyEmailTaken(c *gin.Context, email string) {
+	ctx := c.Request.Context()
+
+	user, err := a.store.GetUserByEmail(ctx, email)
+	if err != nil {
+		log.Errorf("failed to load the account of a registered email address: %v", err)
+		return
+	}
+
+	if !user.Active {
+		return
+	}
+
+	wait, err := a.resetEmails.Take(ctx, user.ID, a.resetEmailLimit)
+	switch {
+	case err != nil:
+		log.Errorf("failed to check the account email limit: %v", err)
+		return
+	case wait > 0:
+		log.Warn("emails to an account are being throttled")
+		return
+	}
+
+	err = a.mailer.Send(ctx, mail.Message{
+		To:      user.Email,
+		Subject: "You already have an account",
+		Body: fmt.Sprintf(
+			"Hi %s,\n\nSomeone tried to create an account with this email address, which already has one. If it was you, sign in as %s, or choose a new password at:\n\n%s/password/forgot\n\nIf it was not you, you can ignore this email.\n",
+			user.Name, user.Username, a.publicURL,
+		),
+	})
+	if err != nil {
+		log.Errorf("failed to send account exists email: %v", err)
+	}
+}
+
+// VerifyEmailHandler confirms the email address of the user the token was sent to.
+func (a Auth) VerifyEmailHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	token, err := a.store.ConsumeUserToken(ctx, store.UserTokenEmailVerification, c.Query("token"))
+	if err != nil {
+		a.renderMessage(c, "Verification failed", "The verification link is invalid or has expired.")
+		return
+	}
+
+	if err := a.store.MarkEmailVerified(ctx, token.UserID); err != nil {
+		log.Errorf("failed to verify email: %v", err)
+		a.renderMessage(c, "Verification failed", "Something went wrong, please try again.")
+		return
+	}
+
+	a.renderMessage(c, "Email verified", "Your email address has been verified. You can now sign in.")
+}
+
+func (a Auth) sendVerificationEmail(c *gin.Context, user *store.User) error {
+	ctx := c.Request.Context()
+
+	token, err := a.store.CreateUserToken(ctx, user.ID, store.UserTokenEmailVerification, a.verificationLifespan)
+	if err != nil {
+		return err
+	}
+
+	link := fmt.Sprintf("%s/register/verify?token=%s", a.publicURL, url.QueryEscape(token))
+
+	return a.mailer.Send(ctx, mail.Message{
+		To:      user.Email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf(
+			"Hi %s,\n\nPlease verify your email address by opening the link below:\n\n%s\n\nThe link expires in %s.\n",
+			user.Name, link, a.verificationLifespan,
+		),
+	})
+}
+
+func (a Auth) renderRegister(c *gin.Context, params Registration, problems []string) {
+	c.Writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	page := html.RegisterParams{
+		Title:    "Create an account",
+		Errors:   problems,
+		Username: params.Username,
+		Name:     params.Name,
+		Email:    params.Email,
+	}
+
+	_ = html.Register(c.Writer, page)
+}
+
+func (a Auth) renderMessage(c *gin.Context, title string, message string) {
+	c.Writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	page := html.MessageParams{
+		Title:   title,
+		Message: message,
+	}
+
+	_ = html.Message(c.Writer, page)
+}
@@ -0,0 +1,39 @@
+package internal
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func registration(username string, email string) url.Values {
+	return url.Values{
+		"username":              {username},
+		"name":                  {username},
+		"email":                 {email},
+		"password":              {"correct horse battery"},
+		"password_confirmation": {"correct horse battery"},
+	}
+}
+
+func TestRegisterDoesNotRevealRegisteredEmails(t *testing.T) {
+	server := newTestServer(t, newTestConfig(t, nil))
+	server.createUser(t, "alice", "correct horse")
+
+	created := postForm(server.auth.RegisterHandler, registration("bob", "bob@example.com"))
+	taken := postForm(server.auth.RegisterHandler, registration("mallory", "alice@example.com"))
+
+	want := strings.ReplaceAll(created.Body.String(), "bob@example.com", "alice@example.com")
+	if taken.Body.String() != want {
+		t.Errorf("a registered email address got another reply: %s", taken.Body.String())
+	}
+
+	recipients := map[string]string{}
+	for _, message := range server.mailer.sent() {
+		recipients[message.To] = message.Subject
+	}
+
+	if recipients["bob@example.com"] != "Verify your email address" || recipients["alice@example.com"] != "You already have an account" {
+		t.Errorf("sent %v, want a verification link to bob and a notice to alice", recipients)
+	}
+}
@@ -0,0 +1,246 @@
+package store
+
+import (
+	"container/list"
+	"context"
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/ory/fosite"
+)
+
+var (
+	// cacheHits, cacheMisses and cacheEvictions count per cache since the process started
+	cacheHits      = expvar.NewMap("cache_hits")
+	cacheMisses    = expvar.NewMap("cache_misses")
+	cacheEvictions = expvar.NewMap("cache_evictions")
+)
+
+// CacheStats reports how a cache has been doing since the process started.
+type CacheStats struct {
+	Hits      int64
+	Misses    int64
+	Evictions int64
+	Entries   int
+}
+
+type cacheEntry struct {
+	key       string
+	value     interface{}
+	expiresAt time.Time
+}
+
+// ttlCache is a bounded map whose entries expire after a fixed time. Once full,
+// the least recently used entry makes room for a new one.
+type ttlCache struct {
+	name       string
+	ttl        time.Duration
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	// recent orders the entries from the most to the least recently used
+	recent *list.List
+	// generation changes on every invalidation, so that a value loaded before an
+	// invalidation is not cached after it
+	generation uint64
+	stats      CacheStats
+}
+
+func newTTLCache(name string, ttl time.Duration, maxEntries int) *ttlCache {
+	return &ttlCache{
+		name:       name,
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    make(map[string]*list.Element),
+		recent:     list.New(),
+	}
+}
+
+func (c *ttlCache) get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if ok && time.Now().After(element.Value.(*cacheEntry).expiresAt) {
+		c.remove(element)
+		ok = false
+	}
+
+	if !ok {
+		c.stats.Misses++
+		cacheMisses.Add(c.name, 1)
+		return nil, false
+	}
+
+	c.recent.MoveToFront(element)
+
+	c.stats.Hits++
+	cacheHits.Add(c.name, 1)
+
+	return element.Value.(*cacheEntry).value, true
+}
+
+// currentGeneration is read before loading a value and passed to put.
+func (c *ttlCache) currentGeneration() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.generation
+}
+
+// put caches a value unless the cache was invalidated since generation was read.
+func (c *ttlCache) put(key string, value interface{}, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation != c.generation {
+		return
+	}
+
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	} else if len(c.entries) >= c.maxEntries && c.recent.Len() > 0 {
+		c.remove(c.recent.Back())
+
+		c.stats.Evictions++
+		cacheEvictions.Add(c.name, 1)
+	}
+
+	c.entries[key] = c.recent.PushFront(&cacheEntry{key: key, value: value, expiresAt: time.Now().Add(c.ttl)})
+}
+
+// remove drops an entry. The caller must hold c.mu.
+func (c *ttlCache) remove(element *list.Element) {
+	delete(c.entries, c.recent.Remove(element).(*cacheEntry).key)
+}
+
+func (c *ttlCache) invalidate(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+}
+
+func (c *ttlCache) snapshot() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := c.stats
+	stats.Entries = len(c.entries)
+
+	return stats
+}
+
+type cacheTransactionKey struct{}
+
+// cacheTransaction holds the invalidations to repeat once a transaction commits,
+// as values loaded while it was open may be stale by then.
+type cacheTransaction struct {
+	mu            sync.Mutex
+	invalidations []func()
+}
+
+// CachedStorage serves active clients from memory for a short while instead of
+// loading them for every token and introspection request. Changes made through
+// it invalidate the cached clients straight away; changes made by other replicas
+// are only seen once the cached clients expire. Access tokens are never cached,
+// so that a token revoked on any replica is refused by all of them at once.
+type CachedStorage struct {
+	Storage
+
+	clients *ttlCache
+}
+
+// NewCachedStorage wraps a store with a cache of clients.
+func NewCachedStorage(storage Storage, clientTTL time.Duration, maxEntries int) *CachedStorage {
+	return &CachedStorage{
+		Storage: storage,
+		clients: newTTLCache("clients", clientTTL, maxEntries),
+	}
+}
+
+// Stats returns the statistics of each cache by name.
+func (s *CachedStorage) Stats() map[string]CacheStats {
+	return map[string]CacheStats{
+		s.clients.name: s.clients.snapshot(),
+	}
+}
+
+// InvalidateClient drops a cached client, e.g. after it was changed.
+func (s *CachedStorage) InvalidateClient(ctx context.Context, id string) {
+	s.invalidate(ctx, func() { s.clients.invalidate(id) })
+}
+
+// invalidate runs an invalidation now and, within a transaction, again once it
+// has committed.
+func (s *CachedStorage) invalidate(ctx context.Context, invalidation func()) {
+	invalidation()
+
+	if tx, ok := ctx.Value(cacheTransactionKey{}).(*cacheTransaction); ok {
+		tx.mu.Lock()
+		tx.invalidations = append(tx.invalidations, invalidation)
+		tx.mu.Unlock()
+	}
+}
+
+func (s *CachedStorage) BeginTX(ctx context.Context) (context.Context, error) {
+	ctx, err := s.Storage.BeginTX(ctx)
+	if err != nil {
+		return ctx, err
+	}
+
+	return context.WithValue(ctx, cacheTransactionKey{}, &cacheTransaction{}), nil
+}
+
+func (s *CachedStorage) Commit(ctx context.Context) error {
+	if err := s.Storage.Commit(ctx); err != nil {
+		return err
+	}
+
+	if tx, ok := ctx.Value(cacheTransactionKey{}).(*cacheTransaction); ok {
+		tx.mu.Lock()
+		for _, invalidation := range tx.invalidations {
+			invalidation()
+		}
+		tx.mu.Unlock()
+	}
+
+	return nil
+}
+
+// GetClient returns the cached client or loads it.
+func (s *CachedStorage) GetClient(ctx context.Context, id string) (fosite.Client, error) {
+	if client, ok := s.clients.get(id); ok {
+		return client.(fosite.Client), nil
+	}
+
+	generation := s.clients.currentGeneration()
+
+	client, err := s.Storage.GetClient(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	s.clients.put(id, client, generation)
+
+	return client, nil
+}
+
+func (s *CachedStorage) UpdateClient(ctx context.Context, client *Client) error {
+	defer s.InvalidateClient(ctx, client.ID)
+
+	return s.Storage.UpdateClient(ctx, client)
+}
+
+// DeleteClient drops the cached client.
+func (s *CachedStorage) DeleteClient(ctx context.Context, id string) error {
+	defer s.InvalidateClient(ctx, id)
+
+	return s.Storage.DeleteClient(ctx, id)
+}
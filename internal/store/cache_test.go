@@ -0,0 +1,68 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestTTLCacheDropsLeastRecentlyUsedEntries(t *testing.T) {
+	cache := newTTLCache("test", time.Minute, 2)
+
+	cache.put("a", 1, cache.currentGeneration())
+	cache.put("b", 2, cache.currentGeneration())
+	cache.get("a")
+	cache.put("c", 3, cache.currentGeneration())
+
+	if _, ok := cache.get("b"); ok {
+		t.Error("the least recently used entry was kept")
+	}
+
+	for _, key := range []string{"a", "c"} {
+		if _, ok := cache.get(key); !ok {
+			t.Errorf("%s was dropped", key)
+		}
+	}
+
+	if stats := cache.snapshot(); stats.Entries != 2 || stats.Evictions != 1 {
+		t.Errorf("got %d entries and %d evictions, want 2 and 1", stats.Entries, stats.Evictions)
+	}
+}
+
+func TestCachedStorageCachesOnlyActiveClients(t *testing.T) {
+	ctx := context.Background()
+
+	backend := NewMemoryStore()
+	cached := NewCachedStorage(backend, time.Minute, 10)
+
+	client := &Client{ID: "app", Active: true}
+	if err := backend.CreateClient(ctx, client); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := cached.GetClient(ctx, "app"); err != nil {
+		t.Fatal(err)
+	}
+
+	// changed behind the cache, as by another replica
+	client.Active = false
+	if err := backend.UpdateClient(ctx, client); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := cached.GetClient(ctx, "app"); err != nil {
+		t.Error("the cached client was not served")
+	}
+
+	cached.InvalidateClient(ctx, "app")
+
+	for i := 0; i < 2; i++ {
+		if _, err := cached.GetClient(ctx, "app"); err == nil {
+			t.Fatal("an inactive client was served")
+		}
+	}
+
+	if stats := cached.Stats()["clients"]; stats.Entries != 0 {
+		t.Errorf("%d clients are cached, want none", stats.Entries)
+	}
+}
@@ -2,6 +2,7 @@ package store
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"time"
 
@@ -9,12 +10,26 @@ import (
 	"github.com/ory/fosite"
 )
 
+var ErrClientExists = errors.New("a client with this ID already exists")
+
+// ClientFilter selects the clients returned by ListClients.
+type ClientFilter struct {
+	// Search matches part of the client ID
+	Search    string
+	Active    *bool
+	Public    *bool
+	GrantType string
+
+	Limit  int
+	Offset int
+}
+
 // ClientAssertionJWTValid returns an error if the JTI is known or the DB check failed
 // and nil if the JTI is not known.
 func (m Store) ClientAssertionJWTValid(ctx context.Context, jti string) error {
 	var result ClientJWT
 
-	if err := m.db.Where(ClientJWT{JTI: jti}).First(&result).Error; err != nil {
+	if err := m.conn(ctx).Where("jti = ?", jti).First(&result).Error; err != nil {
 		return nil
 	}
 
@@ -26,17 +41,131 @@ func (m Store) ClientAssertionJWTValid(ctx context.Context, jti string) error {
 }
 
 // GetClient loads the client by its ID or returns an error
-// if the client does not exist or another error occurred.
+// if the client does not exist, is deactivated or another error occurred.
 func (m Store) GetClient(ctx context.Context, id string) (fosite.Client, error) {
 	var result Client
 
-	if err := m.db.Where(Client{ID: id}).First(&result).Error; err != nil {
-		return nil, fmt.Errorf("error fetching client: %w", err)
+	if id == "" {
+		return nil, fosite.ErrNotFound.WithDebug("no client ID")
+	}
+
+	if err := m.conn(ctx).Where("id = ? AND active = ?", id, true).First(&result).Error; err != nil {
+		return nil, fmt.Errorf("%w: %w", fosite.ErrNotFound, err)
 	}
 
 	return result, nil
 }
 
+// GetClientByID loads a client by its ID, whether or not it is active.
+func (m Store) GetClientByID(ctx context.Context, id string) (*Client, error) {
+	var result Client
+
+	if id == "" {
+		return nil, fosite.ErrNotFound.WithDebug("no client ID")
+	}
+
+	if err := m.conn(ctx).Where("id = ?", id).First(&result).Error; err != nil {
+		return nil, fmt.Errorf("%w: %w", fosite.ErrNotFound, err)
+	}
+
+	return &result, nil
+}
+
+// ListClients returns a page of the clients matching a filter, ordered by ID,
+// and how many clients match in total.
+func (m Store) ListClients(ctx context.Context, filter ClientFilter) ([]Client, int64, error) {
+	query := m.conn(ctx).Model(&Client{})
+
+	if filter.Search != "" {
+		query = query.Where("id LIKE ?", "%"+filter.Search+"%")
+	}
+
+	if filter.Active != nil {
+		query = query.Where("active = ?", *filter.Active)
+	}
+
+	if filter.Public != nil {
+		query = query.Where("public = ?", *filter.Public)
+	}
+
+	if filter.GrantType != "" {
+		// grants are stored as a JSON array of strings
+		query = query.Where("grants LIKE ?", `%"`+filter.GrantType+`"%`)
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, fmt.Errorf("error counting clients: %w", err)
+	}
+
+	// a limit of zero returns every client
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = -1
+	}
+
+	var results []Client
+	if err := query.Order("id").Limit(limit).Offset(filter.Offset).Find(&results).Error; err != nil {
+		return nil, 0, fmt.Errorf("error fetching clients: %w", err)
+	}
+
+	return results, total, nil
+}
+
+// CreateClient registers a new client. The client's secret must already be hashed.
+func (m Store) CreateClient(ctx context.Context, client *Client) error {
+	var count int64
+
+	// deleted clients are removed for good, so their IDs can be reused
+	if err := m.conn(ctx).Model(&Client{}).Where("id = ?", client.ID).Count(&count).Error; err != nil {
+		return fmt.Errorf("error checking client ID: %w", err)
+	}
+
+	if count > 0 {
+		return ErrClientExists
+	}
+
+	if err := m.conn(ctx).Create(client).Error; err != nil {
+		return fmt.Errorf("error creating client: %w", err)
+	}
+
+	return nil
+}
+
+// UpdateClient saves every field of an existing client.
+func (m Store) UpdateClient(ctx context.Context, client *Client) error {
+	result := m.conn(ctx).Model(client).Select("*").Omit("created_at").Updates(client)
+	if result.Error != nil {
+		return fmt.Errorf("failed to update client: %w", result.Error)
+	}
+
+	if result.RowsAffected == 0 {
+		return fosite.ErrNotFound
+	}
+
+	return nil
+}
+
+// DeleteClient revokes every token issued to a client and removes it.
+func (m Store) DeleteClient(ctx context.Context, id string) error {
+	return m.transaction(ctx, func(ctx context.Context) error {
+		if err := m.RevokeClientTokens(ctx, id); err != nil {
+			return err
+		}
+
+		result := m.conn(ctx).Unscoped().Where("id = ?", id).Delete(&Client{})
+		if result.Error != nil {
+			return fmt.Errorf("failed to delete client: %w", result.Error)
+		}
+
+		if result.RowsAffected == 0 {
+			return fosite.ErrNotFound
+		}
+
+		return nil
+	})
+}
+
 // SetClientAssertionJWT marks a JTI as known for the given
 // expiry time. Before inserting the new JTI, it will clean
 // up any existing JTIs that have expired as those tokens can
@@ -44,7 +173,11 @@ func (m Store) GetClient(ctx context.Context, id string) (fosite.Client, error)
 func (m Store) SetClientAssertionJWT(ctx context.Context, jti string, exp time.Time) error {
 	var result ClientJWT
 
-	if err := m.db.Where(ClientJWT{JTI: jti}).Where("expires_at > ?", time.Now()).First(&result).Error; err != nil {
+	if err := m.conn(ctx).Where("jti = ? AND expires_at > ?", jti, time.Now()).Limit(1).Find(&result).Error; err != nil {
+		return fmt.Errorf("error fetching client assertion jwt: %w", err)
+	}
+
+	if result.ID != "" {
 		return fosite.ErrJTIKnown
 	}
 
@@ -54,7 +187,7 @@ func (m Store) SetClientAssertionJWT(ctx context.Context, jti string, exp time.T
 		ExpiresAt: exp,
 	}
 
-	if err := m.db.Create(&jwt).Error; err != nil {
+	if err := m.conn(ctx).Create(&jwt).Error; err != nil {
 		return fmt.Errorf("error creating client assertion jwt: %w", err)
 	}
 
@@ -0,0 +1,261 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/Muchogoc/go-oauth2-server/config"
+	"github.com/Muchogoc/go-oauth2-server/internal/envelope"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+// encryptedColumns lists the columns tagged `serializer:encrypted`.
+var encryptedColumns = []struct {
+	table  string
+	column string
+}{
+	{"authorization_codes", "form"},
+	{"access_tokens", "form"},
+	{"refresh_tokens", "form"},
+	{"pkces", "form"},
+	{"sessions", "extra"},
+}
+
+func init() {
+	// the serializer holds no key: every store passes its own cipher in the
+	// context of its statements, so stores opened with different keys in the same
+	// process do not share one
+	schema.RegisterSerializer("encrypted", encryptedSerializer{})
+}
+
+type cipherKey struct{}
+
+// withCipher returns a context carrying the cipher the encrypted columns are
+// read and written with, nil when encryption at rest is not configured.
+func withCipher(ctx context.Context, cipher *envelope.Cipher) context.Context {
+	return context.WithValue(ctx, cipherKey{}, cipher)
+}
+
+// contextCipher returns the cipher carried by the context of a statement. A
+// statement without one fails rather than reading or writing plaintext.
+func contextCipher(ctx context.Context, field *schema.Field) (*envelope.Cipher, error) {
+	cipher, ok := ctx.Value(cipherKey{}).(*envelope.Cipher)
+	if !ok {
+		return nil, fmt.Errorf("column %s is encrypted but the statement carries no cipher", field.DBName)
+	}
+
+	return cipher, nil
+}
+
+// newCipher returns the cipher for the configured key provider, or nil when
+// encryption at rest is not configured.
+func newCipher(cfg config.Provider) (*envelope.Cipher, error) {
+	switch provider := cfg.GetString("encryption_key_provider"); provider {
+	case "local":
+		path := cfg.GetString("encryption_keyfile")
+		if path == "" {
+			return nil, nil
+		}
+
+		keys, err := envelope.NewLocalKeyProvider(path)
+		if err != nil {
+			return nil, err
+		}
+
+		return envelope.NewCipher(keys), nil
+	default:
+		return nil, fmt.Errorf("unsupported encryption key provider: %s", provider)
+	}
+}
+
+// ErrEncryptionKeyMissing is returned when encryption at rest is required but no
+// key is configured.
+var ErrEncryptionKeyMissing = errors.New("encryption_required is set but no encryption key is configured")
+
+// requiredCipher returns the configured cipher, failing when encryption at rest
+// is required and no key is configured.
+func requiredCipher(cfg config.Provider) (*envelope.Cipher, error) {
+	cipher, err := newCipher(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if cipher == nil && cfg.GetBool("encryption_required") {
+		return nil, ErrEncryptionKeyMissing
+	}
+
+	return cipher, nil
+}
+
+// encryptedSerializer transparently encrypts a column on write and decrypts it on
+// read, with the cipher of the store running the statement. Values written before
+// encryption was enabled are read as they are.
+type encryptedSerializer struct{}
+
+func (s encryptedSerializer) Scan(ctx context.Context, field *schema.Field, dst reflect.Value, dbValue interface{}) error {
+	cipher, err := contextCipher(ctx, field)
+	if err != nil {
+		return err
+	}
+
+	var data []byte
+
+	switch value := dbValue.(type) {
+	case nil:
+	case []byte:
+		data = append([]byte(nil), value...)
+	case string:
+		data = []byte(value)
+	default:
+		return fmt.Errorf("unsupported value for encrypted column %s: %T", field.DBName, dbValue)
+	}
+
+	if len(data) > 0 {
+		if cipher == nil {
+			if _, ok := envelope.Parse(data); ok {
+				return fmt.Errorf("column %s is encrypted but no encryption key is configured", field.DBName)
+			}
+		} else {
+			plaintext, err := cipher.Decrypt(ctx, data)
+			if err != nil {
+				return fmt.Errorf("failed to decrypt column %s: %w", field.DBName, err)
+			}
+
+			data = plaintext
+		}
+	}
+
+	field.ReflectValueOf(ctx, dst).Set(reflect.ValueOf(data).Convert(field.FieldType))
+
+	return nil
+}
+
+func (s encryptedSerializer) Value(ctx context.Context, field *schema.Field, dst reflect.Value, fieldValue interface{}) (interface{}, error) {
+	cipher, err := contextCipher(ctx, field)
+	if err != nil {
+		return nil, err
+	}
+
+	data := reflect.ValueOf(fieldValue).Convert(reflect.TypeOf([]byte(nil))).Bytes()
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	if cipher == nil {
+		return string(data), nil
+	}
+
+	ciphertext, err := cipher.Encrypt(ctx, data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt column %s: %w", field.DBName, err)
+	}
+
+	return string(ciphertext), nil
+}
+
+// ErrEncryptionDisabled is returned when rotating keys without an encryption key.
+var ErrEncryptionDisabled = errors.New("encryption at rest is not configured")
+
+// RotateEncryptionKey re-encrypts every value sealed with a retired
+// key-encryption key, or not encrypted at all, with the current one. It returns
+// how many values were rewritten, after which retired keys can be dropped from
+// the key file.
+func (m Store) RotateEncryptionKey(ctx context.Context) (int64, error) {
+	if m.cipher == nil {
+		return 0, ErrEncryptionDisabled
+	}
+
+	var count int64
+
+	err := m.transaction(ctx, func(ctx context.Context) error {
+		var err error
+
+		count, err = reencrypt(ctx, m.conn(ctx), m.cipher, true)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// CurrentEncryptionKeyID returns the ID of the key-encryption key new values are
+// encrypted with, or an empty string when encryption is not configured.
+func (m Store) CurrentEncryptionKeyID() string {
+	if m.cipher == nil {
+		return ""
+	}
+
+	return m.cipher.CurrentKeyID()
+}
+
+// reencrypt rewrites every encrypted column, either encrypting it with the current
+// key or, when encrypt is false, decrypting it back to plaintext. It is used to
+// encrypt existing rows and to move rows off a retired key.
+func reencrypt(ctx context.Context, tx *gorm.DB, cipher *envelope.Cipher, encrypt bool) (int64, error) {
+	var count int64
+
+	if encrypt && cipher == nil {
+		return count, nil
+	}
+
+	for _, column := range encryptedColumns {
+		column := column
+
+		err := inBatches(tx, column.table, []string{column.column}, func(rows []map[string]interface{}) error {
+			for _, row := range rows {
+				text, ok := columnText(row[column.column])
+				if !ok {
+					continue
+				}
+
+				plaintext := []byte(text)
+
+				sealed, encrypted := envelope.Parse(plaintext)
+				switch {
+				case encrypted && encrypt && sealed.KeyID == cipher.CurrentKeyID():
+					continue
+				case encrypted && cipher == nil:
+					return fmt.Errorf("%s are encrypted but no encryption key is configured", column.table)
+				case encrypted:
+					decrypted, err := cipher.Decrypt(ctx, plaintext)
+					if err != nil {
+						return err
+					}
+
+					plaintext = decrypted
+				case !encrypt:
+					continue
+				}
+
+				value := string(plaintext)
+
+				if encrypt {
+					ciphertext, err := cipher.Encrypt(ctx, plaintext)
+					if err != nil {
+						return err
+					}
+
+					value = string(ciphertext)
+				}
+
+				if err := tx.Table(column.table).Where("id = ?", row["id"]).Update(column.column, value).Error; err != nil {
+					return fmt.Errorf("failed to update %s: %w", column.table, err)
+				}
+
+				count++
+			}
+
+			return nil
+		})
+		if err != nil {
+			return count, err
+		}
+	}
+
+	return count, nil
+}
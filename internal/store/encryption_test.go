@@ -0,0 +1,202 @@
+package store_test
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/Muchogoc/go-oauth2-server/internal/envelope"
+	"github.com/Muchogoc/go-oauth2-server/internal/store"
+	"github.com/spf13/viper"
+)
+
+// writeKeyFile writes a key file with one random key and returns its path.
+func writeKeyFile(t *testing.T) string {
+	t.Helper()
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := json.Marshal(map[string]interface{}{
+		"current": "k1",
+		"keys":    map[string]string{"k1": base64.StdEncoding.EncodeToString(key)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "keys.json")
+	if err := os.WriteFile(path, file, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestEncryptionRequiresKey(t *testing.T) {
+	v := newTestConfig("sqlite", ":memory:")
+	v.Set("encryption_required", true)
+
+	if s, err := store.NewStore(v); !errors.Is(err, store.ErrEncryptionKeyMissing) {
+		if s != nil {
+			_ = s.Close()
+		}
+
+		t.Fatalf("opening a store without a key returned %v, want ErrEncryptionKeyMissing", err)
+	}
+
+	db, err := store.Open(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.NewMigrator(db, v).Up(context.Background()); !errors.Is(err, store.ErrEncryptionKeyMissing) {
+		t.Errorf("migrating without a key returned %v, want ErrEncryptionKeyMissing", err)
+	}
+
+	v.Set("encryption_keyfile", writeKeyFile(t))
+
+	s, err := store.NewStore(v)
+	if err != nil {
+		t.Fatalf("a store with a key was refused: %v", err)
+	}
+
+	_ = s.Close()
+}
+
+func TestSessionClaimsLookingLikeEnvelopes(t *testing.T) {
+	ctx := context.Background()
+	dsn := filepath.Join(t.TempDir(), "auth.db")
+	keyfile := writeKeyFile(t)
+
+	extra := map[string]interface{}{"alg": "A256GCM", "kid": "k1", "ct": "not a ciphertext"}
+
+	for _, encrypted := range []bool{false, true} {
+		v := newTestConfig("sqlite", dsn)
+		if encrypted {
+			v.Set("encryption_keyfile", keyfile)
+		}
+
+		s, err := store.NewStore(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		t.Cleanup(func() { _ = s.Close() })
+
+		if !encrypted {
+			request := newTestRequest(t, s)
+
+			session := request.Session.(*store.Session)
+			session.Extra, _ = json.Marshal(extra)
+
+			if err := s.CreateAccessTokenSession(ctx, "access-signature", request); err != nil {
+				t.Fatal(err)
+			}
+
+			continue
+		}
+
+		// the plaintext claims written before the key was configured are read as they are
+		found, err := s.GetAccessTokenSession(ctx, "access-signature", &store.Session{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := found.GetSession().(*store.Session).GetExtraClaims(); !reflect.DeepEqual(got, extra) {
+			t.Errorf("got claims %v, want %v", got, extra)
+		}
+
+		count, err := s.RotateEncryptionKey(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if count == 0 {
+			t.Fatal("the plaintext claims were taken for an envelope and left unencrypted")
+		}
+
+		found, err = s.GetAccessTokenSession(ctx, "access-signature", &store.Session{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := found.GetSession().(*store.Session).GetExtraClaims(); !reflect.DeepEqual(got, extra) {
+			t.Errorf("got claims %v after encrypting them, want %v", got, extra)
+		}
+	}
+}
+
+// storedForm returns the form column of the access token as stored in a database.
+func storedForm(t *testing.T, dsn string) []byte {
+	t.Helper()
+
+	db, err := store.Open(newTestConfig("sqlite", dsn))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqlDB.Close()
+
+	var form string
+	if err := db.Table("access_tokens").Select("form").Row().Scan(&form); err != nil {
+		t.Fatal(err)
+	}
+
+	return []byte(form)
+}
+
+func TestStoresKeepTheirOwnKeys(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	encrypted := newTestConfig("sqlite", filepath.Join(dir, "encrypted.db"))
+	encrypted.Set("encryption_keyfile", writeKeyFile(t))
+
+	plain := newTestConfig("sqlite", filepath.Join(dir, "plain.db"))
+
+	// the store without a key is opened last and must not take over the key of the
+	// other one
+	var stores []*store.Store
+
+	for _, v := range []*viper.Viper{encrypted, plain} {
+		s, err := store.NewStore(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		t.Cleanup(func() { _ = s.Close() })
+
+		stores = append(stores, s)
+	}
+
+	for _, s := range stores {
+		if err := s.CreateAccessTokenSession(ctx, "access-signature", newTestRequest(t, s)); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := s.GetAccessTokenSession(ctx, "access-signature", &store.Session{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, ok := envelope.Parse(storedForm(t, encrypted.GetString("database_dsn"))); !ok {
+		t.Error("the store with a key wrote its form unencrypted")
+	}
+
+	if _, ok := envelope.Parse(storedForm(t, plain.GetString("database_dsn"))); ok {
+		t.Error("the store without a key encrypted its form")
+	}
+}
@@ -0,0 +1,134 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm/clause"
+)
+
+// PurgePolicy controls which expired and invalidated rows are deleted.
+type PurgePolicy struct {
+	// BatchSize is the most rows deleted by a single statement
+	BatchSize int
+	// Retention keeps rows for this long after they expired or were invalidated,
+	// e.g. for auditing
+	Retention time.Duration
+	// RefreshTokenGracePeriod additionally keeps used refresh tokens so that their
+	// reuse is still detected and revokes the grant
+	RefreshTokenGracePeriod time.Duration
+}
+
+// PurgeExpired deletes expired and invalidated codes, tokens and the sessions no
+// longer referenced by any of them. It returns the number of rows deleted per table.
+func (m Store) PurgeExpired(ctx context.Context, policy PurgePolicy) (map[string]int64, error) {
+	cutoff := time.Now().Add(-policy.Retention)
+	refreshCutoff := cutoff.Add(-policy.RefreshTokenGracePeriod)
+
+	// sessions go last, once the rows referencing them are gone
+	targets := []struct {
+		table string
+		query string
+		args  []interface{}
+	}{
+		{
+			table: "authorization_codes",
+			query: "expires_at < ? OR deleted_at < ?",
+			args:  []interface{}{cutoff, cutoff},
+		},
+		{
+			table: "pkces",
+			query: "expires_at < ? OR deleted_at < ?",
+			args:  []interface{}{cutoff, cutoff},
+		},
+		{
+			table: "access_tokens",
+			query: "expires_at < ? OR (active = ? AND updated_at < ?) OR deleted_at < ?",
+			args:  []interface{}{cutoff, false, cutoff, cutoff},
+		},
+		{
+			table: "refresh_tokens",
+			query: "expires_at < ? OR (active = ? AND updated_at < ?) OR deleted_at < ?",
+			args:  []interface{}{refreshCutoff, false, refreshCutoff, cutoff},
+		},
+		{
+			table: "client_jwts",
+			query: "expires_at < ?",
+			args:  []interface{}{cutoff},
+		},
+		{
+			table: "webauthn_sessions",
+			query: "expires_at < ?",
+			args:  []interface{}{cutoff},
+		},
+		{
+			table: "user_tokens",
+			query: "expires_at < ?",
+			args:  []interface{}{cutoff},
+		},
+		{
+			table: "sessions",
+			query: "updated_at < ? AND id NOT IN (?) AND id NOT IN (?) AND id NOT IN (?) AND id NOT IN (?)",
+			args: []interface{}{
+				cutoff,
+				m.db.Table("authorization_codes").Select("session_id").Where("session_id IS NOT NULL"),
+				m.db.Table("access_tokens").Select("session_id").Where("session_id IS NOT NULL"),
+				m.db.Table("refresh_tokens").Select("session_id").Where("session_id IS NOT NULL"),
+				m.db.Table("pkces").Select("session_id").Where("session_id IS NOT NULL"),
+			},
+		},
+	}
+
+	purged := make(map[string]int64)
+
+	for _, target := range targets {
+		count, err := m.purge(ctx, target.table, policy.BatchSize, target.query, target.args...)
+		purged[target.table] = count
+		if err != nil {
+			return purged, err
+		}
+	}
+
+	return purged, nil
+}
+
+// purge deletes the rows of a table matching a condition in batches, so that a
+// large backlog does not hold locks on the table for long.
+func (m Store) purge(ctx context.Context, table string, batchSize int, query string, args ...interface{}) (int64, error) {
+	var total int64
+
+	// a batch size of zero deletes everything in one go
+	limit := batchSize
+	if limit <= 0 {
+		limit = -1
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return total, err
+		}
+
+		var ids []string
+
+		// querying the table by name also finds soft-deleted rows
+		if err := m.conn(ctx).Table(table).Where(query, args...).Limit(limit).Pluck("id", &ids).Error; err != nil {
+			return total, fmt.Errorf("error finding expired %s: %w", table, err)
+		}
+
+		if len(ids) == 0 {
+			return total, nil
+		}
+
+		result := m.conn(ctx).Exec("DELETE FROM ? WHERE id IN ?", clause.Table{Name: table}, ids)
+		if result.Error != nil {
+			return total, fmt.Errorf("failed to purge %s: %w", table, result.Error)
+		}
+
+		total += result.RowsAffected
+
+		if limit < 0 || len(ids) < limit {
+			return total, nil
+		}
+	}
+}
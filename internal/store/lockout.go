@@ -0,0 +1,77 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm/clause"
+)
+
+// GetLoginAttempt returns the failed login record for a key. A key without
+// failures returns an empty record.
+func (m Store) GetLoginAttempt(ctx context.Context, key string) (*LoginAttempt, error) {
+	var results []LoginAttempt
+
+	// most keys have no failures, Find avoids logging a not found error for them
+	if err := m.conn(ctx).Where("id = ?", key).Limit(1).Find(&results).Error; err != nil {
+		return nil, fmt.Errorf("error fetching login attempt: %w", err)
+	}
+
+	if len(results) == 0 {
+		return &LoginAttempt{ID: key}, nil
+	}
+
+	return &results[0], nil
+}
+
+// UpdateLoginAttempt loads the failed login record for a key, lets update change
+// it and saves the result, while holding a lock on the record so that concurrent
+// updates of a key are applied one after the other. update returns false to
+// leave the record unchanged. A record left without failures is deleted.
+func (m Store) UpdateLoginAttempt(ctx context.Context, key string, update func(attempt *LoginAttempt) bool) (*LoginAttempt, error) {
+	var result LoginAttempt
+
+	err := m.transaction(ctx, func(ctx context.Context) error {
+		db := m.conn(ctx)
+
+		if err := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&LoginAttempt{ID: key}).Error; err != nil {
+			return err
+		}
+
+		// writing to the record before reading it locks it until the transaction
+		// ends, so a concurrent update reads the result of this one
+		if err := db.Model(&LoginAttempt{}).Where("id = ?", key).Update("updated_at", time.Now()).Error; err != nil {
+			return err
+		}
+
+		if err := db.Where("id = ?", key).Take(&result).Error; err != nil {
+			return err
+		}
+
+		changed := update(&result)
+
+		switch {
+		case result.Failures == 0:
+			return db.Unscoped().Where("id = ?", key).Delete(&LoginAttempt{}).Error
+		case changed:
+			return db.Save(&result).Error
+		default:
+			return nil
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error updating login attempt: %w", err)
+	}
+
+	return &result, nil
+}
+
+// ClearLoginAttempt forgets the failed logins recorded for a key.
+func (m Store) ClearLoginAttempt(ctx context.Context, key string) error {
+	if err := m.conn(ctx).Unscoped().Where("id = ?", key).Delete(&LoginAttempt{}).Error; err != nil {
+		return fmt.Errorf("failed to clear login attempt: %w", err)
+	}
+
+	return nil
+}
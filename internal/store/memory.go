@@ -0,0 +1,1363 @@
+package store
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+	"github.com/ory/fosite"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// memoryRow is a stored code or token. Rows are replaced rather than modified in
+// place, so that a transaction can put the previous version back.
+type memoryRow struct {
+	id        string
+	active    bool
+	request   *fosite.Request
+	expiresAt *time.Time
+	updatedAt time.Time
+}
+
+// memoryTable holds codes or tokens by signature.
+type memoryTable struct {
+	// name is the name of the matching database table
+	name string
+	rows map[string]*memoryRow
+}
+
+func newMemoryTable(name string) *memoryTable {
+	return &memoryTable{name: name, rows: make(map[string]*memoryRow)}
+}
+
+// info describes a row the way ListTokens does.
+func (r *memoryRow) info(tokenType fosite.TokenType) TokenInfo {
+	token := TokenInfo{
+		ID:          r.id,
+		Type:        tokenType,
+		RequestID:   r.request.GetID(),
+		Scopes:      r.request.GetGrantedScopes(),
+		Active:      r.active,
+		RequestedAt: r.request.GetRequestedAt(),
+		ExpiresAt:   r.expiresAt,
+	}
+
+	if client := r.request.GetClient(); client != nil {
+		token.ClientID = client.GetID()
+	}
+
+	if session, ok := r.request.Session.(*Session); ok {
+		token.SessionID, token.UserID, token.Username = session.ID, session.UserID, session.Username
+	}
+
+	return token
+}
+
+// set replaces the row of a signature, or deletes it when row is nil.
+func (t *memoryTable) set(signature string, row *memoryRow) {
+	if row == nil {
+		delete(t.rows, signature)
+		return
+	}
+
+	t.rows[signature] = row
+}
+
+type memoryTransactionKey struct{}
+
+// memoryTransaction records how to undo the changes made to codes and tokens.
+type memoryTransaction struct {
+	undo []func()
+	done bool
+}
+
+// MemoryStore keeps everything in process memory and is safe for concurrent use.
+// Transactions run one at a time and a rollback undoes every change made in them,
+// but they are not isolated: reads made outside a transaction see its changes
+// before it commits.
+type MemoryStore struct {
+	mu sync.RWMutex
+	// txMu is held from BeginTX until Commit or Rollback
+	txMu sync.Mutex
+
+	clients          map[string]Client
+	users            map[string]User
+	credentials      map[string]WebAuthnCredential
+	passwordHistory  map[string][]PasswordHistory
+	userRoles        map[string][]string
+	scopes           map[string]Scope
+	roles            map[string]Role
+	userTokens       map[string]UserToken
+	webAuthnSessions map[string]WebAuthnSession
+	loginAttempts    map[string]LoginAttempt
+	clientJWTs       map[string]time.Time
+
+	authorizationCodes *memoryTable
+	accessTokens       *memoryTable
+	refreshTokens      *memoryTable
+	pkces              *memoryTable
+}
+
+// NewMemoryStore returns an empty in-memory store. Clients and users can be
+// declared in the bootstrap file.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		clients:          make(map[string]Client),
+		users:            make(map[string]User),
+		credentials:      make(map[string]WebAuthnCredential),
+		passwordHistory:  make(map[string][]PasswordHistory),
+		userRoles:        make(map[string][]string),
+		scopes:           make(map[string]Scope),
+		roles:            make(map[string]Role),
+		userTokens:       make(map[string]UserToken),
+		webAuthnSessions: make(map[string]WebAuthnSession),
+		loginAttempts:    make(map[string]LoginAttempt),
+		clientJWTs:       make(map[string]time.Time),
+
+		authorizationCodes: newMemoryTable("authorization_codes"),
+		accessTokens:       newMemoryTable("access_tokens"),
+		refreshTokens:      newMemoryTable("refresh_tokens"),
+		pkces:              newMemoryTable("pkces"),
+	}
+}
+
+// Close releases nothing, it only completes the Storage interface.
+func (m *MemoryStore) Close() error {
+	return nil
+}
+
+// BeginTX waits for any other transaction to finish and returns a context
+// carrying a new one.
+func (m *MemoryStore) BeginTX(ctx context.Context) (context.Context, error) {
+	if _, ok := ctx.Value(memoryTransactionKey{}).(*memoryTransaction); ok {
+		return ctx, errors.New("a transaction is already in progress")
+	}
+
+	m.txMu.Lock()
+
+	return context.WithValue(ctx, memoryTransactionKey{}, &memoryTransaction{}), nil
+}
+
+// Commit keeps the changes made in the transaction carried by the context.
+func (m *MemoryStore) Commit(ctx context.Context) error {
+	tx, ok := ctx.Value(memoryTransactionKey{}).(*memoryTransaction)
+	if !ok || tx.done {
+		return ErrNoTransaction
+	}
+
+	tx.done = true
+	m.txMu.Unlock()
+
+	return nil
+}
+
+// Rollback undoes the changes made in the transaction carried by the context.
+func (m *MemoryStore) Rollback(ctx context.Context) error {
+	tx, ok := ctx.Value(memoryTransactionKey{}).(*memoryTransaction)
+	if !ok || tx.done {
+		return ErrNoTransaction
+	}
+
+	m.mu.Lock()
+	for i := len(tx.undo) - 1; i >= 0; i-- {
+		tx.undo[i]()
+	}
+	m.mu.Unlock()
+
+	tx.done = true
+	m.txMu.Unlock()
+
+	return nil
+}
+
+// write replaces the row of a signature, remembering the previous one when the
+// context carries a transaction. The caller must hold m.mu.
+func (m *MemoryStore) write(ctx context.Context, table *memoryTable, signature string, row *memoryRow) {
+	if tx, ok := ctx.Value(memoryTransactionKey{}).(*memoryTransaction); ok {
+		previous := table.rows[signature]
+		tx.undo = append(tx.undo, func() { table.set(signature, previous) })
+	}
+
+	table.set(signature, row)
+}
+
+// putEntry sets an entry of a map, remembering the previous one when the context
+// carries a transaction. The caller must hold m.mu.
+func putEntry[K comparable, V any](ctx context.Context, entries map[K]V, key K, value V) {
+	rememberEntry(ctx, entries, key)
+	entries[key] = value
+}
+
+// deleteEntry deletes an entry of a map, remembering it when the context carries
+// a transaction. The caller must hold m.mu.
+func deleteEntry[K comparable, V any](ctx context.Context, entries map[K]V, key K) {
+	rememberEntry(ctx, entries, key)
+	delete(entries, key)
+}
+
+func rememberEntry[K comparable, V any](ctx context.Context, entries map[K]V, key K) {
+	tx, ok := ctx.Value(memoryTransactionKey{}).(*memoryTransaction)
+	if !ok {
+		return
+	}
+
+	previous, existed := entries[key]
+	tx.undo = append(tx.undo, func() {
+		if existed {
+			entries[key] = previous
+		} else {
+			delete(entries, key)
+		}
+	})
+}
+
+// cloneRequest copies a request, so that changes made by fosite to the request
+// or its session do not leak into the store and vice versa.
+func cloneRequest(request fosite.Requester) *fosite.Request {
+	form := make(url.Values, len(request.GetRequestForm()))
+	for key, values := range request.GetRequestForm() {
+		form[key] = append([]string(nil), values...)
+	}
+
+	var session fosite.Session
+	if request.GetSession() != nil {
+		session = request.GetSession().Clone()
+	}
+
+	return &fosite.Request{
+		ID:                request.GetID(),
+		RequestedAt:       request.GetRequestedAt(),
+		Client:            request.GetClient(),
+		RequestedScope:    append(fosite.Arguments(nil), request.GetRequestedScopes()...),
+		GrantedScope:      append(fosite.Arguments(nil), request.GetGrantedScopes()...),
+		Form:              form,
+		Session:           session,
+		RequestedAudience: append(fosite.Arguments(nil), request.GetRequestedAudience()...),
+		GrantedAudience:   append(fosite.Arguments(nil), request.GetGrantedAudience()...),
+	}
+}
+
+// create stores a code or token for a request.
+func (m *MemoryStore) create(ctx context.Context, table *memoryTable, signature string, request fosite.Requester, tokenType fosite.TokenType) {
+	session := request.GetSession().(*Session)
+
+	row := &memoryRow{
+		id:        uuid.NewString(),
+		active:    true,
+		request:   cloneRequest(request),
+		expiresAt: expiresAt(session, tokenType),
+		updatedAt: time.Now(),
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.write(ctx, table, signature, row)
+}
+
+// find returns the code or token with a signature. The request is a copy that
+// carries the current client and user, as if it was loaded from the database.
+func (m *MemoryStore) find(table *memoryTable, signature string) (*fosite.Request, bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	row, ok := table.rows[signature]
+	if !ok {
+		return nil, false, fosite.ErrNotFound
+	}
+
+	request := cloneRequest(row.request)
+
+	if request.Client != nil {
+		if client, ok := m.clients[request.Client.GetID()]; ok {
+			request.Client = client
+		}
+	}
+
+	if session, ok := request.Session.(*Session); ok {
+		if user, ok := m.users[session.UserID]; ok {
+			session.User = user
+		}
+	}
+
+	return request, row.active, nil
+}
+
+// remove deletes the code or token with a signature, if there is one.
+func (m *MemoryStore) remove(ctx context.Context, table *memoryTable, signature string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := table.rows[signature]; ok {
+		m.write(ctx, table, signature, nil)
+	}
+}
+
+// revoke deactivates the active codes and tokens a function matches and returns
+// how many were revoked by table.
+func (m *MemoryStore) revoke(ctx context.Context, match func(row *memoryRow) bool) map[string]int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	counts := make(map[string]int64)
+
+	for _, table := range []*memoryTable{m.authorizationCodes, m.accessTokens, m.refreshTokens, m.pkces} {
+		counts[table.name] = 0
+
+		for signature, row := range table.rows {
+			if !row.active || !match(row) {
+				continue
+			}
+
+			updated := *row
+			updated.active = false
+			updated.updatedAt = now
+
+			m.write(ctx, table, signature, &updated)
+			counts[table.name]++
+		}
+	}
+
+	return counts
+}
+
+// GetClient loads an active client by its ID.
+func (m *MemoryStore) GetClient(ctx context.Context, id string) (fosite.Client, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	client, ok := m.clients[id]
+	if !ok || !client.Active {
+		return nil, fosite.ErrNotFound
+	}
+
+	return client, nil
+}
+
+// GetClientByID loads a client by its ID, whether or not it is active.
+func (m *MemoryStore) GetClientByID(ctx context.Context, id string) (*Client, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	client, ok := m.clients[id]
+	if !ok {
+		return nil, fosite.ErrNotFound
+	}
+
+	return &client, nil
+}
+
+// ListClients returns a page of the clients matching a filter, ordered by ID,
+// and how many clients match in total.
+func (m *MemoryStore) ListClients(ctx context.Context, filter ClientFilter) ([]Client, int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var matches []Client
+
+	for _, client := range m.clients {
+		if filter.Search != "" && !strings.Contains(client.ID, filter.Search) {
+			continue
+		}
+
+		if filter.Active != nil && client.Active != *filter.Active {
+			continue
+		}
+
+		if filter.Public != nil && client.Public != *filter.Public {
+			continue
+		}
+
+		if filter.GrantType != "" && !fosite.Arguments(client.Grants).Has(filter.GrantType) {
+			continue
+		}
+
+		matches = append(matches, client)
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].ID < matches[j].ID
+	})
+
+	total := int64(len(matches))
+
+	if filter.Offset > 0 {
+		if filter.Offset >= len(matches) {
+			return nil, total, nil
+		}
+
+		matches = matches[filter.Offset:]
+	}
+
+	if filter.Limit > 0 && filter.Limit < len(matches) {
+		matches = matches[:filter.Limit]
+	}
+
+	return matches, total, nil
+}
+
+// CreateClient registers a new client. The client's secret must already be hashed.
+func (m *MemoryStore) CreateClient(ctx context.Context, client *Client) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.clients[client.ID]; ok {
+		return ErrClientExists
+	}
+
+	now := time.Now()
+	client.CreatedAt, client.UpdatedAt = now, now
+	putEntry(ctx, m.clients, client.ID, *client)
+
+	return nil
+}
+
+// UpdateClient saves every field of an existing client.
+func (m *MemoryStore) UpdateClient(ctx context.Context, client *Client) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	existing, ok := m.clients[client.ID]
+	if !ok {
+		return fosite.ErrNotFound
+	}
+
+	client.CreatedAt = existing.CreatedAt
+	client.UpdatedAt = time.Now()
+	putEntry(ctx, m.clients, client.ID, *client)
+
+	return nil
+}
+
+// DeleteClient revokes every token issued to a client and removes it.
+func (m *MemoryStore) DeleteClient(ctx context.Context, id string) error {
+	if err := m.RevokeClientTokens(ctx, id); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.clients[id]; !ok {
+		return fosite.ErrNotFound
+	}
+
+	deleteEntry(ctx, m.clients, id)
+
+	return nil
+}
+
+// ClientAssertionJWTValid returns an error if the JTI is known and nil otherwise.
+func (m *MemoryStore) ClientAssertionJWTValid(ctx context.Context, jti string) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if exp, ok := m.clientJWTs[jti]; ok && exp.After(time.Now()) {
+		return fosite.ErrJTIKnown
+	}
+
+	return nil
+}
+
+// SetClientAssertionJWT marks a JTI as known until it expires.
+func (m *MemoryStore) SetClientAssertionJWT(ctx context.Context, jti string, exp time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if known, ok := m.clientJWTs[jti]; ok && known.After(time.Now()) {
+		return fosite.ErrJTIKnown
+	}
+
+	putEntry(ctx, m.clientJWTs, jti, exp)
+
+	return nil
+}
+
+func (m *MemoryStore) CreateAuthorizeCodeSession(ctx context.Context, code string, request fosite.Requester) error {
+	m.create(ctx, m.authorizationCodes, code, request, fosite.AuthorizeCode)
+	return nil
+}
+
+func (m *MemoryStore) GetAuthorizeCodeSession(ctx context.Context, code string, session fosite.Session) (fosite.Requester, error) {
+	request, active, err := m.find(m.authorizationCodes, code)
+	if err != nil {
+		return nil, err
+	}
+
+	if !active {
+		return request, fosite.ErrInvalidatedAuthorizeCode
+	}
+
+	return request, nil
+}
+
+func (m *MemoryStore) InvalidateAuthorizeCodeSession(ctx context.Context, code string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	row, ok := m.authorizationCodes.rows[code]
+	if !ok {
+		return fosite.ErrNotFound
+	}
+
+	updated := *row
+	updated.active = false
+	updated.updatedAt = time.Now()
+
+	m.write(ctx, m.authorizationCodes, code, &updated)
+
+	return nil
+}
+
+func (m *MemoryStore) CreateAccessTokenSession(ctx context.Context, signature string, request fosite.Requester) error {
+	m.create(ctx, m.accessTokens, signature, request, fosite.AccessToken)
+	return nil
+}
+
+func (m *MemoryStore) GetAccessTokenSession(ctx context.Context, signature string, session fosite.Session) (fosite.Requester, error) {
+	request, active, err := m.find(m.accessTokens, signature)
+	if err != nil {
+		return nil, err
+	}
+
+	if !active {
+		return request, fosite.ErrInactiveToken
+	}
+
+	return request, nil
+}
+
+func (m *MemoryStore) DeleteAccessTokenSession(ctx context.Context, signature string) error {
+	m.remove(ctx, m.accessTokens, signature)
+	return nil
+}
+
+func (m *MemoryStore) CreateRefreshTokenSession(ctx context.Context, signature string, request fosite.Requester) error {
+	m.create(ctx, m.refreshTokens, signature, request, fosite.RefreshToken)
+	return nil
+}
+
+func (m *MemoryStore) GetRefreshTokenSession(ctx context.Context, signature string, session fosite.Session) (fosite.Requester, error) {
+	request, active, err := m.find(m.refreshTokens, signature)
+	if err != nil {
+		return nil, err
+	}
+
+	if !active {
+		return request, fosite.ErrInactiveToken
+	}
+
+	return request, nil
+}
+
+func (m *MemoryStore) DeleteRefreshTokenSession(ctx context.Context, signature string) error {
+	m.remove(ctx, m.refreshTokens, signature)
+	return nil
+}
+
+// RevokeRefreshToken revokes the whole grant of a refresh token, see RevokeGrant.
+func (m *MemoryStore) RevokeRefreshToken(ctx context.Context, requestID string) error {
+	return m.RevokeGrant(ctx, requestID)
+}
+
+// RevokeRefreshTokenMaybeGracePeriod revokes the whole grant of a refresh token
+// straight away, there is no grace period and the signature is ignored.
+func (m *MemoryStore) RevokeRefreshTokenMaybeGracePeriod(ctx context.Context, requestID string, signature string) error {
+	return m.RevokeGrant(ctx, requestID)
+}
+
+// RevokeAccessToken revokes the whole grant of an access token, see RevokeGrant.
+func (m *MemoryStore) RevokeAccessToken(ctx context.Context, requestID string) error {
+	return m.RevokeGrant(ctx, requestID)
+}
+
+// RevokeGrant deactivates the authorization code and every access and refresh
+// token issued for an authorization request. Revoking an unknown grant is not
+// an error.
+func (m *MemoryStore) RevokeGrant(ctx context.Context, requestID string) error {
+	m.revoke(ctx, func(row *memoryRow) bool {
+		return row.request.GetID() == requestID
+	})
+
+	return nil
+}
+
+// RevokeClientTokens deactivates every authorization code, access token and
+// refresh token issued to a client.
+func (m *MemoryStore) RevokeClientTokens(ctx context.Context, clientID string) error {
+	m.revoke(ctx, func(row *memoryRow) bool {
+		return row.request.GetClient() != nil && row.request.GetClient().GetID() == clientID
+	})
+
+	return nil
+}
+
+// ListTokens returns a page of the access and refresh tokens matching a filter,
+// newest first, and how many tokens match in total.
+func (m *MemoryStore) ListTokens(ctx context.Context, filter TokenFilter) ([]TokenInfo, int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	now := time.Now()
+
+	var tokens []TokenInfo
+
+	for _, tokenType := range filter.tokenTypes() {
+		table := m.accessTokens
+		if tokenType == fosite.RefreshToken {
+			table = m.refreshTokens
+		}
+
+		for _, row := range table.rows {
+			token := row.info(tokenType)
+
+			if !filter.matches(token) {
+				continue
+			}
+
+			if filter.ActiveOnly && (!row.active || (row.expiresAt != nil && row.expiresAt.Before(now))) {
+				continue
+			}
+
+			tokens = append(tokens, token)
+		}
+	}
+
+	return pageTokens(tokens, filter), int64(len(tokens)), nil
+}
+
+// RevokeTokens deactivates the authorization codes, access tokens, refresh tokens
+// and PKCE requests matching a filter, whatever its type, and returns how many
+// were revoked by table.
+func (m *MemoryStore) RevokeTokens(ctx context.Context, filter TokenFilter) (map[string]int64, error) {
+	return m.revoke(ctx, func(row *memoryRow) bool {
+		return filter.matches(row.info(""))
+	}), nil
+}
+
+func (m *MemoryStore) CreatePKCERequestSession(ctx context.Context, signature string, requester fosite.Requester) error {
+	m.create(ctx, m.pkces, signature, requester, fosite.AuthorizeCode)
+	return nil
+}
+
+func (m *MemoryStore) GetPKCERequestSession(ctx context.Context, signature string, session fosite.Session) (fosite.Requester, error) {
+	request, _, err := m.find(m.pkces, signature)
+	if err != nil {
+		return nil, err
+	}
+
+	return request, nil
+}
+
+func (m *MemoryStore) DeletePKCERequestSession(ctx context.Context, signature string) error {
+	m.remove(ctx, m.pkces, signature)
+	return nil
+}
+
+func (m *MemoryStore) Authenticate(ctx context.Context, name string, secret string) error {
+	m.mu.RLock()
+	user, ok := m.userByUsername(name)
+	m.mu.RUnlock()
+
+	if !ok {
+		// compare against a dummy hash so that unknown usernames take as long as wrong passwords
+		_ = bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(secret))
+		return fosite.ErrNotFound
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(secret)); err != nil {
+		return fosite.ErrNotFound.WithDebug("Invalid credentials")
+	}
+
+	return CheckUserCanLogin(user)
+}
+
+// userByUsername finds a user by their username. The caller must hold m.mu.
+func (m *MemoryStore) userByUsername(username string) (User, bool) {
+	for _, user := range m.users {
+		if user.Username == username {
+			return user, true
+		}
+	}
+
+	return User{}, false
+}
+
+// withCredentials returns a copy of a user together with their passkeys. The
+// caller must hold m.mu.
+func (m *MemoryStore) withCredentials(user User) *User {
+	user.Credentials = nil
+
+	for _, credential := range m.credentials {
+		if credential.UserID == user.ID {
+			user.Credentials = append(user.Credentials, credential)
+		}
+	}
+
+	sort.Slice(user.Credentials, func(i, j int) bool {
+		return user.Credentials[i].CreatedAt.Before(user.Credentials[j].CreatedAt)
+	})
+
+	return &user
+}
+
+func (m *MemoryStore) GetUser(ctx context.Context, username string) (*User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	user, ok := m.userByUsername(username)
+	if !ok {
+		return nil, fosite.ErrNotFound
+	}
+
+	return m.withCredentials(user), nil
+}
+
+// GetUserByID loads a user, together with their passkeys, by the user ID.
+func (m *MemoryStore) GetUserByID(ctx context.Context, id string) (*User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	user, ok := m.users[id]
+	if !ok {
+		return nil, fosite.ErrNotFound
+	}
+
+	return m.withCredentials(user), nil
+}
+
+// GetUserByEmail loads a user by their email address.
+func (m *MemoryStore) GetUserByEmail(ctx context.Context, email string) (*User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, user := range m.users {
+		if user.Email == email {
+			return &user, nil
+		}
+	}
+
+	return nil, fosite.ErrNotFound
+}
+
+// CreateUser registers a new user. The user's password must already be hashed.
+func (m *MemoryStore) CreateUser(ctx context.Context, user *User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, existing := range m.users {
+		if existing.Username == user.Username {
+			return ErrUsernameTaken
+		}
+
+		if user.Email != "" && existing.Email == user.Email {
+			return ErrEmailTaken
+		}
+	}
+
+	if user.ID == "" {
+		user.ID = uuid.NewString()
+	}
+
+	now := time.Now()
+	user.CreatedAt, user.UpdatedAt = now, now
+
+	stored := *user
+	stored.Credentials = nil
+	putEntry(ctx, m.users, user.ID, stored)
+
+	return nil
+}
+
+// MarkEmailVerified records that a user has confirmed their email address.
+func (m *MemoryStore) MarkEmailVerified(ctx context.Context, userID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[userID]
+	if !ok {
+		return nil
+	}
+
+	now := time.Now()
+	user.EmailVerified = true
+	user.EmailVerifiedAt = &now
+	user.UpdatedAt = now
+	putEntry(ctx, m.users, userID, user)
+
+	return nil
+}
+
+// PasswordReused reports whether a password matches the user's current password
+// or one of their previous `history` passwords.
+func (m *MemoryStore) PasswordReused(ctx context.Context, userID string, password string, history int) (bool, error) {
+	m.mu.RLock()
+	user, ok := m.users[userID]
+	previous := m.passwordHistory[userID]
+	m.mu.RUnlock()
+
+	if !ok {
+		return false, fosite.ErrNotFound
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)) == nil {
+		return true, nil
+	}
+
+	// the history is kept oldest first
+	for i := len(previous) - 1; i >= 0 && len(previous)-i <= history; i-- {
+		if bcrypt.CompareHashAndPassword([]byte(previous[i].Password), []byte(password)) == nil {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// SetUserPassword replaces a user's password hash, keeping the previous one in
+// their password history, and lifts any password reset required of the user.
+func (m *MemoryStore) SetUserPassword(ctx context.Context, userID string, password string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.setUserPassword(ctx, userID, password)
+}
+
+// setUserPassword replaces a user's password hash. The caller must hold m.mu.
+func (m *MemoryStore) setUserPassword(ctx context.Context, userID string, password string) error {
+	user, ok := m.users[userID]
+	if !ok {
+		return fosite.ErrNotFound
+	}
+
+	now := time.Now()
+
+	if user.Password != "" {
+		entry := PasswordHistory{
+			ID:       uuid.NewString(),
+			UserID:   userID,
+			Password: user.Password,
+		}
+		entry.CreatedAt = now
+
+		// the history slice is shared with readers, so it is never appended to in place
+		putEntry(ctx, m.passwordHistory, userID, append(append([]PasswordHistory(nil), m.passwordHistory[userID]...), entry))
+	}
+
+	user.Password = password
+	user.PasswordResetRequired = false
+	user.UpdatedAt = now
+	putEntry(ctx, m.users, userID, user)
+
+	return nil
+}
+
+// RevokeUserTokens deactivates every authorization code, access token and refresh
+// token issued to a user.
+func (m *MemoryStore) RevokeUserTokens(ctx context.Context, userID string) error {
+	m.revoke(ctx, func(row *memoryRow) bool {
+		session, ok := row.request.Session.(*Session)
+		return ok && session.UserID == userID
+	})
+
+	return nil
+}
+
+// ListUsers returns a page of the users matching a filter, ordered by username,
+// and how many users match in total.
+func (m *MemoryStore) ListUsers(ctx context.Context, filter UserFilter) ([]User, int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var matches []User
+
+	for _, user := range m.users {
+		if filter.Search != "" && !strings.Contains(user.Username, filter.Search) &&
+			!strings.Contains(user.Name, filter.Search) && !strings.Contains(user.Email, filter.Search) {
+			continue
+		}
+
+		if filter.Active != nil && user.Active != *filter.Active {
+			continue
+		}
+
+		if filter.Role != "" && !fosite.Arguments(m.userRoles[user.ID]).Has(filter.Role) {
+			continue
+		}
+
+		matches = append(matches, *m.withCredentials(user))
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].Username < matches[j].Username
+	})
+
+	total := int64(len(matches))
+
+	if filter.Offset > 0 {
+		if filter.Offset >= len(matches) {
+			return nil, total, nil
+		}
+
+		matches = matches[filter.Offset:]
+	}
+
+	if filter.Limit > 0 && filter.Limit < len(matches) {
+		matches = matches[:filter.Limit]
+	}
+
+	return matches, total, nil
+}
+
+// UpdateUser saves the profile and account state of an existing user. The
+// password is left alone, use SetUserPassword to change it.
+func (m *MemoryStore) UpdateUser(ctx context.Context, user *User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	existing, ok := m.users[user.ID]
+	if !ok {
+		return fosite.ErrNotFound
+	}
+
+	for _, other := range m.users {
+		if other.ID == user.ID {
+			continue
+		}
+
+		if other.Username == user.Username {
+			return ErrUsernameTaken
+		}
+
+		if user.Email != "" && other.Email == user.Email {
+			return ErrEmailTaken
+		}
+	}
+
+	existing.Name = user.Name
+	existing.Username = user.Username
+	existing.Email = user.Email
+	existing.EmailVerified = user.EmailVerified
+	existing.EmailVerifiedAt = user.EmailVerifiedAt
+	existing.Active = user.Active
+	existing.PasswordResetRequired = user.PasswordResetRequired
+	existing.UpdatedAt = time.Now()
+	putEntry(ctx, m.users, user.ID, existing)
+
+	user.UpdatedAt = existing.UpdatedAt
+
+	return nil
+}
+
+// DeleteUser revokes every token of a user and removes the user together with
+// their passkeys, roles and other records.
+func (m *MemoryStore) DeleteUser(ctx context.Context, id string) error {
+	m.mu.RLock()
+	_, ok := m.users[id]
+	m.mu.RUnlock()
+
+	if !ok {
+		return fosite.ErrNotFound
+	}
+
+	if err := m.RevokeUserTokens(ctx, id); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key, credential := range m.credentials {
+		if credential.UserID == id {
+			deleteEntry(ctx, m.credentials, key)
+		}
+	}
+
+	for key, token := range m.userTokens {
+		if token.UserID == id {
+			deleteEntry(ctx, m.userTokens, key)
+		}
+	}
+
+	deleteEntry(ctx, m.passwordHistory, id)
+	deleteEntry(ctx, m.userRoles, id)
+	deleteEntry(ctx, m.users, id)
+
+	return nil
+}
+
+// GetUserRoles returns the roles of a user in alphabetical order.
+func (m *MemoryStore) GetUserRoles(ctx context.Context, userID string) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return append([]string(nil), m.userRoles[userID]...), nil
+}
+
+// SetUserRoles replaces the roles of a user.
+func (m *MemoryStore) SetUserRoles(ctx context.Context, userID string, roles []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(roles) == 0 {
+		deleteEntry(ctx, m.userRoles, userID)
+		return nil
+	}
+
+	sorted := append([]string(nil), roles...)
+	sort.Strings(sorted)
+	putEntry(ctx, m.userRoles, userID, sorted)
+
+	return nil
+}
+
+// ListScopes returns the declared scopes by name.
+func (m *MemoryStore) ListScopes(ctx context.Context) ([]Scope, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	scopes := make([]Scope, 0, len(m.scopes))
+	for _, scope := range m.scopes {
+		scopes = append(scopes, scope)
+	}
+
+	sort.Slice(scopes, func(i, j int) bool { return scopes[i].Name < scopes[j].Name })
+
+	return scopes, nil
+}
+
+// SaveScope declares a scope, or updates the description of a declared one.
+func (m *MemoryStore) SaveScope(ctx context.Context, scope *Scope) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+
+	scope.CreatedAt, scope.UpdatedAt = now, now
+	if existing, ok := m.scopes[scope.Name]; ok {
+		scope.CreatedAt = existing.CreatedAt
+	}
+
+	putEntry(ctx, m.scopes, scope.Name, *scope)
+
+	return nil
+}
+
+// ListRoles returns the declared roles by name.
+func (m *MemoryStore) ListRoles(ctx context.Context) ([]Role, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	roles := make([]Role, 0, len(m.roles))
+	for _, role := range m.roles {
+		roles = append(roles, role)
+	}
+
+	sort.Slice(roles, func(i, j int) bool { return roles[i].Name < roles[j].Name })
+
+	return roles, nil
+}
+
+// SaveRole declares a role, or updates the description of a declared one.
+func (m *MemoryStore) SaveRole(ctx context.Context, role *Role) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+
+	role.CreatedAt, role.UpdatedAt = now, now
+	if existing, ok := m.roles[role.Name]; ok {
+		role.CreatedAt = existing.CreatedAt
+	}
+
+	putEntry(ctx, m.roles, role.Name, *role)
+
+	return nil
+}
+
+// CreateUserToken issues a single-use token for a user and returns its plaintext
+// value. The plaintext is not stored and cannot be recovered.
+func (m *MemoryStore) CreateUserToken(ctx context.Context, userID string, purpose string, lifespan time.Duration) (string, error) {
+	token, data, err := newUserToken(userID, purpose, lifespan)
+	if err != nil {
+		return "", err
+	}
+
+	data.CreatedAt = time.Now()
+
+	m.mu.Lock()
+	putEntry(ctx, m.userTokens, data.TokenHash, data)
+	m.mu.Unlock()
+
+	return token, nil
+}
+
+// GetUserToken returns a token that is still valid without using it up.
+func (m *MemoryStore) GetUserToken(ctx context.Context, purpose string, token string) (*UserToken, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	result, ok := m.userTokens[hashUserToken(token)]
+	if !ok || result.Purpose != purpose {
+		return nil, fosite.ErrNotFound
+	}
+
+	if result.UsedAt != nil || result.ExpiresAt.Before(time.Now()) {
+		return nil, fosite.ErrNotFound.WithDebug("the token has expired or was already used")
+	}
+
+	result.User = m.users[result.UserID]
+
+	return &result, nil
+}
+
+// ConsumeUserToken marks a token as used and returns it. Unknown, expired and
+// already used tokens return fosite.ErrNotFound.
+func (m *MemoryStore) ConsumeUserToken(ctx context.Context, purpose string, token string) (*UserToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	hash := hashUserToken(token)
+
+	result, ok := m.userTokens[hash]
+	if !ok || result.Purpose != purpose {
+		return nil, fosite.ErrNotFound
+	}
+
+	if result.UsedAt != nil || result.ExpiresAt.Before(time.Now()) {
+		return nil, fosite.ErrNotFound.WithDebug("the token has expired or was already used")
+	}
+
+	now := time.Now()
+	result.UsedAt = &now
+	putEntry(ctx, m.userTokens, hash, result)
+
+	return &result, nil
+}
+
+// ResetUserPassword uses up a password reset token and sets the password of its
+// user, both under one lock.
+func (m *MemoryStore) ResetUserPassword(ctx context.Context, token string, password string) (*UserToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	hash := hashUserToken(token)
+
+	result, ok := m.userTokens[hash]
+	if !ok || result.Purpose != UserTokenPasswordReset {
+		return nil, fosite.ErrNotFound
+	}
+
+	if result.UsedAt != nil || result.ExpiresAt.Before(time.Now()) {
+		return nil, fosite.ErrNotFound.WithDebug("the token has expired or was already used")
+	}
+
+	if err := m.setUserPassword(ctx, result.UserID, password); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	result.UsedAt = &now
+	putEntry(ctx, m.userTokens, hash, result)
+
+	return &result, nil
+}
+
+// CreateWebAuthnCredential stores a passkey that has completed the registration ceremony.
+func (m *MemoryStore) CreateWebAuthnCredential(ctx context.Context, userID string, credential *webauthn.Credential) error {
+	data := newWebAuthnCredential(userID, credential)
+	data.CreatedAt = time.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.credentials[data.ID]; ok {
+		return errors.New("error creating webauthn credential: the credential is already registered")
+	}
+
+	putEntry(ctx, m.credentials, data.ID, data)
+
+	return nil
+}
+
+// UpdateWebAuthnCredential records the authenticator state returned by a successful assertion.
+func (m *MemoryStore) UpdateWebAuthnCredential(ctx context.Context, credential *webauthn.Credential) error {
+	id := base64.RawURLEncoding.EncodeToString(credential.ID)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	data, ok := m.credentials[id]
+	if !ok {
+		return nil
+	}
+
+	now := time.Now()
+	data.SignCount = credential.Authenticator.SignCount
+	data.CloneWarning = credential.Authenticator.CloneWarning
+	data.BackupState = credential.Flags.BackupState
+	data.LastUsedAt = &now
+	putEntry(ctx, m.credentials, id, data)
+
+	return nil
+}
+
+// CreateWebAuthnSession keeps the state of a registration or login ceremony and
+// returns the identifier the browser uses to complete it.
+func (m *MemoryStore) CreateWebAuthnSession(ctx context.Context, session *webauthn.SessionData) (string, error) {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return "", fmt.Errorf("error marshalling webauthn session: %w", err)
+	}
+
+	result := WebAuthnSession{
+		ID:        uuid.NewString(),
+		Data:      data,
+		ExpiresAt: session.Expires,
+	}
+
+	m.mu.Lock()
+	putEntry(ctx, m.webAuthnSessions, result.ID, result)
+	m.mu.Unlock()
+
+	return result.ID, nil
+}
+
+// PopWebAuthnSession loads and removes the state of a ceremony so that a challenge
+// can only ever be answered once.
+func (m *MemoryStore) PopWebAuthnSession(ctx context.Context, id string) (*webauthn.SessionData, error) {
+	m.mu.Lock()
+	result, ok := m.webAuthnSessions[id]
+	deleteEntry(ctx, m.webAuthnSessions, id)
+	m.mu.Unlock()
+
+	if !ok {
+		return nil, fosite.ErrNotFound
+	}
+
+	if !result.ExpiresAt.IsZero() && result.ExpiresAt.Before(time.Now()) {
+		return nil, fosite.ErrNotFound.WithDebug("webauthn session has expired")
+	}
+
+	var session webauthn.SessionData
+	if err := json.Unmarshal(result.Data, &session); err != nil {
+		return nil, fmt.Errorf("error unmarshalling webauthn session: %w", err)
+	}
+
+	return &session, nil
+}
+
+// GetLoginAttempt returns the failed login record for a key. A key without
+// failures returns an empty record.
+func (m *MemoryStore) GetLoginAttempt(ctx context.Context, key string) (*LoginAttempt, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	attempt, ok := m.loginAttempts[key]
+	if !ok {
+		return &LoginAttempt{ID: key}, nil
+	}
+
+	return &attempt, nil
+}
+
+// UpdateLoginAttempt loads the failed login record for a key, lets update change
+// it and saves the result while holding the store's lock. update returns false to
+// leave the record unchanged. A record left without failures is deleted.
+func (m *MemoryStore) UpdateLoginAttempt(ctx context.Context, key string, update func(attempt *LoginAttempt) bool) (*LoginAttempt, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	attempt, ok := m.loginAttempts[key]
+	if !ok {
+		attempt = LoginAttempt{ID: key}
+	}
+
+	changed := update(&attempt)
+
+	switch {
+	case attempt.Failures == 0:
+		deleteEntry(ctx, m.loginAttempts, key)
+	case changed:
+		attempt.UpdatedAt = time.Now()
+		putEntry(ctx, m.loginAttempts, key, attempt)
+	}
+
+	return &attempt, nil
+}
+
+// ClearLoginAttempt forgets the failed logins recorded for a key.
+func (m *MemoryStore) ClearLoginAttempt(ctx context.Context, key string) error {
+	m.mu.Lock()
+	deleteEntry(ctx, m.loginAttempts, key)
+	m.mu.Unlock()
+
+	return nil
+}
+
+// PurgeExpired deletes expired and invalidated codes and tokens under the same
+// policy as the database store. Deleted codes and tokens are removed straight
+// away, and sessions live inside them, so neither needs separate purging.
+func (m *MemoryStore) PurgeExpired(ctx context.Context, policy PurgePolicy) (map[string]int64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	cutoff := time.Now().Add(-policy.Retention)
+	refreshCutoff := cutoff.Add(-policy.RefreshTokenGracePeriod)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	purged := make(map[string]int64)
+
+	purgeTable := func(name string, table *memoryTable, cutoff time.Time, inactive bool) {
+		for signature, row := range table.rows {
+			expired := row.expiresAt != nil && row.expiresAt.Before(cutoff)
+			invalidated := inactive && !row.active && row.updatedAt.Before(cutoff)
+
+			if expired || invalidated {
+				m.write(ctx, table, signature, nil)
+				purged[name]++
+			}
+		}
+	}
+
+	purgeTable("authorization_codes", m.authorizationCodes, cutoff, false)
+	purgeTable("pkces", m.pkces, cutoff, false)
+	purgeTable("access_tokens", m.accessTokens, cutoff, true)
+	purgeTable("refresh_tokens", m.refreshTokens, refreshCutoff, true)
+
+	for jti, exp := range m.clientJWTs {
+		if exp.Before(cutoff) {
+			deleteEntry(ctx, m.clientJWTs, jti)
+			purged["client_jwts"]++
+		}
+	}
+
+	for id, session := range m.webAuthnSessions {
+		if session.ExpiresAt.Before(cutoff) {
+			deleteEntry(ctx, m.webAuthnSessions, id)
+			purged["webauthn_sessions"]++
+		}
+	}
+
+	for hash, token := range m.userTokens {
+		if token.ExpiresAt.Before(cutoff) {
+			deleteEntry(ctx, m.userTokens, hash)
+			purged["user_tokens"]++
+		}
+	}
+
+	return purged, nil
+}
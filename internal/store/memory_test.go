@@ -0,0 +1,45 @@
+package store_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/Muchogoc/go-oauth2-server/internal/store"
+	"github.com/Muchogoc/go-oauth2-server/internal/store/storetest"
+	"github.com/ory/fosite"
+)
+
+func TestMemoryStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.Storage {
+		return store.NewMemoryStore()
+	})
+}
+
+// The memory store runs one transaction at a time but does not isolate it:
+// reads made outside the transaction see its changes before it commits, and a
+// rollback takes them back.
+func TestMemoryTransactionsAreNotIsolated(t *testing.T) {
+	s := store.NewMemoryStore()
+
+	ctx, err := s.BeginTX(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.CreateUser(ctx, &store.User{Username: "alice", Active: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.GetUser(context.Background(), "alice"); err != nil {
+		t.Errorf("a user created in a transaction is not visible outside it: %v", err)
+	}
+
+	if err := s.Rollback(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.GetUser(context.Background(), "alice"); !errors.Is(err, fosite.ErrNotFound) {
+		t.Errorf("a user created in a rolled back transaction returned %v, want fosite.ErrNotFound", err)
+	}
+}
@@ -0,0 +1,350 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/Muchogoc/go-oauth2-server/config"
+	"github.com/Muchogoc/go-oauth2-server/log"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// ErrMigrationLocked is returned when another process holds the migration lock
+// for longer than we are prepared to wait.
+var ErrMigrationLocked = errors.New("migrations are locked by another process")
+
+// migrationLockTimeout is how long a lock may go without a heartbeat before it is
+// assumed that its owner crashed and the lock can be taken over.
+const migrationLockTimeout = 10 * time.Minute
+
+// migrationLockHeartbeat is how often the owner of the lock refreshes it while
+// migrating, well within migrationLockTimeout.
+const migrationLockHeartbeat = time.Minute
+
+// Migration is a single versioned change to the database schema. Each step runs
+// in its own transaction. Note that MySQL commits DDL statements implicitly, so a
+// failing step may be left partially applied there.
+type Migration struct {
+	// Version orders the migrations and is recorded once the migration is applied
+	Version     string
+	Description string
+	Up          func(tx *gorm.DB) error
+	// Down is nil for a migration that cannot be rolled back
+	Down func(tx *gorm.DB) error
+}
+
+// MigrationStatus reports whether a migration has been applied.
+type MigrationStatus struct {
+	Version      string
+	Description  string
+	AppliedAt    *time.Time
+	Irreversible bool
+}
+
+type schemaMigration struct {
+	Version     string `gorm:"primarykey"`
+	Description string
+	AppliedAt   time.Time
+}
+
+func (schemaMigration) TableName() string {
+	return "schema_migrations"
+}
+
+// migrationLock is a single row table. Inserting the row takes the lock, so only
+// one replica can migrate at a time whatever the database.
+type migrationLock struct {
+	ID       int `gorm:"primarykey;autoIncrement:false"`
+	Owner    string
+	LockedAt time.Time
+}
+
+func (migrationLock) TableName() string {
+	return "schema_migrations_lock"
+}
+
+// Migrator applies and rolls back the schema migrations.
+type Migrator struct {
+	db         *gorm.DB
+	migrations []Migration
+	owner      string
+
+	heartbeatInterval time.Duration
+	// stopHeartbeat stops refreshing the lock and waits until it is no longer
+	// being refreshed
+	stopHeartbeat func()
+}
+
+// NewMigrator returns a migrator for the migrations known to this build. Data
+// migrations read the keys they need from the configuration.
+func NewMigrator(db *gorm.DB, cfg config.Provider) *Migrator {
+	hostname, _ := os.Hostname()
+
+	return &Migrator{
+		db:         db,
+		migrations: migrations(cfg),
+		owner:      fmt.Sprintf("%s:%d", hostname, os.Getpid()),
+
+		heartbeatInterval: migrationLockHeartbeat,
+	}
+}
+
+// lock waits until the migration lock is acquired or the context is done.
+func (m *Migrator) lock(ctx context.Context) error {
+	if err := m.db.AutoMigrate(&migrationLock{}); err != nil {
+		return fmt.Errorf("failed to create migration lock table: %w", err)
+	}
+
+	for {
+		// a held lock makes the insert fail, which is expected and not worth logging
+		quiet := m.db.Session(&gorm.Session{Logger: logger.Default.LogMode(logger.Silent)})
+
+		lock := migrationLock{ID: 1, Owner: m.owner, LockedAt: time.Now()}
+		if err := quiet.Create(&lock).Error; err == nil {
+			m.heartbeat()
+			return nil
+		}
+
+		// take over locks left behind by a process that died mid-migration
+		stale := m.db.Where("id = ? AND locked_at < ?", 1, time.Now().Add(-migrationLockTimeout)).Delete(&migrationLock{})
+		if stale.Error != nil {
+			return fmt.Errorf("failed to acquire migration lock: %w", stale.Error)
+		}
+
+		if stale.RowsAffected > 0 {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return ErrMigrationLocked
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// heartbeat refreshes the lock until unlock, so that a long migration is not
+// mistaken for a crashed one and taken over by another replica.
+func (m *Migrator) heartbeat() {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	m.stopHeartbeat = func() {
+		cancel()
+		<-done
+	}
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(m.heartbeatInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			// a refresh is never interrupted, which could leave its connection in a
+			// transaction, so unlock waits for it instead
+			refreshed := m.db.Model(&migrationLock{}).Where("id = ? AND owner = ?", 1, m.owner).Update("locked_at", time.Now())
+			if refreshed.Error != nil {
+				log.Errorf("failed to refresh the migration lock: %v", refreshed.Error)
+				continue
+			}
+
+			if refreshed.RowsAffected == 0 {
+				log.Errorf("the migration lock held by %s was taken over by another process", m.owner)
+				return
+			}
+		}
+	}()
+}
+
+// release releases the migration lock, logging a failure to do so: the lock is
+// then only taken over once it is migrationLockTimeout old.
+func (m *Migrator) release() {
+	if err := m.unlock(); err != nil {
+		log.Errorf("%v, other processes can migrate once it is %s old", err, migrationLockTimeout)
+	}
+}
+
+func (m *Migrator) unlock() error {
+	if m.stopHeartbeat != nil {
+		m.stopHeartbeat()
+		m.stopHeartbeat = nil
+	}
+
+	if err := m.db.Where("id = ? AND owner = ?", 1, m.owner).Delete(&migrationLock{}).Error; err != nil {
+		return fmt.Errorf("failed to release migration lock: %w", err)
+	}
+
+	return nil
+}
+
+// applied returns the recorded migrations keyed by version.
+func (m *Migrator) applied() (map[string]schemaMigration, error) {
+	if err := m.db.AutoMigrate(&schemaMigration{}); err != nil {
+		return nil, fmt.Errorf("failed to create migrations table: %w", err)
+	}
+
+	var rows []schemaMigration
+	if err := m.db.Find(&rows).Error; err != nil {
+		return nil, fmt.Errorf("error fetching applied migrations: %w", err)
+	}
+
+	result := make(map[string]schemaMigration, len(rows))
+	for _, row := range rows {
+		result[row.Version] = row
+	}
+
+	return result, nil
+}
+
+// Status lists every known migration and when it was applied.
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+
+	var result []MigrationStatus
+
+	for _, migration := range m.migrations {
+		status := MigrationStatus{
+			Version:      migration.Version,
+			Description:  migration.Description,
+			Irreversible: migration.Down == nil,
+		}
+
+		if row, ok := applied[migration.Version]; ok {
+			appliedAt := row.AppliedAt
+			status.AppliedAt = &appliedAt
+		}
+
+		result = append(result, status)
+	}
+
+	return result, nil
+}
+
+// Pending returns the migrations that have not been applied yet.
+func (m *Migrator) Pending(ctx context.Context) ([]Migration, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+
+	var pending []Migration
+
+	for _, migration := range m.migrations {
+		if _, ok := applied[migration.Version]; !ok {
+			pending = append(pending, migration)
+		}
+	}
+
+	return pending, nil
+}
+
+// Up applies every pending migration in order and returns how many were applied.
+func (m *Migrator) Up(ctx context.Context) (int, error) {
+	if err := m.lock(ctx); err != nil {
+		return 0, err
+	}
+	defer m.release()
+
+	// another replica may have migrated while we waited for the lock
+	pending, err := m.Pending(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	for i, migration := range pending {
+		err := m.db.Transaction(func(tx *gorm.DB) error {
+			if err := migration.Up(tx); err != nil {
+				return err
+			}
+
+			return tx.Create(&schemaMigration{
+				Version:     migration.Version,
+				Description: migration.Description,
+				AppliedAt:   time.Now(),
+			}).Error
+		})
+		if err != nil {
+			return i, fmt.Errorf("migration %s failed: %w", migration.Version, err)
+		}
+	}
+
+	return len(pending), nil
+}
+
+// Down rolls back the last `steps` applied migrations and returns how many were
+// rolled back. Nothing is rolled back when one of them is irreversible or not
+// known to this version.
+func (m *Migrator) Down(ctx context.Context, steps int) (int, error) {
+	if err := m.lock(ctx); err != nil {
+		return 0, err
+	}
+	defer m.release()
+
+	applied, err := m.applied()
+	if err != nil {
+		return 0, err
+	}
+
+	var versions []string
+	for version := range applied {
+		versions = append(versions, version)
+	}
+
+	sort.Sort(sort.Reverse(sort.StringSlice(versions)))
+
+	known := make(map[string]Migration, len(m.migrations))
+	for _, migration := range m.migrations {
+		known[migration.Version] = migration
+	}
+
+	if len(versions) > steps {
+		versions = versions[:steps]
+	}
+
+	for _, version := range versions {
+		migration, ok := known[version]
+		if !ok {
+			return 0, fmt.Errorf("migration %s is not known to this version and cannot be rolled back, nothing was rolled back", version)
+		}
+
+		if migration.Down == nil {
+			return 0, fmt.Errorf("migration %s (%s) is irreversible, nothing was rolled back", version, migration.Description)
+		}
+	}
+
+	count := 0
+
+	for _, version := range versions {
+		migration := known[version]
+
+		err := m.db.Transaction(func(tx *gorm.DB) error {
+			if err := migration.Down(tx); err != nil {
+				return err
+			}
+
+			return tx.Where("version = ?", version).Delete(&schemaMigration{}).Error
+		})
+		if err != nil {
+			return count, fmt.Errorf("rollback of migration %s failed: %w", version, err)
+		}
+
+		count++
+	}
+
+	return count, nil
+}
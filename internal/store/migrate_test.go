@@ -0,0 +1,185 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Muchogoc/go-oauth2-server/config"
+	"github.com/spf13/viper"
+)
+
+// newMigratedStore returns a store on an in-memory SQLite database.
+func newMigratedStore(t *testing.T) (*Store, config.Provider) {
+	t.Helper()
+
+	v := config.LoadConfigProvider("GO-OAUTH2-SERVER-TEST").(*viper.Viper)
+	v.Set("loglevel", "error")
+	v.Set("database_driver", "sqlite")
+	v.Set("database_dsn", ":memory:")
+	v.Set("token_hash_pepper", "test-pepper")
+
+	s, err := NewStore(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { _ = s.Close() })
+
+	return s, v
+}
+
+func TestMigrationLockHeartbeat(t *testing.T) {
+	s, cfg := newMigratedStore(t)
+	ctx := context.Background()
+
+	owner := NewMigrator(s.db, cfg)
+	owner.heartbeatInterval = 10 * time.Millisecond
+
+	if err := owner.lock(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// a migration running for longer than the timeout
+	stale := time.Now().Add(-2 * migrationLockTimeout)
+	if err := s.db.Model(&migrationLock{}).Where("id = ?", 1).Update("locked_at", stale).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	other := NewMigrator(s.db, cfg)
+	other.owner = "other"
+
+	waitCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+
+	if err := other.lock(waitCtx); !errors.Is(err, ErrMigrationLocked) {
+		t.Fatalf("another migrator got %v, want ErrMigrationLocked", err)
+	}
+
+	if err := owner.unlock(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := other.lock(ctx); err != nil {
+		t.Fatalf("the released lock could not be taken: %v", err)
+	}
+
+	if err := other.unlock(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrationLockTakenOverWithoutHeartbeat(t *testing.T) {
+	s, cfg := newMigratedStore(t)
+	ctx := context.Background()
+
+	crashed := migrationLock{ID: 1, Owner: "crashed", LockedAt: time.Now().Add(-2 * migrationLockTimeout)}
+	if err := s.db.Create(&crashed).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	migrator := NewMigrator(s.db, cfg)
+	if err := migrator.lock(ctx); err != nil {
+		t.Fatalf("the lock of a crashed process was not taken over: %v", err)
+	}
+
+	if err := migrator.unlock(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInBatches(t *testing.T) {
+	s, _ := newMigratedStore(t)
+	ctx := context.Background()
+
+	defer func(size int) { migrationBatchSize = size }(migrationBatchSize)
+	migrationBatchSize = 2
+
+	for i := 0; i < 5; i++ {
+		if err := s.CreateClient(ctx, &Client{ID: fmt.Sprintf("client-%d", i), Active: true, Scopes: StringArray{"openid", "offline"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var batches, rows int
+
+	err := inBatches(s.db, "clients", []string{"scopes"}, func(batch []map[string]interface{}) error {
+		batches++
+		rows += len(batch)
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if batches != 3 || rows != 5 {
+		t.Errorf("read %d rows in %d batches, want 5 in 3", rows, batches)
+	}
+
+	// the string arrays of every batch are converted there and back
+	if err := convertStringArrays(false)(s.db); err != nil {
+		t.Fatal(err)
+	}
+
+	var joined []string
+	if err := s.db.Table("clients").Pluck("scopes", &joined).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	for _, scopes := range joined {
+		if scopes != "openid;offline" {
+			t.Fatalf("got scopes %q, want them joined with ;", scopes)
+		}
+	}
+
+	if err := convertStringArrays(true)(s.db); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		client, err := s.GetClient(ctx, fmt.Sprintf("client-%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if scopes := client.GetScopes(); len(scopes) != 2 || scopes[0] != "openid" || scopes[1] != "offline" {
+			t.Errorf("got scopes %q after converting back", scopes)
+		}
+	}
+}
+
+func TestDownRefusesIrreversibleMigrations(t *testing.T) {
+	s, cfg := newMigratedStore(t)
+	ctx := context.Background()
+
+	migrator := NewMigrator(s.db, cfg)
+
+	count, err := migrator.Down(ctx, 100)
+	if err == nil || !strings.Contains(err.Error(), "0007") {
+		t.Fatalf("rolling back everything returned %v, want an error naming 0007", err)
+	}
+
+	pending, err := migrator.Pending(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 0 || len(pending) != 0 {
+		t.Fatalf("%d migrations were rolled back before the irreversible one", len(pending))
+	}
+
+	// the migrations after it can still be rolled back and applied again
+	if count, err := migrator.Down(ctx, 3); err != nil || count != 3 {
+		t.Fatalf("rolled back %d migrations: %v", count, err)
+	}
+
+	if count, err := migrator.Up(ctx); err != nil || count != 3 {
+		t.Fatalf("applied %d migrations: %v", count, err)
+	}
+}
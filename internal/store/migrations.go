@@ -0,0 +1,629 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Muchogoc/go-oauth2-server/config"
+	"github.com/ory/fosite"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// migrations returns every schema migration in the order they are applied. A
+// migration must never be changed once released; add a new one instead. Each
+// migration declares its own copy of the tables it touches so that later changes
+// to the models do not alter what an old migration does.
+func migrations(cfg config.Provider) []Migration {
+	return []Migration{
+		{
+			Version:     "0001",
+			Description: "create the initial schema",
+			Up:          createInitialSchema,
+			Down: func(tx *gorm.DB) error {
+				return tx.Migrator().DropTable(
+					"password_histories", "user_tokens", "login_attempts", "webauthn_sessions",
+					"webauthn_credentials", "pkces", "refresh_tokens", "access_tokens",
+					"authorization_codes", "sessions", "client_jwts", "clients", "users",
+				)
+			},
+		},
+		{
+			Version:     "0002",
+			Description: "create user roles",
+			Up: func(tx *gorm.DB) error {
+				type userRole struct {
+					ID     int `gorm:"primarykey;autoIncrement"`
+					UserID string
+					RoleID string
+				}
+
+				return tx.Table("user_roles").AutoMigrate(&userRole{})
+			},
+			Down: func(tx *gorm.DB) error {
+				return tx.Migrator().DropTable("user_roles")
+			},
+		},
+		{
+			Version:     "0003",
+			Description: "record the expiry of codes and tokens",
+			Up:          addTokenExpiry,
+			Down: func(tx *gorm.DB) error {
+				for _, table := range []string{"authorization_codes", "access_tokens", "refresh_tokens", "pkces"} {
+					if err := tx.Table(table).Migrator().DropIndex(&tokenExpiry{}, "idx_"+table+"_expires_at"); err != nil {
+						return err
+					}
+
+					if err := tx.Table(table).Migrator().DropColumn(&tokenExpiry{}, "expires_at"); err != nil {
+						return err
+					}
+				}
+
+				return nil
+			},
+		},
+		{
+			Version:     "0004",
+			Description: "hash token signatures and authorization codes",
+			Up: func(tx *gorm.DB) error {
+				pepper, err := tokenPepper(cfg)
+				if err != nil {
+					return err
+				}
+
+				return hashTokenSignatures(pepper)(tx)
+			},
+			// irreversible, token signatures cannot be recovered from their hashes
+			Down: nil,
+		},
+		{
+			Version:     "0005",
+			Description: "encrypt request forms and session claims",
+			// without a key nothing is encrypted; `keys rotate` encrypts the
+			// existing rows once a key is configured
+			Up: func(tx *gorm.DB) error {
+				cipher, err := requiredCipher(cfg)
+				if err != nil {
+					return err
+				}
+
+				_, err = reencrypt(tx.Statement.Context, tx, cipher, true)
+				return err
+			},
+			Down: func(tx *gorm.DB) error {
+				cipher, err := newCipher(cfg)
+				if err != nil {
+					return err
+				}
+
+				_, err = reencrypt(tx.Statement.Context, tx, cipher, false)
+				return err
+			},
+		},
+		{
+			Version:     "0006",
+			Description: "store string arrays as JSON",
+			Up:          convertStringArrays(true),
+			Down:        convertStringArrays(false),
+		},
+		{
+			Version:     "0007",
+			Description: "record the grant of codes and tokens",
+			Up:          addTokenRequestID,
+			// irreversible, tokens of the same grant cannot share an ID again
+			Down: nil,
+		},
+		{
+			Version:     "0008",
+			Description: "let operators require a password reset",
+			Up: func(tx *gorm.DB) error {
+				return tx.Table("users").Migrator().AddColumn(&userPasswordReset{}, "PasswordResetRequired")
+			},
+			Down: func(tx *gorm.DB) error {
+				return tx.Table("users").Migrator().DropColumn(&userPasswordReset{}, "PasswordResetRequired")
+			},
+		},
+		{
+			Version:     "0009",
+			Description: "create the scope and role catalogs",
+			Up: func(tx *gorm.DB) error {
+				type catalogEntry struct {
+					Name        string `gorm:"primarykey"`
+					Description string
+					CreatedAt   time.Time
+					UpdatedAt   time.Time
+				}
+
+				if err := tx.Table("scopes").AutoMigrate(&catalogEntry{}); err != nil {
+					return err
+				}
+
+				return tx.Table("roles").AutoMigrate(&catalogEntry{})
+			},
+			Down: func(tx *gorm.DB) error {
+				return tx.Migrator().DropTable("roles", "scopes")
+			},
+		},
+		{
+			Version:     "0010",
+			Description: "let clients override token lifespans and refresh policy",
+			Up: func(tx *gorm.DB) error {
+				for _, field := range clientTokenPolicyFields {
+					if err := tx.Table("clients").Migrator().AddColumn(&clientTokenPolicy{}, field); err != nil {
+						return err
+					}
+				}
+
+				return nil
+			},
+			Down: func(tx *gorm.DB) error {
+				for _, field := range clientTokenPolicyFields {
+					if err := tx.Table("clients").Migrator().DropColumn(&clientTokenPolicy{}, field); err != nil {
+						return err
+					}
+				}
+
+				return nil
+			},
+		},
+	}
+}
+
+// migrationBatchSize is how many rows a data migration reads at a time, so that
+// large tables are never loaded whole.
+var migrationBatchSize = 500
+
+// inBatches passes the ID and columns of every row of a table to fn, a batch at a
+// time in the order of their IDs. fn may update the rows but not their IDs.
+func inBatches(tx *gorm.DB, table string, columns []string, fn func(rows []map[string]interface{}) error) error {
+	var last interface{}
+
+	for {
+		query := tx.Table(table).Select(append([]string{"id"}, columns...)).Order("id").Limit(migrationBatchSize)
+		if last != nil {
+			query = query.Where("id > ?", last)
+		}
+
+		var rows []map[string]interface{}
+		if err := query.Find(&rows).Error; err != nil {
+			return fmt.Errorf("error fetching %s: %w", table, err)
+		}
+
+		if len(rows) == 0 {
+			return nil
+		}
+
+		if err := fn(rows); err != nil {
+			return err
+		}
+
+		if len(rows) < migrationBatchSize {
+			return nil
+		}
+
+		last = rows[len(rows)-1]["id"]
+	}
+}
+
+// columnText returns the value of a text column read into a map, which drivers
+// return either as a string or as bytes.
+func columnText(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case []byte:
+		return string(v), true
+	default:
+		return "", false
+	}
+}
+
+// initialStringArray is the column type of the string arrays when the initial
+// schema was created, frozen so that changes to StringArray do not change it.
+type initialStringArray []string
+
+func (initialStringArray) GormDataType() string {
+	return "text"
+}
+
+// createInitialSchema creates the tables that used to be auto-migrated on startup.
+// It is safe to run against a database created that way.
+func createInitialSchema(tx *gorm.DB) error {
+	type token struct {
+		gorm.Model
+		ID                string `gorm:"primarykey"`
+		Active            bool
+		Signature         string `gorm:"unique"`
+		RequestedAt       time.Time
+		RequestedScopes   initialStringArray
+		GrantedScopes     initialStringArray
+		Form              datatypes.JSON
+		RequestedAudience initialStringArray
+		GrantedAudience   initialStringArray
+		ClientID          string
+		SessionID         string
+	}
+
+	type authorizationCode struct {
+		gorm.Model
+		ID                string `gorm:"primarykey"`
+		Active            bool
+		Code              string
+		RequestedAt       time.Time
+		RequestedScopes   initialStringArray
+		GrantedScopes     initialStringArray
+		Form              datatypes.JSON
+		RequestedAudience initialStringArray
+		GrantedAudience   initialStringArray
+		ClientID          string
+		SessionID         string
+	}
+
+	type client struct {
+		gorm.Model
+		ID                      string `gorm:"primarykey"`
+		Active                  bool
+		Secret                  string
+		RotatedSecrets          initialStringArray
+		Public                  bool
+		RedirectURIs            initialStringArray
+		Scopes                  initialStringArray
+		Audience                initialStringArray
+		Grants                  initialStringArray
+		ResponseTypes           initialStringArray
+		TokenEndpointAuthMethod string
+		RateLimit               float64
+		RateLimitBurst          int
+	}
+
+	type clientJWT struct {
+		gorm.Model
+		ID        string `gorm:"primarykey"`
+		Active    bool
+		JTI       string
+		ExpiresAt time.Time
+	}
+
+	type session struct {
+		gorm.Model
+		ID        string `gorm:"primarykey"`
+		ClientID  string
+		Username  string
+		Subject   string
+		ExpiresAt datatypes.JSON
+		Extra     datatypes.JSON
+		UserID    string
+	}
+
+	type user struct {
+		gorm.Model
+		ID              string `gorm:"primarykey"`
+		Active          bool
+		Name            string
+		Username        string `gorm:"unique"`
+		Password        string
+		Email           string `gorm:"index"`
+		EmailVerified   bool
+		EmailVerifiedAt *time.Time
+	}
+
+	type webAuthnCredential struct {
+		gorm.Model
+		ID              string `gorm:"primarykey"`
+		CredentialID    []byte
+		PublicKey       []byte
+		AttestationType string
+		Transport       initialStringArray
+		UserPresent     bool
+		UserVerified    bool
+		BackupEligible  bool
+		BackupState     bool
+		AAGUID          []byte
+		SignCount       uint32
+		CloneWarning    bool
+		Attachment      string
+		LastUsedAt      *time.Time
+		UserID          string
+	}
+
+	type webAuthnSession struct {
+		gorm.Model
+		ID        string `gorm:"primarykey"`
+		Data      datatypes.JSON
+		ExpiresAt time.Time
+	}
+
+	type loginAttempt struct {
+		gorm.Model
+		ID            string `gorm:"primarykey"`
+		Failures      int
+		LastFailureAt time.Time
+		LockedUntil   time.Time
+	}
+
+	type userToken struct {
+		gorm.Model
+		ID        string `gorm:"primarykey"`
+		Purpose   string
+		TokenHash string `gorm:"unique"`
+		ExpiresAt time.Time
+		UsedAt    *time.Time
+		UserID    string
+	}
+
+	type passwordHistory struct {
+		gorm.Model
+		ID       string `gorm:"primarykey"`
+		UserID   string `gorm:"index"`
+		Password string
+	}
+
+	tables := []struct {
+		name  string
+		model interface{}
+	}{
+		{"users", &user{}},
+		{"clients", &client{}},
+		{"client_jwts", &clientJWT{}},
+		{"sessions", &session{}},
+		{"authorization_codes", &authorizationCode{}},
+		{"access_tokens", &token{}},
+		{"refresh_tokens", &token{}},
+		{"pkces", &token{}},
+		{"webauthn_credentials", &webAuthnCredential{}},
+		{"webauthn_sessions", &webAuthnSession{}},
+		{"login_attempts", &loginAttempt{}},
+		{"user_tokens", &userToken{}},
+		{"password_histories", &passwordHistory{}},
+	}
+
+	for _, table := range tables {
+		if err := tx.Table(table.name).AutoMigrate(table.model); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type tokenExpiry struct {
+	ExpiresAt *time.Time
+}
+
+// addTokenExpiry adds an indexed expires_at column to the token tables and fills
+// it in from the session of every existing row.
+func addTokenExpiry(tx *gorm.DB) error {
+	tables := []struct {
+		name      string
+		tokenType fosite.TokenType
+	}{
+		{"authorization_codes", fosite.AuthorizeCode},
+		{"access_tokens", fosite.AccessToken},
+		{"refresh_tokens", fosite.RefreshToken},
+		{"pkces", fosite.AuthorizeCode},
+	}
+
+	for _, table := range tables {
+		if err := tx.Table(table.name).Migrator().AddColumn(&tokenExpiry{}, "ExpiresAt"); err != nil {
+			return err
+		}
+
+		index := "idx_" + table.name + "_expires_at"
+		if err := tx.Exec("CREATE INDEX ? ON ? (expires_at)", clause.Table{Name: index}, clause.Table{Name: table.name}).Error; err != nil {
+			return err
+		}
+
+		err := inBatches(tx, table.name, []string{"session_id"}, func(rows []map[string]interface{}) error {
+			var ids []string
+			for _, row := range rows {
+				if id, ok := columnText(row["session_id"]); ok {
+					ids = append(ids, id)
+				}
+			}
+
+			var sessions []struct {
+				ID        string
+				ExpiresAt datatypes.JSON
+			}
+
+			if err := tx.Table("sessions").Select("id", "expires_at").Where("id IN ?", ids).Find(&sessions).Error; err != nil {
+				return err
+			}
+
+			expiries := make(map[string]map[fosite.TokenType]time.Time, len(sessions))
+			for _, session := range sessions {
+				expiry := make(map[fosite.TokenType]time.Time)
+				if session.ExpiresAt != nil {
+					_ = json.Unmarshal(session.ExpiresAt, &expiry)
+				}
+
+				expiries[session.ID] = expiry
+			}
+
+			for _, row := range rows {
+				id, _ := columnText(row["session_id"])
+
+				exp, ok := expiries[id][table.tokenType]
+				if !ok || exp.IsZero() {
+					continue
+				}
+
+				if err := tx.Table(table.name).Where("id = ?", row["id"]).Update("expires_at", exp).Error; err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// hashTokenSignatures replaces the plaintext signatures and codes of existing rows
+// with their keyed hashes, and indexes the codes which are now looked up by hash.
+func hashTokenSignatures(pepper []byte) func(tx *gorm.DB) error {
+	return func(tx *gorm.DB) error {
+		columns := []struct {
+			table  string
+			column string
+		}{
+			{"authorization_codes", "code"},
+			{"access_tokens", "signature"},
+			{"refresh_tokens", "signature"},
+			{"pkces", "signature"},
+		}
+
+		for _, column := range columns {
+			err := inBatches(tx, column.table, []string{column.column}, func(rows []map[string]interface{}) error {
+				for _, row := range rows {
+					value, _ := columnText(row[column.column])
+
+					if err := tx.Table(column.table).Where("id = ?", row["id"]).Update(column.column, hashSignature(pepper, value)).Error; err != nil {
+						return err
+					}
+				}
+
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		return tx.Exec("CREATE INDEX ? ON ? (code)", clause.Table{Name: "idx_authorization_codes_code"}, clause.Table{Name: "authorization_codes"}).Error
+	}
+}
+
+// stringArrayColumns are the columns holding a StringArray.
+var stringArrayColumns = map[string][]string{
+	"clients":              {"rotated_secrets", "redirect_uris", "scopes", "audience", "grants", "response_types"},
+	"authorization_codes":  {"requested_scopes", "granted_scopes", "requested_audience", "granted_audience"},
+	"access_tokens":        {"requested_scopes", "granted_scopes", "requested_audience", "granted_audience"},
+	"refresh_tokens":       {"requested_scopes", "granted_scopes", "requested_audience", "granted_audience"},
+	"pkces":                {"requested_scopes", "granted_scopes", "requested_audience", "granted_audience"},
+	"webauthn_credentials": {"transport"},
+}
+
+// convertStringArrays rewrites string arrays joined with ";" as JSON arrays, or
+// back again. An empty joined value is an empty array, not one empty string.
+func convertStringArrays(toJSON bool) func(tx *gorm.DB) error {
+	return func(tx *gorm.DB) error {
+		for table, columns := range stringArrayColumns {
+			table, columns := table, columns
+
+			err := inBatches(tx, table, columns, func(rows []map[string]interface{}) error {
+				for _, row := range rows {
+					updates := make(map[string]interface{}, len(columns))
+
+					for _, column := range columns {
+						if row[column] == nil {
+							continue
+						}
+
+						value, ok := columnText(row[column])
+						if !ok {
+							return fmt.Errorf("unexpected value in %s.%s: %v", table, column, row[column])
+						}
+
+						converted, err := convertStringArray(value, toJSON)
+						if err != nil {
+							return fmt.Errorf("failed to convert %s.%s of %v: %w", table, column, row["id"], err)
+						}
+
+						updates[column] = converted
+					}
+
+					if len(updates) == 0 {
+						continue
+					}
+
+					if err := tx.Table(table).Where("id = ?", row["id"]).Updates(updates).Error; err != nil {
+						return fmt.Errorf("failed to update %s: %w", table, err)
+					}
+				}
+
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+}
+
+func convertStringArray(value string, toJSON bool) (string, error) {
+	if !toJSON {
+		var values []string
+		if value != "" {
+			if err := json.Unmarshal([]byte(value), &values); err != nil {
+				return "", err
+			}
+		}
+
+		return strings.Join(values, ";"), nil
+	}
+
+	values := []string{}
+	if value != "" {
+		values = strings.Split(value, ";")
+	}
+
+	converted, err := json.Marshal(values)
+	if err != nil {
+		return "", err
+	}
+
+	return string(converted), nil
+}
+
+type tokenRequest struct {
+	RequestID string `gorm:"index"`
+}
+
+// addTokenRequestID adds an indexed request_id column to the token tables. Rows
+// used to be identified by their request ID, so existing rows keep it as both.
+func addTokenRequestID(tx *gorm.DB) error {
+	for _, table := range []string{"authorization_codes", "access_tokens", "refresh_tokens", "pkces"} {
+		if err := tx.Table(table).Migrator().AddColumn(&tokenRequest{}, "RequestID"); err != nil {
+			return err
+		}
+
+		index := "idx_" + table + "_request_id"
+		if err := tx.Exec("CREATE INDEX ? ON ? (request_id)", clause.Table{Name: index}, clause.Table{Name: table}).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Exec("UPDATE ? SET request_id = id", clause.Table{Name: table}).Error; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type userPasswordReset struct {
+	PasswordResetRequired bool
+}
+
+type clientTokenPolicy struct {
+	AccessTokenLifespan         time.Duration
+	RefreshTokenLifespan        time.Duration
+	AuthorizeCodeLifespan       time.Duration
+	IDTokenLifespan             time.Duration
+	DisableRefreshTokenRotation bool
+	RefreshTokenMaxAge          time.Duration
+}
+
+var clientTokenPolicyFields = []string{
+	"AccessTokenLifespan", "RefreshTokenLifespan", "AuthorizeCodeLifespan",
+	"IDTokenLifespan", "DisableRefreshTokenRotation", "RefreshTokenMaxAge",
+}
@@ -4,26 +4,36 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"math"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/google/uuid"
 	"github.com/mohae/deepcopy"
 	"github.com/ory/fosite"
 	"github.com/ory/fosite/token/jwt"
 	"gorm.io/datatypes"
 	"gorm.io/gorm"
-	"time"
 )
 
 type AccessToken struct {
 	gorm.Model
 
-	ID        string `gorm:"primarykey"`
+	ID string `gorm:"primarykey"`
+	// RequestID identifies the grant, it is shared by the code and every token
+	// issued for the same authorization request
+	RequestID string `gorm:"index"`
 	Active    bool
+	// Signature is the keyed hash of the token signature
 	Signature string `gorm:"unique"`
+	// ExpiresAt is nil for tokens that never expire
+	ExpiresAt *time.Time `gorm:"index"`
 
 	RequestedAt       time.Time
 	RequestedScopes   StringArray
 	GrantedScopes     StringArray
-	Form              datatypes.JSON
+	Form              datatypes.JSON `gorm:"serializer:encrypted"`
 	RequestedAudience StringArray
 	GrantedAudience   StringArray
 
@@ -40,14 +50,19 @@ func (AccessToken) TableName() string {
 type AuthorizationCode struct {
 	gorm.Model
 
-	ID     string `gorm:"primarykey"`
-	Active bool
-	Code   string
+	ID string `gorm:"primarykey"`
+	// RequestID identifies the grant, it is shared by the code and every token
+	// issued for the same authorization request
+	RequestID string `gorm:"index"`
+	Active    bool
+	// Code is the keyed hash of the authorization code signature
+	Code      string     `gorm:"index"`
+	ExpiresAt *time.Time `gorm:"index"`
 
 	RequestedAt       time.Time
 	RequestedScopes   StringArray
 	GrantedScopes     StringArray
-	Form              datatypes.JSON
+	Form              datatypes.JSON `gorm:"serializer:encrypted"`
 	RequestedAudience StringArray
 	GrantedAudience   StringArray
 
@@ -75,6 +90,25 @@ type Client struct {
 	Grants                  StringArray
 	ResponseTypes           StringArray
 	TokenEndpointAuthMethod string
+
+	// RateLimit overrides the default requests per second allowed on the token
+	// and introspection endpoints. Zero uses the default.
+	RateLimit      float64
+	RateLimitBurst int
+
+	// Token lifespans overriding the oauth2_* settings for every grant type. Zero
+	// uses the default.
+	AccessTokenLifespan   time.Duration
+	RefreshTokenLifespan  time.Duration
+	AuthorizeCodeLifespan time.Duration
+	IDTokenLifespan       time.Duration
+
+	// DisableRefreshTokenRotation keeps the refresh token of a grant working when
+	// it is used, instead of replacing it with a new one.
+	DisableRefreshTokenRotation bool
+	// RefreshTokenMaxAge bounds how long after the user signed in a grant can be
+	// refreshed. Zero does not bound it.
+	RefreshTokenMaxAge time.Duration
 }
 
 func (Client) TableName() string {
@@ -163,6 +197,55 @@ func (c Client) GetAudience() fosite.Arguments {
 	return Audience
 }
 
+// GetRateLimit returns the requests per second and burst the client overrides the
+// default rate limit with, or a zero rate. The burst defaults to a second's worth.
+func (c Client) GetRateLimit() (float64, int) {
+	if c.RateLimit <= 0 {
+		return 0, 0
+	}
+
+	burst := c.RateLimitBurst
+	if burst <= 0 {
+		burst = int(math.Ceil(c.RateLimit))
+	}
+
+	return c.RateLimit, burst
+}
+
+// GetEffectiveLifespan implements fosite.ClientWithCustomTokenLifespans. The
+// lifespans of a client apply whatever the grant type.
+func (c Client) GetEffectiveLifespan(gt fosite.GrantType, tt fosite.TokenType, fallback time.Duration) time.Duration {
+	var lifespan time.Duration
+
+	switch tt {
+	case fosite.AccessToken:
+		lifespan = c.AccessTokenLifespan
+	case fosite.RefreshToken:
+		lifespan = c.RefreshTokenLifespan
+	case fosite.AuthorizeCode:
+		lifespan = c.AuthorizeCodeLifespan
+	case fosite.IDToken:
+		lifespan = c.IDTokenLifespan
+	}
+
+	if lifespan <= 0 {
+		return fallback
+	}
+
+	return lifespan
+}
+
+// RotatesRefreshTokens reports whether using a refresh token replaces it.
+func (c Client) RotatesRefreshTokens() bool {
+	return !c.DisableRefreshTokenRotation
+}
+
+// GetRefreshTokenMaxAge returns how long after the user signed in a grant can be
+// refreshed, zero when it is not bounded.
+func (c Client) GetRefreshTokenMaxAge() time.Duration {
+	return c.RefreshTokenMaxAge
+}
+
 type ClientJWT struct {
 	gorm.Model
 
@@ -175,14 +258,20 @@ type ClientJWT struct {
 type PKCE struct {
 	gorm.Model
 
-	ID        string `gorm:"primarykey"`
+	ID string `gorm:"primarykey"`
+	// RequestID identifies the grant, it is shared by the code and every token
+	// issued for the same authorization request
+	RequestID string `gorm:"index"`
 	Active    bool
+	// Signature is the keyed hash of the token signature
 	Signature string `gorm:"unique"`
+	// ExpiresAt is nil for tokens that never expire
+	ExpiresAt *time.Time `gorm:"index"`
 
 	RequestedAt       time.Time
 	RequestedScopes   StringArray
 	GrantedScopes     StringArray
-	Form              datatypes.JSON
+	Form              datatypes.JSON `gorm:"serializer:encrypted"`
 	RequestedAudience StringArray
 	GrantedAudience   StringArray
 
@@ -199,14 +288,20 @@ func (PKCE) TableName() string {
 type RefreshToken struct {
 	gorm.Model
 
-	ID        string `gorm:"primarykey"`
+	ID string `gorm:"primarykey"`
+	// RequestID identifies the grant, it is shared by the code and every token
+	// issued for the same authorization request
+	RequestID string `gorm:"index"`
 	Active    bool
+	// Signature is the keyed hash of the token signature
 	Signature string `gorm:"unique"`
+	// ExpiresAt is nil for tokens that never expire
+	ExpiresAt *time.Time `gorm:"index"`
 
 	RequestedAt       time.Time
 	RequestedScopes   StringArray
 	GrantedScopes     StringArray
-	Form              datatypes.JSON
+	Form              datatypes.JSON `gorm:"serializer:encrypted"`
 	RequestedAudience StringArray
 	GrantedAudience   StringArray
 
@@ -230,6 +325,8 @@ func NewSession(
 ) (*Session, error) {
 
 	session := &Session{
+		// records when the user signed in, which bounds the age of refreshed grants
+		Model:    gorm.Model{CreatedAt: time.Now()},
 		ID:       uuid.New().String(),
 		UserID:   userID,
 		ClientID: clientID,
@@ -260,7 +357,7 @@ type Session struct {
 	ExpiresAt datatypes.JSON
 
 	// Default
-	Extra datatypes.JSON
+	Extra datatypes.JSON `gorm:"serializer:encrypted"`
 
 	UserID string
 	User   User
@@ -301,6 +398,16 @@ func (s *Session) GetExpiresAt(key fosite.TokenType) time.Time {
 	return expiresAt[key]
 }
 
+// expiresAt returns the expiry of a token type in the session, or nil if it never expires.
+func expiresAt(s *Session, key fosite.TokenType) *time.Time {
+	exp := s.GetExpiresAt(key)
+	if exp.IsZero() {
+		return nil
+	}
+
+	return &exp
+}
+
 // GetUsername returns the username, if set. This is optional and only used during token introspection.
 func (s *Session) GetUsername() string {
 	if s == nil {
@@ -361,13 +468,172 @@ type User struct {
 	Active   bool
 	Name     string
 	Username string `gorm:"unique"`
+	// Password is the bcrypt hash of the user's password
 	Password string
+	// PasswordResetRequired stops password logins until the user chooses a new password
+	PasswordResetRequired bool
+
+	Email           string `gorm:"index"`
+	EmailVerified   bool
+	EmailVerifiedAt *time.Time
+
+	Credentials []WebAuthnCredential
 }
 
 func (User) TableName() string {
 	return "users"
 }
 
+// WebAuthnID returns the user handle presented to authenticators.
+func (u User) WebAuthnID() []byte {
+	return []byte(u.ID)
+}
+
+// WebAuthnName returns the account name shown by authenticators.
+func (u User) WebAuthnName() string {
+	return u.Username
+}
+
+// WebAuthnDisplayName returns the human-palatable name shown by authenticators.
+func (u User) WebAuthnDisplayName() string {
+	return u.Name
+}
+
+// WebAuthnIcon is deprecated by the specification and always returns an empty string.
+func (u User) WebAuthnIcon() string {
+	return ""
+}
+
+// WebAuthnCredentials returns the passkeys registered by the user.
+func (u User) WebAuthnCredentials() []webauthn.Credential {
+	var credentials []webauthn.Credential
+
+	for _, credential := range u.Credentials {
+		credentials = append(credentials, credential.Credential())
+	}
+
+	return credentials
+}
+
+// WebAuthnCredential is a passkey registered by a user.
+type WebAuthnCredential struct {
+	gorm.Model
+
+	// ID is the base64url encoded credential ID
+	ID              string `gorm:"primarykey"`
+	CredentialID    []byte
+	PublicKey       []byte
+	AttestationType string
+	Transport       StringArray
+
+	UserPresent    bool
+	UserVerified   bool
+	BackupEligible bool
+	BackupState    bool
+
+	AAGUID       []byte
+	SignCount    uint32
+	CloneWarning bool
+	Attachment   string
+	LastUsedAt   *time.Time
+
+	UserID string
+	User   User
+}
+
+func (WebAuthnCredential) TableName() string {
+	return "webauthn_credentials"
+}
+
+// Credential converts the stored credential into its webauthn representation.
+func (c WebAuthnCredential) Credential() webauthn.Credential {
+	var transport []protocol.AuthenticatorTransport
+
+	for _, st := range c.Transport {
+		transport = append(transport, protocol.AuthenticatorTransport(st))
+	}
+
+	return webauthn.Credential{
+		ID:              c.CredentialID,
+		PublicKey:       c.PublicKey,
+		AttestationType: c.AttestationType,
+		Transport:       transport,
+		Flags: webauthn.CredentialFlags{
+			UserPresent:    c.UserPresent,
+			UserVerified:   c.UserVerified,
+			BackupEligible: c.BackupEligible,
+			BackupState:    c.BackupState,
+		},
+		Authenticator: webauthn.Authenticator{
+			AAGUID:       c.AAGUID,
+			SignCount:    c.SignCount,
+			CloneWarning: c.CloneWarning,
+			Attachment:   protocol.AuthenticatorAttachment(c.Attachment),
+		},
+	}
+}
+
+// WebAuthnSession holds the challenge of an in-flight registration or login ceremony.
+type WebAuthnSession struct {
+	gorm.Model
+
+	ID        string `gorm:"primarykey"`
+	Data      datatypes.JSON
+	ExpiresAt time.Time
+}
+
+func (WebAuthnSession) TableName() string {
+	return "webauthn_sessions"
+}
+
+// UserToken is a single-use secret sent to a user, e.g. to verify their email address.
+// Only the SHA-256 hash of the secret is stored.
+type UserToken struct {
+	gorm.Model
+
+	ID        string `gorm:"primarykey"`
+	Purpose   string
+	TokenHash string `gorm:"unique"`
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+
+	UserID string
+	User   User
+}
+
+func (UserToken) TableName() string {
+	return "user_tokens"
+}
+
+// PasswordHistory keeps the hashes of passwords a user had before, so that they
+// cannot be reused.
+type PasswordHistory struct {
+	gorm.Model
+
+	ID       string `gorm:"primarykey"`
+	UserID   string `gorm:"index"`
+	Password string
+}
+
+func (PasswordHistory) TableName() string {
+	return "password_histories"
+}
+
+// LoginAttempt tracks consecutive failed logins for a username or a client IP.
+type LoginAttempt struct {
+	gorm.Model
+
+	// ID is the throttled key e.g. "username:jdoe" or "ip:127.0.0.1"
+	ID            string `gorm:"primarykey"`
+	Failures      int
+	LastFailureAt time.Time
+	LockedUntil   time.Time
+}
+
+func (LoginAttempt) TableName() string {
+	return "login_attempts"
+}
+
 type UserRole struct {
 	ID     int `gorm:"primarykey;autoIncrement"`
 	UserID string
@@ -377,3 +643,28 @@ type UserRole struct {
 func (UserRole) TableName() string {
 	return "user_roles"
 }
+
+// Scope is a scope clients can be allowed to request, as declared by the
+// bootstrap file.
+type Scope struct {
+	Name        string `gorm:"primarykey"`
+	Description string
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+func (Scope) TableName() string {
+	return "scopes"
+}
+
+// Role is a role users can be given, as declared by the bootstrap file.
+type Role struct {
+	Name        string `gorm:"primarykey"`
+	Description string
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+func (Role) TableName() string {
+	return "roles"
+}
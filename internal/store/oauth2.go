@@ -6,10 +6,24 @@ import (
 	"fmt"
 	"net/url"
 
+	"github.com/google/uuid"
 	"github.com/ory/fosite"
+	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm/clause"
 )
 
+// saveSession inserts or updates the session a code or token belongs to.
+func (m Store) saveSession(ctx context.Context, session *Session) error {
+	return m.conn(ctx).Clauses(
+		clause.OnConflict{
+			Columns: []clause.Column{
+				{Name: "id"},
+			},
+			UpdateAll: true,
+		},
+	).Create(session).Error
+}
+
 // CreateAuthorizeCodeSession stores the authorization request for a given authorization code.
 func (m Store) CreateAuthorizeCodeSession(ctx context.Context, code string, request fosite.Requester) (err error) {
 	client := request.GetClient()
@@ -20,21 +34,13 @@ func (m Store) CreateAuthorizeCodeSession(ctx context.Context, code string, requ
 	}
 
 	session := request.GetSession().(*Session)
-	if err = m.db.Clauses(
-		clause.OnConflict{
-			Columns: []clause.Column{
-				{Name: "id"},
-			},
-			UpdateAll: true,
-		},
-	).Create(&session).Error; err != nil {
-		return fmt.Errorf("error creating authorization code session: %w", err)
-	}
 
 	data := AuthorizationCode{
-		ID:                request.GetID(),
+		ID:                uuid.NewString(),
+		RequestID:         request.GetID(),
 		Active:            true,
-		Code:              code,
+		Code:              m.hashSignature(code),
+		ExpiresAt:         expiresAt(session, fosite.AuthorizeCode),
 		RequestedAt:       request.GetRequestedAt(),
 		ClientID:          client.GetID(),
 		RequestedScopes:   StringArray(request.GetRequestedScopes()),
@@ -45,11 +51,18 @@ func (m Store) CreateAuthorizeCodeSession(ctx context.Context, code string, requ
 		GrantedAudience:   StringArray(request.GetGrantedAudience()),
 	}
 
-	if err = m.db.Create(&data).Error; err != nil {
-		return fmt.Errorf("error creating authorization code: %w", err)
-	}
+	// the session and the token are saved together or not at all
+	return m.transaction(ctx, func(ctx context.Context) error {
+		if err := m.saveSession(ctx, session); err != nil {
+			return fmt.Errorf("error creating authorization code session: %w", err)
+		}
 
-	return nil
+		if err := m.conn(ctx).Create(&data).Error; err != nil {
+			return fmt.Errorf("error creating authorization code: %w", err)
+		}
+
+		return nil
+	})
 }
 
 // GetAuthorizeCodeSession hydrates the session based on the given code and returns the authorization request.
@@ -60,7 +73,7 @@ func (m Store) CreateAuthorizeCodeSession(ctx context.Context, code string, requ
 func (m Store) GetAuthorizeCodeSession(ctx context.Context, code string, session fosite.Session) (request fosite.Requester, err error) {
 	var result AuthorizationCode
 
-	if err := m.db.Preload("Session.User").Preload(clause.Associations).Where(AuthorizationCode{Code: code}).First(&result).Error; err != nil {
+	if err := m.conn(ctx).Preload("Session.User").Preload(clause.Associations).Where("code IN ?", m.signatureHashes(code)).First(&result).Error; err != nil {
 		return nil, fmt.Errorf("%w: %w", fosite.ErrNotFound, err)
 	}
 
@@ -71,7 +84,7 @@ func (m Store) GetAuthorizeCodeSession(ctx context.Context, code string, session
 	}
 
 	rq := &fosite.Request{
-		ID:                result.ID,
+		ID:                result.RequestID,
 		RequestedAt:       result.RequestedAt,
 		Client:            result.Client,
 		RequestedScope:    fosite.Arguments(result.RequestedScopes),
@@ -95,12 +108,12 @@ func (m Store) GetAuthorizeCodeSession(ctx context.Context, code string, session
 func (m Store) InvalidateAuthorizeCodeSession(ctx context.Context, code string) (err error) {
 	var result AuthorizationCode
 
-	if err := m.db.Where(AuthorizationCode{Code: code}).First(&result).Error; err != nil {
+	if err := m.conn(ctx).Where("code IN ?", m.signatureHashes(code)).First(&result).Error; err != nil {
 		return fmt.Errorf("%w: %w", fosite.ErrNotFound, err)
 	}
 
 	result.Active = false
-	if err := m.db.Save(result).Error; err != nil {
+	if err := m.conn(ctx).Save(result).Error; err != nil {
 		return fmt.Errorf("failed to invalidate authorization code: %w", err)
 	}
 
@@ -116,21 +129,13 @@ func (m Store) CreateAccessTokenSession(ctx context.Context, signature string, r
 	}
 
 	session := request.GetSession().(*Session)
-	if err = m.db.Clauses(
-		clause.OnConflict{
-			Columns: []clause.Column{
-				{Name: "id"},
-			},
-			UpdateAll: true,
-		},
-	).Create(&session).Error; err != nil {
-		return fmt.Errorf("error creating authorization code session: %w", err)
-	}
 
 	data := AccessToken{
-		ID:                request.GetID(),
+		ID:                uuid.NewString(),
+		RequestID:         request.GetID(),
 		Active:            true,
-		Signature:         signature,
+		Signature:         m.hashSignature(signature),
+		ExpiresAt:         expiresAt(session, fosite.AccessToken),
 		RequestedAt:       request.GetRequestedAt(),
 		ClientID:          client.GetID(),
 		RequestedScopes:   StringArray(request.GetRequestedScopes()),
@@ -141,24 +146,24 @@ func (m Store) CreateAccessTokenSession(ctx context.Context, signature string, r
 		GrantedAudience:   StringArray(request.GetGrantedAudience()),
 	}
 
-	if err = m.db.Clauses(
-		clause.OnConflict{
-			Columns: []clause.Column{
-				{Name: "id"},
-			},
-			UpdateAll: true,
-		},
-	).Create(&data).Error; err != nil {
-		return fmt.Errorf("error creating access token: %w", err)
-	}
+	// the session and the token are saved together or not at all
+	return m.transaction(ctx, func(ctx context.Context) error {
+		if err := m.saveSession(ctx, session); err != nil {
+			return fmt.Errorf("error creating authorization code session: %w", err)
+		}
 
-	return nil
+		if err := m.conn(ctx).Create(&data).Error; err != nil {
+			return fmt.Errorf("error creating access token: %w", err)
+		}
+
+		return nil
+	})
 }
 
 func (m Store) GetAccessTokenSession(ctx context.Context, signature string, session fosite.Session) (request fosite.Requester, err error) {
 	var result AccessToken
 
-	if err := m.db.Preload("Session.User").Preload(clause.Associations).Where(AccessToken{Signature: signature}).First(&result).Error; err != nil {
+	if err := m.conn(ctx).Preload("Session.User").Preload(clause.Associations).Where("signature IN ?", m.signatureHashes(signature)).First(&result).Error; err != nil {
 		return nil, fmt.Errorf("%w: %w", fosite.ErrNotFound, err)
 	}
 
@@ -169,7 +174,7 @@ func (m Store) GetAccessTokenSession(ctx context.Context, signature string, sess
 	}
 
 	rq := &fosite.Request{
-		ID:                result.ID,
+		ID:                result.RequestID,
 		RequestedAt:       result.RequestedAt,
 		Client:            result.Client,
 		RequestedScope:    fosite.Arguments(result.RequestedScopes),
@@ -180,11 +185,16 @@ func (m Store) GetAccessTokenSession(ctx context.Context, signature string, sess
 		GrantedAudience:   fosite.Arguments(result.GrantedAudience),
 	}
 
+	// revoked tokens are reported inactive, as introspection must per RFC 7009
+	if !result.Active {
+		return rq, fosite.ErrInactiveToken
+	}
+
 	return rq, nil
 }
 
 func (m Store) DeleteAccessTokenSession(ctx context.Context, signature string) (err error) {
-	if err := m.db.Where(&AccessToken{Signature: signature}).Delete(&AccessToken{}).Error; err != nil {
+	if err := m.conn(ctx).Where("signature IN ?", m.signatureHashes(signature)).Delete(&AccessToken{}).Error; err != nil {
 		return fmt.Errorf("failed to delete access token: %w", err)
 	}
 
@@ -200,21 +210,13 @@ func (m Store) CreateRefreshTokenSession(ctx context.Context, signature string,
 	}
 
 	session := request.GetSession().(*Session)
-	if err = m.db.Clauses(
-		clause.OnConflict{
-			Columns: []clause.Column{
-				{Name: "id"},
-			},
-			UpdateAll: true,
-		},
-	).Create(&session).Error; err != nil {
-		return fmt.Errorf("error creating refresh token session: %w", err)
-	}
 
 	data := RefreshToken{
-		ID:                request.GetID(),
+		ID:                uuid.NewString(),
+		RequestID:         request.GetID(),
 		Active:            true,
-		Signature:         signature,
+		Signature:         m.hashSignature(signature),
+		ExpiresAt:         expiresAt(session, fosite.RefreshToken),
 		RequestedAt:       request.GetRequestedAt(),
 		ClientID:          client.GetID(),
 		RequestedScopes:   StringArray(request.GetRequestedScopes()),
@@ -225,24 +227,31 @@ func (m Store) CreateRefreshTokenSession(ctx context.Context, signature string,
 		GrantedAudience:   StringArray(request.GetGrantedAudience()),
 	}
 
-	if err = m.db.Clauses(
-		clause.OnConflict{
-			Columns: []clause.Column{
-				{Name: "id"},
-			},
-			UpdateAll: true,
-		},
-	).Create(&data).Error; err != nil {
-		return fmt.Errorf("error creating refresh token: %w", err)
-	}
+	// the session and the token are saved together or not at all
+	return m.transaction(ctx, func(ctx context.Context) error {
+		if err := m.saveSession(ctx, session); err != nil {
+			return fmt.Errorf("error creating refresh token session: %w", err)
+		}
 
-	return nil
+		if err := m.conn(ctx).Create(&data).Error; err != nil {
+			return fmt.Errorf("error creating refresh token: %w", err)
+		}
+
+		return nil
+	})
 }
 
 func (m Store) GetRefreshTokenSession(ctx context.Context, signature string, session fosite.Session) (request fosite.Requester, err error) {
 	var result RefreshToken
 
-	if err := m.db.Preload("Session.User").Preload(clause.Associations).Where(RefreshToken{Signature: signature}).First(&result).Error; err != nil {
+	query := m.conn(ctx)
+
+	// lock the token so that concurrent refreshes with it are serialised
+	if inTransaction(ctx) {
+		query = query.Clauses(clause.Locking{Strength: "UPDATE"})
+	}
+
+	if err := query.Preload("Session.User").Preload(clause.Associations).Where("signature IN ?", m.signatureHashes(signature)).First(&result).Error; err != nil {
 		return nil, fmt.Errorf("%w: %w", fosite.ErrNotFound, err)
 	}
 
@@ -253,7 +262,7 @@ func (m Store) GetRefreshTokenSession(ctx context.Context, signature string, ses
 	}
 
 	rq := &fosite.Request{
-		ID:                result.ID,
+		ID:                result.RequestID,
 		RequestedAt:       result.RequestedAt,
 		Client:            result.Client,
 		RequestedScope:    fosite.Arguments(result.RequestedScopes),
@@ -272,7 +281,7 @@ func (m Store) GetRefreshTokenSession(ctx context.Context, signature string, ses
 }
 
 func (m Store) DeleteRefreshTokenSession(ctx context.Context, signature string) (err error) {
-	if err := m.db.Where(&RefreshToken{Signature: signature}).Delete(&RefreshToken{}).Error; err != nil {
+	if err := m.conn(ctx).Where("signature IN ?", m.signatureHashes(signature)).Delete(&RefreshToken{}).Error; err != nil {
 		return fmt.Errorf("failed to delete refresh token: %w", err)
 	}
 
@@ -286,61 +295,64 @@ func (m Store) DeleteRefreshTokenSession(ctx context.Context, signature string)
 // revocation of access tokens, then the authorization server SHOULD
 // also invalidate all access tokens based on the same authorization
 // grant (see Implementation Note).
+//
+// The whole grant is revoked, see RevokeGrant.
 func (m Store) RevokeRefreshToken(ctx context.Context, requestID string) error {
-
-	var result RefreshToken
-
-	if err := m.db.Where(RefreshToken{ID: requestID}).First(&result).Error; err != nil {
-		return fmt.Errorf("%w: %w", fosite.ErrNotFound, err)
-	}
-
-	result.Active = false
-	if err := m.db.Save(result).Error; err != nil {
-		return fmt.Errorf("failed to invalidate authorization code: %w", err)
-	}
-
-	return nil
+	return m.RevokeGrant(ctx, requestID)
 }
 
-// RevokeRefreshTokenMaybeGracePeriod revokes a refresh token as specified in:
-// https://tools.ietf.org/html/rfc7009#section-2.1
-// If the particular
-// token is a refresh token and the authorization server supports the
-// revocation of access tokens, then the authorization server SHOULD
-// also invalidate all access tokens based on the same authorization
-// grant (see Implementation Note).
-//
-// If the Refresh Token grace period is greater than zero in configuration the token
-// will have its expiration time set as UTCNow + GracePeriod.
+// RevokeRefreshTokenMaybeGracePeriod is called by fosite when a refresh token is
+// used. There is no grace period: the whole grant the token belongs to is revoked
+// straight away, see RevokeGrant, so using the same refresh token twice is always
+// detected as reuse. The signature is not needed for that and is ignored.
 func (m Store) RevokeRefreshTokenMaybeGracePeriod(ctx context.Context, requestID string, signature string) error {
 	return m.RevokeRefreshToken(ctx, requestID)
 }
 
+// RevokeAccessToken revokes an access token together with the rest of its grant,
+// see RevokeGrant.
 func (m Store) RevokeAccessToken(ctx context.Context, requestID string) error {
-	var result AccessToken
+	return m.RevokeGrant(ctx, requestID)
+}
 
-	if err := m.db.Where(AccessToken{ID: requestID}).First(&result).Error; err != nil {
-		return fmt.Errorf("%w: %w", fosite.ErrNotFound, err)
-	}
+// RevokeGrant deactivates the authorization code and every access and refresh
+// token issued for an authorization request, however many times the tokens were
+// refreshed. Revoking an unknown grant is not an error.
+func (m Store) RevokeGrant(ctx context.Context, requestID string) error {
+	return m.revokeTokens(ctx, "request_id = ?", requestID)
+}
 
-	result.Active = false
-	if err := m.db.Save(result).Error; err != nil {
-		return fmt.Errorf("failed to invalidate authorization code: %w", err)
-	}
+// RevokeClientTokens deactivates every authorization code, access token and
+// refresh token issued to a client.
+func (m Store) RevokeClientTokens(ctx context.Context, clientID string) error {
+	return m.revokeTokens(ctx, "client_id = ?", clientID)
+}
 
-	return nil
+// revokeTokens deactivates the codes and tokens matching a condition.
+func (m Store) revokeTokens(ctx context.Context, query string, args ...interface{}) error {
+	return m.transaction(ctx, func(ctx context.Context) error {
+		for _, model := range []interface{}{&AuthorizationCode{}, &AccessToken{}, &RefreshToken{}, &PKCE{}} {
+			if err := m.conn(ctx).Model(model).Where(query, args...).Where("active = ?", true).Update("active", false).Error; err != nil {
+				return fmt.Errorf("failed to revoke tokens: %w", err)
+			}
+		}
+
+		return nil
+	})
 }
 
 func (m Store) Authenticate(ctx context.Context, name string, secret string) error {
 	var result User
 
-	if err := m.db.Where(User{Username: name}).First(&result).Error; err != nil {
+	if err := m.conn(ctx).Where("username = ?", name).First(&result).Error; err != nil {
+		// compare against a dummy hash so that unknown usernames take as long as wrong passwords
+		_ = bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(secret))
 		return fmt.Errorf("%w: %w", fosite.ErrNotFound, err)
 	}
 
-	if result.Password != secret {
+	if err := bcrypt.CompareHashAndPassword([]byte(result.Password), []byte(secret)); err != nil {
 		return fosite.ErrNotFound.WithDebug("Invalid credentials")
 	}
 
-	return nil
+	return CheckUserCanLogin(result)
 }
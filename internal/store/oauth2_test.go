@@ -0,0 +1,79 @@
+package store_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Muchogoc/go-oauth2-server/internal/store"
+	"github.com/ory/fosite"
+)
+
+// newTestRequest stores a client and a user and returns a request they made.
+func newTestRequest(t *testing.T, s store.Storage) *fosite.Request {
+	t.Helper()
+
+	ctx := context.Background()
+
+	client := &store.Client{ID: "test-client", Active: true, Scopes: store.StringArray{"openid"}}
+	if err := s.CreateClient(ctx, client); err != nil {
+		t.Fatal(err)
+	}
+
+	user := &store.User{ID: "test-user", Active: true, Username: "alice"}
+	if err := s.CreateUser(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+
+	session, err := store.NewSession(ctx, client.ID, user.ID, user.Username, user.ID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	session.SetExpiresAt(fosite.AccessToken, time.Now().Add(time.Hour))
+
+	request := fosite.NewRequest()
+	request.ID = "test-request"
+	request.Client = client
+	request.Session = session
+	request.GrantScope("openid")
+
+	return request
+}
+
+func TestRevokedAccessTokensAreInactive(t *testing.T) {
+	forEachDatabase(t, func(t *testing.T, s *store.Store) {
+		testRevokedAccessTokenIsInactive(t, s)
+	})
+
+	t.Run("memory", func(t *testing.T) {
+		testRevokedAccessTokenIsInactive(t, store.NewMemoryStore())
+	})
+}
+
+func testRevokedAccessTokenIsInactive(t *testing.T, s store.Storage) {
+	ctx := context.Background()
+	request := newTestRequest(t, s)
+
+	if err := s.CreateAccessTokenSession(ctx, "access-signature", request); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.GetAccessTokenSession(ctx, "access-signature", &store.Session{}); err != nil {
+		t.Fatalf("an active token was rejected: %v", err)
+	}
+
+	if err := s.RevokeAccessToken(ctx, request.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := s.GetAccessTokenSession(ctx, "access-signature", &store.Session{})
+	if !errors.Is(err, fosite.ErrInactiveToken) {
+		t.Fatalf("a revoked token returned %v, want fosite.ErrInactiveToken", err)
+	}
+
+	if found == nil || found.GetID() != request.ID {
+		t.Errorf("a revoked token did not return its request")
+	}
+}
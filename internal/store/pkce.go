@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net/url"
 
+	"github.com/google/uuid"
 	"github.com/ory/fosite"
 	"gorm.io/gorm/clause"
 )
@@ -19,21 +20,13 @@ func (m Store) CreatePKCERequestSession(ctx context.Context, signature string, r
 	}
 
 	session := requester.GetSession().(*Session)
-	if err = m.db.Clauses(
-		clause.OnConflict{
-			Columns: []clause.Column{
-				{Name: "id"},
-			},
-			UpdateAll: true,
-		},
-	).Create(&session).Error; err != nil {
-		return fmt.Errorf("error creating authorization code session: %w", err)
-	}
 
 	data := PKCE{
-		ID:                requester.GetID(),
+		ID:                uuid.NewString(),
+		RequestID:         requester.GetID(),
 		Active:            true,
-		Signature:         signature,
+		Signature:         m.hashSignature(signature),
+		ExpiresAt:         expiresAt(session, fosite.AuthorizeCode),
 		RequestedAt:       requester.GetRequestedAt(),
 		ClientID:          client.GetID(),
 		RequestedScopes:   StringArray(requester.GetRequestedScopes()),
@@ -44,17 +37,24 @@ func (m Store) CreatePKCERequestSession(ctx context.Context, signature string, r
 		GrantedAudience:   StringArray(requester.GetGrantedAudience()),
 	}
 
-	if err = m.db.Create(&data).Error; err != nil {
-		return fmt.Errorf("error creating PCKE: %w", err)
-	}
+	// the session and the token are saved together or not at all
+	return m.transaction(ctx, func(ctx context.Context) error {
+		if err := m.saveSession(ctx, session); err != nil {
+			return fmt.Errorf("error creating authorization code session: %w", err)
+		}
 
-	return nil
+		if err := m.conn(ctx).Create(&data).Error; err != nil {
+			return fmt.Errorf("error creating PCKE: %w", err)
+		}
+
+		return nil
+	})
 }
 
 func (m Store) GetPKCERequestSession(ctx context.Context, signature string, session fosite.Session) (fosite.Requester, error) {
 	var result PKCE
 
-	if err := m.db.Preload("Session.User").Preload(clause.Associations).Where(PKCE{Signature: signature}).First(&result).Error; err != nil {
+	if err := m.conn(ctx).Preload("Session.User").Preload(clause.Associations).Where("signature IN ?", m.signatureHashes(signature)).First(&result).Error; err != nil {
 		return nil, fmt.Errorf("%w: %w", fosite.ErrNotFound, err)
 	}
 
@@ -65,7 +65,7 @@ func (m Store) GetPKCERequestSession(ctx context.Context, signature string, sess
 	}
 
 	rq := fosite.Request{
-		ID:                result.ID,
+		ID:                result.RequestID,
 		RequestedAt:       result.RequestedAt,
 		Client:            result.Client,
 		RequestedScope:    fosite.Arguments(result.RequestedScopes),
@@ -80,7 +80,7 @@ func (m Store) GetPKCERequestSession(ctx context.Context, signature string, sess
 }
 
 func (m Store) DeletePKCERequestSession(ctx context.Context, signature string) error {
-	if err := m.db.Where(&PKCE{Signature: signature}).Delete(&PKCE{}).Error; err != nil {
+	if err := m.conn(ctx).Where("signature IN ?", m.signatureHashes(signature)).Delete(&PKCE{}).Error; err != nil {
 		return fmt.Errorf("failed to delete PCKE request: %w", err)
 	}
 
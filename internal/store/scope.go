@@ -0,0 +1,56 @@
+package store
+
+import (
+	"context"
+	"fmt"
+
+	"gorm.io/gorm/clause"
+)
+
+// ListScopes returns the declared scopes by name.
+func (m Store) ListScopes(ctx context.Context) ([]Scope, error) {
+	var scopes []Scope
+
+	if err := m.conn(ctx).Order("name").Find(&scopes).Error; err != nil {
+		return nil, fmt.Errorf("error fetching scopes: %w", err)
+	}
+
+	return scopes, nil
+}
+
+// SaveScope declares a scope, or updates the description of a declared one.
+func (m Store) SaveScope(ctx context.Context, scope *Scope) error {
+	err := m.conn(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "name"}},
+		DoUpdates: clause.AssignmentColumns([]string{"description", "updated_at"}),
+	}).Create(scope).Error
+	if err != nil {
+		return fmt.Errorf("failed to save scope: %w", err)
+	}
+
+	return nil
+}
+
+// ListRoles returns the declared roles by name.
+func (m Store) ListRoles(ctx context.Context) ([]Role, error) {
+	var roles []Role
+
+	if err := m.conn(ctx).Order("name").Find(&roles).Error; err != nil {
+		return nil, fmt.Errorf("error fetching roles: %w", err)
+	}
+
+	return roles, nil
+}
+
+// SaveRole declares a role, or updates the description of a declared one.
+func (m Store) SaveRole(ctx context.Context, role *Role) error {
+	err := m.conn(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "name"}},
+		DoUpdates: clause.AssignmentColumns([]string{"description", "updated_at"}),
+	}).Create(role).Error
+	if err != nil {
+		return fmt.Errorf("failed to save role: %w", err)
+	}
+
+	return nil
+}
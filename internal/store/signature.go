@@ -0,0 +1,72 @@
+package store
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"github.com/Muchogoc/go-oauth2-server/config"
+)
+
+// tokenPepper returns the secret key used to hash token signatures, read from
+// token_hash_pepper_file when that is set.
+func tokenPepper(cfg config.Provider) ([]byte, error) {
+	pepper, err := config.Secret(cfg, "token_hash_pepper")
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(pepper), nil
+}
+
+// previousTokenPeppers returns the retired keys that stored signatures may still
+// be hashed with, read one per line from token_hash_previous_peppers_file when
+// that is set.
+func previousTokenPeppers(cfg config.Provider) ([][]byte, error) {
+	values := cfg.GetStringSlice("token_hash_previous_peppers")
+
+	if cfg.GetString("token_hash_previous_peppers_file") != "" {
+		file, err := config.Secret(cfg, "token_hash_previous_peppers")
+		if err != nil {
+			return nil, err
+		}
+
+		values = strings.Split(file, "\n")
+	}
+
+	var peppers [][]byte
+
+	for _, pepper := range values {
+		if pepper = strings.TrimSpace(pepper); pepper != "" {
+			peppers = append(peppers, []byte(pepper))
+		}
+	}
+
+	return peppers, nil
+}
+
+// hashSignature returns the HMAC-SHA256 of a token signature or authorization code.
+// Only the hash is stored, so a copy of the database does not contain usable tokens.
+func hashSignature(pepper []byte, signature string) string {
+	mac := hmac.New(sha256.New, pepper)
+	mac.Write([]byte(signature))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (m Store) hashSignature(signature string) string {
+	return hashSignature(m.pepper, signature)
+}
+
+// signatureHashes returns the hashes a stored signature may have: with the
+// current pepper, which new tokens are hashed with, and with every previous one.
+func (m Store) signatureHashes(signature string) []string {
+	hashes := []string{m.hashSignature(signature)}
+
+	for _, pepper := range m.previousPeppers {
+		hashes = append(hashes, hashSignature(pepper, signature))
+	}
+
+	return hashes
+}
@@ -0,0 +1,131 @@
+package store_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Muchogoc/go-oauth2-server/internal/store"
+	"github.com/ory/fosite"
+)
+
+func TestPepperRequiredOutsideDevMode(t *testing.T) {
+	v := newTestConfig("sqlite", ":memory:")
+	v.Set("token_hash_pepper", "")
+
+	if s, err := store.NewStore(v); err == nil {
+		_ = s.Close()
+		t.Fatal("a store without a pepper was opened outside dev_mode")
+	}
+
+	v.Set("dev_mode", true)
+
+	s, err := store.NewStore(v)
+	if err != nil {
+		t.Fatalf("a store without a pepper was refused in dev_mode: %v", err)
+	}
+
+	_ = s.Close()
+}
+
+func TestPreviousPeppersFindTokens(t *testing.T) {
+	ctx := context.Background()
+	dsn := filepath.Join(t.TempDir(), "auth.db")
+
+	open := func(pepper string, previous ...string) *store.Store {
+		v := newTestConfig("sqlite", dsn)
+		v.Set("token_hash_pepper", pepper)
+		v.Set("token_hash_previous_peppers", previous)
+
+		s, err := store.NewStore(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		t.Cleanup(func() { _ = s.Close() })
+
+		return s
+	}
+
+	old := open("old-pepper")
+	request := newTestRequest(t, old)
+
+	if err := old.CreateAccessTokenSession(ctx, "issued-before", request); err != nil {
+		t.Fatal(err)
+	}
+
+	rotated := open("new-pepper", "old-pepper")
+
+	if _, err := rotated.GetAccessTokenSession(ctx, "issued-before", &store.Session{}); err != nil {
+		t.Errorf("a token issued before the rotation was not found: %v", err)
+	}
+
+	request.ID = "issued-after"
+	if err := rotated.CreateAccessTokenSession(ctx, "issued-after", request); err != nil {
+		t.Fatal(err)
+	}
+
+	dropped := open("new-pepper")
+
+	if _, err := dropped.GetAccessTokenSession(ctx, "issued-after", &store.Session{}); err != nil {
+		t.Errorf("a token issued after the rotation needs the old pepper: %v", err)
+	}
+
+	if _, err := dropped.GetAccessTokenSession(ctx, "issued-before", &store.Session{}); !errors.Is(err, fosite.ErrNotFound) {
+		t.Errorf("a token of a dropped pepper returned %v, want fosite.ErrNotFound", err)
+	}
+}
+
+func TestPeppersFromFiles(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	dsn := filepath.Join(dir, "auth.db")
+
+	old := newTestConfig("sqlite", dsn)
+	old.Set("token_hash_pepper", "old-pepper")
+
+	before, err := store.NewStore(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = before.Close() })
+
+	if err := before.CreateAccessTokenSession(ctx, "issued-before", newTestRequest(t, before)); err != nil {
+		t.Fatal(err)
+	}
+
+	pepperFile, previousFile := filepath.Join(dir, "pepper"), filepath.Join(dir, "previous-peppers")
+
+	if err := os.WriteFile(pepperFile, []byte("new-pepper\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(previousFile, []byte("older-pepper\nold-pepper\n\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// the files take precedence over the values
+	rotated := newTestConfig("sqlite", dsn)
+	rotated.Set("token_hash_pepper", "")
+	rotated.Set("token_hash_pepper_file", pepperFile)
+	rotated.Set("token_hash_previous_peppers_file", previousFile)
+
+	after, err := store.NewStore(rotated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = after.Close() })
+
+	if _, err := after.GetAccessTokenSession(ctx, "issued-before", &store.Session{}); err != nil {
+		t.Errorf("a token hashed with a pepper from the file was not found: %v", err)
+	}
+
+	rotated.Set("token_hash_pepper_file", filepath.Join(dir, "missing"))
+
+	if s, err := store.NewStore(rotated); err == nil {
+		_ = s.Close()
+		t.Error("a store was opened with an unreadable pepper file")
+	}
+}
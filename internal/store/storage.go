@@ -0,0 +1,106 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"github.com/Muchogoc/go-oauth2-server/config"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/ory/fosite"
+	"github.com/ory/fosite/handler/oauth2"
+	"github.com/ory/fosite/handler/pkce"
+	"github.com/ory/fosite/storage"
+)
+
+// Storage is everything the server persists: the storage fosite needs for the
+// enabled grants together with users, passkeys and login throttling. Store keeps
+// it in a database and MemoryStore in process memory.
+type Storage interface {
+	fosite.ClientManager
+	oauth2.CoreStorage
+	oauth2.TokenRevocationStorage
+	oauth2.ResourceOwnerPasswordCredentialsGrantStorage
+	pkce.PKCERequestStorage
+	storage.Transactional
+
+	GetClientByID(ctx context.Context, id string) (*Client, error)
+	ListClients(ctx context.Context, filter ClientFilter) ([]Client, int64, error)
+	CreateClient(ctx context.Context, client *Client) error
+	UpdateClient(ctx context.Context, client *Client) error
+	DeleteClient(ctx context.Context, id string) error
+
+	GetUser(ctx context.Context, username string) (*User, error)
+	GetUserByID(ctx context.Context, id string) (*User, error)
+	GetUserByEmail(ctx context.Context, email string) (*User, error)
+	ListUsers(ctx context.Context, filter UserFilter) ([]User, int64, error)
+	CreateUser(ctx context.Context, user *User) error
+	UpdateUser(ctx context.Context, user *User) error
+	DeleteUser(ctx context.Context, id string) error
+	GetUserRoles(ctx context.Context, userID string) ([]string, error)
+	SetUserRoles(ctx context.Context, userID string, roles []string) error
+	MarkEmailVerified(ctx context.Context, userID string) error
+	PasswordReused(ctx context.Context, userID string, password string, history int) (bool, error)
+	SetUserPassword(ctx context.Context, userID string, password string) error
+	RevokeUserTokens(ctx context.Context, userID string) error
+	RevokeClientTokens(ctx context.Context, clientID string) error
+	RevokeGrant(ctx context.Context, requestID string) error
+	ListTokens(ctx context.Context, filter TokenFilter) ([]TokenInfo, int64, error)
+	RevokeTokens(ctx context.Context, filter TokenFilter) (map[string]int64, error)
+
+	ListScopes(ctx context.Context) ([]Scope, error)
+	SaveScope(ctx context.Context, scope *Scope) error
+	ListRoles(ctx context.Context) ([]Role, error)
+	SaveRole(ctx context.Context, role *Role) error
+
+	CreateUserToken(ctx context.Context, userID string, purpose string, lifespan time.Duration) (string, error)
+	GetUserToken(ctx context.Context, purpose string, token string) (*UserToken, error)
+	ConsumeUserToken(ctx context.Context, purpose string, token string) (*UserToken, error)
+	ResetUserPassword(ctx context.Context, token string, password string) (*UserToken, error)
+
+	CreateWebAuthnCredential(ctx context.Context, userID string, credential *webauthn.Credential) error
+	UpdateWebAuthnCredential(ctx context.Context, credential *webauthn.Credential) error
+	CreateWebAuthnSession(ctx context.Context, session *webauthn.SessionData) (string, error)
+	PopWebAuthnSession(ctx context.Context, id string) (*webauthn.SessionData, error)
+
+	GetLoginAttempt(ctx context.Context, key string) (*LoginAttempt, error)
+	UpdateLoginAttempt(ctx context.Context, key string, update func(attempt *LoginAttempt) bool) (*LoginAttempt, error)
+	ClearLoginAttempt(ctx context.Context, key string) error
+
+	PurgeExpired(ctx context.Context, policy PurgePolicy) (map[string]int64, error)
+	Close() error
+}
+
+var (
+	_ Storage = (*Store)(nil)
+	_ Storage = (*MemoryStore)(nil)
+	_ Storage = (*CachedStorage)(nil)
+)
+
+// New returns the store selected by "database_driver", behind the client cache
+// when "cache_enabled" is set. The "memory" driver keeps
+// everything in process memory, which suits tests and throwaway deployments but
+// loses all clients, users and tokens on restart.
+func New(cfg config.Provider) (Storage, error) {
+	var backend Storage
+
+	if cfg.GetString("database_driver") == "memory" {
+		backend = NewMemoryStore()
+	} else {
+		db, err := NewStore(cfg)
+		if err != nil {
+			return nil, err
+		}
+
+		backend = db
+	}
+
+	if !cfg.GetBool("cache_enabled") {
+		return backend, nil
+	}
+
+	return NewCachedStorage(
+		backend,
+		cfg.GetDuration("cache_client_ttl"),
+		cfg.GetInt("cache_max_entries"),
+	), nil
+}
@@ -1,135 +1,150 @@
 package store
 
 import (
-	"log"
+	"context"
+	"errors"
+	"fmt"
 
-	"github.com/google/uuid"
+	"github.com/Muchogoc/go-oauth2-server/config"
+	"github.com/Muchogoc/go-oauth2-server/internal/envelope"
+	"github.com/Muchogoc/go-oauth2-server/log"
+	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
-	"gorm.io/gorm/clause"
 	"gorm.io/gorm/logger"
 )
 
-var dsn = "auth.db"
-
 type Store struct {
 	db *gorm.DB
+	// pepper keys the hashes of token signatures and authorization codes
+	pepper []byte
+	// previousPeppers keyed the hashes of tokens issued before the pepper was rotated
+	previousPeppers [][]byte
+	// cipher encrypts request forms and session claims, nil when not configured
+	cipher *envelope.Cipher
 }
 
-func NewStore() *Store {
+// dialector returns the GORM dialect for a database driver name.
+func dialector(driver string, dsn string) (gorm.Dialector, error) {
+	switch driver {
+	case "sqlite":
+		return sqlite.Open(dsn), nil
+	case "postgres":
+		return postgres.Open(dsn), nil
+	case "mysql":
+		// MySQL cannot index unbounded text columns, which string IDs and
+		// foreign keys would otherwise map to
+		return mysql.New(mysql.Config{DSN: dsn, DefaultStringSize: 191}), nil
+	default:
+		return nil, fmt.Errorf("unsupported database driver: %s", driver)
+	}
+}
+
+// Open connects to the database selected by the "database_driver" and
+// "database_dsn" configuration and applies the connection pool settings.
+func Open(cfg config.Provider) (*gorm.DB, error) {
+	driver := cfg.GetString("database_driver")
+
+	dialect, err := dialector(driver, cfg.GetString("database_dsn"))
+	if err != nil {
+		return nil, err
+	}
+
 	db, err := gorm.Open(
-		sqlite.Open(dsn),
+		dialect,
 		&gorm.Config{
 			Logger: logger.Default.LogMode(logger.Error),
 		},
 	)
 	if err != nil {
-		log.Fatal("failed to connect database")
+		return nil, fmt.Errorf("failed to connect database: %w", err)
 	}
 
-	err = db.AutoMigrate(
-		AccessToken{},
-		AuthorizationCode{},
-		Client{},
-		ClientJWT{},
-		User{},
-		PKCE{},
-		RefreshToken{},
-		Session{},
-	)
+	sqlDB, err := db.DB()
 	if err != nil {
-		log.Fatal("failed to run migrations:", err)
+		return nil, fmt.Errorf("failed to access database pool: %w", err)
 	}
 
-	users := []User{
-		{
-			ID:       uuid.NewString(),
-			Active:   true,
-			Name:     "Charles Doe",
-			Username: "ovl_doe",
-			Password: "12345678",
-		},
+	maxOpen := cfg.GetInt("database_max_open_conns")
+	// SQLite serialises writers, and every connection to an in-memory
+	// database would otherwise get its own empty database
+	if driver == "sqlite" && maxOpen == 0 {
+		maxOpen = 1
 	}
 
-	clients := []Client{
-		{
-			ID:     "client-one",
-			Active: true,
-			Secret: "$2a$10$IxMdI6d.LIRZPpSfEwNoeu4rY3FhDREsxFJXikcgdRRAStxUlsuEO", // "foobar"
-			RotatedSecrets: []string{
-				"$2y$10$X51gLxUQJ.hGw1epgHTE5u0bt64xM0COU7K9iAp.OFg8p2pUd.1zC", // "foobaz"
-			},
-			Public: false,
-			RedirectURIs: []string{
-				"http://localhost:8080/callback",
-				"http://127.0.0.1:8080/callback",
-				"http://127.0.0.1:8080/accounts/customprovider/login/callback/",
-				"http://localhost:8080/accounts/customprovider/login/callback/",
-			},
-			Scopes: []string{
-				"fosite", "photos", "offline",
-			},
-			Audience: []string{},
-			Grants: []string{
-				"implicit", "refresh_token", "authorization_code", "client_credentials",
-			},
-			ResponseTypes: []string{
-				"code", "token", "code token", "implicit",
-			},
-			TokenEndpointAuthMethod: "client_secret_basic",
-		},
-		{
-			ID:     "client-two",
-			Active: true,
-			Secret: "$2a$10$IxMdI6d.LIRZPpSfEwNoeu4rY3FhDREsxFJXikcgdRRAStxUlsuEO", // "foobar"
-			RotatedSecrets: []string{
-				"$2y$10$X51gLxUQJ.hGw1epgHTE5u0bt64xM0COU7K9iAp.OFg8p2pUd.1zC", // "foobaz"
-			},
-			Public:       false,
-			RedirectURIs: []string{},
-			Scopes: []string{
-				"fosite", "photos", "offline",
-			},
-			Audience: []string{},
-			Grants: []string{
-				"implicit", "refresh_token", "authorization_code", "client_credentials",
-			},
-			ResponseTypes: []string{
-				"code", "token", "code token",
-			},
-			TokenEndpointAuthMethod: "client_secret_basic",
-		},
+	sqlDB.SetMaxOpenConns(maxOpen)
+	sqlDB.SetMaxIdleConns(cfg.GetInt("database_max_idle_conns"))
+	sqlDB.SetConnMaxLifetime(cfg.GetDuration("database_conn_max_lifetime"))
+	sqlDB.SetConnMaxIdleTime(cfg.GetDuration("database_conn_max_idle_time"))
+
+	return db, nil
+}
+
+func NewStore(cfg config.Provider) (*Store, error) {
+	db, err := Open(cfg)
+	if err != nil {
+		return nil, err
 	}
 
-	for _, client := range clients {
-		err = db.Clauses(
-			clause.OnConflict{
-				Columns: []clause.Column{
-					{Name: "id"},
-				},
-				UpdateAll: true,
-			},
-		).Create(&client).Error
-		if err != nil {
-			log.Fatal("failed to create client:", err)
+	pepper, err := tokenPepper(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	previousPeppers, err := previousTokenPeppers(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(pepper) == 0 {
+		if !cfg.GetBool("dev_mode") {
+			return nil, errors.New("token_hash_pepper must be set outside dev_mode")
 		}
+
+		log.Warn("token_hash_pepper is not set, token signatures are hashed without a secret key")
+	}
+
+	cipher, err := requiredCipher(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load encryption keys: %w", err)
+	}
+
+	if cipher == nil {
+		log.Warn("encryption_keyfile is not set, request forms and session claims are stored unencrypted")
 	}
 
-	for _, user := range users {
-		err = db.Clauses(
-			clause.OnConflict{
-				Columns: []clause.Column{
-					{Name: "username"},
-				},
-				UpdateAll: true,
-			},
-		).Create(&user).Error
+	migrator := NewMigrator(db, cfg)
+
+	if cfg.GetBool("database_migrate_on_start") {
+		if _, err := migrator.Up(context.Background()); err != nil {
+			return nil, fmt.Errorf("failed to run migrations: %w", err)
+		}
+	} else {
+		pending, err := migrator.Pending(context.Background())
 		if err != nil {
-			log.Fatal("failed to create client:", err)
+			return nil, err
+		}
+
+		if len(pending) > 0 {
+			return nil, fmt.Errorf("the database schema is out of date, %d migrations are pending", len(pending))
 		}
 	}
 
 	return &Store{
-		db: db,
+		db:              db,
+		pepper:          pepper,
+		previousPeppers: previousPeppers,
+		cipher:          cipher,
+	}, nil
+}
+
+// Close closes the connections to the database.
+func (m Store) Close() error {
+	sqlDB, err := m.db.DB()
+	if err != nil {
+		return err
 	}
+
+	return sqlDB.Close()
 }
@@ -0,0 +1,115 @@
+package store_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/Muchogoc/go-oauth2-server/config"
+	"github.com/Muchogoc/go-oauth2-server/internal/store"
+	"github.com/Muchogoc/go-oauth2-server/internal/store/storetest"
+	"github.com/spf13/viper"
+)
+
+// testDatabases are the drivers the SQL store is tested on, with the environment
+// variable holding their DSN. SQLite runs in memory when its variable is unset;
+// the other databases are skipped.
+var testDatabases = []struct {
+	driver string
+	env    string
+}{
+	{"sqlite", "GO_OAUTH2_SERVER_TEST_SQLITE_DSN"},
+	{"postgres", "GO_OAUTH2_SERVER_TEST_POSTGRES_DSN"},
+	{"mysql", "GO_OAUTH2_SERVER_TEST_MYSQL_DSN"},
+}
+
+// testDSN returns the DSN of a test database, skipping the test when it is not
+// configured.
+func testDSN(t *testing.T, driver string, env string) string {
+	t.Helper()
+
+	dsn := os.Getenv(env)
+	if dsn == "" && driver != "sqlite" {
+		t.Skipf("%s is not set", env)
+	}
+
+	if dsn == "" {
+		dsn = ":memory:"
+	}
+
+	return dsn
+}
+
+// forEachDatabase runs a test against a store on every configured database.
+func forEachDatabase(t *testing.T, test func(t *testing.T, s *store.Store)) {
+	for _, database := range testDatabases {
+		database := database
+
+		t.Run(database.driver, func(t *testing.T) {
+			test(t, newTestStore(t, database.driver, testDSN(t, database.driver, database.env)))
+		})
+	}
+}
+
+func TestStore(t *testing.T) {
+	for _, database := range testDatabases {
+		database := database
+
+		t.Run(database.driver, func(t *testing.T) {
+			dsn := testDSN(t, database.driver, database.env)
+
+			storetest.Run(t, func(t *testing.T) store.Storage {
+				return newTestStore(t, database.driver, dsn)
+			})
+		})
+	}
+}
+
+// newTestConfig returns the default configuration for a database.
+func newTestConfig(driver string, dsn string) *viper.Viper {
+	v := config.LoadConfigProvider("GO-OAUTH2-SERVER-TEST").(*viper.Viper)
+	v.Set("loglevel", "error")
+	v.Set("database_driver", driver)
+	v.Set("database_dsn", dsn)
+	v.Set("token_hash_pepper", "test-pepper")
+
+	return v
+}
+
+// newTestStore returns a store on an empty, migrated database. Shared databases
+// are emptied by dropping every table first.
+func newTestStore(t *testing.T, driver string, dsn string) *store.Store {
+	t.Helper()
+
+	v := newTestConfig(driver, dsn)
+
+	if dsn != ":memory:" {
+		db, err := store.Open(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tables, err := db.Migrator().GetTables()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, table := range tables {
+			if err := db.Migrator().DropTable(table); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if sqlDB, err := db.DB(); err == nil {
+			_ = sqlDB.Close()
+		}
+	}
+
+	s, err := store.NewStore(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { _ = s.Close() })
+
+	return s
+}
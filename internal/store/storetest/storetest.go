@@ -0,0 +1,795 @@
+// Package storetest checks that an implementation of store.Storage behaves like
+// the others, so that the database and in-memory stores can be used in place of
+// each other.
+package storetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Muchogoc/go-oauth2-server/internal/store"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/ory/fosite"
+)
+
+// Factory returns an empty store for a test.
+type Factory func(t *testing.T) store.Storage
+
+// Run runs every conformance test against stores returned by newStore.
+func Run(t *testing.T, newStore Factory) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, s store.Storage)
+	}{
+		{"Clients", testClients},
+		{"Users", testUsers},
+		{"UserTokens", testUserTokens},
+		{"AuthorizeCodes", testAuthorizeCodes},
+		{"AccessTokens", testAccessTokens},
+		{"RefreshTokens", testRefreshTokens},
+		{"PKCE", testPKCE},
+		{"RevokeGrant", testRevokeGrant},
+		{"UsedRefreshTokens", testUsedRefreshTokens},
+		{"RevokeClientTokens", testRevokeClientTokens},
+		{"LoginAttempts", testLoginAttempts},
+		{"WebAuthnSessions", testWebAuthnSessions},
+		{"EmptyIDs", testEmptyIDs},
+		{"Transactions", testTransactions},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, newStore(t))
+		})
+	}
+}
+
+// createClient stores an active client.
+func createClient(t *testing.T, s store.Storage, id string) *store.Client {
+	t.Helper()
+
+	client := &store.Client{
+		ID:           id,
+		Active:       true,
+		RedirectURIs: store.StringArray{"https://example.com/callback"},
+		Scopes:       store.StringArray{"openid", "offline"},
+		Grants:       store.StringArray{"authorization_code", "refresh_token"},
+	}
+
+	if err := s.CreateClient(context.Background(), client); err != nil {
+		t.Fatal(err)
+	}
+
+	return client
+}
+
+// createUser stores an active user.
+func createUser(t *testing.T, s store.Storage, username string) *store.User {
+	t.Helper()
+
+	hash, err := store.HashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := &store.User{
+		Active:   true,
+		Name:     username,
+		Username: username,
+		Password: hash,
+		Email:    username + "@example.com",
+	}
+
+	if err := s.CreateUser(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+
+	return user
+}
+
+// newRequest returns a request of a user to a client, with tokens expiring in
+// an hour.
+func newRequest(t *testing.T, client *store.Client, user *store.User, id string) *fosite.Request {
+	t.Helper()
+
+	session, err := store.NewSession(context.Background(), client.ID, user.ID, user.Username, user.ID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tokenType := range []fosite.TokenType{fosite.AuthorizeCode, fosite.AccessToken, fosite.RefreshToken} {
+		session.SetExpiresAt(tokenType, time.Now().Add(time.Hour).Round(time.Second))
+	}
+
+	request := fosite.NewRequest()
+	request.ID = id
+	request.Client = client
+	request.Session = session
+	request.RequestedAt = time.Now().UTC().Round(time.Second)
+	request.SetRequestedScopes(fosite.Arguments{"openid", "offline"})
+	request.GrantScope("openid")
+	request.GrantScope("offline")
+	request.Form.Set("redirect_uri", "https://example.com/callback")
+
+	return request
+}
+
+// checkRequest fails the test when a stored request does not match the one that
+// was stored.
+func checkRequest(t *testing.T, got fosite.Requester, want *fosite.Request) {
+	t.Helper()
+
+	if got == nil {
+		t.Fatal("no request was returned")
+	}
+
+	if got.GetID() != want.GetID() {
+		t.Errorf("got request %s, want %s", got.GetID(), want.GetID())
+	}
+
+	if got.GetClient().GetID() != want.GetClient().GetID() {
+		t.Errorf("got client %s, want %s", got.GetClient().GetID(), want.GetClient().GetID())
+	}
+
+	if fmt.Sprint(got.GetGrantedScopes()) != fmt.Sprint(want.GetGrantedScopes()) {
+		t.Errorf("got granted scopes %v, want %v", got.GetGrantedScopes(), want.GetGrantedScopes())
+	}
+
+	if got.GetRequestForm().Get("redirect_uri") != want.GetRequestForm().Get("redirect_uri") {
+		t.Errorf("got form %v, want %v", got.GetRequestForm(), want.GetRequestForm())
+	}
+
+	if got.GetSession().GetSubject() != want.GetSession().GetSubject() {
+		t.Errorf("got subject %s, want %s", got.GetSession().GetSubject(), want.GetSession().GetSubject())
+	}
+
+	if !got.GetSession().GetExpiresAt(fosite.AccessToken).Equal(want.GetSession().GetExpiresAt(fosite.AccessToken)) {
+		t.Errorf("got expiry %s, want %s", got.GetSession().GetExpiresAt(fosite.AccessToken), want.GetSession().GetExpiresAt(fosite.AccessToken))
+	}
+}
+
+func testClients(t *testing.T, s store.Storage) {
+	ctx := context.Background()
+	client := createClient(t, s, "app")
+
+	if err := s.CreateClient(ctx, &store.Client{ID: "app"}); err == nil {
+		t.Error("a client was created twice")
+	}
+
+	found, err := s.GetClient(ctx, "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fmt.Sprint(found.GetRedirectURIs()) != fmt.Sprint(client.RedirectURIs) || fmt.Sprint(found.GetScopes()) != fmt.Sprint(client.Scopes) {
+		t.Errorf("got redirect URIs %v and scopes %v", found.GetRedirectURIs(), found.GetScopes())
+	}
+
+	client.Active = false
+	client.Scopes = store.StringArray{"openid"}
+
+	if err := s.UpdateClient(ctx, client); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.GetClient(ctx, "app"); !errors.Is(err, fosite.ErrNotFound) {
+		t.Errorf("an inactive client returned %v, want fosite.ErrNotFound", err)
+	}
+
+	updated, err := s.GetClientByID(ctx, "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if updated.Active || fmt.Sprint(updated.Scopes) != "[openid]" {
+		t.Errorf("the update was not stored: active %t, scopes %v", updated.Active, updated.Scopes)
+	}
+
+	createClient(t, s, "other")
+
+	clients, total, err := s.ListClients(ctx, store.ClientFilter{Search: "app"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if total != 1 || len(clients) != 1 || clients[0].ID != "app" {
+		t.Errorf("listed %d of %d clients, want only app", len(clients), total)
+	}
+
+	if err := s.DeleteClient(ctx, "app"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.GetClientByID(ctx, "app"); !errors.Is(err, fosite.ErrNotFound) {
+		t.Errorf("a deleted client returned %v, want fosite.ErrNotFound", err)
+	}
+
+	if err := s.DeleteClient(ctx, "app"); !errors.Is(err, fosite.ErrNotFound) {
+		t.Errorf("deleting a deleted client returned %v, want fosite.ErrNotFound", err)
+	}
+}
+
+func testUsers(t *testing.T, s store.Storage) {
+	ctx := context.Background()
+	user := createUser(t, s, "alice")
+
+	if user.ID == "" {
+		t.Fatal("the user was not given an ID")
+	}
+
+	if err := s.CreateUser(ctx, &store.User{Username: "alice"}); !errors.Is(err, store.ErrUsernameTaken) {
+		t.Errorf("a taken username returned %v, want ErrUsernameTaken", err)
+	}
+
+	if err := s.CreateUser(ctx, &store.User{Username: "bob", Email: "alice@example.com"}); !errors.Is(err, store.ErrEmailTaken) {
+		t.Errorf("a taken email returned %v, want ErrEmailTaken", err)
+	}
+
+	for name, get := range map[string]func() (*store.User, error){
+		"username": func() (*store.User, error) { return s.GetUser(ctx, "alice") },
+		"ID":       func() (*store.User, error) { return s.GetUserByID(ctx, user.ID) },
+		"email":    func() (*store.User, error) { return s.GetUserByEmail(ctx, "alice@example.com") },
+	} {
+		found, err := get()
+		if err != nil {
+			t.Fatalf("getting the user by %s: %v", name, err)
+		}
+
+		if found.ID != user.ID {
+			t.Errorf("getting the user by %s returned %s", name, found.ID)
+		}
+	}
+
+	if err := s.Authenticate(ctx, "alice", "correct horse"); err != nil {
+		t.Errorf("the password was refused: %v", err)
+	}
+
+	if err := s.Authenticate(ctx, "alice", "wrong"); err == nil {
+		t.Error("a wrong password was accepted")
+	}
+
+	user.Name = "Alice"
+	if err := s.UpdateUser(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.SetUserRoles(ctx, user.ID, []string{"admin", "auditor"}); err != nil {
+		t.Fatal(err)
+	}
+
+	roles, err := s.GetUserRoles(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fmt.Sprint(roles) != "[admin auditor]" {
+		t.Errorf("got roles %v", roles)
+	}
+
+	if err := s.MarkEmailVerified(ctx, user.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := s.GetUserByID(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if found.Name != "Alice" || !found.EmailVerified {
+		t.Errorf("got name %q and verified %t", found.Name, found.EmailVerified)
+	}
+
+	hash, err := store.HashPassword("battery staple")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.SetUserPassword(ctx, user.ID, hash); err != nil {
+		t.Fatal(err)
+	}
+
+	if reused, err := s.PasswordReused(ctx, user.ID, "correct horse", 1); err != nil || !reused {
+		t.Errorf("the previous password is not in the history: %t, %v", reused, err)
+	}
+
+	users, total, err := s.ListUsers(ctx, store.UserFilter{Role: "admin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if total != 1 || len(users) != 1 || users[0].ID != user.ID {
+		t.Errorf("listed %d of %d admins", len(users), total)
+	}
+
+	if err := s.DeleteUser(ctx, user.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.GetUser(ctx, "alice"); !errors.Is(err, fosite.ErrNotFound) {
+		t.Errorf("a deleted user returned %v, want fosite.ErrNotFound", err)
+	}
+}
+
+func testUserTokens(t *testing.T, s store.Storage) {
+	ctx := context.Background()
+	user := createUser(t, s, "alice")
+
+	token, err := s.CreateUserToken(ctx, user.ID, store.UserTokenEmailVerification, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.GetUserToken(ctx, store.UserTokenPasswordReset, token); !errors.Is(err, fosite.ErrNotFound) {
+		t.Errorf("a token was found for another purpose: %v", err)
+	}
+
+	found, err := s.GetUserToken(ctx, store.UserTokenEmailVerification, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if found.UserID != user.ID {
+		t.Errorf("the token belongs to %s, want %s", found.UserID, user.ID)
+	}
+
+	if _, err := s.ConsumeUserToken(ctx, store.UserTokenEmailVerification, token); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.ConsumeUserToken(ctx, store.UserTokenEmailVerification, token); !errors.Is(err, fosite.ErrNotFound) {
+		t.Errorf("a token was used twice: %v", err)
+	}
+
+	expired, err := s.CreateUserToken(ctx, user.ID, store.UserTokenPasswordReset, -time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.ResetUserPassword(ctx, expired, "new-hash"); !errors.Is(err, fosite.ErrNotFound) {
+		t.Errorf("an expired token reset the password: %v", err)
+	}
+
+	reset, err := s.CreateUserToken(ctx, user.ID, store.UserTokenPasswordReset, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hash, err := store.HashPassword("battery staple")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.ResetUserPassword(ctx, reset, hash); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Authenticate(ctx, "alice", "battery staple"); err != nil {
+		t.Errorf("the reset password was refused: %v", err)
+	}
+
+	if _, err := s.ResetUserPassword(ctx, reset, hash); !errors.Is(err, fosite.ErrNotFound) {
+		t.Errorf("a reset token was used twice: %v", err)
+	}
+}
+
+func testAuthorizeCodes(t *testing.T, s store.Storage) {
+	ctx := context.Background()
+	request := newRequest(t, createClient(t, s, "app"), createUser(t, s, "alice"), "grant")
+
+	if err := s.CreateAuthorizeCodeSession(ctx, "code", request); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := s.GetAuthorizeCodeSession(ctx, "code", &store.Session{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkRequest(t, found, request)
+
+	if err := s.InvalidateAuthorizeCodeSession(ctx, "code"); err != nil {
+		t.Fatal(err)
+	}
+
+	// fosite revokes the tokens of a code that is used twice, so it needs the request
+	found, err = s.GetAuthorizeCodeSession(ctx, "code", &store.Session{})
+	if !errors.Is(err, fosite.ErrInvalidatedAuthorizeCode) {
+		t.Fatalf("a used code returned %v, want fosite.ErrInvalidatedAuthorizeCode", err)
+	}
+
+	checkRequest(t, found, request)
+
+	if _, err := s.GetAuthorizeCodeSession(ctx, "unknown", &store.Session{}); !errors.Is(err, fosite.ErrNotFound) {
+		t.Errorf("an unknown code returned %v, want fosite.ErrNotFound", err)
+	}
+}
+
+func testAccessTokens(t *testing.T, s store.Storage) {
+	ctx := context.Background()
+	request := newRequest(t, createClient(t, s, "app"), createUser(t, s, "alice"), "grant")
+
+	if err := s.CreateAccessTokenSession(ctx, "access", request); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := s.GetAccessTokenSession(ctx, "access", &store.Session{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkRequest(t, found, request)
+
+	if err := s.DeleteAccessTokenSession(ctx, "access"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.GetAccessTokenSession(ctx, "access", &store.Session{}); !errors.Is(err, fosite.ErrNotFound) {
+		t.Errorf("a deleted token returned %v, want fosite.ErrNotFound", err)
+	}
+}
+
+func testRefreshTokens(t *testing.T, s store.Storage) {
+	ctx := context.Background()
+	request := newRequest(t, createClient(t, s, "app"), createUser(t, s, "alice"), "grant")
+
+	if err := s.CreateRefreshTokenSession(ctx, "refresh", request); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := s.GetRefreshTokenSession(ctx, "refresh", &store.Session{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkRequest(t, found, request)
+
+	if err := s.RevokeRefreshToken(ctx, request.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// fosite revokes the whole grant when a revoked refresh token is used
+	found, err = s.GetRefreshTokenSession(ctx, "refresh", &store.Session{})
+	if !errors.Is(err, fosite.ErrInactiveToken) {
+		t.Fatalf("a revoked token returned %v, want fosite.ErrInactiveToken", err)
+	}
+
+	checkRequest(t, found, request)
+
+	if err := s.DeleteRefreshTokenSession(ctx, "refresh"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.GetRefreshTokenSession(ctx, "refresh", &store.Session{}); !errors.Is(err, fosite.ErrNotFound) {
+		t.Errorf("a deleted token returned %v, want fosite.ErrNotFound", err)
+	}
+}
+
+func testPKCE(t *testing.T, s store.Storage) {
+	ctx := context.Background()
+	request := newRequest(t, createClient(t, s, "app"), createUser(t, s, "alice"), "grant")
+	request.Form.Set("code_challenge", "challenge")
+
+	if err := s.CreatePKCERequestSession(ctx, "pkce", request); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := s.GetPKCERequestSession(ctx, "pkce", &store.Session{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkRequest(t, found, request)
+
+	if found.GetRequestForm().Get("code_challenge") != "challenge" {
+		t.Errorf("the code challenge was not stored: %v", found.GetRequestForm())
+	}
+
+	if err := s.DeletePKCERequestSession(ctx, "pkce"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.GetPKCERequestSession(ctx, "pkce", &store.Session{}); !errors.Is(err, fosite.ErrNotFound) {
+		t.Errorf("a deleted PKCE request returned %v, want fosite.ErrNotFound", err)
+	}
+}
+
+// issue stores the code and the tokens of a grant, signed with the grant's ID.
+func issue(t *testing.T, s store.Storage, request *fosite.Request) {
+	t.Helper()
+
+	ctx := context.Background()
+
+	if err := s.CreateAuthorizeCodeSession(ctx, request.ID+"-code", request); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.InvalidateAuthorizeCodeSession(ctx, request.ID+"-code"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.CreateAccessTokenSession(ctx, request.ID+"-access", request); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.CreateRefreshTokenSession(ctx, request.ID+"-refresh", request); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// active reports whether the access and refresh tokens of a grant are active.
+func active(t *testing.T, s store.Storage, requestID string) (bool, bool) {
+	t.Helper()
+
+	ctx := context.Background()
+
+	_, accessErr := s.GetAccessTokenSession(ctx, requestID+"-access", &store.Session{})
+	if accessErr != nil && !errors.Is(accessErr, fosite.ErrInactiveToken) {
+		t.Fatal(accessErr)
+	}
+
+	_, refreshErr := s.GetRefreshTokenSession(ctx, requestID+"-refresh", &store.Session{})
+	if refreshErr != nil && !errors.Is(refreshErr, fosite.ErrInactiveToken) {
+		t.Fatal(refreshErr)
+	}
+
+	return accessErr == nil, refreshErr == nil
+}
+
+func testRevokeGrant(t *testing.T, s store.Storage) {
+	client := createClient(t, s, "app")
+	user := createUser(t, s, "alice")
+
+	revoked := newRequest(t, client, user, "revoked")
+	issue(t, s, revoked)
+
+	// the tokens refreshed from a grant keep its request ID
+	refreshed := newRequest(t, client, user, "revoked")
+	if err := s.CreateAccessTokenSession(context.Background(), "refreshed-access", refreshed); err != nil {
+		t.Fatal(err)
+	}
+
+	kept := newRequest(t, client, user, "kept")
+	issue(t, s, kept)
+
+	if err := s.RevokeAccessToken(context.Background(), revoked.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if access, refresh := active(t, s, revoked.ID); access || refresh {
+		t.Errorf("after revoking the grant its access token is active %t and refresh token %t", access, refresh)
+	}
+
+	if _, err := s.GetAccessTokenSession(context.Background(), "refreshed-access", &store.Session{}); !errors.Is(err, fosite.ErrInactiveToken) {
+		t.Errorf("a refreshed access token of the grant returned %v, want fosite.ErrInactiveToken", err)
+	}
+
+	if access, refresh := active(t, s, kept.ID); !access || !refresh {
+		t.Errorf("another grant's access token is active %t and refresh token %t", access, refresh)
+	}
+
+	if err := s.RevokeGrant(context.Background(), "unknown"); err != nil {
+		t.Errorf("revoking an unknown grant returned %v", err)
+	}
+}
+
+func testUsedRefreshTokens(t *testing.T, s store.Storage) {
+	request := newRequest(t, createClient(t, s, "app"), createUser(t, s, "alice"), "grant")
+	issue(t, s, request)
+
+	// there is no grace period, a used refresh token cannot be used again
+	if err := s.RevokeRefreshTokenMaybeGracePeriod(context.Background(), request.ID, request.ID+"-refresh"); err != nil {
+		t.Fatal(err)
+	}
+
+	if access, refresh := active(t, s, request.ID); access || refresh {
+		t.Errorf("after using the refresh token the access token is active %t and refresh token %t", access, refresh)
+	}
+}
+
+func testRevokeClientTokens(t *testing.T, s store.Storage) {
+	user := createUser(t, s, "alice")
+
+	revoked := newRequest(t, createClient(t, s, "revoked"), user, "revoked-grant")
+	issue(t, s, revoked)
+
+	kept := newRequest(t, createClient(t, s, "kept"), user, "kept-grant")
+	issue(t, s, kept)
+
+	if err := s.RevokeClientTokens(context.Background(), "revoked"); err != nil {
+		t.Fatal(err)
+	}
+
+	if access, refresh := active(t, s, revoked.ID); access || refresh {
+		t.Errorf("after revoking the client its access token is active %t and refresh token %t", access, refresh)
+	}
+
+	if access, refresh := active(t, s, kept.ID); !access || !refresh {
+		t.Errorf("another client's access token is active %t and refresh token %t", access, refresh)
+	}
+}
+
+func testLoginAttempts(t *testing.T, s store.Storage) {
+	ctx := context.Background()
+
+	attempt, err := s.GetLoginAttempt(ctx, "user:alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if attempt.Failures != 0 {
+		t.Fatalf("a new key has %d failures", attempt.Failures)
+	}
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			_, err := s.UpdateLoginAttempt(ctx, "user:alice", func(attempt *store.LoginAttempt) bool {
+				attempt.Failures++
+				return true
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	attempt, err = s.GetLoginAttempt(ctx, "user:alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if attempt.Failures != 20 {
+		t.Errorf("20 concurrent updates counted %d failures", attempt.Failures)
+	}
+
+	// an update that changes nothing is not saved
+	unchanged, err := s.UpdateLoginAttempt(ctx, "user:alice", func(attempt *store.LoginAttempt) bool {
+		attempt.Failures = 1
+		return false
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if unchanged.Failures != 1 {
+		t.Errorf("the update returned %d failures, want the changed attempt", unchanged.Failures)
+	}
+
+	if attempt, _ := s.GetLoginAttempt(ctx, "user:alice"); attempt.Failures != 20 {
+		t.Errorf("an unchanged attempt was saved with %d failures", attempt.Failures)
+	}
+
+	if err := s.ClearLoginAttempt(ctx, "user:alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	if attempt, _ := s.GetLoginAttempt(ctx, "user:alice"); attempt.Failures != 0 {
+		t.Errorf("a cleared key has %d failures", attempt.Failures)
+	}
+}
+
+func testWebAuthnSessions(t *testing.T, s store.Storage) {
+	ctx := context.Background()
+
+	id, err := s.CreateWebAuthnSession(ctx, &webauthn.SessionData{
+		Challenge: "challenge",
+		UserID:    []byte("alice"),
+		Expires:   time.Now().Add(time.Minute),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an empty ID must not match the ceremony of another user
+	if _, err := s.PopWebAuthnSession(ctx, ""); !errors.Is(err, fosite.ErrNotFound) {
+		t.Errorf("an empty session ID returned %v, want fosite.ErrNotFound", err)
+	}
+
+	session, err := s.PopWebAuthnSession(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if session.Challenge != "challenge" {
+		t.Errorf("got challenge %q, want %q", session.Challenge, "challenge")
+	}
+
+	if _, err := s.PopWebAuthnSession(ctx, id); !errors.Is(err, fosite.ErrNotFound) {
+		t.Errorf("a used session returned %v, want fosite.ErrNotFound", err)
+	}
+}
+
+func testEmptyIDs(t *testing.T, s store.Storage) {
+	ctx := context.Background()
+
+	createClient(t, s, "app")
+	createUser(t, s, "alice")
+
+	if _, err := s.GetClient(ctx, ""); !errors.Is(err, fosite.ErrNotFound) {
+		t.Errorf("GetClient with an empty ID returned %v, want fosite.ErrNotFound", err)
+	}
+
+	if _, err := s.GetClientByID(ctx, ""); !errors.Is(err, fosite.ErrNotFound) {
+		t.Errorf("GetClientByID with an empty ID returned %v, want fosite.ErrNotFound", err)
+	}
+
+	if _, err := s.GetUserByID(ctx, ""); !errors.Is(err, fosite.ErrNotFound) {
+		t.Errorf("GetUserByID with an empty ID returned %v, want fosite.ErrNotFound", err)
+	}
+}
+
+func testTransactions(t *testing.T, s store.Storage) {
+	client := createClient(t, s, "app")
+	user := createUser(t, s, "alice")
+
+	for _, commit := range []bool{false, true} {
+		ctx, err := s.BeginTX(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		request := newRequest(t, client, user, fmt.Sprintf("grant-%t", commit))
+		if err := s.CreateAccessTokenSession(ctx, request.ID, request); err != nil {
+			t.Fatal(err)
+		}
+
+		name := fmt.Sprintf("changed-%t", commit)
+		changed := *user
+		changed.Name = name
+
+		if err := s.UpdateUser(ctx, &changed); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = s.UpdateLoginAttempt(ctx, "user:alice", func(attempt *store.LoginAttempt) bool {
+			attempt.Failures++
+			return true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if commit {
+			err = s.Commit(ctx)
+		} else {
+			err = s.Rollback(ctx)
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, tokenErr := s.GetAccessTokenSession(context.Background(), request.ID, &store.Session{})
+
+		found, err := s.GetUserByID(context.Background(), user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		attempt, err := s.GetLoginAttempt(context.Background(), "user:alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if commit && (tokenErr != nil || found.Name != name || attempt.Failures != 1) {
+			t.Errorf("a commit kept token error %v, name %q and %d failures", tokenErr, found.Name, attempt.Failures)
+		}
+
+		if !commit && (!errors.Is(tokenErr, fosite.ErrNotFound) || found.Name == name || attempt.Failures != 0) {
+			t.Errorf("a rollback left token error %v, name %q and %d failures", tokenErr, found.Name, attempt.Failures)
+		}
+	}
+}
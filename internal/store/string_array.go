@@ -2,32 +2,58 @@ package store
 
 import (
 	"database/sql/driver"
+	"encoding/json"
 	"fmt"
-	"strings"
 )
 
+// StringArray is stored as a JSON array in a text column, which every supported
+// database can hold. Values written before migration 0006 were joined with ";".
 type StringArray []string
 
+// GormDataType stores the array in a text column on every database.
+func (StringArray) GormDataType() string {
+	return "text"
+}
+
 func (s StringArray) Value() (driver.Value, error) {
 	if s == nil {
-		return "", nil
+		return "[]", nil
 	}
 
-	return strings.Join(s, ";"), nil
+	value, err := json.Marshal([]string(s))
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal string array: %w", err)
+	}
+
+	return string(value), nil
 }
 
 func (s *StringArray) Scan(value interface{}) error {
-	// case when value from the db was NULL
-	if value == nil {
+	var data []byte
+
+	switch value := value.(type) {
+	case nil:
+		// case when value from the db was NULL
 		return nil
+	case string:
+		data = []byte(value)
+	case []byte:
+		data = value
+	default:
+		return fmt.Errorf("failed to cast value to string: %v", value)
 	}
 
-	st, ok := value.(string)
-	if !ok {
-		return fmt.Errorf("failed to cast value to string: %v", value)
+	if len(data) == 0 {
+		*s = nil
+		return nil
+	}
+
+	var result []string
+	if err := json.Unmarshal(data, &result); err != nil {
+		return fmt.Errorf("failed to unmarshal string array: %w", err)
 	}
 
-	*s = strings.Split(st, ";")
+	*s = result
 
 	return nil
 }
@@ -0,0 +1,71 @@
+package store_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/Muchogoc/go-oauth2-server/internal/store"
+)
+
+func TestStringArrayScan(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+		want  store.StringArray
+	}{
+		{"string", `["openid","offline"]`, store.StringArray{"openid", "offline"}},
+		{"bytes", []byte(`["openid","offline"]`), store.StringArray{"openid", "offline"}},
+		{"empty array", []byte(`[]`), store.StringArray{}},
+		{"empty", []byte{}, nil},
+		{"null", nil, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got store.StringArray
+			if err := got.Scan(tt.value); err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+
+	var got store.StringArray
+	if err := got.Scan(42); err == nil {
+		t.Error("an integer was scanned without an error")
+	}
+}
+
+func TestStringArrayRoundTrip(t *testing.T) {
+	forEachDatabase(t, func(t *testing.T, s *store.Store) {
+		ctx := context.Background()
+
+		client := &store.Client{
+			ID:           "test-client",
+			Active:       true,
+			RedirectURIs: store.StringArray{"https://example.com/callback?a=1;b=2"},
+			Scopes:       store.StringArray{"openid", "offline"},
+		}
+
+		if err := s.CreateClient(ctx, client); err != nil {
+			t.Fatal(err)
+		}
+
+		found, err := s.GetClient(ctx, client.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := found.GetRedirectURIs(); !reflect.DeepEqual(got, []string(client.RedirectURIs)) {
+			t.Errorf("got redirect URIs %q, want %q", got, client.RedirectURIs)
+		}
+
+		if got := found.GetScopes(); !reflect.DeepEqual([]string(got), []string(client.Scopes)) {
+			t.Errorf("got scopes %q, want %q", got, client.Scopes)
+		}
+	})
+}
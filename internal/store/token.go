@@ -0,0 +1,283 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/ory/fosite"
+	"gorm.io/gorm"
+)
+
+// TokenInfo describes an access or refresh token without revealing it.
+type TokenInfo struct {
+	ID   string
+	Type fosite.TokenType
+	// RequestID identifies the grant the token belongs to
+	RequestID   string
+	ClientID    string
+	SessionID   string
+	UserID      string
+	Username    string
+	Scopes      []string
+	Active      bool
+	RequestedAt time.Time
+	// ExpiresAt is nil for tokens that never expire
+	ExpiresAt *time.Time
+}
+
+// TokenFilter narrows down the tokens returned by ListTokens and revoked by
+// RevokeTokens. Zero values match every token.
+type TokenFilter struct {
+	// Type is fosite.AccessToken or fosite.RefreshToken, or empty for both
+	Type fosite.TokenType
+	// RequestID matches the tokens of a single grant
+	RequestID string
+	UserID    string
+	ClientID  string
+	// Scope matches tokens that were granted the scope
+	Scope string
+	// IssuedAfter and IssuedBefore bound the time the tokens were requested at
+	IssuedAfter  time.Time
+	IssuedBefore time.Time
+	// ActiveOnly leaves out revoked and expired tokens
+	ActiveOnly bool
+	Limit      int
+	Offset     int
+}
+
+// IsEmpty reports whether the filter matches every token regardless of who or
+// what it was issued to.
+func (f TokenFilter) IsEmpty() bool {
+	return f.RequestID == "" && f.UserID == "" && f.ClientID == "" && f.Scope == "" &&
+		f.IssuedAfter.IsZero() && f.IssuedBefore.IsZero()
+}
+
+// matches reports whether a token matches the criteria of the filter, leaving
+// out its type and whether it is active.
+func (f TokenFilter) matches(token TokenInfo) bool {
+	switch {
+	case f.RequestID != "" && token.RequestID != f.RequestID:
+		return false
+	case f.UserID != "" && token.UserID != f.UserID:
+		return false
+	case f.ClientID != "" && token.ClientID != f.ClientID:
+		return false
+	case f.Scope != "" && !fosite.Arguments(token.Scopes).Has(f.Scope):
+		return false
+	case !f.IssuedAfter.IsZero() && token.RequestedAt.Before(f.IssuedAfter):
+		return false
+	case !f.IssuedBefore.IsZero() && !token.RequestedAt.Before(f.IssuedBefore):
+		return false
+	}
+
+	return true
+}
+
+// tokenTypes returns the token types a filter covers.
+func (f TokenFilter) tokenTypes() []fosite.TokenType {
+	if f.Type != "" {
+		return []fosite.TokenType{f.Type}
+	}
+
+	return []fosite.TokenType{fosite.AccessToken, fosite.RefreshToken}
+}
+
+// sortTokens orders tokens newest first.
+func sortTokens(tokens []TokenInfo) {
+	sort.Slice(tokens, func(i, j int) bool {
+		if !tokens[i].RequestedAt.Equal(tokens[j].RequestedAt) {
+			return tokens[i].RequestedAt.After(tokens[j].RequestedAt)
+		}
+
+		return tokens[i].ID < tokens[j].ID
+	})
+}
+
+// pageTokens sorts tokens and returns the page a filter asks for.
+func pageTokens(tokens []TokenInfo, filter TokenFilter) []TokenInfo {
+	sortTokens(tokens)
+
+	if filter.Offset > 0 {
+		if filter.Offset >= len(tokens) {
+			return nil
+		}
+
+		tokens = tokens[filter.Offset:]
+	}
+
+	if filter.Limit > 0 && filter.Limit < len(tokens) {
+		tokens = tokens[:filter.Limit]
+	}
+
+	return tokens
+}
+
+// ListTokens returns a page of the access and refresh tokens matching a filter,
+// newest first, and how many tokens match in total.
+func (m Store) ListTokens(ctx context.Context, filter TokenFilter) ([]TokenInfo, int64, error) {
+	var (
+		tokens []TokenInfo
+		total  int64
+	)
+
+	// the page of the merged list is among the first offset+limit rows of each table
+	limit := 0
+	if filter.Limit > 0 {
+		limit = filter.Offset + filter.Limit
+	}
+
+	for _, tokenType := range filter.tokenTypes() {
+		results, count, err := m.listTokens(ctx, tokenType, filter, limit)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		tokens = append(tokens, results...)
+		total += count
+	}
+
+	return pageTokens(tokens, filter), total, nil
+}
+
+// listTokens returns the first limit tokens of one type matching a filter, or all
+// of them when limit is not positive, and how many match in total.
+func (m Store) listTokens(ctx context.Context, tokenType fosite.TokenType, filter TokenFilter, limit int) ([]TokenInfo, int64, error) {
+	table := "access_tokens"
+	if tokenType == fosite.RefreshToken {
+		table = "refresh_tokens"
+	}
+
+	query := m.conn(ctx).Table(table).
+		Joins("LEFT JOIN sessions ON sessions.id = " + table + ".session_id").
+		Where(table + ".deleted_at IS NULL")
+
+	query = m.filterTokens(ctx, query, table, filter)
+
+	if filter.ActiveOnly {
+		query = query.Where(table+".active = ? AND ("+table+".expires_at IS NULL OR "+table+".expires_at > ?)", true, time.Now())
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, fmt.Errorf("error counting tokens: %w", err)
+	}
+
+	if limit <= 0 {
+		limit = -1
+	}
+
+	var rows []struct {
+		ID            string
+		RequestID     string
+		ClientID      string
+		SessionID     string
+		UserID        string
+		Username      string
+		GrantedScopes StringArray
+		Active        bool
+		RequestedAt   time.Time
+		ExpiresAt     *time.Time
+	}
+
+	err := query.
+		Select(table + ".id, " + table + ".request_id, " + table + ".client_id, " + table + ".session_id, " +
+			"COALESCE(sessions.user_id, '') AS user_id, COALESCE(sessions.username, '') AS username, " + table + ".granted_scopes, " + table + ".active, " +
+			table + ".requested_at, " + table + ".expires_at").
+		Order(table + ".requested_at DESC, " + table + ".id").
+		Limit(limit).
+		Scan(&rows).Error
+	if err != nil {
+		return nil, 0, fmt.Errorf("error fetching tokens: %w", err)
+	}
+
+	tokens := make([]TokenInfo, 0, len(rows))
+
+	for _, row := range rows {
+		tokens = append(tokens, TokenInfo{
+			ID:          row.ID,
+			Type:        tokenType,
+			RequestID:   row.RequestID,
+			ClientID:    row.ClientID,
+			SessionID:   row.SessionID,
+			UserID:      row.UserID,
+			Username:    row.Username,
+			Scopes:      row.GrantedScopes,
+			Active:      row.Active,
+			RequestedAt: row.RequestedAt,
+			ExpiresAt:   row.ExpiresAt,
+		})
+	}
+
+	return tokens, total, nil
+}
+
+// filterTokens adds the criteria of a filter to a query of a code or token table.
+// Columns are qualified with the table name, so that the query can join others.
+func (m Store) filterTokens(ctx context.Context, query *gorm.DB, table string, filter TokenFilter) *gorm.DB {
+	if filter.RequestID != "" {
+		query = query.Where(table+".request_id = ?", filter.RequestID)
+	}
+
+	if filter.UserID != "" {
+		sessions := m.conn(ctx).Model(&Session{}).Unscoped().Select("id").Where("user_id = ?", filter.UserID)
+		query = query.Where(table+".session_id IN (?)", sessions)
+	}
+
+	if filter.ClientID != "" {
+		query = query.Where(table+".client_id = ?", filter.ClientID)
+	}
+
+	if filter.Scope != "" {
+		// scopes are stored as a JSON array of strings
+		query = query.Where(table+".granted_scopes LIKE ?", `%"`+filter.Scope+`"%`)
+	}
+
+	if !filter.IssuedAfter.IsZero() {
+		query = query.Where(table+".requested_at >= ?", filter.IssuedAfter)
+	}
+
+	if !filter.IssuedBefore.IsZero() {
+		query = query.Where(table+".requested_at < ?", filter.IssuedBefore)
+	}
+
+	return query
+}
+
+// RevokeTokens deactivates the authorization codes, access tokens, refresh tokens
+// and PKCE requests matching a filter, whatever its type, and returns how many
+// were revoked by table.
+func (m Store) RevokeTokens(ctx context.Context, filter TokenFilter) (map[string]int64, error) {
+	counts := make(map[string]int64)
+
+	tables := []struct {
+		name  string
+		model interface{}
+	}{
+		{"authorization_codes", &AuthorizationCode{}},
+		{"access_tokens", &AccessToken{}},
+		{"refresh_tokens", &RefreshToken{}},
+		{"pkces", &PKCE{}},
+	}
+
+	err := m.transaction(ctx, func(ctx context.Context) error {
+		for _, table := range tables {
+			query := m.conn(ctx).Model(table.model).Where(table.name+".active = ?", true)
+
+			result := m.filterTokens(ctx, query, table.name, filter).Update("active", false)
+			if result.Error != nil {
+				return fmt.Errorf("failed to revoke %s: %w", table.name, result.Error)
+			}
+
+			counts[table.name] = result.RowsAffected
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return counts, nil
+}
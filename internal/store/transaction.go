@@ -0,0 +1,80 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+var ErrNoTransaction = errors.New("no transaction in the context")
+
+type transactionKey struct{}
+
+// conn returns the transaction started by BeginTX for the context, if any, so
+// that every store method called with that context takes part in it. Statements
+// carry the cipher of the store for its encrypted columns.
+func (m Store) conn(ctx context.Context) *gorm.DB {
+	if tx, ok := ctx.Value(transactionKey{}).(*gorm.DB); ok {
+		return tx
+	}
+
+	return m.db.WithContext(withCipher(ctx, m.cipher))
+}
+
+func inTransaction(ctx context.Context) bool {
+	_, ok := ctx.Value(transactionKey{}).(*gorm.DB)
+	return ok
+}
+
+// BeginTX starts a transaction and returns a context carrying it. It implements
+// fosite's storage.Transactional, which fosite uses to make token exchanges atomic.
+func (m Store) BeginTX(ctx context.Context) (context.Context, error) {
+	if inTransaction(ctx) {
+		return ctx, errors.New("a transaction is already in progress")
+	}
+
+	tx := m.db.WithContext(withCipher(ctx, m.cipher)).Begin()
+	if tx.Error != nil {
+		return ctx, fmt.Errorf("failed to begin transaction: %w", tx.Error)
+	}
+
+	return context.WithValue(ctx, transactionKey{}, tx), nil
+}
+
+// Commit commits the transaction carried by the context.
+func (m Store) Commit(ctx context.Context) error {
+	tx, ok := ctx.Value(transactionKey{}).(*gorm.DB)
+	if !ok {
+		return ErrNoTransaction
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// Rollback aborts the transaction carried by the context.
+func (m Store) Rollback(ctx context.Context) error {
+	tx, ok := ctx.Value(transactionKey{}).(*gorm.DB)
+	if !ok {
+		return ErrNoTransaction
+	}
+
+	if err := tx.Rollback().Error; err != nil {
+		return fmt.Errorf("failed to roll back transaction: %w", err)
+	}
+
+	return nil
+}
+
+// transaction runs fn in a transaction, or in a savepoint of the transaction
+// carried by the context.
+func (m Store) transaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	return m.conn(ctx).Transaction(func(tx *gorm.DB) error {
+		return fn(context.WithValue(ctx, transactionKey{}, tx))
+	})
+}
@@ -2,19 +2,474 @@ package store
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/ory/fosite"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
 )
 
+const (
+	// UserTokenEmailVerification is the purpose of tokens that confirm an email address
+	UserTokenEmailVerification = "email_verification"
+	// UserTokenPasswordReset is the purpose of tokens that let a user choose a new password
+	UserTokenPasswordReset = "password_reset"
+)
+
+var (
+	ErrUsernameTaken = errors.New("username is already taken")
+	ErrEmailTaken    = errors.New("email is already registered")
+	// ErrPasswordResetRequired is returned by Authenticate for a correct password
+	// that an operator has asked the user to replace. It wraps fosite.ErrNotFound
+	// so that the password grant refuses it like any other failed login.
+	ErrPasswordResetRequired = fmt.Errorf("%w: password reset required", fosite.ErrNotFound)
+)
+
+// dummyPasswordHash is compared against when a user does not exist. It is the hash of "password".
+var dummyPasswordHash = []byte("$2a$10$7gYV4B62F0kA.96q7uCRNeViGntX0KJCMGS23kEXpHQAL10gZoT.m")
+
+// HashPassword returns the bcrypt hash of a password.
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash password: %w", err)
+	}
+
+	return string(hash), nil
+}
+
+// CheckUserCanLogin refuses deactivated users and users who must reset their
+// password. It is only called once the password or passkey has been checked, so
+// that the response does not reveal the state of an account to someone without
+// it.
+func CheckUserCanLogin(user User) error {
+	if !user.Active {
+		return fosite.ErrNotFound.WithDebug("the user is deactivated")
+	}
+
+	if user.PasswordResetRequired {
+		return ErrPasswordResetRequired
+	}
+
+	return nil
+}
+
+func hashUserToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// newUserToken generates a user token and returns its plaintext value together
+// with the record to store.
+func newUserToken(userID string, purpose string, lifespan time.Duration) (string, UserToken, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", UserToken{}, fmt.Errorf("failed to generate token: %w", err)
+	}
+
+	token := base64.RawURLEncoding.EncodeToString(secret)
+
+	return token, UserToken{
+		ID:        uuid.NewString(),
+		Purpose:   purpose,
+		TokenHash: hashUserToken(token),
+		ExpiresAt: time.Now().Add(lifespan),
+		UserID:    userID,
+	}, nil
+}
+
+// GetUserByEmail loads a user by their email address.
+func (m Store) GetUserByEmail(ctx context.Context, email string) (*User, error) {
+	var result User
+
+	if err := m.conn(ctx).Where("email = ?", email).First(&result).Error; err != nil {
+		return nil, fmt.Errorf("%w: %w", fosite.ErrNotFound, err)
+	}
+
+	return &result, nil
+}
+
 func (m Store) GetUser(ctx context.Context, username string) (*User, error) {
 	var result User
 
-	if err := m.db.Preload(clause.Associations).Where(User{Username: username}).First(&result).Error; err != nil {
+	if err := m.conn(ctx).Preload(clause.Associations).Where("username = ?", username).First(&result).Error; err != nil {
 		return nil, fmt.Errorf("%w: %w", fosite.ErrNotFound, err)
 	}
 
 	return &result, nil
 
 }
+
+// CreateUser registers a new user. The user's password must already be hashed.
+func (m Store) CreateUser(ctx context.Context, user *User) error {
+	var count int64
+
+	if err := m.conn(ctx).Model(&User{}).Where("username = ?", user.Username).Count(&count).Error; err != nil {
+		return fmt.Errorf("error checking username: %w", err)
+	}
+
+	if count > 0 {
+		return ErrUsernameTaken
+	}
+
+	if user.Email != "" {
+		if err := m.conn(ctx).Model(&User{}).Where("email = ?", user.Email).Count(&count).Error; err != nil {
+			return fmt.Errorf("error checking email: %w", err)
+		}
+
+		if count > 0 {
+			return ErrEmailTaken
+		}
+	}
+
+	if user.ID == "" {
+		user.ID = uuid.NewString()
+	}
+
+	if err := m.conn(ctx).Create(user).Error; err != nil {
+		return fmt.Errorf("error creating user: %w", err)
+	}
+
+	return nil
+}
+
+// CreateUserToken issues a single-use token for a user and returns its plaintext
+// value. The plaintext is not stored and cannot be recovered.
+func (m Store) CreateUserToken(ctx context.Context, userID string, purpose string, lifespan time.Duration) (string, error) {
+	token, data, err := newUserToken(userID, purpose, lifespan)
+	if err != nil {
+		return "", err
+	}
+
+	if err := m.conn(ctx).Create(&data).Error; err != nil {
+		return "", fmt.Errorf("error creating user token: %w", err)
+	}
+
+	return token, nil
+}
+
+// GetUserToken returns a token that is still valid without using it up.
+func (m Store) GetUserToken(ctx context.Context, purpose string, token string) (*UserToken, error) {
+	var result UserToken
+
+	if err := m.conn(ctx).Preload(clause.Associations).Where("purpose = ? AND token_hash = ?", purpose, hashUserToken(token)).First(&result).Error; err != nil {
+		return nil, fmt.Errorf("%w: %w", fosite.ErrNotFound, err)
+	}
+
+	if result.UsedAt != nil || result.ExpiresAt.Before(time.Now()) {
+		return nil, fosite.ErrNotFound.WithDebug("the token has expired or was already used")
+	}
+
+	return &result, nil
+}
+
+// ConsumeUserToken marks a token as used and returns it. Unknown, expired and
+// already used tokens return fosite.ErrNotFound.
+func (m Store) ConsumeUserToken(ctx context.Context, purpose string, token string) (*UserToken, error) {
+	var result UserToken
+
+	if err := m.conn(ctx).Where("purpose = ? AND token_hash = ?", purpose, hashUserToken(token)).First(&result).Error; err != nil {
+		return nil, fmt.Errorf("%w: %w", fosite.ErrNotFound, err)
+	}
+
+	if result.UsedAt != nil || result.ExpiresAt.Before(time.Now()) {
+		return nil, fosite.ErrNotFound.WithDebug("the token has expired or was already used")
+	}
+
+	// the used_at condition stops two requests from consuming the same token
+	now := time.Now()
+	updated := m.conn(ctx).Model(&UserToken{}).Where("id = ? AND used_at IS NULL", result.ID).Update("used_at", &now)
+	if updated.Error != nil {
+		return nil, fmt.Errorf("failed to consume user token: %w", updated.Error)
+	}
+
+	if updated.RowsAffected == 0 {
+		return nil, fosite.ErrNotFound.WithDebug("the token was already used")
+	}
+
+	result.UsedAt = &now
+
+	return &result, nil
+}
+
+// ResetUserPassword uses up a password reset token and sets the password of its
+// user in one transaction, so that a token is never spent without the password
+// changing, nor the password changed twice with one token.
+func (m Store) ResetUserPassword(ctx context.Context, token string, password string) (*UserToken, error) {
+	var result *UserToken
+
+	err := m.transaction(ctx, func(ctx context.Context) error {
+		consumed, err := m.ConsumeUserToken(ctx, UserTokenPasswordReset, token)
+		if err != nil {
+			return err
+		}
+
+		if err := m.SetUserPassword(ctx, consumed.UserID, password); err != nil {
+			return err
+		}
+
+		result = consumed
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// MarkEmailVerified records that a user has confirmed their email address.
+func (m Store) MarkEmailVerified(ctx context.Context, userID string) error {
+	now := time.Now()
+
+	if err := m.conn(ctx).Model(&User{}).Where("id = ?", userID).Updates(map[string]interface{}{
+		"email_verified":    true,
+		"email_verified_at": &now,
+	}).Error; err != nil {
+		return fmt.Errorf("failed to verify email: %w", err)
+	}
+
+	return nil
+}
+
+// PasswordReused reports whether a password matches the user's current password
+// or one of their previous `history` passwords.
+func (m Store) PasswordReused(ctx context.Context, userID string, password string, history int) (bool, error) {
+	var user User
+
+	if err := m.conn(ctx).Where("id = ?", userID).First(&user).Error; err != nil {
+		return false, fmt.Errorf("%w: %w", fosite.ErrNotFound, err)
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)) == nil {
+		return true, nil
+	}
+
+	if history <= 0 {
+		return false, nil
+	}
+
+	var previous []PasswordHistory
+
+	if err := m.conn(ctx).Where("user_id = ?", userID).Order("created_at desc").Limit(history).Find(&previous).Error; err != nil {
+		return false, fmt.Errorf("error fetching password history: %w", err)
+	}
+
+	for _, entry := range previous {
+		if bcrypt.CompareHashAndPassword([]byte(entry.Password), []byte(password)) == nil {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// SetUserPassword replaces a user's password hash, keeping the previous one in
+// their password history, and lifts any password reset required of the user.
+func (m Store) SetUserPassword(ctx context.Context, userID string, password string) error {
+	return m.conn(ctx).Transaction(func(tx *gorm.DB) error {
+		var user User
+
+		if err := tx.Where("id = ?", userID).First(&user).Error; err != nil {
+			return fmt.Errorf("%w: %w", fosite.ErrNotFound, err)
+		}
+
+		if user.Password != "" {
+			entry := PasswordHistory{
+				ID:       uuid.NewString(),
+				UserID:   userID,
+				Password: user.Password,
+			}
+
+			if err := tx.Create(&entry).Error; err != nil {
+				return fmt.Errorf("error saving password history: %w", err)
+			}
+		}
+
+		if err := tx.Model(&User{}).Where("id = ?", userID).Updates(map[string]interface{}{
+			"password":                password,
+			"password_reset_required": false,
+		}).Error; err != nil {
+			return fmt.Errorf("failed to update password: %w", err)
+		}
+
+		return nil
+	})
+}
+
+// RevokeUserTokens deactivates every authorization code, access token and refresh
+// token issued to a user and removes their sessions.
+func (m Store) RevokeUserTokens(ctx context.Context, userID string) error {
+	return m.transaction(ctx, func(ctx context.Context) error {
+		sessions := m.conn(ctx).Model(&Session{}).Select("id").Where("user_id = ?", userID)
+
+		if err := m.revokeTokens(ctx, "session_id IN (?)", sessions); err != nil {
+			return err
+		}
+
+		if err := m.conn(ctx).Where("user_id = ?", userID).Delete(&Session{}).Error; err != nil {
+			return fmt.Errorf("failed to delete user sessions: %w", err)
+		}
+
+		return nil
+	})
+}
+
+// UserFilter narrows down the users returned by ListUsers. Zero values match
+// every user.
+type UserFilter struct {
+	// Search matches part of the username, name or email address
+	Search string
+	Active *bool
+	Role   string
+	Limit  int
+	Offset int
+}
+
+// ListUsers returns a page of the users matching a filter, ordered by username,
+// and how many users match in total.
+func (m Store) ListUsers(ctx context.Context, filter UserFilter) ([]User, int64, error) {
+	query := m.conn(ctx).Model(&User{})
+
+	if filter.Search != "" {
+		pattern := "%" + filter.Search + "%"
+		query = query.Where("username LIKE ? OR name LIKE ? OR email LIKE ?", pattern, pattern, pattern)
+	}
+
+	if filter.Active != nil {
+		query = query.Where("active = ?", *filter.Active)
+	}
+
+	if filter.Role != "" {
+		query = query.Where("id IN (?)", m.conn(ctx).Model(&UserRole{}).Select("user_id").Where("role_id = ?", filter.Role))
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, fmt.Errorf("error counting users: %w", err)
+	}
+
+	// a limit of zero returns every user
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = -1
+	}
+
+	var results []User
+	if err := query.Preload(clause.Associations).Order("username").Limit(limit).Offset(filter.Offset).Find(&results).Error; err != nil {
+		return nil, 0, fmt.Errorf("error fetching users: %w", err)
+	}
+
+	return results, total, nil
+}
+
+// UpdateUser saves the profile and account state of an existing user. The
+// password is left alone, use SetUserPassword to change it.
+func (m Store) UpdateUser(ctx context.Context, user *User) error {
+	var count int64
+
+	if err := m.conn(ctx).Model(&User{}).Where("username = ? AND id <> ?", user.Username, user.ID).Count(&count).Error; err != nil {
+		return fmt.Errorf("error checking username: %w", err)
+	}
+
+	if count > 0 {
+		return ErrUsernameTaken
+	}
+
+	if user.Email != "" {
+		if err := m.conn(ctx).Model(&User{}).Where("email = ? AND id <> ?", user.Email, user.ID).Count(&count).Error; err != nil {
+			return fmt.Errorf("error checking email: %w", err)
+		}
+
+		if count > 0 {
+			return ErrEmailTaken
+		}
+	}
+
+	updated := m.conn(ctx).Model(user).
+		Select("name", "username", "email", "email_verified", "email_verified_at", "active", "password_reset_required").
+		Updates(user)
+	if updated.Error != nil {
+		return fmt.Errorf("failed to update user: %w", updated.Error)
+	}
+
+	if updated.RowsAffected == 0 {
+		return fosite.ErrNotFound
+	}
+
+	return nil
+}
+
+// DeleteUser revokes every token of a user and removes the user together with
+// their passkeys, roles and other records.
+func (m Store) DeleteUser(ctx context.Context, id string) error {
+	return m.transaction(ctx, func(ctx context.Context) error {
+		var count int64
+
+		if err := m.conn(ctx).Model(&User{}).Where("id = ?", id).Count(&count).Error; err != nil {
+			return fmt.Errorf("error checking user: %w", err)
+		}
+
+		if count == 0 {
+			return fosite.ErrNotFound
+		}
+
+		if err := m.RevokeUserTokens(ctx, id); err != nil {
+			return err
+		}
+
+		for _, model := range []interface{}{&WebAuthnCredential{}, &UserToken{}, &PasswordHistory{}} {
+			if err := m.conn(ctx).Unscoped().Where("user_id = ?", id).Delete(model).Error; err != nil {
+				return fmt.Errorf("failed to delete user records: %w", err)
+			}
+		}
+
+		if err := m.conn(ctx).Where("user_id = ?", id).Delete(&UserRole{}).Error; err != nil {
+			return fmt.Errorf("failed to delete user roles: %w", err)
+		}
+
+		// users are removed for good, so that their username and email can be reused
+		if err := m.conn(ctx).Unscoped().Delete(&User{}, "id = ?", id).Error; err != nil {
+			return fmt.Errorf("failed to delete user: %w", err)
+		}
+
+		return nil
+	})
+}
+
+// GetUserRoles returns the roles of a user in alphabetical order.
+func (m Store) GetUserRoles(ctx context.Context, userID string) ([]string, error) {
+	var roles []string
+
+	if err := m.conn(ctx).Model(&UserRole{}).Where("user_id = ?", userID).Order("role_id").Pluck("role_id", &roles).Error; err != nil {
+		return nil, fmt.Errorf("error fetching user roles: %w", err)
+	}
+
+	return roles, nil
+}
+
+// SetUserRoles replaces the roles of a user.
+func (m Store) SetUserRoles(ctx context.Context, userID string, roles []string) error {
+	return m.transaction(ctx, func(ctx context.Context) error {
+		if err := m.conn(ctx).Where("user_id = ?", userID).Delete(&UserRole{}).Error; err != nil {
+			return fmt.Errorf("failed to clear user roles: %w", err)
+		}
+
+		for _, role := range roles {
+			if err := m.conn(ctx).Create(&UserRole{UserID: userID, RoleID: role}).Error; err != nil {
+				return fmt.Errorf("failed to assign user role: %w", err)
+			}
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,139 @@
+package store
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+	"github.com/ory/fosite"
+	"gorm.io/gorm/clause"
+)
+
+// GetUserByID loads a user, together with their passkeys, by the user ID.
+func (m Store) GetUserByID(ctx context.Context, id string) (*User, error) {
+	var result User
+
+	if id == "" {
+		return nil, fosite.ErrNotFound.WithDebug("no user ID")
+	}
+
+	if err := m.conn(ctx).Preload(clause.Associations).Where("id = ?", id).First(&result).Error; err != nil {
+		return nil, fmt.Errorf("%w: %w", fosite.ErrNotFound, err)
+	}
+
+	return &result, nil
+}
+
+// CreateWebAuthnCredential stores a passkey that has completed the registration ceremony.
+func (m Store) CreateWebAuthnCredential(ctx context.Context, userID string, credential *webauthn.Credential) error {
+	data := newWebAuthnCredential(userID, credential)
+
+	if err := m.conn(ctx).Create(&data).Error; err != nil {
+		return fmt.Errorf("error creating webauthn credential: %w", err)
+	}
+
+	return nil
+}
+
+// newWebAuthnCredential converts a registered passkey into its stored form.
+func newWebAuthnCredential(userID string, credential *webauthn.Credential) WebAuthnCredential {
+	var transport StringArray
+
+	for _, st := range credential.Transport {
+		transport = append(transport, string(st))
+	}
+
+	return WebAuthnCredential{
+		ID:              base64.RawURLEncoding.EncodeToString(credential.ID),
+		CredentialID:    credential.ID,
+		PublicKey:       credential.PublicKey,
+		AttestationType: credential.AttestationType,
+		Transport:       transport,
+		UserPresent:     credential.Flags.UserPresent,
+		UserVerified:    credential.Flags.UserVerified,
+		BackupEligible:  credential.Flags.BackupEligible,
+		BackupState:     credential.Flags.BackupState,
+		AAGUID:          credential.Authenticator.AAGUID,
+		SignCount:       credential.Authenticator.SignCount,
+		CloneWarning:    credential.Authenticator.CloneWarning,
+		Attachment:      string(credential.Authenticator.Attachment),
+		UserID:          userID,
+	}
+}
+
+// UpdateWebAuthnCredential records the authenticator state returned by a successful assertion.
+func (m Store) UpdateWebAuthnCredential(ctx context.Context, credential *webauthn.Credential) error {
+	id := base64.RawURLEncoding.EncodeToString(credential.ID)
+	now := time.Now()
+
+	if err := m.conn(ctx).Model(&WebAuthnCredential{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"sign_count":    credential.Authenticator.SignCount,
+		"clone_warning": credential.Authenticator.CloneWarning,
+		"backup_state":  credential.Flags.BackupState,
+		"last_used_at":  &now,
+	}).Error; err != nil {
+		return fmt.Errorf("failed to update webauthn credential: %w", err)
+	}
+
+	return nil
+}
+
+// CreateWebAuthnSession persists the state of a registration or login ceremony and
+// returns the identifier the browser uses to complete it.
+func (m Store) CreateWebAuthnSession(ctx context.Context, session *webauthn.SessionData) (string, error) {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return "", fmt.Errorf("error marshalling webauthn session: %w", err)
+	}
+
+	result := WebAuthnSession{
+		ID:        uuid.NewString(),
+		Data:      data,
+		ExpiresAt: session.Expires,
+	}
+
+	if err := m.conn(ctx).Create(&result).Error; err != nil {
+		return "", fmt.Errorf("error creating webauthn session: %w", err)
+	}
+
+	return result.ID, nil
+}
+
+// PopWebAuthnSession loads and removes the state of a ceremony so that a challenge
+// can only ever be answered once.
+func (m Store) PopWebAuthnSession(ctx context.Context, id string) (*webauthn.SessionData, error) {
+	var result WebAuthnSession
+
+	if id == "" {
+		return nil, fosite.ErrNotFound.WithDebug("no webauthn session ID")
+	}
+
+	if err := m.conn(ctx).Where("id = ?", id).First(&result).Error; err != nil {
+		return nil, fmt.Errorf("%w: %w", fosite.ErrNotFound, err)
+	}
+
+	// another request may have answered the same challenge in the meantime
+	deleted := m.conn(ctx).Where("id = ?", id).Delete(&WebAuthnSession{})
+	if deleted.Error != nil {
+		return nil, fmt.Errorf("failed to delete webauthn session: %w", deleted.Error)
+	}
+
+	if deleted.RowsAffected == 0 {
+		return nil, fosite.ErrNotFound.WithDebug("webauthn session already used")
+	}
+
+	if !result.ExpiresAt.IsZero() && result.ExpiresAt.Before(time.Now()) {
+		return nil, fosite.ErrNotFound.WithDebug("webauthn session has expired")
+	}
+
+	var session webauthn.SessionData
+	if err := json.Unmarshal(result.Data, &session); err != nil {
+		return nil, fmt.Errorf("error unmarshalling webauthn session: %w", err)
+	}
+
+	return &session, nil
+}
@@ -0,0 +1,243 @@
+// Package tlsconfig serves the server over HTTPS with a certificate that is
+// reloaded when its files change, and turns plain HTTP requests away.
+package tlsconfig
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Muchogoc/go-oauth2-server/config"
+	"github.com/Muchogoc/go-oauth2-server/log"
+	"github.com/fsnotify/fsnotify"
+	"github.com/gin-gonic/gin"
+)
+
+// reloadDelay lets a certificate and its key both be written before they are
+// read again.
+const reloadDelay = 500 * time.Millisecond
+
+var versions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Enabled reports whether a certificate is configured.
+func Enabled(cfg config.Provider) bool {
+	return cfg.GetString("tls_cert_file") != "" || cfg.GetString("tls_key_file") != ""
+}
+
+// New returns the TLS configuration of the tls_* settings, or every problem with
+// them, and the certificate it serves. The certificate has to be closed once the
+// server stops.
+func New(cfg config.Provider) (*tls.Config, *Certificate, error) {
+	var problems []string
+
+	certFile, keyFile := cfg.GetString("tls_cert_file"), cfg.GetString("tls_key_file")
+	if certFile == "" || keyFile == "" {
+		problems = append(problems, "tls_cert_file and tls_key_file must be set together")
+	}
+
+	version, ok := versions[cfg.GetString("tls_min_version")]
+	if !ok {
+		problems = append(problems, fmt.Sprintf("tls_min_version must be 1.2 or 1.3, not %q", cfg.GetString("tls_min_version")))
+	}
+
+	suites, invalid := cipherSuites(cfg.GetStringSlice("tls_cipher_suites"))
+	problems = append(problems, invalid...)
+
+	if len(problems) > 0 {
+		return nil, nil, fmt.Errorf("invalid configuration: %s", strings.Join(problems, ", "))
+	}
+
+	certificate, err := LoadCertificate(certFile, keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	conf := &tls.Config{
+		MinVersion:     version,
+		CipherSuites:   suites,
+		GetCertificate: certificate.GetCertificate,
+	}
+
+	return conf, certificate, nil
+}
+
+// cipherSuites returns the IDs of named cipher suites, among those Go considers
+// secure. TLS 1.3 suites cannot be configured.
+func cipherSuites(names []string) ([]uint16, []string) {
+	var (
+		ids      []uint16
+		problems []string
+	)
+
+	for _, name := range names {
+		found := false
+
+		for _, suite := range tls.CipherSuites() {
+			if suite.Name == name {
+				ids, found = append(ids, suite.ID), true
+				break
+			}
+		}
+
+		if !found {
+			problems = append(problems, fmt.Sprintf("tls_cipher_suites: %q is not a supported cipher suite", name))
+		}
+	}
+
+	return ids, problems
+}
+
+// Certificate is the certificate of the server, which is reloaded when its
+// certificate or key file changes. A change that cannot be loaded, for instance
+// while only one of the files has been replaced, keeps the previous certificate.
+type Certificate struct {
+	certFile string
+	keyFile  string
+
+	current atomic.Pointer[tls.Certificate]
+	watcher *fsnotify.Watcher
+
+	mu    sync.Mutex
+	timer *time.Timer
+}
+
+// LoadCertificate loads a PEM certificate chain and key, and starts watching
+// their files.
+func LoadCertificate(certFile string, keyFile string) (*Certificate, error) {
+	c := &Certificate{certFile: certFile, keyFile: keyFile}
+
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to watch TLS certificate: %w", err)
+	}
+
+	// directories are watched rather than the files, which are often replaced
+	// by renaming another file or swapping a symbolic link
+	for _, dir := range []string{filepath.Dir(certFile), filepath.Dir(keyFile)} {
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return nil, fmt.Errorf("failed to watch TLS certificate: %w", err)
+		}
+	}
+
+	c.watcher = watcher
+
+	go c.watch()
+
+	return c, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (c *Certificate) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.current.Load(), nil
+}
+
+// Close stops watching the certificate files.
+func (c *Certificate) Close() error {
+	c.mu.Lock()
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	c.mu.Unlock()
+
+	return c.watcher.Close()
+}
+
+func (c *Certificate) load() error {
+	certificate, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+
+	previous := c.current.Swap(&certificate)
+
+	if previous != nil && !bytes.Equal(previous.Certificate[0], certificate.Certificate[0]) {
+		log.WithFields(log.Fields{"cert_file": c.certFile}).Info("reloaded TLS certificate")
+	}
+
+	return nil
+}
+
+func (c *Certificate) watch() {
+	for {
+		select {
+		case _, ok := <-c.watcher.Events:
+			if !ok {
+				return
+			}
+
+			c.mu.Lock()
+			if c.timer != nil {
+				c.timer.Stop()
+			}
+
+			c.timer = time.AfterFunc(reloadDelay, func() {
+				if err := c.load(); err != nil {
+					log.Errorf("TLS certificate not reloaded: %v", err)
+				}
+			})
+			c.mu.Unlock()
+		case err, ok := <-c.watcher.Errors:
+			if !ok {
+				return
+			}
+
+			log.Errorf("failed to watch TLS certificate: %v", err)
+		}
+	}
+}
+
+// RedirectHandler sends plain HTTP requests to the HTTPS listener on httpsPort.
+// Only GET and HEAD requests are redirected: other requests may already have sent
+// credentials in the clear, and clients should fail rather than learn to retry.
+func RedirectHandler(httpsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "This server only accepts HTTPS requests.", http.StatusBadRequest)
+			return
+		}
+
+		host := r.Host
+		if hostname, _, err := net.SplitHostPort(host); err == nil {
+			host = hostname
+		}
+
+		if httpsPort != "" && httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		}
+
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// HSTS sets the Strict-Transport-Security header on HTTPS responses, telling
+// browsers to only use HTTPS for maxAge. A zero maxAge sets nothing.
+func HSTS(maxAge time.Duration, includeSubdomains bool) gin.HandlerFunc {
+	value := "max-age=" + strconv.Itoa(int(maxAge.Seconds()))
+	if includeSubdomains {
+		value += "; includeSubDomains"
+	}
+
+	return func(c *gin.Context) {
+		if maxAge > 0 && c.Request.TLS != nil {
+			c.Header("Strict-Transport-Security", value)
+		}
+
+		c.Next()
+	}
+}
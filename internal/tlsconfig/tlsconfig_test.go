@@ -0,0 +1,251 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Muchogoc/go-oauth2-server/config"
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+)
+
+// writeCertificate writes a self-signed certificate for a name and its key to
+// cert.pem and key.pem in dir. The files are replaced by renaming, as most tools
+// that renew certificates do.
+func writeCertificate(t *testing.T, dir string, name string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeFile(t, filepath.Join(dir, "key.pem"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+	writeFile(t, filepath.Join(dir, "cert.pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+// writeFile replaces a file by renaming a new one over it.
+func writeFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+
+	if err := os.WriteFile(path+".tmp", data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Rename(path+".tmp", path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// servedName returns the common name of the certificate being served.
+func servedName(t *testing.T, c *Certificate) string {
+	t.Helper()
+
+	certificate, err := c.GetCertificate(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return parsed.Subject.CommonName
+}
+
+// waitForName waits for the certificate of a name to be served.
+func waitForName(t *testing.T, c *Certificate, name string) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for servedName(t, c) != name {
+		if time.Now().After(deadline) {
+			t.Fatalf("serving %s, want %s", servedName(t, c), name)
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func newTestConfig(settings map[string]interface{}) *viper.Viper {
+	v := config.LoadConfigProvider("GO-OAUTH2-SERVER-TEST").(*viper.Viper)
+	v.Set("loglevel", "error")
+
+	for key, value := range settings {
+		v.Set(key, value)
+	}
+
+	return v
+}
+
+func TestNewValidatesSettings(t *testing.T) {
+	dir := t.TempDir()
+	writeCertificate(t, dir, "first.example.com")
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	tests := []struct {
+		name     string
+		settings map[string]interface{}
+		problem  string
+	}{
+		{"valid", map[string]interface{}{"tls_cert_file": certFile, "tls_key_file": keyFile, "tls_min_version": "1.3"}, ""},
+		{"key missing", map[string]interface{}{"tls_cert_file": certFile}, "tls_cert_file and tls_key_file must be set together"},
+		{"old version", map[string]interface{}{"tls_cert_file": certFile, "tls_key_file": keyFile, "tls_min_version": "1.0"}, `tls_min_version must be 1.2 or 1.3, not "1.0"`},
+		{"insecure cipher suite", map[string]interface{}{
+			"tls_cert_file":     certFile,
+			"tls_key_file":      keyFile,
+			"tls_cipher_suites": []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", "TLS_RSA_WITH_RC4_128_SHA"},
+		}, `"TLS_RSA_WITH_RC4_128_SHA" is not a supported cipher suite`},
+		{"unreadable files", map[string]interface{}{"tls_cert_file": keyFile, "tls_key_file": certFile}, "failed to load TLS certificate"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf, certificate, err := New(newTestConfig(tt.settings))
+
+			if tt.problem == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				defer certificate.Close()
+
+				if conf.MinVersion != tls.VersionTLS13 || servedName(t, certificate) != "first.example.com" {
+					t.Errorf("got version %x serving %s", conf.MinVersion, servedName(t, certificate))
+				}
+
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tt.problem) {
+				t.Errorf("got error %v, want one containing %q", err, tt.problem)
+			}
+		})
+	}
+}
+
+func TestCertificateReload(t *testing.T) {
+	dir := t.TempDir()
+	writeCertificate(t, dir, "first.example.com")
+
+	certificate, err := LoadCertificate(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer certificate.Close()
+
+	if name := servedName(t, certificate); name != "first.example.com" {
+		t.Fatalf("serving %s, want first.example.com", name)
+	}
+
+	writeCertificate(t, dir, "second.example.com")
+	waitForName(t, certificate, "second.example.com")
+
+	// a certificate that does not match its key is not served, the previous one is
+	second, err := os.ReadFile(filepath.Join(dir, "cert.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeCertificate(t, dir, "third.example.com")
+	writeFile(t, filepath.Join(dir, "cert.pem"), second)
+
+	time.Sleep(2 * reloadDelay)
+
+	if name := servedName(t, certificate); name != "second.example.com" {
+		t.Errorf("serving %s after a broken change, want second.example.com", name)
+	}
+
+	writeCertificate(t, dir, "fourth.example.com")
+	waitForName(t, certificate, "fourth.example.com")
+}
+
+func TestRedirectHandler(t *testing.T) {
+	tests := []struct {
+		method   string
+		target   string
+		port     string
+		status   int
+		location string
+	}{
+		{http.MethodGet, "http://example.com/oauth2/auth?client_id=app", "8443", http.StatusMovedPermanently, "https://example.com:8443/oauth2/auth?client_id=app"},
+		{http.MethodHead, "http://example.com:8080/", "443", http.StatusMovedPermanently, "https://example.com/"},
+		{http.MethodGet, "http://example.com:8080/", "", http.StatusMovedPermanently, "https://example.com/"},
+		{http.MethodPost, "http://example.com/oauth2/token", "8443", http.StatusBadRequest, ""},
+	}
+
+	for _, tt := range tests {
+		recorder := httptest.NewRecorder()
+		RedirectHandler(tt.port).ServeHTTP(recorder, httptest.NewRequest(tt.method, tt.target, nil))
+
+		if recorder.Code != tt.status || recorder.Header().Get("Location") != tt.location {
+			t.Errorf("%s %s: got %d to %q, want %d to %q", tt.method, tt.target, recorder.Code, recorder.Header().Get("Location"), tt.status, tt.location)
+		}
+	}
+}
+
+func TestHSTS(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name   string
+		maxAge time.Duration
+		tls    bool
+		want   string
+	}{
+		{"https", 24 * time.Hour, true, "max-age=86400; includeSubDomains"},
+		{"plain http", 24 * time.Hour, false, ""},
+		{"disabled", 0, true, ""},
+	}
+
+	for _, tt := range tests {
+		router := gin.New()
+		router.GET("/", HSTS(tt.maxAge, true), func(c *gin.Context) { c.Status(http.StatusOK) })
+
+		request := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tt.tls {
+			request.TLS = &tls.ConnectionState{}
+		}
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+
+		if got := recorder.Header().Get("Strict-Transport-Security"); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
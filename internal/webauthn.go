@@ -0,0 +1,195 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/Muchogoc/go-oauth2-server/internal/html"
+	"github.com/Muchogoc/go-oauth2-server/internal/store"
+	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/ory/fosite"
+)
+
+type WebAuthnRegistration struct {
+	Username string `json:"username" binding:"required"`
+	Password string `json:"password" binding:"required"`
+}
+
+type WebAuthnCeremony struct {
+	SessionID string      `json:"session_id"`
+	Options   interface{} `json:"options"`
+}
+
+// WebAuthnRegisterPageHandler renders the page used to enrol a passkey.
+func (a Auth) WebAuthnRegisterPageHandler(c *gin.Context) {
+	c.Writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	params := html.RegisterPasskeyParams{
+		Title: "Register a passkey",
+	}
+
+	_ = html.RegisterPasskey(c.Writer, params)
+}
+
+// BeginWebAuthnRegistrationHandler starts the registration ceremony for a user
+// that has proven their identity with their password.
+func (a Auth) BeginWebAuthnRegistrationHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	params := WebAuthnRegistration{}
+	if err := c.ShouldBindJSON(&params); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_request"})
+		return
+	}
+
+	allowed, err := a.beginLogin(ctx, params.Username, c.ClientIP())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "server_error"})
+		return
+	}
+
+	if !allowed {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid_credentials"})
+		return
+	}
+
+	user, err := a.authenticatePassword(ctx, params.Username, params.Password)
+	if err != nil {
+		a.loginFailed(ctx, params.Username, c.ClientIP())
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid_credentials"})
+		return
+	}
+
+	a.loginSucceeded(ctx, user.Username, c.ClientIP())
+
+	var exclusions []protocol.CredentialDescriptor
+	for _, credential := range user.WebAuthnCredentials() {
+		exclusions = append(exclusions, credential.Descriptor())
+	}
+
+	options, session, err := a.webAuthn.BeginRegistration(
+		user,
+		webauthn.WithExclusions(exclusions),
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementRequired),
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "server_error"})
+		return
+	}
+
+	id, err := a.store.CreateWebAuthnSession(ctx, session)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "server_error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, WebAuthnCeremony{SessionID: id, Options: options})
+}
+
+// FinishWebAuthnRegistrationHandler verifies the attestation returned by the
+// authenticator and stores the new passkey.
+func (a Auth) FinishWebAuthnRegistrationHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	session, err := a.store.PopWebAuthnSession(ctx, c.Query("session_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_session"})
+		return
+	}
+
+	user, err := a.store.GetUserByID(ctx, string(session.UserID))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_session"})
+		return
+	}
+
+	credential, err := a.webAuthn.FinishRegistration(user, *session, c.Request)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_credential"})
+		return
+	}
+
+	if err := a.store.CreateWebAuthnCredential(ctx, user.ID, credential); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "server_error"})
+		return
+	}
+
+	c.Status(http.StatusCreated)
+}
+
+// BeginWebAuthnLoginHandler starts a discoverable login ceremony. The user is
+// identified by the passkey the authenticator picks, so no username is needed.
+func (a Auth) BeginWebAuthnLoginHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	options, session, err := a.webAuthn.BeginDiscoverableLogin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "server_error"})
+		return
+	}
+
+	id, err := a.store.CreateWebAuthnSession(ctx, session)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "server_error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, WebAuthnCeremony{SessionID: id, Options: options})
+}
+
+// authenticatePasskey validates a passkey assertion submitted with the login form
+// and returns the user it belongs to.
+func (a Auth) authenticatePasskey(ctx context.Context, sessionID string, assertion string) (*store.User, error) {
+	session, err := a.store.PopWebAuthnSession(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := protocol.ParseCredentialRequestResponseBody(strings.NewReader(assertion))
+	if err != nil {
+		return nil, fosite.ErrAccessDenied.WithWrap(err).WithDebug(err.Error())
+	}
+
+	var user *store.User
+
+	credential, err := a.webAuthn.ValidateDiscoverableLogin(
+		func(rawID, userHandle []byte) (webauthn.User, error) {
+			result, err := a.store.GetUserByID(ctx, string(userHandle))
+			if err != nil {
+				return nil, err
+			}
+
+			for _, credential := range result.Credentials {
+				if bytes.Equal(credential.CredentialID, rawID) {
+					user = result
+					return result, nil
+				}
+			}
+
+			return nil, fosite.ErrNotFound.WithDebug("credential is not registered to the user")
+		},
+		*session,
+		response,
+	)
+	if err != nil {
+		return nil, fosite.ErrAccessDenied.WithWrap(err).WithDebug(err.Error())
+	}
+
+	if err := a.store.UpdateWebAuthnCredential(ctx, credential); err != nil {
+		return nil, err
+	}
+
+	// a signature counter that went backwards means the credential may have been cloned
+	if credential.Authenticator.CloneWarning {
+		return nil, fosite.ErrAccessDenied.WithDebug("the authenticator signature counter is out of sync")
+	}
+
+	if err := store.CheckUserCanLogin(*user); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
@@ -0,0 +1,432 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/Muchogoc/go-oauth2-server/internal/store"
+	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+)
+
+// softAuthenticator is a passkey kept in memory, answering ceremonies the way a
+// platform authenticator would with a "none" attestation.
+type softAuthenticator struct {
+	rpID   string
+	origin string
+
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	userHandle   []byte
+	signCount    uint32
+}
+
+func newSoftAuthenticator(t *testing.T, rpID string, origin string) *softAuthenticator {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	credentialID := make([]byte, 16)
+	if _, err := rand.Read(credentialID); err != nil {
+		t.Fatal(err)
+	}
+
+	return &softAuthenticator{rpID: rpID, origin: origin, key: key, credentialID: credentialID}
+}
+
+func (a *softAuthenticator) clientData(t *testing.T, ceremony string, challenge []byte) []byte {
+	t.Helper()
+
+	data, err := json.Marshal(map[string]string{
+		"type":      ceremony,
+		"challenge": base64.RawURLEncoding.EncodeToString(challenge),
+		"origin":    a.origin,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+// authData returns the authenticator data, with the attested credential when
+// attested is set.
+func (a *softAuthenticator) authData(t *testing.T, attested bool) []byte {
+	t.Helper()
+
+	rpIDHash := sha256.Sum256([]byte(a.rpID))
+
+	flags := byte(protocol.FlagUserPresent | protocol.FlagUserVerified)
+	if attested {
+		flags |= byte(protocol.FlagAttestedCredentialData)
+	}
+
+	data := append([]byte(nil), rpIDHash[:]...)
+	data = append(data, flags)
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+
+	if !attested {
+		return data
+	}
+
+	publicKey, err := webauthncbor.Marshal(webauthncose.EC2PublicKeyData{
+		PublicKeyData: webauthncose.PublicKeyData{
+			KeyType:   int64(webauthncose.EllipticKey),
+			Algorithm: int64(webauthncose.AlgES256),
+		},
+		Curve:  int64(webauthncose.P256),
+		XCoord: a.key.X.FillBytes(make([]byte, 32)),
+		YCoord: a.key.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data = append(data, make([]byte, 16)...) // AAGUID
+	data = binary.BigEndian.AppendUint16(data, uint16(len(a.credentialID)))
+	data = append(data, a.credentialID...)
+
+	return append(data, publicKey...)
+}
+
+// create answers a registration ceremony.
+func (a *softAuthenticator) create(t *testing.T, options protocol.CredentialCreation) []byte {
+	t.Helper()
+
+	userHandle, err := base64.RawURLEncoding.DecodeString(options.Response.User.ID.(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a.userHandle = userHandle
+
+	attestation, err := webauthncbor.Marshal(map[string]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[string]interface{}{},
+		"authData": a.authData(t, true),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"id":    base64.RawURLEncoding.EncodeToString(a.credentialID),
+		"rawId": base64.RawURLEncoding.EncodeToString(a.credentialID),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    base64.RawURLEncoding.EncodeToString(a.clientData(t, "webauthn.create", options.Response.Challenge)),
+			"attestationObject": base64.RawURLEncoding.EncodeToString(attestation),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return body
+}
+
+// get answers a login ceremony, signing with the current counter.
+func (a *softAuthenticator) get(t *testing.T, challenge []byte) string {
+	t.Helper()
+
+	authData := a.authData(t, false)
+	clientData := a.clientData(t, "webauthn.get", challenge)
+	clientDataHash := sha256.Sum256(clientData)
+	signed := sha256.Sum256(append(append([]byte(nil), authData...), clientDataHash[:]...))
+
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, signed[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"id":    base64.RawURLEncoding.EncodeToString(a.credentialID),
+		"rawId": base64.RawURLEncoding.EncodeToString(a.credentialID),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    base64.RawURLEncoding.EncodeToString(clientData),
+			"authenticatorData": base64.RawURLEncoding.EncodeToString(authData),
+			"signature":         base64.RawURLEncoding.EncodeToString(signature),
+			"userHandle":        base64.RawURLEncoding.EncodeToString(a.userHandle),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(body)
+}
+
+func (s *testServer) webAuthnRouter() *gin.Engine {
+	router := gin.New()
+	router.POST("/webauthn/register/begin", s.auth.BeginWebAuthnRegistrationHandler)
+	router.POST("/webauthn/register/finish", s.auth.FinishWebAuthnRegistrationHandler)
+	router.POST("/webauthn/login/begin", s.auth.BeginWebAuthnLoginHandler)
+
+	return router
+}
+
+func serve(router http.Handler, request *http.Request) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	return recorder
+}
+
+// registerPasskey enrols the authenticator for a user through the registration
+// endpoints.
+func (s *testServer) registerPasskey(t *testing.T, authenticator *softAuthenticator, username string, password string) {
+	t.Helper()
+
+	body, _ := json.Marshal(WebAuthnRegistration{Username: username, Password: password})
+	response := serve(s.webAuthnRouter(), httptest.NewRequest(http.MethodPost, "/webauthn/register/begin", bytes.NewReader(body)))
+
+	if response.Code != http.StatusOK {
+		t.Fatalf("begin registration returned %d: %s", response.Code, response.Body.String())
+	}
+
+	var ceremony struct {
+		SessionID string                      `json:"session_id"`
+		Options   protocol.CredentialCreation `json:"options"`
+	}
+
+	if err := json.Unmarshal(response.Body.Bytes(), &ceremony); err != nil {
+		t.Fatal(err)
+	}
+
+	request := httptest.NewRequest(http.MethodPost, "/webauthn/register/finish?session_id="+ceremony.SessionID, bytes.NewReader(authenticator.create(t, ceremony.Options)))
+	response = serve(s.webAuthnRouter(), request)
+
+	if response.Code != http.StatusCreated {
+		t.Fatalf("finish registration returned %d: %s", response.Code, response.Body.String())
+	}
+}
+
+// beginPasskeyLogin starts a login ceremony and returns its session and challenge.
+func (s *testServer) beginPasskeyLogin(t *testing.T) (string, []byte) {
+	t.Helper()
+
+	response := serve(s.webAuthnRouter(), httptest.NewRequest(http.MethodPost, "/webauthn/login/begin", nil))
+	if response.Code != http.StatusOK {
+		t.Fatalf("begin login returned %d: %s", response.Code, response.Body.String())
+	}
+
+	var ceremony struct {
+		SessionID string                       `json:"session_id"`
+		Options   protocol.CredentialAssertion `json:"options"`
+	}
+
+	if err := json.Unmarshal(response.Body.Bytes(), &ceremony); err != nil {
+		t.Fatal(err)
+	}
+
+	return ceremony.SessionID, ceremony.Options.Response.Challenge
+}
+
+// passkeyLogin signs in at the authorization endpoint with a passkey assertion.
+func (s *testServer) passkeyLogin(t *testing.T, session string, assertion string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	return s.authorize(t, "openid", url.Values{
+		"webauthn_session":   {session},
+		"webauthn_assertion": {assertion},
+	})
+}
+
+func TestWebAuthnRegistrationAndLogin(t *testing.T) {
+	server := newTestServer(t, newTestConfig(t, nil))
+	user := server.createUser(t, "alice", "correct horse")
+
+	authenticator := newSoftAuthenticator(t, "localhost", testOrigin)
+	server.registerPasskey(t, authenticator, "alice", "correct horse")
+
+	stored, err := server.store.GetUserByID(context.Background(), user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(stored.Credentials) != 1 || !bytes.Equal(stored.Credentials[0].CredentialID, authenticator.credentialID) {
+		t.Fatalf("the passkey was not stored: %+v", stored.Credentials)
+	}
+
+	for i := 0; i < 2; i++ {
+		authenticator.signCount++
+
+		session, challenge := server.beginPasskeyLogin(t)
+		authorizationCode(t, server.passkeyLogin(t, session, authenticator.get(t, challenge)))
+	}
+
+	stored, err = server.store.GetUserByID(context.Background(), user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stored.Credentials[0].SignCount != authenticator.signCount {
+		t.Errorf("stored sign count %d, want %d", stored.Credentials[0].SignCount, authenticator.signCount)
+	}
+}
+
+func TestWebAuthnRegistrationRequiresPassword(t *testing.T) {
+	server := newTestServer(t, newTestConfig(t, nil))
+	server.createUser(t, "alice", "correct horse")
+
+	body, _ := json.Marshal(WebAuthnRegistration{Username: "alice", Password: "wrong"})
+	response := serve(server.webAuthnRouter(), httptest.NewRequest(http.MethodPost, "/webauthn/register/begin", bytes.NewReader(body)))
+
+	if response.Code != http.StatusUnauthorized {
+		t.Fatalf("begin registration returned %d, want 401", response.Code)
+	}
+}
+
+func TestWebAuthnLoginRejected(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(a *softAuthenticator, challenge []byte) []byte
+	}{
+		{
+			name: "sign count went backwards",
+			tamper: func(a *softAuthenticator, challenge []byte) []byte {
+				a.signCount = 1
+				return challenge
+			},
+		},
+		{
+			name: "wrong challenge",
+			tamper: func(a *softAuthenticator, challenge []byte) []byte {
+				return []byte("a challenge the server never issued")
+			},
+		},
+		{
+			name: "wrong origin",
+			tamper: func(a *softAuthenticator, challenge []byte) []byte {
+				a.origin = "https://evil.example.com"
+				return challenge
+			},
+		},
+		{
+			name: "wrong relying party",
+			tamper: func(a *softAuthenticator, challenge []byte) []byte {
+				a.rpID = "evil.example.com"
+				return challenge
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := newTestServer(t, newTestConfig(t, nil))
+			server.createUser(t, "alice", "correct horse")
+
+			authenticator := newSoftAuthenticator(t, "localhost", testOrigin)
+			server.registerPasskey(t, authenticator, "alice", "correct horse")
+
+			// a first login moves the stored counter past zero
+			authenticator.signCount = 5
+			session, challenge := server.beginPasskeyLogin(t)
+			authorizationCode(t, server.passkeyLogin(t, session, authenticator.get(t, challenge)))
+
+			authenticator.signCount = 6
+			session, challenge = server.beginPasskeyLogin(t)
+			challenge = test.tamper(authenticator, challenge)
+
+			response := server.passkeyLogin(t, session, authenticator.get(t, challenge))
+			if response.Code != http.StatusOK || response.Header().Get("Location") != "" {
+				t.Fatalf("login returned %d to %q, want the login page again", response.Code, response.Header().Get("Location"))
+			}
+		})
+	}
+}
+
+func TestWebAuthnSessionAnsweredOnce(t *testing.T) {
+	server := newTestServer(t, newTestConfig(t, nil))
+	server.createUser(t, "alice", "correct horse")
+
+	authenticator := newSoftAuthenticator(t, "localhost", testOrigin)
+	server.registerPasskey(t, authenticator, "alice", "correct horse")
+
+	authenticator.signCount = 1
+	session, challenge := server.beginPasskeyLogin(t)
+	assertion := authenticator.get(t, challenge)
+
+	authorizationCode(t, server.passkeyLogin(t, session, assertion))
+
+	if response := server.passkeyLogin(t, session, assertion); response.Header().Get("Location") != "" {
+		t.Fatalf("a replayed assertion signed in again")
+	}
+}
+
+func TestWebAuthnLoginChecksAccount(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings map[string]interface{}
+		change   func(user *store.User)
+		message  string
+	}{
+		{
+			name:    "password reset required",
+			change:  func(user *store.User) { user.PasswordResetRequired = true },
+			message: "Your password must be reset",
+		},
+		{
+			name:     "email not verified",
+			settings: map[string]interface{}{"require_email_verification": true},
+			change:   func(user *store.User) { user.EmailVerified = false },
+			message:  "Please verify your email address",
+		},
+		{
+			name:    "deactivated",
+			change:  func(user *store.User) { user.Active = false },
+			message: "Invalid username or password",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := newTestServer(t, newTestConfig(t, test.settings))
+			user := server.createUser(t, "alice", "correct horse")
+
+			authenticator := newSoftAuthenticator(t, "localhost", testOrigin)
+			server.registerPasskey(t, authenticator, "alice", "correct horse")
+
+			stored, err := server.store.GetUserByID(context.Background(), user.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			test.change(stored)
+
+			if err := server.store.UpdateUser(context.Background(), stored); err != nil {
+				t.Fatal(err)
+			}
+
+			authenticator.signCount = 1
+			session, challenge := server.beginPasskeyLogin(t)
+
+			response := server.passkeyLogin(t, session, authenticator.get(t, challenge))
+			if response.Header().Get("Location") != "" {
+				t.Fatalf("login redirected to %q, want the login page again", response.Header().Get("Location"))
+			}
+
+			if !strings.Contains(response.Body.String(), test.message) {
+				t.Errorf("the login page does not say %q: %s", test.message, response.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/Muchogoc/go-oauth2-server/config"
+	"github.com/Muchogoc/go-oauth2-server/internal/store"
+	"github.com/Muchogoc/go-oauth2-server/log"
+)
+
+var keysCommands = []command{
+	{"rotate", "", "re-encrypt stored data with the current key of the key file", runKeysRotate},
+}
+
+// runKeysRotate implements `keys rotate`. Add a new key to the key file and make
+// it current first; once this has run, retired keys can be removed from the file.
+func runKeysRotate(cfg config.Provider, args []string) error {
+	if err := parseArgs(newFlagSet("keys rotate", ""), args, 0); err != nil {
+		return err
+	}
+
+	storage, err := openStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+
+	count, err := storage.RotateEncryptionKey(context.Background())
+	if errors.Is(err, store.ErrEncryptionDisabled) {
+		return fmt.Errorf("%w, set encryption_keyfile", err)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	keyID := storage.CurrentEncryptionKeyID()
+
+	auditCLI("keys.rotate", log.Fields{"key_id": keyID, "reencrypted": count})
+
+	fmt.Printf("re-encrypted %d values with key %s\n", count, keyID)
+
+	return nil
+}
@@ -43,6 +43,15 @@ func init() {
 }
 
 
+// Configure applies the log level and format of a config provider to the default
+// logger, for instance once a config file has been read.
+func Configure(cfg config.Provider) {
+	l := newLogrusLogger(cfg)
+
+	defaultLogger.SetFormatter(l.Formatter)
+	defaultLogger.SetLevel(l.Level)
+}
+
 // NewLogger returns a configured logrus instance
 func NewLogger(cfg config.Provider) *logrus.Logger {
 	return newLogrusLogger(cfg)
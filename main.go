@@ -1,62 +1,151 @@
 package main
 
 import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
 	"os"
-	"time"
+	"text/tabwriter"
 
 	"github.com/Muchogoc/go-oauth2-server/config"
-	"github.com/Muchogoc/go-oauth2-server/internal"
-	"github.com/Muchogoc/go-oauth2-server/internal/store"
 	"github.com/Muchogoc/go-oauth2-server/log"
-	"github.com/gin-gonic/gin"
-	"github.com/ory/fosite"
-	"github.com/ory/fosite/compose"
 )
 
+// command is a subcommand of the binary, or of a group of subcommands such as
+// `client`.
+type command struct {
+	name string
+	// args describes the arguments in usage messages
+	args    string
+	summary string
+	run     func(cfg config.Provider, args []string) error
+}
+
+var commands = []command{
+	{"serve", "", "start the server, the default when no command is given", runServe},
+	{"migrate", "up | down [steps] | status", "apply or roll back database migrations, except the irreversible ones", runMigrate},
+	{"client", "<command>", "create, list, rotate the secret of or delete clients", group("client", clientCommands)},
+	{"user", "<command>", "create, set the password of or disable users", group("user", userCommands)},
+	{"token", "<command>", "revoke codes and tokens", group("token", tokenCommands)},
+	{"keys", "<command>", "rotate the keys encrypting stored data", group("keys", keysCommands)},
+	{"bootstrap", "<command>", "apply, validate or export bootstrap files", group("bootstrap", bootstrapCommands)},
+	{"gc", "", "purge expired codes, tokens and sessions once", runGC},
+	{"version", "", "print the version", runVersion},
+}
+
 func main() {
 	cfg := config.Config()
 
-	r := gin.Default()
+	flags := flag.NewFlagSet("go-oauth2-server", flag.ContinueOnError)
+	flags.Usage = func() {}
+	configFile := flags.String("config", cfg.GetString("config_file"), "")
 
-	secret := []byte("some-cool-secret-that-is-32bytes")
+	if err := flags.Parse(os.Args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			printCommands(os.Stdout, "", commands)
+			return
+		}
 
-	conf := &fosite.Config{
-		GlobalSecret: secret,
+		printCommands(os.Stderr, "", commands)
+		os.Exit(2)
+	}
 
-		AccessTokenLifespan:   1 * time.Hour,
-		RefreshTokenLifespan:  24 * time.Hour,
-		AuthorizeCodeLifespan: 5 * time.Minute,
+	if *configFile != "" {
+		if err := config.ReadConfigFile(*configFile); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
 
-		SendDebugMessagesToClients: true,
+		log.Configure(cfg)
 	}
 
-	storage := store.NewStore()
+	name, args := "serve", flags.Args()
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
+	}
 
-	provider := compose.Compose(
-		conf,
-		storage,
-		compose.NewOAuth2HMACStrategy(conf),
-		compose.OAuth2AuthorizeExplicitFactory,
-		compose.OAuth2AuthorizeImplicitFactory,
-		compose.OAuth2ClientCredentialsGrantFactory,
-		compose.OAuth2RefreshTokenGrantFactory,
-		compose.OAuth2TokenIntrospectionFactory,
-		compose.OAuth2TokenRevocationFactory,
-	)
+	if name == "help" {
+		printCommands(os.Stdout, "", commands)
+		return
+	}
 
-	auth := internal.NewAuth(provider, storage)
+	command, ok := findCommand(commands, name)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command: %s\n\n", name)
+		printCommands(os.Stderr, "", commands)
+		os.Exit(2)
+	}
 
-	oauth2Routes := r.Group("/oauth2")
+	err := command.run(cfg, args)
+	switch {
+	case err == nil:
+	case errors.Is(err, flag.ErrHelp):
+	case errors.Is(err, errUsage):
+		os.Exit(2)
+	default:
+		fmt.Fprintf(os.Stderr, "%s failed: %v\n", name, err)
+		os.Exit(1)
+	}
+}
 
-	oauth2Routes.GET("/authorize", auth.AuthorizeHandler)
-	oauth2Routes.POST("/authorize", auth.AuthorizeHandler)
-	oauth2Routes.POST("/token", auth.TokenHandler)
-	oauth2Routes.POST("/revoke", auth.RevokeHandler)
-	oauth2Routes.POST("/introspect", auth.IntrospectionHandler)
+func findCommand(commands []command, name string) (command, bool) {
+	for _, command := range commands {
+		if command.name == name {
+			return command, true
+		}
+	}
 
-	log.Info("starting server and listening on ", cfg.GetString("listen_address"))
-	err := r.Run(cfg.GetString("listen_address"))
-	if err != nil {
-		os.Exit(1)
+	return command{}, false
+}
+
+// printCommands writes the usage of a list of commands, prefixed by the group
+// they belong to.
+func printCommands(w io.Writer, group string, commands []command) {
+	prefix := "go-oauth2-server "
+	if group != "" {
+		prefix += group + " "
+	}
+
+	if group == "" {
+		fmt.Fprintf(w, "usage: %s[-config file] <command> [arguments]\n\ncommands:\n", prefix)
+	} else {
+		fmt.Fprintf(w, "usage: %s<command> [arguments]\n\ncommands:\n", prefix)
+	}
+
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, command := range commands {
+		fmt.Fprintf(table, "  %s %s\t%s\n", command.name, command.args, command.summary)
+	}
+	_ = table.Flush()
+
+	if group == "" {
+		fmt.Fprintf(w, "\n-config names a YAML, TOML or JSON config file, also read from config_file\n")
+	}
+
+	fmt.Fprintf(w, "\nrun `%s<command> -h` for the flags of a command\n", prefix)
+}
+
+// group returns a command that runs one of a group of subcommands.
+func group(name string, subcommands []command) func(cfg config.Provider, args []string) error {
+	return func(cfg config.Provider, args []string) error {
+		if len(args) == 0 {
+			printCommands(os.Stderr, name, subcommands)
+			return errUsage
+		}
+
+		if args[0] == "help" || args[0] == "-h" || args[0] == "-help" || args[0] == "--help" {
+			printCommands(os.Stdout, name, subcommands)
+			return nil
+		}
+
+		command, ok := findCommand(subcommands, args[0])
+		if !ok {
+			fmt.Fprintf(os.Stderr, "unknown %s command: %s\n\n", name, args[0])
+			printCommands(os.Stderr, name, subcommands)
+			return errUsage
+		}
+
+		return command.run(cfg, args[1:])
 	}
 }
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/Muchogoc/go-oauth2-server/config"
+	"github.com/Muchogoc/go-oauth2-server/internal/store"
+)
+
+// runMigrate implements the `migrate [up | down [steps] | status]` subcommand.
+func runMigrate(cfg config.Provider, args []string) error {
+	db, err := store.Open(cfg)
+	if err != nil {
+		return err
+	}
+
+	migrator := store.NewMigrator(db, cfg)
+	ctx := context.Background()
+
+	command := "up"
+	if len(args) > 0 {
+		command = args[0]
+	}
+
+	switch command {
+	case "up":
+		count, err := migrator.Up(ctx)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("applied %d migrations\n", count)
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				return fmt.Errorf("invalid number of steps: %s", args[1])
+			}
+		}
+
+		count, err := migrator.Down(ctx, steps)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("rolled back %d migrations\n", count)
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, status := range statuses {
+			applied := "pending"
+			if status.AppliedAt != nil {
+				applied = status.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+
+			description := status.Description
+			if status.Irreversible {
+				description += " (irreversible)"
+			}
+
+			fmt.Printf("%s  %-20s  %s\n", status.Version, applied, description)
+		}
+	default:
+		return fmt.Errorf("unknown migrate command: %s, expected up, down or status", command)
+	}
+
+	return nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Muchogoc/go-oauth2-server/config"
+	"github.com/Muchogoc/go-oauth2-server/internal"
+	"github.com/Muchogoc/go-oauth2-server/internal/html"
+	"github.com/Muchogoc/go-oauth2-server/internal/ratelimit"
+	"github.com/Muchogoc/go-oauth2-server/log"
+	"github.com/fsnotify/fsnotify"
+)
+
+// reloadableSettings are applied when the config file changes. Every other
+// setting is only read on startup.
+var reloadableSettings = map[string]bool{
+	"loglevel":                       true,
+	"json_logs":                      true,
+	"ratelimit_ip_rate":              true,
+	"ratelimit_ip_burst":             true,
+	"ratelimit_client_rate":          true,
+	"ratelimit_client_burst":         true,
+	"oauth2_access_token_lifespan":   true,
+	"oauth2_refresh_token_lifespan":  true,
+	"oauth2_authorize_code_lifespan": true,
+	"oauth2_id_token_lifespan":       true,
+	"oauth2_send_debug_messages":     true,
+	"templates_dir":                  true,
+}
+
+// reloader applies the reloadable settings of a changed config file to the
+// running server, and reloads the templates when a file of templates_dir
+// changes.
+type reloader struct {
+	mu      sync.Mutex
+	current config.Provider
+
+	oauth2  *internal.OAuth2Config
+	limiter *ratelimit.Limiter
+
+	templates *fsnotify.Watcher
+}
+
+// watchConfig starts reloading the config file the server was started with, if
+// any, and the templates directory.
+func watchConfig(cfg config.Provider, oauth2 *internal.OAuth2Config, limiter *ratelimit.Limiter) (*reloader, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to watch templates: %w", err)
+	}
+
+	r := &reloader{
+		current:   cfg,
+		oauth2:    oauth2,
+		limiter:   limiter,
+		templates: watcher,
+	}
+
+	if dir := cfg.GetString("templates_dir"); dir != "" {
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return nil, fmt.Errorf("failed to watch templates: %w", err)
+		}
+	}
+
+	go r.watchTemplates()
+
+	if path := cfg.ConfigFileUsed(); path != "" {
+		config.Watch(path, r.reload)
+	}
+
+	return r, nil
+}
+
+// Close stops watching the templates directory. Watching the config file stops
+// with the process.
+func (r *reloader) Close() error {
+	return r.templates.Close()
+}
+
+// reload applies the reloadable settings of next once they are all valid, and
+// warns about the other settings that changed.
+func (r *reloader) reload(next config.Provider, err error) {
+	if err != nil {
+		log.Errorf("config file not reloaded: %v", err)
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var changed []string
+
+	for _, key := range changedSettings(r.current, next) {
+		if reloadableSettings[key] {
+			changed = append(changed, key)
+			continue
+		}
+
+		// values are left out, they may be secrets
+		log.WithFields(log.Fields{"setting": key}).Warn("setting changed in the config file, restart the server to apply it")
+	}
+
+	if len(changed) == 0 {
+		r.current = next
+		return
+	}
+
+	// everything is validated before anything is applied
+	settings, err := internal.LoadOAuth2Settings(next)
+	if err != nil {
+		log.Errorf("config file not reloaded: %v", err)
+		return
+	}
+
+	if problems := validateRateLimits(next); len(problems) > 0 {
+		log.Errorf("config file not reloaded: invalid configuration: %s", strings.Join(problems, ", "))
+		return
+	}
+
+	dir := next.GetString("templates_dir")
+
+	templates, err := html.Load(dir)
+	if err != nil {
+		log.Errorf("config file not reloaded: %v", err)
+		return
+	}
+
+	if previous := r.current.GetString("templates_dir"); previous != dir {
+		if previous != "" {
+			_ = r.templates.Remove(previous)
+		}
+
+		if dir != "" {
+			if err := r.templates.Add(dir); err != nil {
+				log.Errorf("failed to watch templates: %v", err)
+			}
+		}
+	}
+
+	r.oauth2.SetSettings(settings)
+	r.limiter.SetLimits(rateLimits(next))
+	html.Use(templates)
+
+	for _, key := range changed {
+		log.WithFields(log.Fields{
+			"setting": key,
+			"from":    r.current.Get(key),
+			"to":      next.Get(key),
+		}).Info("reloaded setting")
+	}
+
+	// last, so that the changes are logged at the level they were made under
+	log.Configure(next)
+
+	r.current = next
+}
+
+// watchTemplates reloads the templates whenever a file of templates_dir changes,
+// until the watcher is closed.
+func (r *reloader) watchTemplates() {
+	for {
+		select {
+		case _, ok := <-r.templates.Events:
+			if !ok {
+				return
+			}
+
+			r.mu.Lock()
+			dir := r.current.GetString("templates_dir")
+
+			templates, err := html.Load(dir)
+			if err != nil {
+				log.Errorf("templates not reloaded: %v", err)
+			} else {
+				html.Use(templates)
+				log.WithFields(log.Fields{"dir": dir}).Info("reloaded templates")
+			}
+			r.mu.Unlock()
+		case err, ok := <-r.templates.Errors:
+			if !ok {
+				return
+			}
+
+			log.Errorf("failed to watch templates: %v", err)
+		}
+	}
+}
+
+// changedSettings returns the settings whose values differ between two providers.
+func changedSettings(before config.Provider, after config.Provider) []string {
+	keys := make(map[string]bool)
+	for _, key := range before.AllKeys() {
+		keys[key] = true
+	}
+
+	for _, key := range after.AllKeys() {
+		keys[key] = true
+	}
+
+	var changed []string
+
+	for key := range keys {
+		if fmt.Sprint(before.Get(key)) != fmt.Sprint(after.Get(key)) {
+			changed = append(changed, key)
+		}
+	}
+
+	sort.Strings(changed)
+
+	return changed
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Muchogoc/go-oauth2-server/config"
+	"github.com/Muchogoc/go-oauth2-server/internal"
+	"github.com/Muchogoc/go-oauth2-server/internal/ratelimit"
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// newTestConfig returns the default configuration in dev_mode with settings
+// overridden.
+func newTestConfig(settings map[string]interface{}) *viper.Viper {
+	v := config.LoadConfigProvider("GO-OAUTH2-SERVER-TEST").(*viper.Viper)
+	v.Set("dev_mode", true)
+	v.Set("loglevel", "error")
+
+	for key, value := range settings {
+		v.Set(key, value)
+	}
+
+	return v
+}
+
+// testReloader is a reloader together with a router serving through its limiter.
+type testReloader struct {
+	*reloader
+	router *gin.Engine
+}
+
+func newTestReloader(t *testing.T, cfg config.Provider) *testReloader {
+	t.Helper()
+
+	conf, err := internal.NewOAuth2Config(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ipLimit, clientLimit := rateLimits(cfg)
+	limiter := ratelimit.NewLimiter(ratelimit.NewMemoryBackend(0), ipLimit, clientLimit)
+
+	r, err := watchConfig(cfg, conf, limiter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { r.Close() })
+
+	router := gin.New()
+	router.GET("/", limiter.Middleware(), func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	return &testReloader{reloader: r, router: router}
+}
+
+// get requests the router.
+func (r *testReloader) get() *httptest.ResponseRecorder {
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	request.RemoteAddr = "192.0.2.1:1234"
+
+	recorder := httptest.NewRecorder()
+	r.router.ServeHTTP(recorder, request)
+
+	return recorder
+}
+
+func TestReloadAppliesReloadableSettings(t *testing.T) {
+	r := newTestReloader(t, newTestConfig(nil))
+
+	next := newTestConfig(map[string]interface{}{
+		"oauth2_access_token_lifespan": 2 * time.Hour,
+		"ratelimit_ip_rate":            0.001,
+		"ratelimit_ip_burst":           1,
+	})
+
+	r.reload(next, nil)
+
+	if lifespan := r.oauth2.GetAccessTokenLifespan(context.Background()); lifespan != 2*time.Hour {
+		t.Errorf("the access token lifespan is %s, want 2h", lifespan)
+	}
+
+	first, second := r.get(), r.get()
+
+	if first.Code != http.StatusOK || second.Code != http.StatusTooManyRequests {
+		t.Errorf("with a burst of 1 two requests got %d and %d", first.Code, second.Code)
+	}
+
+	if r.current != next {
+		t.Error("the reloaded config did not become the current one")
+	}
+}
+
+func TestReloadRejectsInvalidSettings(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings map[string]interface{}
+	}{
+		{"lifespan", map[string]interface{}{"oauth2_access_token_lifespan": 0}},
+		// settings only read on startup are validated too
+		{"entropy", map[string]interface{}{"oauth2_min_parameter_entropy": 0}},
+		{"zero rate", map[string]interface{}{"ratelimit_ip_rate": 0}},
+		{"negative burst", map[string]interface{}{"ratelimit_client_burst": -1}},
+		{"templates", map[string]interface{}{"templates_dir": filepath.Join(t.TempDir(), "missing")}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			current := newTestConfig(nil)
+			r := newTestReloader(t, current)
+
+			// a valid change made together with an invalid one is not applied either
+			settings := map[string]interface{}{"oauth2_refresh_token_lifespan": 3 * time.Hour}
+			for key, value := range tt.settings {
+				settings[key] = value
+			}
+
+			r.reload(newTestConfig(settings), nil)
+
+			if lifespan := r.oauth2.GetRefreshTokenLifespan(context.Background()); lifespan == 3*time.Hour {
+				t.Error("a config with an invalid setting was applied")
+			}
+
+			if r.current != current {
+				t.Error("a config with an invalid setting became the current one")
+			}
+		})
+	}
+}
+
+func TestReloadIgnoresStartupSettings(t *testing.T) {
+	r := newTestReloader(t, newTestConfig(nil))
+
+	// settings only read on startup are left as they were, even when invalid
+	next := newTestConfig(map[string]interface{}{
+		"database_driver":              "unknown",
+		"oauth2_access_token_lifespan": 2 * time.Hour,
+	})
+
+	r.reload(next, nil)
+
+	if lifespan := r.oauth2.GetAccessTokenLifespan(context.Background()); lifespan != 2*time.Hour {
+		t.Errorf("the access token lifespan is %s, want 2h", lifespan)
+	}
+
+	if r.current != next {
+		t.Error("the reloaded config did not become the current one")
+	}
+}
+
+func TestReloadKeepsConfigThatCannotBeRead(t *testing.T) {
+	current := newTestConfig(nil)
+	r := newTestReloader(t, current)
+
+	r.reload(nil, errors.New("failed to read config file"))
+
+	if r.current != current {
+		t.Error("an unreadable config file replaced the current config")
+	}
+
+	if lifespan := r.oauth2.GetAccessTokenLifespan(context.Background()); lifespan != current.GetDuration("oauth2_access_token_lifespan") {
+		t.Errorf("the access token lifespan changed to %s", lifespan)
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Muchogoc/go-oauth2-server/config"
+	"github.com/Muchogoc/go-oauth2-server/internal"
+	"github.com/Muchogoc/go-oauth2-server/internal/html"
+	"github.com/Muchogoc/go-oauth2-server/internal/janitor"
+	"github.com/Muchogoc/go-oauth2-server/internal/mail"
+	"github.com/Muchogoc/go-oauth2-server/internal/ratelimit"
+	"github.com/Muchogoc/go-oauth2-server/internal/store"
+	"github.com/Muchogoc/go-oauth2-server/internal/tlsconfig"
+	"github.com/Muchogoc/go-oauth2-server/log"
+	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/ory/fosite/compose"
+)
+
+// readHeaderTimeout bounds how long a client can take to send request headers, so
+// idle connections cannot hold the server open.
+const readHeaderTimeout = 10 * time.Second
+
+// runServe implements the `serve` subcommand, which is also run when no
+// subcommand is given.
+func runServe(cfg config.Provider, args []string) error {
+	if err := parseArgs(newFlagSet("serve", ""), args, 0); err != nil {
+		return err
+	}
+
+	conf, err := internal.NewOAuth2Config(cfg)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	storage, err := store.New(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to initialise store: %w", err)
+	}
+
+	defer func() {
+		if err := storage.Close(); err != nil {
+			log.Errorf("failed to close the database: %v", err)
+			return
+		}
+
+		log.Info("closed the database")
+	}()
+
+	if path := cfg.GetString("bootstrap_file"); path != "" {
+		if err := applyBootstrapFile(ctx, cfg, storage, path); err != nil {
+			return fmt.Errorf("failed to apply bootstrap file: %w", err)
+		}
+	}
+
+	provider := internal.NewOAuth2Provider(
+		conf,
+		storage,
+		compose.NewOAuth2HMACStrategy(conf),
+		internal.AuthorizeExplicitFactory,
+		compose.OAuth2AuthorizeImplicitFactory,
+		compose.OAuth2ClientCredentialsGrantFactory,
+		internal.RefreshTokenGrantFactory,
+		compose.OAuth2TokenIntrospectionFactory,
+		compose.OAuth2TokenRevocationFactory,
+	)
+
+	webAuthn, err := webauthn.New(&webauthn.Config{
+		RPID:          cfg.GetString("webauthn_rp_id"),
+		RPDisplayName: cfg.GetString("webauthn_rp_display_name"),
+		RPOrigins:     cfg.GetStringSlice("webauthn_rp_origins"),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to configure webauthn: %w", err)
+	}
+
+	mailer, err := mail.NewMailer(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to configure mailer: %w", err)
+	}
+
+	if cfg.GetBool("gc_enabled") {
+		gc := janitor.NewJanitor(cfg, storage)
+		if err := gc.Start(); err != nil {
+			return fmt.Errorf("invalid configuration: %w", err)
+		}
+		defer gc.Stop()
+	}
+
+	auth := internal.NewAuth(cfg, provider, storage, webAuthn, mailer)
+
+	if problems := validateRateLimits(cfg); len(problems) > 0 {
+		return fmt.Errorf("invalid configuration: %s", strings.Join(problems, ", "))
+	}
+
+	ipLimit, clientLimit := rateLimits(cfg)
+	limiter := ratelimit.NewLimiter(ratelimit.NewMemoryBackend(cfg.GetInt("ratelimit_max_buckets")), ipLimit, clientLimit)
+
+	// registrations and password reset requests are only limited by client IP
+	registerLimiter := ratelimit.NewLimiter(ratelimit.NewMemoryBackend(cfg.GetInt("ratelimit_max_buckets")), ratelimit.Limit{
+		Rate:  cfg.GetFloat64("ratelimit_register_rate"),
+		Burst: cfg.GetInt("ratelimit_register_burst"),
+	}, ratelimit.Limit{})
+
+	forgotPasswordLimiter := ratelimit.NewLimiter(ratelimit.NewMemoryBackend(cfg.GetInt("ratelimit_max_buckets")), ratelimit.Limit{
+		Rate:  cfg.GetFloat64("ratelimit_forgot_password_rate"),
+		Burst: cfg.GetInt("ratelimit_forgot_password_burst"),
+	}, ratelimit.Limit{})
+
+	templates, err := html.Load(cfg.GetString("templates_dir"))
+	if err != nil {
+		return err
+	}
+
+	html.Use(templates)
+
+	reloader, err := watchConfig(cfg, conf, limiter)
+	if err != nil {
+		return err
+	}
+	defer reloader.Close()
+
+	r, err := newRouter(cfg)
+	if err != nil {
+		return err
+	}
+
+	r.Use(tlsconfig.HSTS(cfg.GetDuration("hsts_max_age"), cfg.GetBool("hsts_include_subdomains")))
+
+	oauth2Routes := r.Group("/oauth2")
+
+	oauth2Routes.GET("/authorize", auth.AuthorizeHandler)
+	oauth2Routes.POST("/authorize", auth.AuthorizeHandler)
+	oauth2Routes.POST("/token", limiter.Middleware(), auth.TokenHandler)
+	oauth2Routes.POST("/revoke", auth.RevokeHandler)
+	oauth2Routes.POST("/introspect", limiter.Middleware(), auth.IntrospectionHandler)
+
+	r.GET("/register", auth.RegisterPageHandler)
+	r.POST("/register", registerLimiter.Middleware(), auth.RegisterHandler)
+	r.GET("/register/verify", auth.VerifyEmailHandler)
+
+	passwordRoutes := r.Group("/password")
+
+	passwordRoutes.GET("/forgot", auth.ForgotPasswordPageHandler)
+	passwordRoutes.POST("/forgot", forgotPasswordLimiter.Middleware(), auth.ForgotPasswordHandler)
+	passwordRoutes.GET("/reset", auth.ResetPasswordPageHandler)
+	passwordRoutes.POST("/reset", auth.ResetPasswordHandler)
+	passwordRoutes.GET("/change", auth.ChangePasswordPageHandler)
+	passwordRoutes.POST("/change", auth.ChangePasswordHandler)
+
+	webAuthnRoutes := r.Group("/webauthn")
+
+	webAuthnRoutes.GET("/register", auth.WebAuthnRegisterPageHandler)
+	webAuthnRoutes.POST("/register/begin", auth.BeginWebAuthnRegistrationHandler)
+	webAuthnRoutes.POST("/register/finish", auth.FinishWebAuthnRegistrationHandler)
+	webAuthnRoutes.POST("/login/begin", auth.BeginWebAuthnLoginHandler)
+
+	adminRoutes := r.Group("/admin", auth.RequireAdmin())
+
+	adminRoutes.GET("/clients", auth.ListClientsHandler)
+	adminRoutes.POST("/clients", auth.CreateClientHandler)
+	adminRoutes.GET("/clients/:id", auth.GetClientHandler)
+	adminRoutes.PUT("/clients/:id", auth.UpdateClientHandler)
+	adminRoutes.DELETE("/clients/:id", auth.DeleteClientHandler)
+	adminRoutes.POST("/clients/:id/activate", auth.ActivateClientHandler)
+	adminRoutes.POST("/clients/:id/deactivate", auth.DeactivateClientHandler)
+	adminRoutes.POST("/clients/:id/rotate-secret", auth.RotateClientSecretHandler)
+	adminRoutes.POST("/clients/:id/revoke-tokens", auth.RevokeClientTokensHandler)
+
+	adminRoutes.GET("/users", auth.ListUsersHandler)
+	adminRoutes.POST("/users", auth.CreateUserHandler)
+	adminRoutes.GET("/users/:id", auth.GetUserHandler)
+	adminRoutes.PUT("/users/:id", auth.UpdateUserHandler)
+	adminRoutes.DELETE("/users/:id", auth.DeleteUserHandler)
+	adminRoutes.POST("/users/:id/activate", auth.ActivateUserHandler)
+	adminRoutes.POST("/users/:id/deactivate", auth.DeactivateUserHandler)
+	adminRoutes.POST("/users/:id/reset-password", auth.ResetUserPasswordHandler)
+	adminRoutes.PUT("/users/:id/roles", auth.SetUserRolesHandler)
+	adminRoutes.GET("/users/:id/sessions", auth.UserSessionsHandler)
+	adminRoutes.GET("/users/:id/tokens", auth.UserTokensHandler)
+	adminRoutes.POST("/users/:id/revoke-tokens", auth.RevokeUserTokensHandler)
+
+	adminRoutes.GET("/tokens", auth.ListTokensHandler)
+	adminRoutes.POST("/tokens/revoke", auth.RevokeTokensHandler)
+	adminRoutes.GET("/sessions", auth.ListSessionsHandler)
+	adminRoutes.DELETE("/grants/:id", auth.RevokeGrantHandler)
+
+	if cfg.GetBool("metrics_enabled") {
+		r.GET("/debug/vars", gin.WrapH(expvar.Handler()))
+	}
+
+	server := &http.Server{
+		Addr:              cfg.GetString("listen_address"),
+		Handler:           r,
+		ReadHeaderTimeout: readHeaderTimeout,
+	}
+
+	servers := []*http.Server{server}
+	listen := server.ListenAndServe
+
+	if tlsconfig.Enabled(cfg) {
+		tlsConfig, certificate, err := tlsconfig.New(cfg)
+		if err != nil {
+			return err
+		}
+		defer certificate.Close()
+
+		server.TLSConfig = tlsConfig
+		listen = func() error { return server.ListenAndServeTLS("", "") }
+
+		if address := cfg.GetString("tls_redirect_address"); address != "" {
+			_, port, err := net.SplitHostPort(server.Addr)
+			if err != nil {
+				return fmt.Errorf("invalid listen_address: %w", err)
+			}
+
+			listener, err := net.Listen("tcp", address)
+			if err != nil {
+				return fmt.Errorf("failed to listen on tls_redirect_address: %w", err)
+			}
+
+			redirect := &http.Server{
+				Handler:           tlsconfig.RedirectHandler(port),
+				ReadHeaderTimeout: readHeaderTimeout,
+			}
+			servers = append(servers, redirect)
+
+			go func() {
+				if err := redirect.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+					log.Errorf("redirect listener stopped: %v", err)
+				}
+			}()
+
+			log.Info("redirecting plain HTTP to HTTPS from ", address)
+		}
+
+		log.Info("starting server and listening for HTTPS on ", server.Addr)
+	} else {
+		log.Info("starting server and listening on ", server.Addr)
+	}
+
+	errs := make(chan error, 1)
+
+	go func() {
+		errs <- listen()
+	}()
+
+	select {
+	case err := <-errs:
+		for _, server := range servers {
+			server.Close()
+		}
+
+		return err
+	case <-ctx.Done():
+	}
+
+	// a second signal kills the process rather than waiting for the drain
+	stop()
+
+	timeout := cfg.GetDuration("shutdown_timeout")
+	log.Info("shutting down, draining requests for up to ", timeout)
+
+	drain, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	shutdownServers(drain, servers)
+
+	// the deferred calls then stop the background workers, newest first, and
+	// close the database last
+	return nil
+}
+
+// shutdownServers stops accepting connections and waits for the requests in
+// flight until ctx is done, when the remaining connections are closed.
+func shutdownServers(ctx context.Context, servers []*http.Server) {
+	var wg sync.WaitGroup
+
+	for _, server := range servers {
+		wg.Add(1)
+
+		go func(server *http.Server) {
+			defer wg.Done()
+
+			if err := server.Shutdown(ctx); err != nil {
+				log.Warn("requests still in flight were cut off: ", err)
+				server.Close()
+			}
+		}(server)
+	}
+
+	wg.Wait()
+}
+
+// newRouter returns a router that takes the client IP, used by the rate limits and
+// the login lockout, from the X-Forwarded-For header only on requests sent by one
+// of the trusted_proxies.
+func newRouter(cfg config.Provider) (*gin.Engine, error) {
+	r := gin.Default()
+
+	if err := r.SetTrustedProxies(cfg.GetStringSlice("trusted_proxies")); err != nil {
+		return nil, fmt.Errorf("invalid configuration: trusted_proxies: %w", err)
+	}
+
+	return r, nil
+}
+
+// validateRateLimits returns a message for every token and introspection rate
+// limit setting that is not positive.
+func validateRateLimits(cfg config.Provider) []string {
+	var problems []string
+
+	for _, key := range []string{"ratelimit_ip_rate", "ratelimit_ip_burst", "ratelimit_client_rate", "ratelimit_client_burst"} {
+		if cfg.GetFloat64(key) <= 0 {
+			problems = append(problems, key+" must be positive")
+		}
+	}
+
+	return problems
+}
+
+// rateLimits returns the IP limit and the default client limit.
+func rateLimits(cfg config.Provider) (ratelimit.Limit, ratelimit.Limit) {
+	ip := ratelimit.Limit{
+		Rate:  cfg.GetFloat64("ratelimit_ip_rate"),
+		Burst: cfg.GetInt("ratelimit_ip_burst"),
+	}
+
+	client := ratelimit.Limit{
+		Rate:  cfg.GetFloat64("ratelimit_client_rate"),
+		Burst: cfg.GetInt("ratelimit_client_burst"),
+	}
+
+	return ip, client
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// startServer serves handler on a local port and returns the server and its URL.
+func startServer(t *testing.T, handler http.Handler) (*http.Server, string) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &http.Server{Handler: handler, ReadHeaderTimeout: readHeaderTimeout}
+
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			t.Error(err)
+		}
+	}()
+
+	t.Cleanup(func() { server.Close() })
+
+	return server, "http://" + listener.Addr().String()
+}
+
+// blockingHandler answers once release is closed, after telling started that a
+// request arrived.
+func blockingHandler(started chan<- struct{}, release <-chan struct{}) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+
+		select {
+		case <-release:
+			w.WriteHeader(http.StatusOK)
+		case <-r.Context().Done():
+		}
+	})
+}
+
+// get requests a URL on a new connection and sends the result to results.
+func get(url string, results chan<- error) {
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+
+	response, err := client.Get(url)
+	if err == nil {
+		response.Body.Close()
+
+		if response.StatusCode != http.StatusOK {
+			err = errors.New(response.Status)
+		}
+	}
+
+	results <- err
+}
+
+// refused reports whether a server no longer accepts connections.
+func refused(url string) bool {
+	conn, err := net.Dial("tcp", strings.TrimPrefix(url, "http://"))
+	if err != nil {
+		return true
+	}
+
+	conn.Close()
+
+	return false
+}
+
+func TestShutdownDrainsRequestsInFlight(t *testing.T) {
+	started, release := make(chan struct{}, 1), make(chan struct{})
+
+	server, url := startServer(t, blockingHandler(started, release))
+	redirect, redirectURL := startServer(t, http.NotFoundHandler())
+
+	results := make(chan error, 1)
+	go get(url, results)
+	<-started
+
+	done := make(chan struct{})
+
+	go func() {
+		shutdownServers(context.Background(), []*http.Server{server, redirect})
+		close(done)
+	}()
+
+	// new connections are refused on every listener while the request is served
+	deadline := time.Now().Add(5 * time.Second)
+
+	for !refused(url) || !refused(redirectURL) {
+		if time.Now().After(deadline) {
+			t.Fatal("the servers still accept connections while shutting down")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	select {
+	case <-done:
+		t.Fatal("the servers shut down before the request in flight was answered")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+
+	if err := <-results; err != nil {
+		t.Errorf("the request in flight failed: %v", err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the servers did not shut down once the request was answered")
+	}
+}
+
+func TestShutdownCutsOffRequestsAfterTimeout(t *testing.T) {
+	started, release := make(chan struct{}, 1), make(chan struct{})
+	defer close(release)
+
+	server, url := startServer(t, blockingHandler(started, release))
+
+	results := make(chan error, 1)
+	go get(url, results)
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	shutdownServers(ctx, []*http.Server{server})
+
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("shutting down took %s, want about the timeout", elapsed)
+	}
+
+	select {
+	case err := <-results:
+		if err == nil {
+			t.Error("a request outliving the timeout was answered")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("a request outliving the timeout was not cut off")
+	}
+}
+
+func TestRouterTrustsOnlyTrustedProxies(t *testing.T) {
+	tests := []struct {
+		name    string
+		proxies []string
+		want    string
+	}{
+		{"no proxies", nil, "192.0.2.1"},
+		{"trusted proxy", []string{"192.0.2.0/24"}, "203.0.113.7"},
+		{"other proxy", []string{"198.51.100.1"}, "192.0.2.1"},
+	}
+
+	for _, tt := range tests {
+		settings := map[string]interface{}{}
+		if tt.proxies != nil {
+			settings["trusted_proxies"] = tt.proxies
+		}
+
+		router, err := newRouter(newTestConfig(settings))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got string
+		router.GET("/", func(c *gin.Context) { got = c.ClientIP() })
+
+		request := httptest.NewRequest(http.MethodGet, "/", nil)
+		request.RemoteAddr = "192.0.2.1:1234"
+		request.Header.Set("X-Forwarded-For", "203.0.113.7")
+
+		router.ServeHTTP(httptest.NewRecorder(), request)
+
+		if got != tt.want {
+			t.Errorf("%s: the client IP is %s, want %s", tt.name, got, tt.want)
+		}
+	}
+
+	if _, err := newRouter(newTestConfig(map[string]interface{}{"trusted_proxies": []string{"proxy.example.com"}})); err == nil {
+		t.Error("a trusted proxy that is not an address was accepted")
+	}
+}
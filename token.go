@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/Muchogoc/go-oauth2-server/config"
+	"github.com/Muchogoc/go-oauth2-server/internal/store"
+	"github.com/Muchogoc/go-oauth2-server/log"
+)
+
+var tokenCommands = []command{
+	{"revoke", "", "revoke the codes and tokens matching the flags", runTokenRevoke},
+}
+
+// timeFlag is a flag holding an RFC 3339 time.
+type timeFlag struct {
+	time.Time
+}
+
+func (t *timeFlag) String() string {
+	if t.IsZero() {
+		return ""
+	}
+
+	return t.Format(time.RFC3339)
+}
+
+func (t *timeFlag) Set(value string) error {
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return fmt.Errorf("must be an RFC 3339 time")
+	}
+
+	t.Time = parsed
+
+	return nil
+}
+
+// runTokenRevoke implements `token revoke`. At least one criterion is required,
+// so that a mistaken command cannot sign out everyone.
+func runTokenRevoke(cfg config.Provider, args []string) error {
+	var (
+		filter                    store.TokenFilter
+		user                      string
+		issuedAfter, issuedBefore timeFlag
+	)
+
+	flags := newFlagSet("token revoke", "")
+	flags.StringVar(&filter.RequestID, "grant", "", "revoke the code and tokens of a grant")
+	flags.StringVar(&user, "user", "", "revoke the tokens of a user, by username or id")
+	flags.StringVar(&filter.ClientID, "client", "", "revoke the tokens of a client")
+	flags.StringVar(&filter.Scope, "scope", "", "revoke the tokens granted a scope")
+	flags.Var(&issuedAfter, "issued-after", "revoke the tokens issued at or after an RFC 3339 time")
+	flags.Var(&issuedBefore, "issued-before", "revoke the tokens issued before an RFC 3339 time")
+
+	if err := parseArgs(flags, args, 0); err != nil {
+		return err
+	}
+
+	filter.IssuedAfter, filter.IssuedBefore = issuedAfter.Time, issuedBefore.Time
+
+	if filter.IsEmpty() && user == "" {
+		fmt.Fprintln(flags.Output(), "at least one of -grant, -user, -client, -scope, -issued-after or -issued-before is required")
+		flags.Usage()
+
+		return errUsage
+	}
+
+	storage, err := openStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+
+	ctx := context.Background()
+
+	if user != "" {
+		found, err := findUser(ctx, storage, user)
+		if err != nil {
+			return err
+		}
+
+		filter.UserID = found.ID
+	}
+
+	counts, err := storage.RevokeTokens(ctx, filter)
+	if err != nil {
+		return err
+	}
+
+	var (
+		tables []string
+		total  int64
+	)
+
+	for table, count := range counts {
+		tables = append(tables, table)
+		total += count
+	}
+
+	sort.Strings(tables)
+
+	for _, table := range tables {
+		fmt.Printf("%-20s %d\n", table, counts[table])
+	}
+
+	fields := log.Fields{"revoked": total}
+
+	for key, value := range map[string]string{
+		"grant_id":  filter.RequestID,
+		"user_id":   filter.UserID,
+		"client_id": filter.ClientID,
+		"scope":     filter.Scope,
+	} {
+		if value != "" {
+			fields[key] = value
+		}
+	}
+
+	if !filter.IssuedAfter.IsZero() {
+		fields["issued_after"] = issuedAfter.String()
+	}
+
+	if !filter.IssuedBefore.IsZero() {
+		fields["issued_before"] = issuedBefore.String()
+	}
+
+	auditCLI("tokens.revoke", fields)
+
+	return nil
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Muchogoc/go-oauth2-server/config"
+	"github.com/Muchogoc/go-oauth2-server/internal"
+	"github.com/Muchogoc/go-oauth2-server/internal/store"
+	"github.com/Muchogoc/go-oauth2-server/log"
+	"github.com/ory/fosite"
+)
+
+var userCommands = []command{
+	{"create", "", "create an active user, reading the password from the standard input", runUserCreate},
+	{"set-password", "<username or id>", "replace the password of a user, read from the standard input", runUserSetPassword},
+	{"disable", "<username or id>", "stop a user from signing in and revoke their tokens", runUserDisable},
+}
+
+// findUser looks a user up by username, then by ID.
+func findUser(ctx context.Context, storage store.Storage, name string) (*store.User, error) {
+	user, err := storage.GetUser(ctx, name)
+	if errors.Is(err, fosite.ErrNotFound) {
+		user, err = storage.GetUserByID(ctx, name)
+	}
+
+	if errors.Is(err, fosite.ErrNotFound) {
+		return nil, fmt.Errorf("user %s does not exist", name)
+	}
+
+	return user, err
+}
+
+// runUserCreate implements `user create`. The user is validated like the admin
+// API does, and the password must meet the password policy.
+func runUserCreate(cfg config.Provider, args []string) error {
+	var params internal.UserRequest
+
+	var roles listFlag
+
+	flags := newFlagSet("user create", "")
+	flags.StringVar(&params.Username, "username", "", "username to sign in with")
+	flags.StringVar(&params.Name, "name", "", "full name")
+	flags.StringVar(&params.Email, "email", "", "email address, optional")
+	flags.BoolVar(&params.EmailVerified, "email-verified", false, "mark the email address verified")
+	flags.Var(&roles, "role", "role of the user, repeatable")
+
+	if err := parseArgs(flags, args, 0); err != nil {
+		return err
+	}
+
+	params.Normalise()
+
+	problems := params.Validate()
+
+	normalised, roleProblems := internal.NormaliseRoles(roles)
+	problems = append(problems, roleProblems...)
+
+	if len(problems) > 0 {
+		return problemsError(problems)
+	}
+
+	password, err := readPassword()
+	if err != nil {
+		return err
+	}
+
+	if problems := internal.NewPasswordPolicy(cfg).Validate(password, params.Username); len(problems) > 0 {
+		return problemsError(problems)
+	}
+
+	hash, err := store.HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	storage, err := openStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+
+	ctx := context.Background()
+
+	user := &store.User{
+		Active:        true,
+		Name:          params.Name,
+		Username:      params.Username,
+		Password:      hash,
+		Email:         params.Email,
+		EmailVerified: params.EmailVerified && params.Email != "",
+	}
+
+	if user.EmailVerified {
+		now := time.Now()
+		user.EmailVerifiedAt = &now
+	}
+
+	if err := storage.CreateUser(ctx, user); err != nil {
+		return err
+	}
+
+	if err := storage.SetUserRoles(ctx, user.ID, normalised); err != nil {
+		return err
+	}
+
+	auditCLI("user.create", log.Fields{"user_id": user.ID, "username": user.Username, "roles": normalised})
+
+	return printJSON(internal.NewUserResponse(*user, normalised))
+}
+
+// runUserSetPassword implements `user set-password`. The user is signed out
+// everywhere unless -keep-tokens is set, and no longer has to reset the password.
+func runUserSetPassword(cfg config.Provider, args []string) error {
+	flags := newFlagSet("user set-password", "<username or id>")
+	keepTokens := flags.Bool("keep-tokens", false, "leave the tokens of the user active")
+
+	if err := parseArgs(flags, args, 1); err != nil {
+		return err
+	}
+
+	storage, err := openStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+
+	ctx := context.Background()
+
+	user, err := findUser(ctx, storage, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	password, err := readPassword()
+	if err != nil {
+		return err
+	}
+
+	if problems := internal.NewPasswordPolicy(cfg).Validate(password, user.Username); len(problems) > 0 {
+		return problemsError(problems)
+	}
+
+	hash, err := store.HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	if err := storage.SetUserPassword(ctx, user.ID, hash); err != nil {
+		return err
+	}
+
+	if !*keepTokens {
+		if err := storage.RevokeUserTokens(ctx, user.ID); err != nil {
+			return err
+		}
+	}
+
+	auditCLI("user.set_password", log.Fields{"user_id": user.ID, "username": user.Username, "keep_tokens": *keepTokens})
+
+	fmt.Printf("set the password of %s\n", user.Username)
+
+	return nil
+}
+
+// runUserDisable implements `user disable`. The account is kept so that it can
+// be reactivated through the admin API.
+func runUserDisable(cfg config.Provider, args []string) error {
+	flags := newFlagSet("user disable", "<username or id>")
+
+	if err := parseArgs(flags, args, 1); err != nil {
+		return err
+	}
+
+	storage, err := openStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+
+	ctx := context.Background()
+
+	user, err := findUser(ctx, storage, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	user.Active = false
+
+	if err := storage.UpdateUser(ctx, user); err != nil {
+		return err
+	}
+
+	if err := storage.RevokeUserTokens(ctx, user.ID); err != nil {
+		return err
+	}
+
+	auditCLI("user.deactivate", log.Fields{"user_id": user.ID, "username": user.Username})
+
+	fmt.Printf("disabled %s\n", user.Username)
+
+	return nil
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/Muchogoc/go-oauth2-server/config"
+	"github.com/Muchogoc/go-oauth2-server/version"
+)
+
+// runVersion implements the `version` subcommand.
+func runVersion(cfg config.Provider, args []string) error {
+	if err := parseArgs(newFlagSet("version", ""), args, 0); err != nil {
+		return err
+	}
+
+	fmt.Printf("go-oauth2-server %s\n", version.Version)
+	fmt.Printf("git commit: %s\n", version.GitCommit)
+	fmt.Printf("built:      %s\n", version.BuildDate)
+	fmt.Printf("go:         %s %s\n", version.GoVersion, version.OsArch)
+
+	return nil
+}